@@ -2,72 +2,27 @@ package main
 
 import (
 	"bytes"
-	//"errors"
-	//"flag"
+	"flag"
 	"fmt"
-	"io"
 	"net"
 	"os"
-	"strings"
-	"sync"
-	"time"
-	//"path/filepath"
 	parser "github.com/Yashver1/KVCacheGo/pkg/parser"
+	"github.com/Yashver1/KVCacheGo/pkg/store"
 )
 
 
-const (
-	simpleStrings byte = '+'
-	errorString byte = '-'
-	bulkStrings byte = '$'
-	arrays byte = '*'
-	integers byte = ':'
-)
-
-type KVStore struct {
-	*sync.RWMutex
-	store map[string]*Entry
-}
-
-type Entry struct {
-	entry []byte
-	creationTime time.Time
-	expiryTime time.Time
-	
-}
-
-type Config struct {
-	dir string
-	dbFileName string
-}
-
-var config Config
-
-// func init(){
-// 	var dir string
-// 	var dbFileName string
-// 	flag.StringVar(&dir,"dir","","The path to the RDB file store")
-// 	flag.StringVar(&dbFileName,"dbfilename","","The name of the RDB" )
-// 	flag.Parse()
-
-// 	if _, err := os.Stat(filepath.Join(dir,dbFileName)); errors.Is(err, os.ErrNotExist){
-// 		dir = ""
-// 	}
-
-// 	config = Config{
-// 		dir: dir,
-// 		dbFileName: dbFileName,
-// 	}
-// }
-
 func main() {
+	eventLoop := flag.Bool("event-loop", false, "run every command on a single goroutine instead of locking the keyspace shards")
+	dir := flag.String("dir", ".", "the directory holding the RDB file")
+	dbFileName := flag.String("dbfilename", "", "the RDB file written by SAVE, dump.rdb if not given. Only loaded at startup when given")
+	flag.Parse()
 
-
-	fmt.Printf("server config: %v",config)
-	kvstore := KVStore{
-		RWMutex: &sync.RWMutex{},
-		store: make(map[string]*Entry),
+	kvstore, err := store.NewWithOptions(store.Options{EventLoop: *eventLoop, Dir: *dir, DBFilename: *dbFileName})
+	if err != nil {
+		fmt.Printf("Error: %v",err)
+		os.Exit(1)
 	}
+	defer kvstore.Close()
 
 	ln,err := net.Listen("tcp",":6379")
 	if err!=nil{
@@ -76,18 +31,6 @@ func main() {
 	}
 	defer ln.Close()
 
-	ticker := time.NewTicker(time.Minute*5)
-	defer ticker.Stop()
-
-	//expiry clear loop
-	go func(){
-		for range ticker.C{
-			kvstore.removeExpired()
-		}
-	}()
-
-
-
 	//Main server handle loop
 	for {
 		conn, err := ln.Accept()
@@ -96,22 +39,62 @@ func main() {
 			os.Exit(1)
 
 		}
-		go handleConnection(conn,&kvstore)
+		go handleConnection(conn,kvstore)
 	}
 }
 
-func handleConnection(conn net.Conn, kvstore *KVStore){
-	defer conn.Close()
+type client struct {
+	conn net.Conn
+	requests chan []byte
+	// closed once the connection can't be read anymore so blocked
+	// commands stop waiting on a client that has gone away
+	closed chan struct{}
+	stopped chan struct{}
+	// the connection as the store sees it
+	session *store.Client
+}
+
+func newClient(conn net.Conn) *client{
+	closed := make(chan struct{})
+	return &client{
+		conn: conn,
+		requests: make(chan []byte, 16),
+		closed: closed,
+		stopped: make(chan struct{}),
+		session: store.NewClient(closed),
+	}
+}
+
+// readLoop runs in its own goroutine so the connection is still watched
+// while a command is blocked
+func (client *client) readLoop(){
+	defer close(client.closed)
+	defer close(client.requests)
 
 	for {
 		buffer := make([]byte,1024)
-		lengthOfData, err := conn.Read(buffer)
-		if err == io.EOF{
+		lengthOfData, err := client.conn.Read(buffer)
+		if err != nil{
+			return
+		}
+		select {
+		case client.requests <- buffer[:lengthOfData]:
+		case <-client.stopped:
 			return
 		}
-		reader := bytes.NewReader(buffer[:lengthOfData])
+	}
+}
 
-		message, err := selectReply(reader, kvstore)
+func handleConnection(conn net.Conn, kvstore *store.KVStore){
+	defer conn.Close()
+	client := newClient(conn)
+	defer close(client.stopped)
+	go client.readLoop()
+
+	for request := range client.requests {
+		reader := bytes.NewReader(request)
+
+		message, err := selectReply(reader, kvstore, client)
 		if err!=nil{
 			fmt.Printf("Error from parsing Message: %v",err)
 			return 
@@ -124,7 +107,7 @@ func handleConnection(conn net.Conn, kvstore *KVStore){
 }
 
 
-func selectReply(reader *bytes.Reader, kvstore *KVStore) ([]byte,error){
+func selectReply(reader *bytes.Reader, kvstore *store.KVStore, client *client) ([]byte,error){
 
 	clientMessage, err := parser.ParseRESP(reader)
 	if err!=nil{
@@ -148,28 +131,9 @@ func selectReply(reader *bytes.Reader, kvstore *KVStore) ([]byte,error){
 			messageArray = append(messageArray, checkedMsg)
 		}
 
-		// Get command
-		command := messageArray[0]
-		switch strings.ToUpper(string(command)){
-
-		case "CONFIG":
-			if string(messageArray[1]) == "GET"{
-				message = handleCONFIGGET(messageArray)
-			}
-
-		case "ECHO":
-			message = handleECHO(messageArray)
-		case "PING":
-			message = handlePING()
-		case "SET":
-			message, err = kvstore.handleSET(messageArray) 
-			if err!=nil{
-				return nil,err
-			}
-		case "GET":
-			message = kvstore.handleGET(messageArray)
-		default:
-			return nil, fmt.Errorf("error:%v",err)
+		message, err = kvstore.Execute(client.session, messageArray)
+		if err != nil {
+			return nil, err
 		}
 
 	  //For strings, ints etc
@@ -181,13 +145,3 @@ func selectReply(reader *bytes.Reader, kvstore *KVStore) ([]byte,error){
 
 	return message, nil
 }
-
-func (kvstore *KVStore) removeExpired(){
-	kvstore.Lock()
-	defer kvstore.Unlock()
-	for key, entry := range kvstore.store {
-		if (entry.expiryTime.Before(time.Now())){
-			delete(kvstore.store, key)
-		}
-	}
-}
\ No newline at end of file
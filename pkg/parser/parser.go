@@ -79,7 +79,7 @@ func ParseRESP(reader *bytes.Reader) (interface{}, error)  {
 		return parseBulkStrings(reader,bulkLength)
 
 	case arrays:
-		length , err := reader.ReadByte()
+		length, err := readTilEndOfType(reader,'\r')
 		if err!=nil{
 			return nil, err
 		}
@@ -87,7 +87,6 @@ func ParseRESP(reader *bytes.Reader) (interface{}, error)  {
 		if err!=nil{
 			return nil, err
 		}
-		clearEndOfByte(reader)
 		return parseArray(reader, arrayLength)
 //	case integers:
 		// handle integers
@@ -85,6 +85,10 @@ func TestParseRESP(t *testing.T) {
 		{"*3\r\n$3\r\nSET\r\n$10\r\nstrawberry\r\n$9\r\nraspberry\r\n", 
 			[]interface{}{[]byte("SET"), []byte("strawberry"), []byte("raspberry")}, 
 			false},
+		// arrays with a multi digit length
+		{"*10\r\n$5\r\nRPUSH\r\n$4\r\nlist\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n$1\r\nd\r\n$1\r\ne\r\n$1\r\nf\r\n$1\r\ng\r\n$1\r\nh\r\n",
+			[]interface{}{[]byte("RPUSH"), []byte("list"), []byte("a"), []byte("b"), []byte("c"), []byte("d"), []byte("e"), []byte("f"), []byte("g"), []byte("h")},
+			false},
 	}
 
 	for _, test := range tests {
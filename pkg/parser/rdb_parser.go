@@ -3,8 +3,11 @@ package parser
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"math"
 	"strconv"
+	"strings"
 	"io"
 )
 
@@ -128,7 +131,7 @@ func readRdbFile(reader *bytes.Reader) (map[string]string, error){
 					}
 
 					expiryInMiliseconds := binary.BigEndian.Uint64(buffer)
-					valueType, err := reader.ReadByte()
+					valueType, err := readValueType(reader)
 					if err!=nil{
 						return nil,err
 					}
@@ -147,7 +150,7 @@ func readRdbFile(reader *bytes.Reader) (map[string]string, error){
 					}
 
 					expiryInSeconds := binary.BigEndian.Uint32(buffer)
-					valueType, err := reader.ReadByte()
+					valueType, err := readValueType(reader)
 					if err!=nil{
 						return nil, err
 					}
@@ -158,6 +161,23 @@ func readRdbFile(reader *bytes.Reader) (map[string]string, error){
 					}
 					dbValues[keyValuePair[0]] = keyValuePair[1] + strconv.Itoa(int(expiryInSeconds))
 
+				//access metadata for eviction, skipped as the values are returned as strings
+				case 0xF8, 0xF9:
+					reader, err = restoreReader(reader, KeyValueOpCode)
+					if err!=nil{
+						return nil, err
+					}
+					valueType, err := readValueType(reader)
+					if err!=nil{
+						return nil, err
+					}
+
+					keyValuePair, err := readRdbKeyValuePairs(reader, int(valueType))
+					if err!=nil{
+						return nil, err
+					}
+					dbValues[keyValuePair[0]] = keyValuePair[1]
+
 				//if doesnt match case that means that the next KeyValuePair is not one with expiry. According to rdb file format keyValueOpCode should be the value-type
 
 				case 0xFE:
@@ -193,6 +213,29 @@ func readRdbFile(reader *bytes.Reader) (map[string]string, error){
 
 }
 
+//readValueType reads the value type of a key, skipping the idle time (0xF8) or LFU counter (0xF9) written ahead of it
+func readValueType(reader *bytes.Reader) (byte, error) {
+	for {
+		valueType, err := reader.ReadByte()
+		if err!=nil{
+			return 0, err
+		}
+
+		switch valueType {
+		case 0xF8:
+			if _, err := ReadLength(reader); err!=nil{
+				return 0, err
+			}
+		case 0xF9:
+			if _, err := reader.ReadByte(); err!=nil{
+				return 0, err
+			}
+		default:
+			return valueType, nil
+		}
+	}
+}
+
 //TODO Implement parsing of other encoded key value types
 //returns an array of length 2 where [0] is key [1] is value
 func readRdbKeyValuePairs(reader *bytes.Reader, valueType int)([]string, error){
@@ -200,17 +243,34 @@ func readRdbKeyValuePairs(reader *bytes.Reader, valueType int)([]string, error){
 	var keyValuePair []string
 	switch valueType{
 	case 0:
-		key, err := readLengthEncodedString(reader)
+		key, err := ReadString(reader)
+		if err!=nil{
+			return nil, err
+		}
+		value, err := ReadString(reader)
+		if err!=nil{
+			return nil, err
+		}
+
+		keyValuePair = append(keyValuePair, string(key))
+		keyValuePair = append(keyValuePair, string(value))
+	//module values, the value is the module type name followed by every string the module saved
+	case 7:
+		key, err := ReadString(reader)
+		if err!=nil{
+			return nil, err
+		}
+		moduleID, err := ReadLength(reader)
 		if err!=nil{
 			return nil, err
 		}
-		value, err := readLengthEncodedString(reader)
+		values, err := readModuleOpcodes(reader)
 		if err!=nil{
 			return nil, err
 		}
 
-		keyValuePair = append(keyValuePair, string(key.value))
-		keyValuePair = append(keyValuePair, string(value.value))
+		keyValuePair = append(keyValuePair, string(key))
+		keyValuePair = append(keyValuePair, moduleTypeName(moduleID) + " " + strings.Join(values, " "))
 	//missing other types
 	default:
 		return nil, fmt.Errorf("invalid rdb value type")
@@ -223,6 +283,212 @@ func readRdbKeyValuePairs(reader *bytes.Reader, valueType int)([]string, error){
 
 
 
+const moduleTypeNameCharset = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+
+//module ids are the 9 character type name at 6 bits a character followed by a 10 bit encoding version
+func moduleTypeName(moduleID uint64) string {
+	name := make([]byte, 9)
+	for i := range name {
+		name[i] = moduleTypeNameCharset[(moduleID >> (10 + 6*(8-uint(i)))) & 63]
+	}
+	return string(name)
+}
+
+//ReadLength reads a plain length, including the 32 and 64 bit forms
+func ReadLength(reader *bytes.Reader) (uint64, error) {
+	initByte, err := reader.ReadByte()
+	if err!=nil{
+		return 0, err
+	}
+
+	switch {
+	case initByte == 0x80:
+		buffer := make([]byte, 4)
+		if _, err := io.ReadFull(reader, buffer); err!=nil{
+			return 0, err
+		}
+		return uint64(binary.BigEndian.Uint32(buffer)), nil
+	case initByte == 0x81:
+		buffer := make([]byte, 8)
+		if _, err := io.ReadFull(reader, buffer); err!=nil{
+			return 0, err
+		}
+		return binary.BigEndian.Uint64(buffer), nil
+	case initByte >> 6 == 0x00:
+		return uint64(initByte & 0x3f), nil
+	case initByte >> 6 == 0x01:
+		secondHalf, err := reader.ReadByte()
+		if err!=nil{
+			return 0, err
+		}
+		return uint64(initByte & 0x3f) << 8 | uint64(secondHalf), nil
+	}
+	return 0, fmt.Errorf("invalid length encoding")
+}
+
+//readModuleOpcodes reads the values a module saved up to the EOF opcode
+func readModuleOpcodes(reader *bytes.Reader) ([]string, error) {
+	var values []string
+	for {
+		opCode, err := ReadLength(reader)
+		if err!=nil{
+			return nil, err
+		}
+
+		switch opCode {
+		//EOF
+		case 0:
+			return values, nil
+		//signed and unsigned integers
+		case 1, 2:
+			value, err := ReadLength(reader)
+			if err!=nil{
+				return nil, err
+			}
+			values = append(values, strconv.FormatUint(value, 10))
+		//float and double, saved little endian
+		case 3:
+			buffer := make([]byte, 4)
+			if _, err := io.ReadFull(reader, buffer); err!=nil{
+				return nil, err
+			}
+			value := math.Float32frombits(binary.LittleEndian.Uint32(buffer))
+			values = append(values, strconv.FormatFloat(float64(value), 'g', -1, 32))
+		case 4:
+			buffer := make([]byte, 8)
+			if _, err := io.ReadFull(reader, buffer); err!=nil{
+				return nil, err
+			}
+			value := math.Float64frombits(binary.LittleEndian.Uint64(buffer))
+			values = append(values, strconv.FormatFloat(value, 'g', -1, 64))
+		//string
+		case 5:
+			value, err := ReadString(reader)
+			if err!=nil{
+				return nil, err
+			}
+			values = append(values, string(value))
+		default:
+			return nil, fmt.Errorf("invalid module opcode")
+		}
+	}
+}
+
+var errInvalidString = errors.New("invalid rdb string")
+
+//ReadString reads a string in any encoding redis writes it in, plain, as a little endian integer or LZF compressed
+func ReadString(reader *bytes.Reader) ([]byte, error) {
+	initByte, err := reader.ReadByte()
+	if err!=nil{
+		return nil, err
+	}
+	if initByte >> 6 != 0x03 {
+		if err := reader.UnreadByte(); err!=nil{
+			return nil, err
+		}
+		length, err := ReadLength(reader)
+		if err!=nil{
+			return nil, err
+		}
+		return readBytes(reader, length)
+	}
+
+	switch initByte & 0x3f {
+	case 0:
+		value, err := readBytes(reader, 1)
+		if err!=nil{
+			return nil, err
+		}
+		return strconv.AppendInt(nil, int64(int8(value[0])), 10), nil
+	case 1:
+		value, err := readBytes(reader, 2)
+		if err!=nil{
+			return nil, err
+		}
+		return strconv.AppendInt(nil, int64(int16(binary.LittleEndian.Uint16(value))), 10), nil
+	case 2:
+		value, err := readBytes(reader, 4)
+		if err!=nil{
+			return nil, err
+		}
+		return strconv.AppendInt(nil, int64(int32(binary.LittleEndian.Uint32(value))), 10), nil
+	case 3:
+		compressedLength, err := ReadLength(reader)
+		if err!=nil{
+			return nil, err
+		}
+		length, err := ReadLength(reader)
+		if err!=nil{
+			return nil, err
+		}
+		compressed, err := readBytes(reader, compressedLength)
+		if err!=nil{
+			return nil, err
+		}
+		return lzfDecompress(compressed, length)
+	}
+	return nil, errInvalidString
+}
+
+//readBytes reads exactly size bytes, refusing sizes past the end of the input before allocating them
+func readBytes(reader *bytes.Reader, size uint64) ([]byte, error) {
+	if size > uint64(reader.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	buffer := make([]byte, size)
+	if _, err := io.ReadFull(reader, buffer); err!=nil{
+		return nil, err
+	}
+	return buffer, nil
+}
+
+//lzfDecompress expands LZF data, a mix of literal runs and back references into what has been written so far
+func lzfDecompress(input []byte, length uint64) ([]byte, error) {
+	//a back reference expands 3 bytes into at most 264, anything claiming more is corrupt
+	if length > uint64(len(input)) * 88 {
+		return nil, errInvalidString
+	}
+	output := make([]byte, 0, length)
+	for i := 0; i < len(input); {
+		control := int(input[i])
+		i++
+		if control < 1<<5 {
+			run := control + 1
+			if i + run > len(input) {
+				return nil, errInvalidString
+			}
+			output = append(output, input[i:i+run]...)
+			i += run
+			continue
+		}
+
+		run := control >> 5
+		if run == 7 {
+			if i >= len(input) {
+				return nil, errInvalidString
+			}
+			run += int(input[i])
+			i++
+		}
+		if i >= len(input) {
+			return nil, errInvalidString
+		}
+		reference := len(output) - (control & 0x1f) << 8 - int(input[i]) - 1
+		i++
+		if reference < 0 {
+			return nil, errInvalidString
+		}
+		//the reference can overlap what it is copying, byte by byte on purpose
+		for j := 0; j < run + 2; j++ {
+			output = append(output, output[reference+j])
+		}
+	}
+	if uint64(len(output)) != length {
+		return nil, errInvalidString
+	}
+	return output, nil
+}
+
 func readLengthEncodedString(reader *bytes.Reader)(LengthEncodedValue, error){
 	initByte, err := reader.ReadByte()
 	if err!=nil{
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"math"
 	"strconv"
 	"testing"
 	"os"
@@ -111,4 +112,83 @@ func TestReadLengthEncodedString(t *testing.T) {
 			}
 		})
 	}
-}
\ No newline at end of file
+}
+func TestReadModuleValue(t *testing.T) {
+	// a ReJSON-RL (encoding version 3) value holding a single string, as RedisJSON saves documents
+	input := []byte{0x03, 'd', 'o', 'c', 0x81, 0x45, 0xe2, 0x52, 0x38, 0xdf, 0x91, 0x2c, 0x03, 0x05, 0x07, '{', '"', 'a', '"', ':', '1', '}', 0x00}
+	reader := bytes.NewReader(input)
+	got, err := readRdbKeyValuePairs(reader, 7)
+	if err != nil {
+		t.Fatalf("readRdbKeyValuePairs() error = %v", err)
+	}
+	if got[0] != "doc" || got[1] != `ReJSON-RL {"a":1}` {
+		t.Errorf("readRdbKeyValuePairs() = %q", got)
+	}
+}
+
+func TestReadRdbFileSkipsAccessMetadata(t *testing.T) {
+	// a string key saved with an idle time of 300 seconds and one saved with an LFU counter of 7
+	input := []byte("REDIS0011")
+	input = append(input, 0xFE, 0x00)
+	input = append(input, 0xF8, 0x41, 0x2c, 0x00, 0x01, 'a', 0x01, '1')
+	input = append(input, 0xF9, 0x07, 0x00, 0x01, 'b', 0x01, '2')
+	input = append(input, 0xFF)
+	result, err := readRdbFile(bytes.NewReader(input))
+	if err != nil {
+		t.Fatalf("readRdbFile() error = %v", err)
+	}
+	if got := result["dbNumbers0"]; got != "map[a:1 b:2]" {
+		t.Errorf("readRdbFile() db 0 = %q", got)
+	}
+}
+
+func TestReadString(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		want  string
+	}{
+		{"plain", []byte{0x03, 'a', 'b', 'c'}, "abc"},
+		{"8 bit integer", []byte{0xc0, 0xfb}, "-5"},
+		{"16 bit integer, little endian", []byte{0xc1, 0x39, 0x30}, "12345"},
+		{"32 bit integer, little endian", []byte{0xc2, 0x15, 0xcd, 0x5b, 0x07}, "123456789"},
+		// a literal run of "abc" then a back reference 3 bytes back copying 4, overlapping what it writes
+		{"lzf", []byte{0xc3, 0x06, 0x07, 0x02, 'a', 'b', 'c', 0x40, 0x02}, "abcabca"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReadString(bytes.NewReader(tt.input))
+			if err != nil || string(got) != tt.want {
+				t.Errorf("ReadString() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+
+	for name, input := range map[string][]byte{
+		"truncated":                  {0x05, 'a', 'b'},
+		"length past the input":      {0x80, 0xff, 0xff, 0xff, 0xff},
+		"lzf reference before start": {0xc3, 0x02, 0x04, 0x40, 0x05},
+		"lzf wrong length":           {0xc3, 0x04, 0x09, 0x02, 'a', 'b', 'c'},
+		"unknown encoding":           {0xc4},
+	} {
+		if _, err := ReadString(bytes.NewReader(input)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestReadModuleFloats(t *testing.T) {
+	// a float of 1.5 and a double of -0.25 followed by EOF
+	input := []byte{0x03}
+	input = binary.LittleEndian.AppendUint32(input, math.Float32bits(1.5))
+	input = append(input, 0x04)
+	input = binary.LittleEndian.AppendUint64(input, math.Float64bits(-0.25))
+	input = append(input, 0x00)
+	got, err := readModuleOpcodes(bytes.NewReader(input))
+	if err != nil {
+		t.Fatalf("readModuleOpcodes() error = %v", err)
+	}
+	if fmt.Sprint(got) != "[1.5 -0.25]" {
+		t.Errorf("readModuleOpcodes() = %q", got)
+	}
+}
@@ -0,0 +1,188 @@
+package store
+
+import (
+	"slices"
+	"time"
+)
+
+// ErrWrongType is returned when a key holds a different type than the
+// call expects
+var ErrWrongType = errWrongType
+
+// ErrOOM is returned by writes refused because used memory is over
+// maxmemory and the maxmemory-policy can't evict enough to make room
+var ErrOOM = errOOM
+
+// SetOptions are the SET options. A zero TTL means no expiry, NX only
+// sets missing keys, XX only existing ones, KeepTTL keeps the ttl of the
+// value being replaced
+type SetOptions struct {
+	TTL     time.Duration
+	NX      bool
+	XX      bool
+	KeepTTL bool
+}
+
+// Get returns the string at key, ok is false if the key doesn't exist
+func (kvstore *KVStore) Get(key string) (value []byte, ok bool, err error) {
+	defer kvstore.borrowLoop()()
+	kvstore.rlockKeys(key)
+	defer kvstore.runlockKeys(key)
+
+	entry, err := kvstore.lookupTypedRead(key, stringType)
+	if entry == nil || err != nil {
+		return nil, false, err
+	}
+	return slices.Clone(entry.bytes()), true, nil
+}
+
+// Set stores value at key, replacing any value of any type, and reports
+// whether it was set, which NX or XX can prevent. Out of memory it
+// returns ErrOOM
+func (kvstore *KVStore) Set(key string, value []byte, options SetOptions) (bool, error) {
+	defer kvstore.borrowLoop()()
+	if !kvstore.performEvictions() {
+		return false, ErrOOM
+	}
+	kvstore.lockKeys(key)
+	defer kvstore.unlockKeys(key)
+
+	existing := kvstore.lookupKeyWrite(key)
+	if options.NX && existing != nil || options.XX && existing == nil {
+		return false, nil
+	}
+	entry := newEntry()
+	entry.setString(slices.Clone(value))
+	switch {
+	case options.TTL > 0:
+		entry.expiryTime = entry.creationTime.Add(options.TTL)
+	case options.KeepTTL && existing != nil && existing.hasExpiry():
+		entry.expiryTime = existing.expiryTime
+	}
+	kvstore.setKey(key, entry)
+	return true, nil
+}
+
+// Delete removes keys and returns how many existed
+func (kvstore *KVStore) Delete(keys ...string) int {
+	defer kvstore.borrowLoop()()
+	kvstore.lockKeys(keys...)
+	defer kvstore.unlockKeys(keys...)
+
+	deleted := 0
+	for _, key := range keys {
+		if kvstore.lookupKeyWrite(key) != nil {
+			kvstore.deleteKey(key)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+func (kvstore *KVStore) Exists(key string) bool {
+	defer kvstore.borrowLoop()()
+	kvstore.rlockKeys(key)
+	defer kvstore.runlockKeys(key)
+
+	return kvstore.lookupKeyRead(key) != nil
+}
+
+// Type returns the name TYPE would give the value at key, none if the key
+// doesn't exist
+func (kvstore *KVStore) Type(key string) string {
+	defer kvstore.borrowLoop()()
+	kvstore.rlockKeys(key)
+	defer kvstore.runlockKeys(key)
+
+	entry := kvstore.lookupKeyRead(key)
+	if entry == nil {
+		return "none"
+	}
+	return entry.objectType.String()
+}
+
+// Expire gives key a ttl, a ttl that isn't positive deletes it straight
+// away. It reports whether the key exists
+func (kvstore *KVStore) Expire(key string, ttl time.Duration) bool {
+	defer kvstore.borrowLoop()()
+	kvstore.lockKeys(key)
+	defer kvstore.unlockKeys(key)
+
+	entry := kvstore.lookupKeyWrite(key)
+	if entry == nil {
+		return false
+	}
+	if ttl <= 0 {
+		kvstore.deleteKey(key)
+		return true
+	}
+	entry.expiryTime = time.Now().Add(ttl)
+	kvstore.signalModifiedKey(key)
+	return true
+}
+
+// Persist removes key's ttl and reports whether it had one
+func (kvstore *KVStore) Persist(key string) bool {
+	defer kvstore.borrowLoop()()
+	kvstore.lockKeys(key)
+	defer kvstore.unlockKeys(key)
+
+	entry := kvstore.lookupKeyWrite(key)
+	if entry == nil || !entry.hasExpiry() {
+		return false
+	}
+	entry.expiryTime = entry.creationTime.Add(noExpiry)
+	kvstore.signalModifiedKey(key)
+	return true
+}
+
+// TTL returns how long key has left, -1 if it has no ttl. ok is false if
+// the key doesn't exist
+func (kvstore *KVStore) TTL(key string) (ttl time.Duration, ok bool) {
+	defer kvstore.borrowLoop()()
+	kvstore.rlockKeys(key)
+	defer kvstore.runlockKeys(key)
+
+	entry := kvstore.lookupKeyRead(key)
+	if entry == nil {
+		return 0, false
+	}
+	if !entry.hasExpiry() {
+		return -1, true
+	}
+	return time.Until(entry.expiryTime), true
+}
+
+// Scan returns keys matching the glob pattern match, all keys if it is
+// empty, and the cursor to pass next time, 0 once every key has been
+// returned. The cursor is the index of the shard to visit next. A call
+// takes whole shards, holding one shard lock at a time, until it has at
+// least count keys, so as with SCAN's COUNT more may come back. Keys
+// present for the whole iteration are returned exactly once
+func (kvstore *KVStore) Scan(cursor uint64, match string, count int) ([]string, uint64) {
+	if count <= 0 {
+		count = defaultScanCount
+	}
+
+	defer kvstore.borrowLoop()()
+	defer kvstore.expireLazily()
+
+	var keys []string
+	for index := cursor; index < shardCount; index++ {
+		if len(keys) >= count {
+			return keys, index
+		}
+		shard := kvstore.shards[index]
+		kvstore.rlockShard(shard)
+		for key := range shard.store {
+			if match != "" && !stringMatch([]byte(match), []byte(key)) {
+				continue
+			}
+			if kvstore.lookupKeyReadNoTouch(key) != nil {
+				keys = append(keys, key)
+			}
+		}
+		kvstore.runlockShard(shard)
+	}
+	return keys, 0
+}
@@ -0,0 +1,154 @@
+package store
+
+import (
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestGetSet(t *testing.T) {
+	kvstore := New()
+	defer kvstore.Close()
+
+	if _, ok, err := kvstore.Get("missing"); ok || err != nil {
+		t.Errorf("Get of a missing key = %v, %v", ok, err)
+	}
+	buffer := []byte("value")
+	kvstore.Set("k", buffer, SetOptions{})
+	buffer[0] = 'X'
+	if value, ok, _ := kvstore.Get("k"); !ok || string(value) != "value" {
+		t.Errorf("Set should copy the value, got %q", value)
+	}
+
+	if set, err := kvstore.Set("k", []byte("other"), SetOptions{NX: true}); set || err != nil {
+		t.Errorf("NX should not replace an existing key, got %v, %v", set, err)
+	}
+	if set, err := kvstore.Set("new", []byte("v"), SetOptions{XX: true}); set || err != nil || kvstore.Exists("new") {
+		t.Errorf("XX should not create a key, got %v, %v", set, err)
+	}
+
+	kvstore.RPush("list", []byte("a"))
+	if _, _, err := kvstore.Get("list"); err != ErrWrongType {
+		t.Errorf("Get of a list should be ErrWrongType, got %v", err)
+	}
+	if set, _ := kvstore.Set("list", []byte("v"), SetOptions{}); !set || kvstore.Type("list") != "string" {
+		t.Errorf("Set should replace values of any type")
+	}
+
+	// values set through the API are seen by commands and the other way round
+	if reply := string(kvstore.handleGET(command("GET", "k"))); reply != "$5\r\nvalue\r\n" {
+		t.Errorf("GET k = %q", reply)
+	}
+	kvstore.handleSET(command("SET", "fromCommand", "1"))
+	if value, _, _ := kvstore.Get("fromCommand"); string(value) != "1" {
+		t.Errorf("Get of a key SET by command = %q", value)
+	}
+}
+
+func TestExpireTTLPersist(t *testing.T) {
+	kvstore := New()
+	defer kvstore.Close()
+
+	kvstore.Set("k", []byte("v"), SetOptions{})
+	if ttl, ok := kvstore.TTL("k"); !ok || ttl != -1 {
+		t.Errorf("TTL of a key without one = %v, %v", ttl, ok)
+	}
+	if kvstore.Persist("k") {
+		t.Errorf("Persist of a key without a ttl should report false")
+	}
+	if !kvstore.Expire("k", time.Minute) {
+		t.Fatalf("Expire of an existing key should report true")
+	}
+	if ttl, _ := kvstore.TTL("k"); ttl <= 59*time.Second || ttl > time.Minute {
+		t.Errorf("TTL after Expire = %v", ttl)
+	}
+
+	kvstore.Set("k", []byte("v2"), SetOptions{KeepTTL: true})
+	if ttl, _ := kvstore.TTL("k"); ttl <= 0 {
+		t.Errorf("KeepTTL should keep the ttl, got %v", ttl)
+	}
+	if !kvstore.Persist("k") {
+		t.Errorf("Persist of a key with a ttl should report true")
+	}
+	if isExpiring(kvstore, "k") {
+		t.Errorf("Persist should drop the key from the expires index")
+	}
+
+	kvstore.Set("short", []byte("v"), SetOptions{TTL: time.Millisecond})
+	time.Sleep(5 * time.Millisecond)
+	if kvstore.Exists("short") {
+		t.Errorf("a key past its ttl should not exist")
+	}
+	if kvstore.Expire("missing", time.Minute) {
+		t.Errorf("Expire of a missing key should report false")
+	}
+	kvstore.Expire("k", 0)
+	if kvstore.Exists("k") {
+		t.Errorf("Expire with no time left should delete")
+	}
+}
+
+func TestScanAndDelete(t *testing.T) {
+	kvstore := New()
+	defer kvstore.Close()
+
+	for i := 0; i < 100; i++ {
+		kvstore.Set("user:"+strconv.Itoa(i), []byte("v"), SetOptions{})
+		kvstore.Set("order:"+strconv.Itoa(i), []byte("v"), SetOptions{})
+	}
+
+	var seen []string
+	cursor := uint64(0)
+	for {
+		var keys []string
+		keys, cursor = kvstore.Scan(cursor, "user:*", 7)
+		seen = append(seen, keys...)
+		if cursor == 0 {
+			break
+		}
+	}
+	slices.Sort(seen)
+	if len(seen) != 100 || len(slices.Compact(seen)) != 100 {
+		t.Errorf("expected each user key once, got %d keys", len(seen))
+	}
+
+	if deleted := kvstore.Delete("user:1", "user:2", "missing"); deleted != 2 {
+		t.Errorf("Delete should count existing keys, got %d", deleted)
+	}
+	if keys, _ := kvstore.Scan(0, "user:[12]", 100); len(keys) != 0 {
+		t.Errorf("deleted keys should not be scanned, got %v", keys)
+	}
+}
+
+func TestScanAcrossWrites(t *testing.T) {
+	kvstore := New()
+	defer kvstore.Close()
+	for i := 0; i < 200; i++ {
+		kvstore.Set("key:"+strconv.Itoa(i), []byte("v"), SetOptions{})
+	}
+
+	seen := make(map[string]int)
+	cursor := uint64(0)
+	for round := 0; ; round++ {
+		var keys []string
+		keys, cursor = kvstore.Scan(cursor, "", 5)
+		for _, key := range keys {
+			seen[key]++
+		}
+		if cursor == 0 {
+			break
+		}
+		if cursor >= shardCount {
+			t.Fatalf("expected the cursor to be a shard index, got %d", cursor)
+		}
+		// keys come and go between calls
+		kvstore.Set("new:"+strconv.Itoa(round), []byte("v"), SetOptions{})
+		kvstore.Delete("key:" + strconv.Itoa(199-round))
+	}
+	for i := 0; i < 100; i++ {
+		if key := "key:" + strconv.Itoa(i); seen[key] != 1 {
+			t.Errorf("expected %s once, got it %d times", key, seen[key])
+		}
+	}
+}
@@ -0,0 +1,696 @@
+package store
+
+import (
+	"errors"
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+var (
+	errBitOffset        = errors.New("ERR bit offset is not an integer or out of range")
+	errBitValue         = errors.New("ERR bit is not an integer or out of range")
+	errBitArgument      = errors.New("ERR The bit argument must be 1 or 0.")
+	errBitopNot         = errors.New("ERR BITOP NOT must be called with a single source key.")
+	errBitfieldType     = errors.New("ERR Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is.")
+	errBitfieldOverflow = errors.New("ERR Invalid OVERFLOW type specified")
+	errBitfieldReadOnly = errors.New("ERR BITFIELD_RO only supports the GET subcommand")
+)
+
+// strings can't grow past 512MB, the same cap redis puts on bulk strings
+const maxStringLength = 512 * 1024 * 1024
+
+// parseBitOffset reads a bit offset into a string, which has to stay
+// inside the maximum string length
+func parseBitOffset(value []byte) (int64, error) {
+	offset, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil || offset < 0 || offset>>3 >= maxStringLength {
+		return 0, errBitOffset
+	}
+	return offset, nil
+}
+
+// mutableString returns the raw bytes of a string entry, grown with zero
+// bytes to at least size. Int encoded values are converted to raw first
+func (entry *Entry) mutableString(size int64) []byte {
+	if entry.encoding == encodingInt {
+		entry.entry = entry.bytes()
+		entry.intValue = 0
+		entry.encoding = encodingRaw
+	}
+	if int64(len(entry.entry)) < size {
+		grown := make([]byte, size)
+		copy(grown, entry.entry)
+		entry.entry = grown
+	}
+	return entry.entry
+}
+
+// lookupStringForBits returns the string at key grown to hold size bytes,
+// creating it if needed. Caller must hold the write lock
+func (kvstore *KVStore) lookupStringForBits(key string, size int64) (*Entry, error) {
+	entry, err := kvstore.lookupTypedWrite(key, stringType)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		entry = newEntry()
+		kvstore.setKey(key, entry)
+	}
+	entry.mutableString(size)
+	return entry, nil
+}
+
+// getBit reads the bit at offset, bits count from the most significant
+// bit of the first byte and anything past the end of the string is 0
+func getBit(value []byte, offset int64) int {
+	index := offset >> 3
+	if index >= int64(len(value)) {
+		return 0
+	}
+	return int(value[index]>>(7-uint(offset&7))) & 1
+}
+
+func setBit(value []byte, offset int64, bit int) {
+	mask := byte(1) << (7 - uint(offset&7))
+	if bit == 1 {
+		value[offset>>3] |= mask
+	} else {
+		value[offset>>3] &^= mask
+	}
+}
+
+func (kvstore *KVStore) handleSETBIT(messages [][]byte) []byte {
+	if len(messages) != 4 {
+		return wrongArgumentsError("setbit")
+	}
+	offset, err := parseBitOffset(messages[2])
+	if err != nil {
+		return encodeError(err)
+	}
+	if len(messages[3]) != 1 || (messages[3][0] != '0' && messages[3][0] != '1') {
+		return encodeError(errBitValue)
+	}
+	bit := int(messages[3][0] - '0')
+
+	kvstore.lockKeys(string(messages[1]))
+	defer kvstore.unlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupStringForBits(string(messages[1]), offset>>3+1)
+	if err != nil {
+		return encodeError(err)
+	}
+	value := entry.entry
+	previous := getBit(value, offset)
+	setBit(value, offset, bit)
+	return encodeInteger(int64(previous))
+}
+
+func (kvstore *KVStore) handleGETBIT(messages [][]byte) []byte {
+	if len(messages) != 3 {
+		return wrongArgumentsError("getbit")
+	}
+	offset, err := parseBitOffset(messages[2])
+	if err != nil {
+		return encodeError(err)
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedRead(string(messages[1]), stringType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return encodeInteger(0)
+	}
+	return encodeInteger(int64(getBit(entry.bytes(), offset)))
+}
+
+// bitRange resolves start and end, in bytes or with isBit in bits, to an
+// inclusive range of bit offsets into a string of length bytes. ok is
+// false when the range is empty
+func bitRange(start int64, end int64, length int64, isBit bool) (int64, int64, bool) {
+	total := length
+	if isBit {
+		total = length * 8
+	}
+	if start < 0 {
+		start += total
+	}
+	if end < 0 {
+		end += total
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= total {
+		end = total - 1
+	}
+	if start > end || total == 0 {
+		return 0, 0, false
+	}
+	if !isBit {
+		return start * 8, end*8 + 7, true
+	}
+	return start, end, true
+}
+
+// parseBitRangeUnit reads the optional BYTE / BIT argument
+func parseBitRangeUnit(arguments [][]byte) (bool, error) {
+	if len(arguments) == 0 {
+		return false, nil
+	}
+	switch strings.ToUpper(string(arguments[0])) {
+	case "BYTE":
+		return false, nil
+	case "BIT":
+		return true, nil
+	}
+	return false, errSyntax
+}
+
+// countBits counts the set bits between the first and last bit offsets
+func countBits(value []byte, first int64, last int64) int64 {
+	var count int64
+	firstByte, lastByte := first>>3, last>>3
+	for i := firstByte; i <= lastByte; i++ {
+		b := value[i]
+		if i == firstByte {
+			b &= 0xff >> uint(first&7)
+		}
+		if i == lastByte {
+			b &= 0xff << uint(7-last&7)
+		}
+		count += int64(bits.OnesCount8(b))
+	}
+	return count
+}
+
+func (kvstore *KVStore) handleBITCOUNT(messages [][]byte) []byte {
+	if len(messages) < 2 {
+		return wrongArgumentsError("bitcount")
+	}
+	if len(messages) == 3 || len(messages) > 5 {
+		return encodeError(errSyntax)
+	}
+	var start, end int64
+	isBit := false
+	ranged := len(messages) > 2
+	if ranged {
+		var err error
+		if start, err = parseInteger(messages[2]); err != nil {
+			return encodeError(err)
+		}
+		if end, err = parseInteger(messages[3]); err != nil {
+			return encodeError(err)
+		}
+		if isBit, err = parseBitRangeUnit(messages[4:]); err != nil {
+			return encodeError(err)
+		}
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedRead(string(messages[1]), stringType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return encodeInteger(0)
+	}
+	value := entry.bytes()
+	if !ranged {
+		start, end = 0, -1
+	}
+	first, last, ok := bitRange(start, end, int64(len(value)), isBit)
+	if !ok {
+		return encodeInteger(0)
+	}
+	return encodeInteger(countBits(value, first, last))
+}
+
+// findBit returns the offset of the first bit equal to bit between the
+// first and last offsets, skipping whole bytes that can't match
+func findBit(value []byte, first int64, last int64, bit int) (int64, bool) {
+	skip := byte(0)
+	if bit == 0 {
+		skip = 0xff
+	}
+	for offset := first; offset <= last; {
+		if offset&7 == 0 && offset+7 <= last && value[offset>>3] == skip {
+			offset += 8
+			continue
+		}
+		if getBit(value, offset) == bit {
+			return offset, true
+		}
+		offset++
+	}
+	return 0, false
+}
+
+func (kvstore *KVStore) handleBITPOS(messages [][]byte) []byte {
+	if len(messages) < 3 {
+		return wrongArgumentsError("bitpos")
+	}
+	if len(messages) > 6 {
+		return encodeError(errSyntax)
+	}
+	if len(messages[2]) != 1 || (messages[2][0] != '0' && messages[2][0] != '1') {
+		return encodeError(errBitArgument)
+	}
+	bit := int(messages[2][0] - '0')
+
+	start, end := int64(0), int64(-1)
+	endGiven, isBit := false, false
+	var err error
+	if len(messages) > 3 {
+		if start, err = parseInteger(messages[3]); err != nil {
+			return encodeError(err)
+		}
+	}
+	if len(messages) > 4 {
+		if end, err = parseInteger(messages[4]); err != nil {
+			return encodeError(err)
+		}
+		endGiven = true
+	}
+	if isBit, err = parseBitRangeUnit(messages[min(len(messages), 5):]); err != nil {
+		return encodeError(err)
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedRead(string(messages[1]), stringType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		// a missing key is an endless run of zeros
+		if bit == 1 {
+			return encodeInteger(-1)
+		}
+		return encodeInteger(0)
+	}
+	value := entry.bytes()
+	first, last, ok := bitRange(start, end, int64(len(value)), isBit)
+	if !ok {
+		return encodeInteger(-1)
+	}
+	if position, found := findBit(value, first, last, bit); found {
+		return encodeInteger(position)
+	}
+	// without an explicit end the string counts as padded with zeros
+	if bit == 0 && !endGiven {
+		return encodeInteger(last + 1)
+	}
+	return encodeInteger(-1)
+}
+
+func (kvstore *KVStore) handleBITOP(messages [][]byte) []byte {
+	if len(messages) < 4 {
+		return wrongArgumentsError("bitop")
+	}
+	operation := strings.ToUpper(string(messages[1]))
+	switch operation {
+	case "AND", "OR", "XOR":
+	case "NOT":
+		if len(messages) != 4 {
+			return encodeError(errBitopNot)
+		}
+	default:
+		return encodeError(errSyntax)
+	}
+
+	keys := keyStrings(messages[2:])
+	kvstore.lockKeys(keys...)
+	defer kvstore.unlockKeys(keys...)
+
+	sources := make([][]byte, 0, len(messages)-3)
+	longest := 0
+	for _, key := range messages[3:] {
+		entry, err := kvstore.lookupTypedWrite(string(key), stringType)
+		if err != nil {
+			return encodeError(err)
+		}
+		var value []byte
+		if entry != nil {
+			value = entry.bytes()
+		}
+		sources = append(sources, value)
+		if len(value) > longest {
+			longest = len(value)
+		}
+	}
+
+	// shorter strings behave as if padded with zero bytes
+	result := make([]byte, longest)
+	for i := range result {
+		byteAt := func(source []byte) byte {
+			if i < len(source) {
+				return source[i]
+			}
+			return 0
+		}
+		b := byteAt(sources[0])
+		for _, source := range sources[1:] {
+			switch operation {
+			case "AND":
+				b &= byteAt(source)
+			case "OR":
+				b |= byteAt(source)
+			case "XOR":
+				b ^= byteAt(source)
+			}
+		}
+		if operation == "NOT" {
+			b = ^b
+		}
+		result[i] = b
+	}
+
+	destination := string(messages[2])
+	if len(result) == 0 {
+		kvstore.deleteKey(destination)
+		return encodeInteger(0)
+	}
+	entry := newEntry()
+	entry.entry = result
+	kvstore.setKey(destination, entry)
+	return encodeInteger(int64(len(result)))
+}
+
+type bitfieldOpcode int
+
+const (
+	bitfieldGet bitfieldOpcode = iota
+	bitfieldSet
+	bitfieldIncrby
+)
+
+type bitfieldOverflow int
+
+const (
+	overflowWrap bitfieldOverflow = iota
+	overflowSat
+	overflowFail
+)
+
+// bitfieldOp is one GET, SET or INCRBY of a BITFIELD call, with the
+// OVERFLOW behaviour in force when it was given
+type bitfieldOp struct {
+	opcode   bitfieldOpcode
+	signed   bool
+	bits     uint
+	offset   int64
+	value    int64
+	overflow bitfieldOverflow
+}
+
+// parseBitfieldType reads i1 to i64 or u1 to u63
+func parseBitfieldType(value []byte) (bool, uint, error) {
+	if len(value) < 2 {
+		return false, 0, errBitfieldType
+	}
+	var signed bool
+	switch value[0] {
+	case 'i', 'I':
+		signed = true
+	case 'u', 'U':
+	default:
+		return false, 0, errBitfieldType
+	}
+	size, err := strconv.ParseUint(string(value[1:]), 10, 8)
+	if err != nil || size < 1 || (signed && size > 64) || (!signed && size > 63) {
+		return false, 0, errBitfieldType
+	}
+	return signed, uint(size), nil
+}
+
+// parseBitfieldOffset reads an offset in bits, or with a leading # in
+// multiples of the field width
+func parseBitfieldOffset(value []byte, width uint) (int64, error) {
+	multiply := len(value) > 0 && value[0] == '#'
+	if multiply {
+		value = value[1:]
+	}
+	offset, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil || offset < 0 {
+		return 0, errBitOffset
+	}
+	if multiply {
+		if offset > math.MaxInt64/int64(width) {
+			return 0, errBitOffset
+		}
+		offset *= int64(width)
+	}
+	if offset>>3 >= maxStringLength {
+		return 0, errBitOffset
+	}
+	return offset, nil
+}
+
+func parseBitfieldOps(arguments [][]byte, readOnly bool) ([]bitfieldOp, error) {
+	var ops []bitfieldOp
+	overflow := overflowWrap
+	for i := 0; i < len(arguments); {
+		subcommand := strings.ToUpper(string(arguments[i]))
+		remaining := len(arguments) - i - 1
+		if subcommand == "OVERFLOW" && remaining >= 1 {
+			switch strings.ToUpper(string(arguments[i+1])) {
+			case "WRAP":
+				overflow = overflowWrap
+			case "SAT":
+				overflow = overflowSat
+			case "FAIL":
+				overflow = overflowFail
+			default:
+				return nil, errBitfieldOverflow
+			}
+			i += 2
+			continue
+		}
+
+		op := bitfieldOp{overflow: overflow}
+		taken := 3
+		switch {
+		case subcommand == "GET" && remaining >= 2:
+			op.opcode = bitfieldGet
+		case subcommand == "SET" && remaining >= 3:
+			op.opcode = bitfieldSet
+			taken = 4
+		case subcommand == "INCRBY" && remaining >= 3:
+			op.opcode = bitfieldIncrby
+			taken = 4
+		default:
+			return nil, errSyntax
+		}
+		if readOnly && op.opcode != bitfieldGet {
+			return nil, errBitfieldReadOnly
+		}
+
+		var err error
+		if op.signed, op.bits, err = parseBitfieldType(arguments[i+1]); err != nil {
+			return nil, err
+		}
+		if op.offset, err = parseBitfieldOffset(arguments[i+2], op.bits); err != nil {
+			return nil, err
+		}
+		if taken == 4 {
+			if op.value, err = parseInteger(arguments[i+3]); err != nil {
+				return nil, err
+			}
+		}
+		ops = append(ops, op)
+		i += taken
+	}
+	return ops, nil
+}
+
+// getBits reads width bits at offset as an unsigned integer
+func getBits(value []byte, offset int64, width uint) uint64 {
+	var result uint64
+	for i := uint(0); i < width; i++ {
+		result = result<<1 | uint64(getBit(value, offset+int64(i)))
+	}
+	return result
+}
+
+func setBits(value []byte, offset int64, width uint, field uint64) {
+	for i := uint(0); i < width; i++ {
+		setBit(value, offset+int64(i), int(field>>(width-1-i))&1)
+	}
+}
+
+// signExtend turns the low width bits of field into a signed integer
+func signExtend(field uint64, width uint) int64 {
+	if width == 64 {
+		return int64(field)
+	}
+	shift := 64 - width
+	return int64(field<<shift) >> shift
+}
+
+// checkSignedOverflow reports whether value + increment leaves the range
+// of a signed width bit integer, along with what to store instead under
+// WRAP or SAT
+func checkSignedOverflow(value int64, increment int64, width uint, overflow bitfieldOverflow) (int64, bool) {
+	max := int64(math.MaxInt64)
+	if width != 64 {
+		max = int64(1)<<(width-1) - 1
+	}
+	min := -max - 1
+	maxIncrement := max - value
+	minIncrement := min - value
+
+	var limit int64
+	switch {
+	case value > max || (width != 64 && increment > maxIncrement) || (value >= 0 && increment > 0 && increment > maxIncrement):
+		limit = max
+	case value < min || (width != 64 && increment < minIncrement) || (value < 0 && increment < 0 && increment < minIncrement):
+		limit = min
+	default:
+		return 0, false
+	}
+	if overflow == overflowWrap {
+		// add as unsigned so the wrap around is well defined
+		sum := uint64(value) + uint64(increment)
+		return signExtend(sum, width), true
+	}
+	return limit, true
+}
+
+// checkUnsignedOverflow is checkSignedOverflow for unsigned fields
+func checkUnsignedOverflow(value uint64, increment int64, width uint, overflow bitfieldOverflow) (uint64, bool) {
+	max := uint64(1)<<width - 1
+	maxIncrement := int64(max - value)
+	minIncrement := -int64(value)
+
+	var limit uint64
+	switch {
+	case value > max || (increment > 0 && increment > maxIncrement):
+		limit = max
+	case increment < 0 && increment < minIncrement:
+		limit = 0
+	default:
+		return 0, false
+	}
+	if overflow == overflowWrap {
+		return (value + uint64(increment)) & max, true
+	}
+	return limit, true
+}
+
+// apply runs op against value, which must already be long enough for
+// writes. The reply is nil when a FAIL overflow skipped the write
+func (op bitfieldOp) apply(value []byte) []byte {
+	field := getBits(value, op.offset, op.bits)
+	mask := uint64(math.MaxUint64)
+	if op.bits < 64 {
+		mask = uint64(1)<<op.bits - 1
+	}
+
+	if op.signed {
+		current := signExtend(field, op.bits)
+		if op.opcode == bitfieldGet {
+			return encodeInteger(current)
+		}
+		updated, reply := op.value, current
+		if op.opcode == bitfieldIncrby {
+			updated = current + op.value
+		}
+		base, increment := op.value, int64(0)
+		if op.opcode == bitfieldIncrby {
+			base, increment = current, op.value
+		}
+		if limited, overflowed := checkSignedOverflow(base, increment, op.bits, op.overflow); overflowed {
+			if op.overflow == overflowFail {
+				return nullBulkReply
+			}
+			updated = limited
+		}
+		if op.opcode == bitfieldIncrby {
+			reply = updated
+		}
+		setBits(value, op.offset, op.bits, uint64(updated)&mask)
+		return encodeInteger(reply)
+	}
+
+	if op.opcode == bitfieldGet {
+		return encodeInteger(int64(field))
+	}
+	updated, reply := uint64(op.value), field
+	base, increment := uint64(op.value), int64(0)
+	if op.opcode == bitfieldIncrby {
+		updated = field + uint64(op.value)
+		base, increment = field, op.value
+	}
+	if limited, overflowed := checkUnsignedOverflow(base, increment, op.bits, op.overflow); overflowed {
+		if op.overflow == overflowFail {
+			return nullBulkReply
+		}
+		updated = limited
+	}
+	if op.opcode == bitfieldIncrby {
+		reply = updated
+	}
+	setBits(value, op.offset, op.bits, updated&mask)
+	return encodeInteger(int64(reply))
+}
+
+// handleBITFIELD serves BITFIELD and BITFIELD_RO
+func (kvstore *KVStore) handleBITFIELD(messages [][]byte) []byte {
+	command := strings.ToLower(string(messages[0]))
+	if len(messages) < 2 {
+		return wrongArgumentsError(command)
+	}
+	readOnly := command == "bitfield_ro"
+	ops, err := parseBitfieldOps(messages[2:], readOnly)
+	if err != nil {
+		return encodeError(err)
+	}
+
+	// the string only grows to cover the fields that are written
+	var size int64
+	for _, op := range ops {
+		if op.opcode != bitfieldGet {
+			size = max(size, (op.offset+int64(op.bits)+7)>>3)
+		}
+	}
+
+	key := string(messages[1])
+	var value []byte
+	if size == 0 {
+		kvstore.rlockKeys(key)
+		defer kvstore.runlockKeys(key)
+		entry, err := kvstore.lookupTypedRead(key, stringType)
+		if err != nil {
+			return encodeError(err)
+		}
+		if entry != nil {
+			value = entry.bytes()
+		}
+	} else {
+		kvstore.lockKeys(key)
+		defer kvstore.unlockKeys(key)
+		entry, err := kvstore.lookupStringForBits(key, size)
+		if err != nil {
+			return encodeError(err)
+		}
+		value = entry.entry
+	}
+
+	replies := make([][]byte, 0, len(ops))
+	for _, op := range ops {
+		replies = append(replies, op.apply(value))
+	}
+	return encodeRawArray(replies)
+}
@@ -0,0 +1,141 @@
+package store
+
+import (
+	"testing"
+)
+
+func setString(kvstore *KVStore, key string, value string) {
+	entry := newEntry()
+	entry.setString([]byte(value))
+	kvstore.shardFor(key).store[key] = entry
+}
+
+// the expected replies come from the examples in the redis documentation
+func TestBitCountAndPos(t *testing.T) {
+	kvstore := newKVStore()
+	setString(kvstore, "foobar", "foobar")
+	setString(kvstore, "leading", "\xff\xf0\x00")
+	setString(kvstore, "middle", "\x00\xff\xf0")
+	setString(kvstore, "ones", "\xff\xff\xff")
+
+	cases := []struct {
+		arguments []string
+		expected  int64
+	}{
+		{[]string{"BITCOUNT", "foobar"}, 26},
+		{[]string{"BITCOUNT", "foobar", "0", "0"}, 4},
+		{[]string{"BITCOUNT", "foobar", "1", "1"}, 6},
+		{[]string{"BITCOUNT", "foobar", "1", "1", "BYTE"}, 6},
+		{[]string{"BITCOUNT", "foobar", "5", "30", "BIT"}, 17},
+		{[]string{"BITCOUNT", "foobar", "-2", "-1"}, 7},
+		{[]string{"BITCOUNT", "missing"}, 0},
+		{[]string{"BITPOS", "leading", "0"}, 12},
+		{[]string{"BITPOS", "middle", "1", "0"}, 8},
+		{[]string{"BITPOS", "middle", "1", "2"}, 16},
+		{[]string{"BITPOS", "middle", "1", "2", "-1", "BYTE"}, 16},
+		{[]string{"BITPOS", "middle", "1", "7", "15", "BIT"}, 8},
+		{[]string{"BITPOS", "ones", "0"}, 24},
+		{[]string{"BITPOS", "ones", "0", "0", "-1"}, -1},
+		{[]string{"BITPOS", "missing", "0"}, 0},
+		{[]string{"BITPOS", "missing", "1"}, -1},
+	}
+	for _, tc := range cases {
+		handler := kvstore.handleBITCOUNT
+		if tc.arguments[0] == "BITPOS" {
+			handler = kvstore.handleBITPOS
+		}
+		reply := handler(command(tc.arguments...))
+		if string(reply) != string(encodeInteger(tc.expected)) {
+			t.Errorf("%v expected %d, got %q", tc.arguments, tc.expected, reply)
+		}
+	}
+}
+
+func TestSetBitGrowsAndConvertsIntegers(t *testing.T) {
+	kvstore := newKVStore()
+	if reply := kvstore.handleSETBIT(command("SETBIT", "key", "7", "1")); string(reply) != ":0\r\n" {
+		t.Fatalf("expected the old bit 0, got %q", reply)
+	}
+	if value := string(kvstore.find("key").bytes()); value != "\x01" {
+		t.Errorf("expected \\x01, got %q", value)
+	}
+
+	// "1" is 0x31, clearing its lowest bit leaves 0x30 which is "0"
+	setString(kvstore, "number", "1")
+	kvstore.handleSETBIT(command("SETBIT", "number", "7", "0"))
+	entry := kvstore.find("number")
+	if entry.encoding != encodingRaw || string(entry.bytes()) != "0" {
+		t.Errorf("expected a raw \"0\", got %q encoding %v", entry.bytes(), entry.encoding)
+	}
+}
+
+func TestBitop(t *testing.T) {
+	kvstore := newKVStore()
+	setString(kvstore, "a", "foobar")
+	setString(kvstore, "b", "abcdef")
+	if reply := kvstore.handleBITOP(command("BITOP", "AND", "dest", "a", "b")); string(reply) != ":6\r\n" {
+		t.Fatalf("expected length 6, got %q", reply)
+	}
+	if value := string(kvstore.find("dest").bytes()); value != "`bc`ab" {
+		t.Errorf("expected `bc`ab, got %q", value)
+	}
+
+	setString(kvstore, "short", "\xff")
+	kvstore.handleBITOP(command("BITOP", "OR", "dest", "short", "missing", "a"))
+	if value := string(kvstore.find("dest").bytes()); value != "\xffoobar" {
+		t.Errorf("shorter strings should be zero padded, got %q", value)
+	}
+	kvstore.handleBITOP(command("BITOP", "NOT", "dest", "short"))
+	if value := string(kvstore.find("dest").bytes()); value != "\x00" {
+		t.Errorf("expected NOT \\xff to be \\x00, got %q", value)
+	}
+	kvstore.handleBITOP(command("BITOP", "XOR", "dest", "missing"))
+	if kvstore.find("dest") != nil {
+		t.Errorf("an empty result should remove the destination")
+	}
+}
+
+func TestBitfieldOverflow(t *testing.T) {
+	kvstore := newKVStore()
+	// from the BITFIELD documentation, a 2 bit counter wrapping next to a
+	// saturating one
+	expected := [][2]int64{{1, 1}, {2, 2}, {3, 3}, {0, 3}}
+	for i, pair := range expected {
+		reply := kvstore.handleBITFIELD(command("BITFIELD", "counters", "INCRBY", "u2", "100", "1", "OVERFLOW", "SAT", "INCRBY", "u2", "102", "1"))
+		if string(reply) != string(encodeIntegerArray(pair[:])) {
+			t.Errorf("call %d expected %v, got %q", i, pair, reply)
+		}
+	}
+	if reply := kvstore.handleBITFIELD(command("BITFIELD", "counters", "OVERFLOW", "FAIL", "INCRBY", "u2", "102", "1")); string(reply) != "*1\r\n$-1\r\n" {
+		t.Errorf("FAIL should reply nil, got %q", reply)
+	}
+
+	cases := []struct {
+		arguments []string
+		expected  string
+	}{
+		{[]string{"SET", "i8", "0", "127"}, "*1\r\n:0\r\n"},
+		{[]string{"INCRBY", "i8", "0", "1"}, "*1\r\n:-128\r\n"},
+		{[]string{"OVERFLOW", "SAT", "INCRBY", "i8", "0", "-1"}, "*1\r\n:-128\r\n"},
+		{[]string{"SET", "u8", "#1", "300"}, "*1\r\n:0\r\n"},
+		{[]string{"GET", "u8", "8", "GET", "i4", "8"}, "*2\r\n:44\r\n:2\r\n"},
+		{[]string{"OVERFLOW", "SAT", "SET", "u8", "8", "-5"}, "*1\r\n:44\r\n"},
+		{[]string{"GET", "u8", "8"}, "*1\r\n:255\r\n"},
+		{[]string{"SET", "i64", "16", "-9223372036854775808"}, "*1\r\n:0\r\n"},
+		{[]string{"OVERFLOW", "FAIL", "INCRBY", "i64", "16", "-1"}, "*1\r\n$-1\r\n"},
+		{[]string{"INCRBY", "i64", "16", "-1"}, "*1\r\n:9223372036854775807\r\n"},
+	}
+	for _, tc := range cases {
+		reply := kvstore.handleBITFIELD(command(append([]string{"BITFIELD", "fields"}, tc.arguments...)...))
+		if string(reply) != tc.expected {
+			t.Errorf("%v expected %q, got %q", tc.arguments, tc.expected, reply)
+		}
+	}
+
+	if reply := kvstore.handleBITFIELD(command("BITFIELD_RO", "fields", "SET", "u8", "0", "1")); string(reply) != string(encodeError(errBitfieldReadOnly)) {
+		t.Errorf("BITFIELD_RO should refuse writes, got %q", reply)
+	}
+	if reply := kvstore.handleBITFIELD(command("BITFIELD", "fields", "GET", "u64", "0")); string(reply) != string(encodeError(errBitfieldType)) {
+		t.Errorf("u64 should be rejected, got %q", reply)
+	}
+}
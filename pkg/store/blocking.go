@@ -0,0 +1,231 @@
+package store
+
+import (
+	"errors"
+	"math"
+	"slices"
+	"strconv"
+	"time"
+)
+
+var (
+	errTimeoutNotFloat = errors.New("ERR timeout is not a float or out of range")
+	errTimeoutNegative = errors.New("ERR timeout is negative")
+	errTimeoutNotInt   = errors.New("ERR timeout is not an integer or out of range")
+)
+
+// Client is what the store knows of a connection, a blocking command
+// waits on it and gives up once closed is closed
+type Client struct {
+	closed <-chan struct{}
+	// set by a blocking command in event loop mode, Execute calls it
+	// once the command has left the loop
+	wait func() []byte
+}
+
+func NewClient(closed <-chan struct{}) *Client {
+	return &Client{closed: closed}
+}
+
+// blockedClient is a client parked on one or more keys by a blocking
+// command. Clients are queued per key in arrival order and served first
+// come first served whenever one of their keys is signalled as ready
+type blockedClient struct {
+	keys []string
+	// locks holds every key serve touches, the keys waited on and any
+	// destination, all locked whenever the client is served or gives up
+	locks []string
+	// serve runs with locks held once key may have data for the client,
+	// returning the reply and whether the client could be served
+	serve  func(key string) ([]byte, bool)
+	reply  chan []byte
+	served bool
+}
+
+// parseTimeout reads a blocking command timeout given in seconds, zero
+// means block forever
+func parseTimeout(value []byte) (time.Duration, error) {
+	seconds, err := strconv.ParseFloat(string(value), 64)
+	if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return 0, errTimeoutNotFloat
+	}
+	if seconds < 0 {
+		return 0, errTimeoutNegative
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// parseTimeoutMilliseconds reads the BLOCK option of the stream commands,
+// which is given in whole milliseconds, zero means block forever
+func parseTimeoutMilliseconds(value []byte) (time.Duration, error) {
+	milliseconds, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		return 0, errTimeoutNotInt
+	}
+	if milliseconds < 0 {
+		return 0, errTimeoutNegative
+	}
+	return time.Duration(milliseconds) * time.Millisecond, nil
+}
+
+// blockForKeys queues a new blocked client on every key. destinations
+// are any other keys serve writes to. Caller must hold the write locks of
+// keys and destinations
+func (kvstore *KVStore) blockForKeys(keys []string, destinations []string, serve func(key string) ([]byte, bool)) *blockedClient {
+	blocked := &blockedClient{
+		serve: serve,
+		reply: make(chan []byte, 1),
+	}
+
+	kvstore.blockingLock.Lock()
+	defer kvstore.blockingLock.Unlock()
+
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		blocked.keys = append(blocked.keys, key)
+		kvstore.blocked[key] = append(kvstore.blocked[key], blocked)
+	}
+	blocked.locks = append(slices.Clone(blocked.keys), destinations...)
+	return blocked
+}
+
+// unblockClient removes the client from the queue of every key it waits on.
+// Caller must hold blockingLock
+func (kvstore *KVStore) unblockClient(blocked *blockedClient) {
+	for _, key := range blocked.keys {
+		queue := kvstore.blocked[key]
+		for i, queued := range queue {
+			if queued == blocked {
+				queue = append(queue[:i], queue[i+1:]...)
+				break
+			}
+		}
+		if len(queue) == 0 {
+			delete(kvstore.blocked, key)
+		} else {
+			kvstore.blocked[key] = queue
+		}
+	}
+}
+
+// signalKeyAsReady is called by every command that adds data a blocked
+// client could be waiting on. The key is queued and the clients waiting on
+// it are served by serveBlockedClients once the command has released its
+// locks. Caller must hold the write lock of key's shard
+func (kvstore *KVStore) signalKeyAsReady(key string) {
+	kvstore.blockingLock.Lock()
+	defer kvstore.blockingLock.Unlock()
+
+	if len(kvstore.blocked[key]) == 0 {
+		return
+	}
+	kvstore.readyKeys = append(kvstore.readyKeys, key)
+	kvstore.hasReadyKeys.Store(true)
+}
+
+// serveBlockedClients serves clients waiting on ready keys in FIFO order.
+// Anything they push in turn is queued and handled by the same loop, and
+// only one goroutine runs the loop at a time, so serving never recurses.
+// unlockKeys calls it, caller must hold no shard locks
+func (kvstore *KVStore) serveBlockedClients() {
+	if !kvstore.hasReadyKeys.Load() {
+		return
+	}
+
+	kvstore.blockingLock.Lock()
+	if kvstore.servingBlocked {
+		kvstore.blockingLock.Unlock()
+		return
+	}
+	kvstore.servingBlocked = true
+	for len(kvstore.readyKeys) > 0 {
+		readyKey := kvstore.readyKeys[0]
+		kvstore.readyKeys = kvstore.readyKeys[1:]
+		queue := slices.Clone(kvstore.blocked[readyKey])
+
+		kvstore.blockingLock.Unlock()
+		// a client that can't be served, say a BLPOP on a key that now
+		// holds a sorted set, mustn't hold up the ones queued behind it
+		for _, blocked := range queue {
+			kvstore.serveBlockedClient(blocked, readyKey)
+		}
+		kvstore.blockingLock.Lock()
+	}
+	kvstore.hasReadyKeys.Store(false)
+	kvstore.servingBlocked = false
+	kvstore.blockingLock.Unlock()
+}
+
+func (kvstore *KVStore) serveBlockedClient(blocked *blockedClient, readyKey string) {
+	kvstore.lockKeys(blocked.locks...)
+	defer kvstore.releaseKeys(blocked.locks)
+
+	kvstore.blockingLock.Lock()
+	served := blocked.served
+	kvstore.blockingLock.Unlock()
+	if served {
+		return
+	}
+	reply, ok := blocked.serve(readyKey)
+	if !ok {
+		return
+	}
+
+	kvstore.blockingLock.Lock()
+	kvstore.unblockClient(blocked)
+	blocked.served = true
+	kvstore.blockingLock.Unlock()
+	blocked.reply <- reply
+}
+
+// waitUntilServed parks the calling connection until the blocked client is
+// served, the timeout passes or the connection closes. Must be called
+// without holding any shard lock. The event loop can't be parked, so in
+// event loop mode the wait is left to Execute and the reply is nil
+func (kvstore *KVStore) waitUntilServed(blocked *blockedClient, client *Client, timeout time.Duration, timeoutReply []byte) []byte {
+	if kvstore.options.EventLoop {
+		client.wait = func() []byte {
+			return kvstore.awaitReply(blocked, client, timeout, timeoutReply)
+		}
+		return nil
+	}
+	return kvstore.awaitReply(blocked, client, timeout, timeoutReply)
+}
+
+func (kvstore *KVStore) awaitReply(blocked *blockedClient, client *Client, timeout time.Duration, timeoutReply []byte) []byte {
+	var timer <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		timer = t.C
+	}
+
+	select {
+	case reply := <-blocked.reply:
+		return reply
+	case <-timer:
+	case <-client.closed:
+	}
+
+	var reply []byte
+	kvstore.run(func() {
+		// with the client's keys locked it can't be in the middle of
+		// being served
+		kvstore.lockKeys(blocked.locks...)
+		defer kvstore.unlockKeys(blocked.locks...)
+		kvstore.blockingLock.Lock()
+		defer kvstore.blockingLock.Unlock()
+		// served between the timer firing and getting the locks
+		if blocked.served {
+			reply = <-blocked.reply
+			return
+		}
+		kvstore.unblockClient(blocked)
+		reply = timeoutReply
+	})
+	return reply
+}
@@ -0,0 +1,193 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestClient() *Client {
+	return NewClient(make(chan struct{}))
+}
+
+func command(arguments ...string) [][]byte {
+	var result [][]byte
+	for _, argument := range arguments {
+		result = append(result, []byte(argument))
+	}
+	return result
+}
+
+// waitForBlocked spins until count clients are queued on key
+func waitForBlocked(t *testing.T, kvstore *KVStore, key string, count int) {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		kvstore.blockingLock.Lock()
+		queued := len(kvstore.blocked[key])
+		kvstore.blockingLock.Unlock()
+		if queued == count {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("expected %d clients blocked on %s", count, key)
+}
+
+func TestBlockedClientsServedInOrder(t *testing.T) {
+	kvstore := newKVStore()
+	replies := make([]chan string, 3)
+	for i := range replies {
+		replies[i] = make(chan string, 1)
+		go func(reply chan string) {
+			reply <- string(kvstore.handleBLPOP(command("BLPOP", "queue", "0"), newTestClient()))
+		}(replies[i])
+		waitForBlocked(t, kvstore, "queue", i+1)
+	}
+
+	kvstore.handleRPUSH(command("RPUSH", "queue", "a", "b"))
+	for i, expected := range []string{"a", "b"} {
+		reply := <-replies[i]
+		if reply != string(encodeArray(command("queue", expected))) {
+			t.Errorf("client %d expected %s, got %q", i, expected, reply)
+		}
+	}
+	waitForBlocked(t, kvstore, "queue", 1)
+
+	kvstore.handleLPUSH(command("LPUSH", "queue", "c"))
+	if reply := <-replies[2]; reply != string(encodeArray(command("queue", "c"))) {
+		t.Errorf("client 2 expected c, got %q", reply)
+	}
+	if kvstore.keyCount() != 0 {
+		t.Errorf("expected the drained list to be removed")
+	}
+}
+
+func TestBlockedClientSkippedWhenTypeDoesNotMatch(t *testing.T) {
+	kvstore := newKVStore()
+	listReply := make(chan string, 1)
+	zsetReply := make(chan string, 1)
+	go func() {
+		listReply <- string(kvstore.handleBLPOP(command("BLPOP", "key", "0.2"), newTestClient()))
+	}()
+	waitForBlocked(t, kvstore, "key", 1)
+	go func() {
+		zsetReply <- string(kvstore.handleBZPOPMIN(command("BZPOPMIN", "key", "0"), newTestClient()))
+	}()
+	waitForBlocked(t, kvstore, "key", 2)
+
+	kvstore.handleZADD(command("ZADD", "key", "1", "member"))
+	if reply := <-zsetReply; reply != string(encodeArray(command("key", "member", "1"))) {
+		t.Errorf("expected the sorted set pop to be served, got %q", reply)
+	}
+	if reply := <-listReply; reply != string(nullArrayReply) {
+		t.Errorf("expected the list pop to time out, got %q", reply)
+	}
+}
+
+func TestBlockedClientLeavesQueueOnDisconnect(t *testing.T) {
+	kvstore := newKVStore()
+	closed := make(chan struct{})
+	client := NewClient(closed)
+	reply := make(chan string, 1)
+	go func() {
+		reply <- string(kvstore.handleBRPOP(command("BRPOP", "a", "b", "0"), client))
+	}()
+	waitForBlocked(t, kvstore, "b", 1)
+
+	close(closed)
+	<-reply
+	kvstore.blockingLock.Lock()
+	defer kvstore.blockingLock.Unlock()
+	if len(kvstore.blocked) != 0 {
+		t.Errorf("expected no blocked clients left, got %v", kvstore.blocked)
+	}
+}
+
+// executeBlocked runs a blocking command through Execute on its own
+// goroutine and waits until it is queued on key
+func executeBlocked(t *testing.T, kvstore *KVStore, key string, queued int, arguments ...string) chan string {
+	reply := make(chan string, 1)
+	go func() {
+		message, err := kvstore.Execute(newTestClient(), command(arguments...))
+		if err != nil {
+			message = []byte(err.Error())
+		}
+		reply <- string(message)
+	}()
+	waitForBlocked(t, kvstore, key, queued)
+	return reply
+}
+
+func TestBlockingListCommands(t *testing.T) {
+	kvstore := newKVStore()
+	client := newTestClient()
+
+	t.Run("timeout", func(t *testing.T) {
+		for _, arguments := range [][]string{
+			{"BLPOP", "missing", "0.05"},
+			{"BRPOP", "missing", "other", "0.05"},
+			{"BLMPOP", "0.05", "1", "missing", "LEFT"},
+		} {
+			start := time.Now()
+			if got := execute(t, kvstore, client, arguments...); got != string(nullArrayReply) {
+				t.Errorf("%v: expected a null array, got %q", arguments, got)
+			}
+			if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+				t.Errorf("%v: returned after %v, before the timeout", arguments, elapsed)
+			}
+		}
+		if got := execute(t, kvstore, client, "BLMOVE", "missing", "destination", "LEFT", "RIGHT", "0.05"); got != string(nullBulkReply) {
+			t.Errorf("expected BLMOVE to time out with a null bulk, got %q", got)
+		}
+		if kvstore.keyCount() != 0 {
+			t.Errorf("a timed out command shouldn't create keys")
+		}
+	})
+
+	t.Run("served immediately", func(t *testing.T) {
+		execute(t, kvstore, client, "RPUSH", "ready", "a", "b", "c")
+		if got := execute(t, kvstore, client, "BRPOP", "missing", "ready", "0"); got != string(encodeArray(command("ready", "c"))) {
+			t.Errorf("expected BRPOP to pop the tail of the first non empty list, got %q", got)
+		}
+		if got := execute(t, kvstore, client, "BLMPOP", "0", "2", "missing", "ready", "LEFT", "COUNT", "5"); got != string(encodeKeyAndValues("ready", command("a", "b"))) {
+			t.Errorf("expected BLMPOP to pop what's there, got %q", got)
+		}
+	})
+
+	t.Run("BRPOP FIFO", func(t *testing.T) {
+		first := executeBlocked(t, kvstore, "queue", 1, "BRPOP", "queue", "0")
+		second := executeBlocked(t, kvstore, "queue", 2, "BRPOP", "queue", "0")
+		execute(t, kvstore, client, "RPUSH", "queue", "a", "b")
+		if got := <-first; got != string(encodeArray(command("queue", "b"))) {
+			t.Errorf("the first waiter should get the tail, got %q", got)
+		}
+		if got := <-second; got != string(encodeArray(command("queue", "a"))) {
+			t.Errorf("the second waiter should get what's left, got %q", got)
+		}
+	})
+
+	t.Run("BLMOVE", func(t *testing.T) {
+		reply := executeBlocked(t, kvstore, "source", 1, "BLMOVE", "source", "destination", "RIGHT", "LEFT", "0")
+		execute(t, kvstore, client, "RPUSH", "destination", "old")
+		execute(t, kvstore, client, "LPUSH", "source", "x", "y")
+		if got := <-reply; got != string(encodeBulkString([]byte("x"))) {
+			t.Errorf("expected the tail of source, got %q", got)
+		}
+		if got := execute(t, kvstore, client, "LRANGE", "destination", "0", "-1"); got != string(encodeArray(command("x", "old"))) {
+			t.Errorf("expected x pushed onto the head of destination, got %q", got)
+		}
+		if got := execute(t, kvstore, client, "LRANGE", "source", "0", "-1"); got != string(encodeArray(command("y"))) {
+			t.Errorf("expected y left in source, got %q", got)
+		}
+	})
+
+	t.Run("BLMPOP", func(t *testing.T) {
+		reply := executeBlocked(t, kvstore, "second", 1, "BLMPOP", "0", "2", "first", "second", "RIGHT", "COUNT", "2")
+		execute(t, kvstore, client, "RPUSH", "second", "a", "b", "c")
+		if got := <-reply; got != string(encodeKeyAndValues("second", command("c", "b"))) {
+			t.Errorf("expected two elements from the tail, got %q", got)
+		}
+		if got := execute(t, kvstore, client, "LLEN", "second"); got != ":1\r\n" {
+			t.Errorf("expected one element left, got %q", got)
+		}
+	})
+}
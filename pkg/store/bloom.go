@@ -0,0 +1,332 @@
+package store
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var (
+	errItemExists        = errors.New("ERR item exists")
+	errBloomErrorRate    = errors.New("ERR (0 < error rate range < 1)")
+	errBloomCapacity     = errors.New("ERR (capacity should be larger than 0)")
+	errBloomExpansion    = errors.New("ERR expansion should be greater or equal to 1")
+	errBloomNonScaling   = errors.New("ERR Nonscaling filters cannot expand")
+	errBloomFull         = errors.New("ERR non scaling filter is full")
+	errBloomBadErrorRate = errors.New("ERR bad error rate")
+	errBloomBadCapacity  = errors.New("ERR bad capacity")
+)
+
+// defaults for filters BF.ADD creates, same as RedisBloom
+const (
+	bloomDefaultErrorRate = 0.01
+	bloomDefaultCapacity  = 100
+	bloomDefaultExpansion = 2
+	// each layer added to a scaling filter halves the error rate so the
+	// overall rate stays under what was asked for
+	bloomTighteningRatio = 0.5
+)
+
+// bloomLayer is a single fixed size bloom filter
+type bloomLayer struct {
+	bits     []uint64
+	size     uint64
+	hashes   int
+	capacity int64
+	count    int64
+}
+
+// bloomLayerBits is how many bits a layer for capacity items at errorRate
+// takes
+func bloomLayerBits(capacity float64, errorRate float64) float64 {
+	bitsPerEntry := -math.Log(errorRate) / (math.Ln2 * math.Ln2)
+	return max(math.Ceil(capacity*bitsPerEntry), 64)
+}
+
+func newBloomLayer(capacity int64, errorRate float64) *bloomLayer {
+	bitsPerEntry := -math.Log(errorRate) / (math.Ln2 * math.Ln2)
+	size := uint64(bloomLayerBits(float64(capacity), errorRate))
+	return &bloomLayer{
+		bits:     make([]uint64, (size+63)/64),
+		size:     size,
+		hashes:   int(math.Ceil(math.Ln2 * bitsPerEntry)),
+		capacity: capacity,
+	}
+}
+
+// bloomHash is the pair of hashes the bit positions are derived from by
+// double hashing, computed once per item for every layer
+type bloomHash struct {
+	a uint64
+	b uint64
+}
+
+func hashBloomItem(item []byte) bloomHash {
+	a := murmurHash64A(item, 0xc6a4a7935bd1e995)
+	return bloomHash{a: a, b: murmurHash64A(item, a)}
+}
+
+func (layer *bloomLayer) contains(hash bloomHash) bool {
+	for i := 0; i < layer.hashes; i++ {
+		bit := (hash.a + uint64(i)*hash.b) % layer.size
+		if layer.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (layer *bloomLayer) add(hash bloomHash) {
+	for i := 0; i < layer.hashes; i++ {
+		bit := (hash.a + uint64(i)*hash.b) % layer.size
+		layer.bits[bit/64] |= 1 << (bit % 64)
+	}
+	layer.count++
+}
+
+// scalableBloom is a stack of bloom layers, a new and larger one is added
+// whenever the newest fills up unless the filter was made non scaling
+type scalableBloom struct {
+	layers     []*bloomLayer
+	errorRate  float64
+	expansion  int64
+	nonScaling bool
+}
+
+func newScalableBloom(errorRate float64, capacity int64, expansion int64, nonScaling bool) *scalableBloom {
+	return &scalableBloom{
+		layers:     []*bloomLayer{newBloomLayer(capacity, errorRate*bloomTighteningRatio)},
+		errorRate:  errorRate,
+		expansion:  expansion,
+		nonScaling: nonScaling,
+	}
+}
+
+func (bloom *scalableBloom) contains(hash bloomHash) bool {
+	for _, layer := range bloom.layers {
+		if layer.contains(hash) {
+			return true
+		}
+	}
+	return false
+}
+
+// add inserts item, returning false if it may already have been there
+func (bloom *scalableBloom) add(item []byte) (bool, error) {
+	hash := hashBloomItem(item)
+	if bloom.contains(hash) {
+		return false, nil
+	}
+	last := bloom.layers[len(bloom.layers)-1]
+	if last.count >= last.capacity {
+		if bloom.nonScaling {
+			return false, errBloomFull
+		}
+		errorRate := bloom.errorRate * math.Pow(bloomTighteningRatio, float64(len(bloom.layers)+1))
+		capacity := float64(last.capacity) * float64(bloom.expansion)
+		if bloomLayerBits(capacity, errorRate)/8 > maxAllocationSize {
+			return false, errTooLarge
+		}
+		last = newBloomLayer(int64(capacity), errorRate)
+		bloom.layers = append(bloom.layers, last)
+	}
+	last.add(hash)
+	return true, nil
+}
+
+func (bloom *scalableBloom) count() int64 {
+	var count int64
+	for _, layer := range bloom.layers {
+		count += layer.count
+	}
+	return count
+}
+
+func (entry *Entry) bloom() *scalableBloom {
+	return entry.value.(*scalableBloom)
+}
+
+func newBloomEntry(bloom *scalableBloom) *Entry {
+	entry := newEntry()
+	entry.objectType = bloomType
+	entry.encoding = encodingBloom
+	entry.value = bloom
+	return entry
+}
+
+func (kvstore *KVStore) handleBFRESERVE(messages [][]byte) []byte {
+	if len(messages) < 4 {
+		return wrongArgumentsError("bf.reserve")
+	}
+	errorRate, err := strconv.ParseFloat(string(messages[2]), 64)
+	if err != nil {
+		return encodeError(errBloomBadErrorRate)
+	}
+	if errorRate <= 0 || errorRate >= 1 {
+		return encodeError(errBloomErrorRate)
+	}
+	capacity, err := strconv.ParseInt(string(messages[3]), 10, 64)
+	if err != nil {
+		return encodeError(errBloomBadCapacity)
+	}
+	if capacity <= 0 {
+		return encodeError(errBloomCapacity)
+	}
+	expansion, expansionGiven, nonScaling := int64(bloomDefaultExpansion), false, false
+	for position := 4; position < len(messages); position++ {
+		switch strings.ToUpper(string(messages[position])) {
+		case "NONSCALING":
+			nonScaling = true
+		case "EXPANSION":
+			if position+1 >= len(messages) {
+				return encodeError(errSyntax)
+			}
+			position++
+			if expansion, err = strconv.ParseInt(string(messages[position]), 10, 64); err != nil || expansion < 1 {
+				return encodeError(errBloomExpansion)
+			}
+			expansionGiven = true
+		default:
+			return encodeError(errSyntax)
+		}
+	}
+	if nonScaling && expansionGiven {
+		return encodeError(errBloomNonScaling)
+	}
+
+	key := string(messages[1])
+	kvstore.lockKeys(key)
+	defer kvstore.unlockKeys(key)
+
+	if kvstore.lookupKeyWrite(key) != nil {
+		return encodeError(errItemExists)
+	}
+	if err := kvstore.checkAllocation(bloomLayerBits(float64(capacity), errorRate*bloomTighteningRatio) / 8); err != nil {
+		return encodeError(err)
+	}
+	kvstore.setKey(key, newBloomEntry(newScalableBloom(errorRate, capacity, expansion, nonScaling)))
+	return okReply
+}
+
+// bloomAdd adds every item to the filter at key, creating it with the
+// defaults if needed. Each result is 1, 0 or the error for that item
+func (kvstore *KVStore) bloomAdd(key string, items [][]byte) ([][]byte, error) {
+	entry, err := kvstore.lookupTypedWrite(key, bloomType)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		entry = newBloomEntry(newScalableBloom(bloomDefaultErrorRate, bloomDefaultCapacity, bloomDefaultExpansion, false))
+		kvstore.setKey(key, entry)
+	}
+	results := make([][]byte, len(items))
+	for i, item := range items {
+		added, err := entry.bloom().add(item)
+		switch {
+		case err != nil:
+			results[i] = encodeError(err)
+		case added:
+			results[i] = encodeInteger(1)
+		default:
+			results[i] = encodeInteger(0)
+		}
+	}
+	return results, nil
+}
+
+func (kvstore *KVStore) handleBFADD(messages [][]byte) []byte {
+	if len(messages) != 3 {
+		return wrongArgumentsError("bf.add")
+	}
+
+	kvstore.lockKeys(string(messages[1]))
+	defer kvstore.unlockKeys(string(messages[1]))
+
+	results, err := kvstore.bloomAdd(string(messages[1]), messages[2:])
+	if err != nil {
+		return encodeError(err)
+	}
+	return results[0]
+}
+
+func (kvstore *KVStore) handleBFMADD(messages [][]byte) []byte {
+	if len(messages) < 3 {
+		return wrongArgumentsError("bf.madd")
+	}
+
+	kvstore.lockKeys(string(messages[1]))
+	defer kvstore.unlockKeys(string(messages[1]))
+
+	results, err := kvstore.bloomAdd(string(messages[1]), messages[2:])
+	if err != nil {
+		return encodeError(err)
+	}
+	return encodeRawArray(results)
+}
+
+// bloomExists reports for each item whether the filter at key may hold it
+func (kvstore *KVStore) bloomExists(key string, items [][]byte) ([]int64, error) {
+	entry, err := kvstore.lookupTypedRead(key, bloomType)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]int64, len(items))
+	if entry == nil {
+		return results, nil
+	}
+	for i, item := range items {
+		if entry.bloom().contains(hashBloomItem(item)) {
+			results[i] = 1
+		}
+	}
+	return results, nil
+}
+
+func (kvstore *KVStore) handleBFEXISTS(messages [][]byte) []byte {
+	if len(messages) != 3 {
+		return wrongArgumentsError("bf.exists")
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	results, err := kvstore.bloomExists(string(messages[1]), messages[2:])
+	if err != nil {
+		return encodeError(err)
+	}
+	return encodeInteger(results[0])
+}
+
+func (kvstore *KVStore) handleBFMEXISTS(messages [][]byte) []byte {
+	if len(messages) < 3 {
+		return wrongArgumentsError("bf.mexists")
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	results, err := kvstore.bloomExists(string(messages[1]), messages[2:])
+	if err != nil {
+		return encodeError(err)
+	}
+	return encodeIntegerArray(results)
+}
+
+func (kvstore *KVStore) handleBFCARD(messages [][]byte) []byte {
+	if len(messages) != 2 {
+		return wrongArgumentsError("bf.card")
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedRead(string(messages[1]), bloomType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return encodeInteger(0)
+	}
+	return encodeInteger(entry.bloom().count())
+}
@@ -0,0 +1,79 @@
+package store
+
+import (
+	"strconv"
+	"testing"
+)
+
+// TestScalableBloomErrorRate fills a filter well past its initial capacity
+// and checks it scaled, kept every item and stayed near the asked for
+// false positive rate
+func TestScalableBloomErrorRate(t *testing.T) {
+	kvstore := newKVStore()
+	if reply := kvstore.handleBFRESERVE(command("BF.RESERVE", "bf", "0.01", "100")); string(reply) != string(okReply) {
+		t.Fatalf("reserve failed %q", reply)
+	}
+	for i := 0; i < 2000; i++ {
+		kvstore.handleBFADD(command("BF.ADD", "bf", "item"+strconv.Itoa(i)))
+	}
+	bloom := kvstore.find("bf").bloom()
+	if len(bloom.layers) < 2 {
+		t.Errorf("expected the filter to scale, it has %d layers", len(bloom.layers))
+	}
+	for i := 0; i < 2000; i++ {
+		if reply := kvstore.handleBFEXISTS(command("BF.EXISTS", "bf", "item"+strconv.Itoa(i))); string(reply) != ":1\r\n" {
+			t.Fatalf("item%d went missing", i)
+		}
+	}
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if bloom.contains(hashBloomItem([]byte("other" + strconv.Itoa(i)))) {
+			falsePositives++
+		}
+	}
+	if rate := float64(falsePositives) / 10000; rate > 0.02 {
+		t.Errorf("false positive rate %f is well over 0.01", rate)
+	}
+}
+
+func TestNonScalingBloomFills(t *testing.T) {
+	kvstore := newKVStore()
+	kvstore.handleBFRESERVE(command("BF.RESERVE", "bf", "0.01", "2", "NONSCALING"))
+	reply := kvstore.handleBFMADD(command("BF.MADD", "bf", "a", "b", "c", "a"))
+	expected := "*4\r\n:1\r\n:1\r\n" + string(encodeError(errBloomFull)) + ":0\r\n"
+	if string(reply) != expected {
+		t.Errorf("expected %q, got %q", expected, reply)
+	}
+	if reply := kvstore.handleBFRESERVE(command("BF.RESERVE", "bf", "0.01", "2")); string(reply) != string(encodeError(errItemExists)) {
+		t.Errorf("reserving an existing key should fail, got %q", reply)
+	}
+	if reply := kvstore.handleBFRESERVE(command("BF.RESERVE", "x", "0.01", "2", "NONSCALING", "EXPANSION", "2")); string(reply) != string(encodeError(errBloomNonScaling)) {
+		t.Errorf("expected %q, got %q", encodeError(errBloomNonScaling), reply)
+	}
+}
+
+func TestBloomSizeLimits(t *testing.T) {
+	kvstore := newKVStore()
+	for _, arguments := range [][]string{
+		{"BF.RESERVE", "bf", "0.01", "9223372036854775807"},
+		{"BF.RESERVE", "bf", "1e-300", "100000000"},
+	} {
+		if reply := kvstore.handleBFRESERVE(command(arguments...)); string(reply) != "-"+errTooLarge.Error()+"\r\n" {
+			t.Errorf("%v: expected the filter to be refused, got %q", arguments, reply)
+		}
+	}
+
+	// a filter can't scale past the limit either
+	kvstore.handleBFRESERVE(command("BF.RESERVE", "bf", "0.01", "2", "EXPANSION", "9223372036854775807"))
+	kvstore.handleBFADD(command("BF.ADD", "bf", "a"))
+	kvstore.handleBFADD(command("BF.ADD", "bf", "b"))
+	if reply := kvstore.handleBFADD(command("BF.ADD", "bf", "c")); string(reply) != "-"+errTooLarge.Error()+"\r\n" {
+		t.Errorf("expected the filter to stop scaling, got %q", reply)
+	}
+
+	// nor take used memory past maxmemory
+	configure(t, kvstore, "maxmemory", "1mb")
+	if reply := kvstore.handleBFRESERVE(command("BF.RESERVE", "big", "0.01", "10000000")); string(reply) != "-"+errOOM.Error()+"\r\n" {
+		t.Errorf("expected the filter to be refused over maxmemory, got %q", reply)
+	}
+}
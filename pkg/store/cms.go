@@ -0,0 +1,204 @@
+package store
+
+import (
+	"errors"
+	"math"
+	"strconv"
+)
+
+var (
+	errCMSKeyExists  = errors.New("ERR CMS: key already exists")
+	errCMSNoKey      = errors.New("ERR CMS: key does not exist")
+	errCMSDimensions = errors.New("ERR CMS: invalid width/depth value")
+	errCMSErrorRate  = errors.New("ERR CMS: invalid overestimation value")
+	errCMSProbabilty = errors.New("ERR CMS: invalid prob value")
+	errCMSIncrement  = errors.New("ERR CMS: Cannot parse number")
+	errCMSOverflow   = errors.New("ERR CMS: INCRBY overflow")
+)
+
+// countMinSketch keeps depth rows of width counters, an item adds to one
+// counter per row and its count is the smallest of them, which can only
+// ever be an overestimate
+type countMinSketch struct {
+	width    uint64
+	depth    uint64
+	counters []uint32
+	count    uint64
+}
+
+func newCountMinSketch(width uint64, depth uint64) *countMinSketch {
+	return &countMinSketch{
+		width:    width,
+		depth:    depth,
+		counters: make([]uint32, width*depth),
+	}
+}
+
+func (sketch *countMinSketch) counter(row uint64, item []byte) *uint32 {
+	return &sketch.counters[row*sketch.width+murmurHash64A(item, row)%sketch.width]
+}
+
+func (sketch *countMinSketch) query(item []byte) uint32 {
+	result := uint32(math.MaxUint32)
+	for row := uint64(0); row < sketch.depth; row++ {
+		result = min(result, *sketch.counter(row, item))
+	}
+	return result
+}
+
+// increment adds to item's counters and returns its new count, failing
+// without changing anything if a counter would overflow
+func (sketch *countMinSketch) increment(item []byte, value uint32) (uint32, error) {
+	for row := uint64(0); row < sketch.depth; row++ {
+		if *sketch.counter(row, item) > math.MaxUint32-value {
+			return 0, errCMSOverflow
+		}
+	}
+	for row := uint64(0); row < sketch.depth; row++ {
+		*sketch.counter(row, item) += value
+	}
+	sketch.count += uint64(value)
+	return sketch.query(item), nil
+}
+
+func (entry *Entry) sketch() *countMinSketch {
+	return entry.value.(*countMinSketch)
+}
+
+// createSketch stores a new sketch at key unless the key is taken
+func (kvstore *KVStore) createSketch(key string, width uint64, depth uint64) []byte {
+	kvstore.lockKeys(key)
+	defer kvstore.unlockKeys(key)
+
+	if kvstore.lookupKeyWrite(key) != nil {
+		return encodeError(errCMSKeyExists)
+	}
+	if err := kvstore.checkAllocation(float64(width) * float64(depth) * 4); err != nil {
+		return encodeError(err)
+	}
+	entry := newEntry()
+	entry.objectType = cmsType
+	entry.encoding = encodingCMS
+	entry.value = newCountMinSketch(width, depth)
+	kvstore.setKey(key, entry)
+	return okReply
+}
+
+func (kvstore *KVStore) handleCMSINITBYDIM(messages [][]byte) []byte {
+	if len(messages) != 4 {
+		return wrongArgumentsError("cms.initbydim")
+	}
+	width, err := strconv.ParseUint(string(messages[2]), 10, 32)
+	if err != nil || width == 0 {
+		return encodeError(errCMSDimensions)
+	}
+	depth, err := strconv.ParseUint(string(messages[3]), 10, 32)
+	if err != nil || depth == 0 {
+		return encodeError(errCMSDimensions)
+	}
+	return kvstore.createSketch(string(messages[1]), width, depth)
+}
+
+// handleCMSINITBYPROB sizes the sketch so counts are overestimated by no
+// more than error times the total count, with the given probability of
+// going over that
+func (kvstore *KVStore) handleCMSINITBYPROB(messages [][]byte) []byte {
+	if len(messages) != 4 {
+		return wrongArgumentsError("cms.initbyprob")
+	}
+	errorRate, err := strconv.ParseFloat(string(messages[2]), 64)
+	if err != nil || errorRate <= 0 || errorRate >= 1 {
+		return encodeError(errCMSErrorRate)
+	}
+	probability, err := strconv.ParseFloat(string(messages[3]), 64)
+	if err != nil || probability <= 0 || probability >= 1 {
+		return encodeError(errCMSProbabilty)
+	}
+	width := math.Ceil(2 / errorRate)
+	depth := math.Ceil(math.Log10(probability) / math.Log10(0.5))
+	// checked before converting as a tiny error rate overflows a uint64
+	if width*depth*4 > maxAllocationSize {
+		return encodeError(errTooLarge)
+	}
+	return kvstore.createSketch(string(messages[1]), uint64(width), uint64(depth))
+}
+
+func (kvstore *KVStore) handleCMSINCRBY(messages [][]byte) []byte {
+	if len(messages) < 4 || len(messages)%2 != 0 {
+		return wrongArgumentsError("cms.incrby")
+	}
+	pairs := messages[2:]
+	increments := make([]uint32, len(pairs)/2)
+	for i := range increments {
+		value, err := strconv.ParseUint(string(pairs[i*2+1]), 10, 32)
+		if err != nil {
+			return encodeError(errCMSIncrement)
+		}
+		increments[i] = uint32(value)
+	}
+
+	kvstore.lockKeys(string(messages[1]))
+	defer kvstore.unlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedWrite(string(messages[1]), cmsType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return encodeError(errCMSNoKey)
+	}
+	counts := make([]int64, len(increments))
+	for i, increment := range increments {
+		count, err := entry.sketch().increment(pairs[i*2], increment)
+		if err != nil {
+			return encodeError(err)
+		}
+		counts[i] = int64(count)
+	}
+	return encodeIntegerArray(counts)
+}
+
+func (kvstore *KVStore) handleCMSQUERY(messages [][]byte) []byte {
+	if len(messages) < 3 {
+		return wrongArgumentsError("cms.query")
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedRead(string(messages[1]), cmsType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return encodeError(errCMSNoKey)
+	}
+	counts := make([]int64, len(messages)-2)
+	for i, item := range messages[2:] {
+		counts[i] = int64(entry.sketch().query(item))
+	}
+	return encodeIntegerArray(counts)
+}
+
+func (kvstore *KVStore) handleCMSINFO(messages [][]byte) []byte {
+	if len(messages) != 2 {
+		return wrongArgumentsError("cms.info")
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedRead(string(messages[1]), cmsType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return encodeError(errCMSNoKey)
+	}
+	sketch := entry.sketch()
+	return encodeRawArray([][]byte{
+		encodeBulkString([]byte("width")), encodeInteger(int64(sketch.width)),
+		encodeBulkString([]byte("depth")), encodeInteger(int64(sketch.depth)),
+		encodeBulkString([]byte("count")), encodeInteger(int64(sketch.count)),
+	})
+}
@@ -0,0 +1,57 @@
+package store
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestCountMinSketch(t *testing.T) {
+	kvstore := newKVStore()
+	if reply := kvstore.handleCMSINITBYPROB(command("CMS.INITBYPROB", "cms", "0.001", "0.01")); string(reply) != string(okReply) {
+		t.Fatalf("init failed %q", reply)
+	}
+	sketch := kvstore.find("cms").sketch()
+	if sketch.width != 2000 || sketch.depth != 7 {
+		t.Errorf("expected 2000x7, got %dx%d", sketch.width, sketch.depth)
+	}
+
+	if reply := kvstore.handleCMSINCRBY(command("CMS.INCRBY", "cms", "a", "5", "b", "3", "a", "2")); string(reply) != "*3\r\n:5\r\n:3\r\n:7\r\n" {
+		t.Errorf("unexpected counts %q", reply)
+	}
+	for i := 0; i < 1000; i++ {
+		kvstore.handleCMSINCRBY(command("CMS.INCRBY", "cms", "item"+strconv.Itoa(i), "1"))
+	}
+	// with 1010 counted the error bound is about 1
+	if reply := kvstore.handleCMSQUERY(command("CMS.QUERY", "cms", "a", "b", "missing")); string(reply) != "*3\r\n:7\r\n:3\r\n:0\r\n" {
+		t.Errorf("unexpected estimates %q", reply)
+	}
+	if sketch.count != 1010 {
+		t.Errorf("expected a total of 1010, got %d", sketch.count)
+	}
+
+	if reply := kvstore.handleCMSINCRBY(command("CMS.INCRBY", "cms", "a", "4294967295")); string(reply) != string(encodeError(errCMSOverflow)) {
+		t.Errorf("expected an overflow error, got %q", reply)
+	}
+	if reply := kvstore.handleCMSINITBYDIM(command("CMS.INITBYDIM", "cms", "10", "2")); string(reply) != string(encodeError(errCMSKeyExists)) {
+		t.Errorf("expected a key exists error, got %q", reply)
+	}
+	if reply := kvstore.handleCMSQUERY(command("CMS.QUERY", "missing", "a")); string(reply) != string(encodeError(errCMSNoKey)) {
+		t.Errorf("expected a missing key error, got %q", reply)
+	}
+}
+
+func TestCountMinSketchSizeLimits(t *testing.T) {
+	kvstore := newKVStore()
+	for _, arguments := range [][]string{
+		{"CMS.INITBYDIM", "cms", "4294967295", "4294967295"},
+		{"CMS.INITBYPROB", "cms", "1e-300", "0.01"},
+	} {
+		if reply, _ := kvstore.Execute(newTestClient(), command(arguments...)); string(reply) != "-"+errTooLarge.Error()+"\r\n" {
+			t.Errorf("%v: expected the sketch to be refused, got %q", arguments, reply)
+		}
+	}
+	configure(t, kvstore, "maxmemory", "1mb")
+	if reply := kvstore.handleCMSINITBYDIM(command("CMS.INITBYDIM", "cms", "1000000", "10")); string(reply) != "-"+errOOM.Error()+"\r\n" {
+		t.Errorf("expected the sketch to be refused over maxmemory, got %q", reply)
+	}
+}
@@ -0,0 +1,321 @@
+package store
+
+import (
+	"math"
+	"slices"
+)
+
+// The typed collection calls behave like the commands they are named
+// after, returning ErrWrongType when key holds another type and, for the
+// writes that add data, ErrOOM when out of memory. Values passed in are
+// copied and values returned are the caller's to keep
+
+// HSet sets field in the hash at key and reports whether it is new
+func (kvstore *KVStore) HSet(key string, field string, value []byte) (bool, error) {
+	defer kvstore.borrowLoop()()
+	if !kvstore.performEvictions() {
+		return false, ErrOOM
+	}
+	kvstore.lockKeys(key)
+	defer kvstore.unlockKeys(key)
+
+	entry, err := kvstore.lookupOrCreateHash(key)
+	if err != nil {
+		return false, err
+	}
+	created := entry.hashSet(field, slices.Clone(value), &kvstore.config)
+	kvstore.signalModifiedKey(key)
+	return created, nil
+}
+
+func (kvstore *KVStore) HGet(key string, field string) ([]byte, bool, error) {
+	defer kvstore.borrowLoop()()
+	kvstore.rlockKeys(key)
+	defer kvstore.runlockKeys(key)
+
+	entry, err := kvstore.lookupTypedRead(key, hashType)
+	if entry == nil || err != nil {
+		return nil, false, err
+	}
+	value, ok := entry.hash().get(field)
+	return slices.Clone(value), ok, nil
+}
+
+// HDel removes fields from the hash at key and returns how many existed
+func (kvstore *KVStore) HDel(key string, fields ...string) (int, error) {
+	defer kvstore.borrowLoop()()
+	kvstore.lockKeys(key)
+	defer kvstore.unlockKeys(key)
+
+	entry, err := kvstore.lookupTypedWrite(key, hashType)
+	if entry == nil || err != nil {
+		return 0, err
+	}
+	hash := entry.hash()
+	deleted := 0
+	for _, field := range fields {
+		if hash.delete(field) {
+			deleted++
+		}
+	}
+	if deleted > 0 {
+		kvstore.signalModifiedKey(key)
+	}
+	kvstore.removeIfEmptyHash(key, hash)
+	return deleted, nil
+}
+
+func (kvstore *KVStore) HGetAll(key string) (map[string][]byte, error) {
+	defer kvstore.borrowLoop()()
+	kvstore.rlockKeys(key)
+	defer kvstore.runlockKeys(key)
+
+	entry, err := kvstore.lookupTypedRead(key, hashType)
+	if entry == nil || err != nil {
+		return map[string][]byte{}, err
+	}
+	result := make(map[string][]byte, entry.hash().Len())
+	entry.hash().forEach(func(field string, value []byte) bool {
+		result[field] = slices.Clone(value)
+		return true
+	})
+	return result, nil
+}
+
+// LPush pushes values onto the head of the list at key one at a time, so
+// the last value ends up first, and returns the new length
+func (kvstore *KVStore) LPush(key string, values ...[]byte) (int, error) {
+	return kvstore.push(key, listHead, values)
+}
+
+// RPush appends values to the list at key and returns the new length
+func (kvstore *KVStore) RPush(key string, values ...[]byte) (int, error) {
+	return kvstore.push(key, listTail, values)
+}
+
+func (kvstore *KVStore) push(key string, end listEnd, values [][]byte) (int, error) {
+	defer kvstore.borrowLoop()()
+	if !kvstore.performEvictions() {
+		return 0, ErrOOM
+	}
+	kvstore.lockKeys(key)
+	defer kvstore.unlockKeys(key)
+
+	list, err := kvstore.lookupOrCreateList(key)
+	if err != nil {
+		return 0, err
+	}
+	for _, value := range values {
+		list.push(end, slices.Clone(value))
+	}
+	length := list.Len()
+	kvstore.removeIfEmptyList(key, list)
+	kvstore.signalKeyAsReady(key)
+	return length, nil
+}
+
+func (kvstore *KVStore) LPop(key string) ([]byte, bool, error) {
+	return kvstore.pop(key, listHead)
+}
+
+func (kvstore *KVStore) RPop(key string) ([]byte, bool, error) {
+	return kvstore.pop(key, listTail)
+}
+
+func (kvstore *KVStore) pop(key string, end listEnd) ([]byte, bool, error) {
+	defer kvstore.borrowLoop()()
+	kvstore.lockKeys(key)
+	defer kvstore.unlockKeys(key)
+
+	entry, err := kvstore.lookupTypedWrite(key, listType)
+	if entry == nil || err != nil {
+		return nil, false, err
+	}
+	list := entry.list()
+	value, ok := list.pop(end)
+	kvstore.removeIfEmptyList(key, list)
+	return value, ok, nil
+}
+
+// LRange returns the elements from start to stop inclusive, negative
+// indexes count from the tail as in LRANGE
+func (kvstore *KVStore) LRange(key string, start int, stop int) ([][]byte, error) {
+	defer kvstore.borrowLoop()()
+	kvstore.rlockKeys(key)
+	defer kvstore.runlockKeys(key)
+
+	entry, err := kvstore.lookupTypedRead(key, listType)
+	if entry == nil || err != nil {
+		return [][]byte{}, err
+	}
+	values := entry.list().rangeOf(start, stop)
+	for i, value := range values {
+		values[i] = slices.Clone(value)
+	}
+	return values, nil
+}
+
+func (kvstore *KVStore) LLen(key string) (int, error) {
+	defer kvstore.borrowLoop()()
+	kvstore.rlockKeys(key)
+	defer kvstore.runlockKeys(key)
+
+	entry, err := kvstore.lookupTypedRead(key, listType)
+	if entry == nil || err != nil {
+		return 0, err
+	}
+	return entry.list().Len(), nil
+}
+
+// SAdd adds members to the set at key and returns how many were new
+func (kvstore *KVStore) SAdd(key string, members ...string) (int, error) {
+	defer kvstore.borrowLoop()()
+	if !kvstore.performEvictions() {
+		return 0, ErrOOM
+	}
+	kvstore.lockKeys(key)
+	defer kvstore.unlockKeys(key)
+
+	entry, err := kvstore.lookupOrCreateSet(key)
+	if err != nil {
+		return 0, err
+	}
+	added := 0
+	for _, member := range members {
+		if entry.setAdd(member, &kvstore.config) {
+			added++
+		}
+	}
+	kvstore.removeIfEmptySet(key, entry.set())
+	return added, nil
+}
+
+// SRem removes members from the set at key and returns how many existed
+func (kvstore *KVStore) SRem(key string, members ...string) (int, error) {
+	defer kvstore.borrowLoop()()
+	kvstore.lockKeys(key)
+	defer kvstore.unlockKeys(key)
+
+	entry, err := kvstore.lookupTypedWrite(key, setType)
+	if entry == nil || err != nil {
+		return 0, err
+	}
+	set := entry.set()
+	removed := 0
+	for _, member := range members {
+		if set.remove(member) {
+			removed++
+		}
+	}
+	kvstore.removeIfEmptySet(key, set)
+	return removed, nil
+}
+
+func (kvstore *KVStore) SIsMember(key string, member string) (bool, error) {
+	defer kvstore.borrowLoop()()
+	kvstore.rlockKeys(key)
+	defer kvstore.runlockKeys(key)
+
+	entry, err := kvstore.lookupTypedRead(key, setType)
+	if entry == nil || err != nil {
+		return false, err
+	}
+	return entry.set().contains(member), nil
+}
+
+func (kvstore *KVStore) SMembers(key string) ([]string, error) {
+	defer kvstore.borrowLoop()()
+	kvstore.rlockKeys(key)
+	defer kvstore.runlockKeys(key)
+
+	entry, err := kvstore.lookupTypedRead(key, setType)
+	if entry == nil || err != nil {
+		return []string{}, err
+	}
+	return entry.set().all(), nil
+}
+
+// ScoredMember is a sorted set member with its score
+type ScoredMember struct {
+	Member string
+	Score  float64
+}
+
+// ZAdd adds member to the sorted set at key or moves it to score, and
+// reports whether it is new
+func (kvstore *KVStore) ZAdd(key string, score float64, member string) (bool, error) {
+	if math.IsNaN(score) {
+		return false, errScoreNaN
+	}
+
+	defer kvstore.borrowLoop()()
+	if !kvstore.performEvictions() {
+		return false, ErrOOM
+	}
+	kvstore.lockKeys(key)
+	defer kvstore.unlockKeys(key)
+
+	entry, err := kvstore.lookupOrCreateZset(key)
+	if err != nil {
+		return false, err
+	}
+	added := entry.zset().set(score, member)
+	if added {
+		kvstore.signalKeyAsReady(key)
+	}
+	return added, nil
+}
+
+func (kvstore *KVStore) ZScore(key string, member string) (float64, bool, error) {
+	defer kvstore.borrowLoop()()
+	kvstore.rlockKeys(key)
+	defer kvstore.runlockKeys(key)
+
+	entry, err := kvstore.lookupTypedRead(key, zsetType)
+	if entry == nil || err != nil {
+		return 0, false, err
+	}
+	score, ok := entry.zset().score(member)
+	return score, ok, nil
+}
+
+// ZRem removes members from the sorted set at key and returns how many
+// existed
+func (kvstore *KVStore) ZRem(key string, members ...string) (int, error) {
+	defer kvstore.borrowLoop()()
+	kvstore.lockKeys(key)
+	defer kvstore.unlockKeys(key)
+
+	entry, err := kvstore.lookupTypedWrite(key, zsetType)
+	if entry == nil || err != nil {
+		return 0, err
+	}
+	zset := entry.zset()
+	removed := 0
+	for _, member := range members {
+		if zset.remove(member) {
+			removed++
+		}
+	}
+	kvstore.removeIfEmptyZset(key, zset)
+	return removed, nil
+}
+
+// ZRange returns the members ranked start to stop inclusive, lowest score
+// first, negative ranks count from the highest as in ZRANGE
+func (kvstore *KVStore) ZRange(key string, start int, stop int) ([]ScoredMember, error) {
+	defer kvstore.borrowLoop()()
+	kvstore.rlockKeys(key)
+	defer kvstore.runlockKeys(key)
+
+	entry, err := kvstore.lookupTypedRead(key, zsetType)
+	if entry == nil || err != nil {
+		return []ScoredMember{}, err
+	}
+	nodes := entry.zset().nodesByRank(start, stop, false)
+	result := make([]ScoredMember, len(nodes))
+	for i, node := range nodes {
+		result[i] = ScoredMember{Member: node.member, Score: node.score}
+	}
+	return result, nil
+}
@@ -0,0 +1,105 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHashCollection(t *testing.T) {
+	kvstore := newKVStore()
+	if created, _ := kvstore.HSet("h", "a", []byte("1")); !created {
+		t.Errorf("HSet of a new field should report it as created")
+	}
+	if created, _ := kvstore.HSet("h", "a", []byte("2")); created {
+		t.Errorf("HSet of an existing field should not report it as created")
+	}
+	kvstore.HSet("h", "b", []byte("3"))
+	if value, ok, _ := kvstore.HGet("h", "a"); !ok || string(value) != "2" {
+		t.Errorf("HGet h a = %q, %v", value, ok)
+	}
+	all, _ := kvstore.HGetAll("h")
+	if len(all) != 2 || string(all["b"]) != "3" {
+		t.Errorf("HGetAll = %v", all)
+	}
+	if deleted, _ := kvstore.HDel("h", "a", "b", "c"); deleted != 2 || kvstore.Exists("h") {
+		t.Errorf("HDel should remove the fields and the emptied hash, deleted %d", deleted)
+	}
+}
+
+func TestListCollection(t *testing.T) {
+	kvstore := newKVStore()
+	kvstore.RPush("l", []byte("b"), []byte("c"))
+	if length, _ := kvstore.LPush("l", []byte("a")); length != 3 {
+		t.Errorf("LPush should return the new length, got %d", length)
+	}
+	values, _ := kvstore.LRange("l", 0, -1)
+	if !reflect.DeepEqual(values, [][]byte{[]byte("a"), []byte("b"), []byte("c")}) {
+		t.Errorf("LRange = %q", values)
+	}
+	if value, ok, _ := kvstore.RPop("l"); !ok || string(value) != "c" {
+		t.Errorf("RPop = %q", value)
+	}
+	kvstore.LPop("l")
+	kvstore.LPop("l")
+	if _, ok, _ := kvstore.LPop("l"); ok || kvstore.Exists("l") {
+		t.Errorf("popping the last element should remove the list")
+	}
+}
+
+func TestBlockedClientServedByCollectionCall(t *testing.T) {
+	kvstore := newKVStore()
+	reply := make(chan string, 1)
+	go func() {
+		reply <- string(kvstore.handleBLPOP(command("BLPOP", "queue", "0"), newTestClient()))
+	}()
+	waitForBlocked(t, kvstore, "queue", 1)
+
+	kvstore.RPush("queue", []byte("job"))
+	if got := <-reply; got != "*2\r\n$5\r\nqueue\r\n$3\r\njob\r\n" {
+		t.Errorf("BLPOP should be served by RPush, got %q", got)
+	}
+}
+
+func TestSetCollection(t *testing.T) {
+	kvstore := newKVStore()
+	if added, _ := kvstore.SAdd("s", "1", "2", "2", "x"); added != 3 {
+		t.Errorf("SAdd should count new members, got %d", added)
+	}
+	if member, _ := kvstore.SIsMember("s", "x"); !member {
+		t.Errorf("x should be a member")
+	}
+	if removed, _ := kvstore.SRem("s", "1", "missing"); removed != 1 {
+		t.Errorf("SRem should count removed members, got %d", removed)
+	}
+	members, _ := kvstore.SMembers("s")
+	if len(members) != 2 {
+		t.Errorf("SMembers = %v", members)
+	}
+	if _, err := kvstore.SAdd("s2", ""); err != nil {
+		t.Errorf("SAdd of an empty member: %v", err)
+	}
+}
+
+func TestSortedSetCollection(t *testing.T) {
+	kvstore := newKVStore()
+	kvstore.ZAdd("z", 2, "b")
+	kvstore.ZAdd("z", 1, "a")
+	if added, _ := kvstore.ZAdd("z", 3, "a"); added {
+		t.Errorf("moving a member should not report it as added")
+	}
+	if score, ok, _ := kvstore.ZScore("z", "a"); !ok || score != 3 {
+		t.Errorf("ZScore z a = %v, %v", score, ok)
+	}
+	members, _ := kvstore.ZRange("z", 0, -1)
+	if !reflect.DeepEqual(members, []ScoredMember{{"b", 2}, {"a", 3}}) {
+		t.Errorf("ZRange = %v", members)
+	}
+	if removed, _ := kvstore.ZRem("z", "a", "b"); removed != 2 || kvstore.Exists("z") {
+		t.Errorf("ZRem should remove the members and the emptied set")
+	}
+
+	kvstore.Set("string", []byte("v"), SetOptions{})
+	if _, err := kvstore.ZAdd("string", 1, "a"); err != ErrWrongType {
+		t.Errorf("ZAdd on a string should be ErrWrongType, got %v", err)
+	}
+}
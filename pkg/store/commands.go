@@ -1,4 +1,4 @@
-package main
+package store
 
 import (
 	"bytes"
@@ -12,6 +12,9 @@ func handlePING() []byte {
 }
 
 func handleECHO(messages [][]byte) []byte {
+	if len(messages) != 2 {
+		return wrongArgumentsError("echo")
+	}
 	var result []byte
 	echoValue:= messages[1]
 	result = append(result, '+')
@@ -23,21 +26,31 @@ func handleECHO(messages [][]byte) []byte {
 }
 
 
-func handleCONFIGGET(messages [][]byte) []byte{
+func (kvstore *KVStore) handleCONFIGGET(messages [][]byte) []byte{
+	if len(messages) != 3 {
+		return wrongArgumentsError("config|get")
+	}
 	var result []byte
 	requestedFlag := string(messages[2])
 
 
 	switch requestedFlag{
 	case "dir":
-		flagValue := config.dir
+		flagValue := kvstore.config.dir
 		flagValueLength := strconv.Itoa(len(flagValue))
 		result = []byte(fmt.Sprintf("*2\r\n$3\r\ndir\r\n$%s\r\n%s\r\n",flagValueLength,flagValue))
 
 	case "dbfilename":
-		flagValue := config.dbFileName
+		flagValue := kvstore.config.dbFileName
 		flagValueLength := strconv.Itoa(len(flagValue))
 		result = []byte(fmt.Sprintf("*2\r\n$10\r\ndbfilename\r\n$%s\r\n%s\r\n",flagValueLength,flagValue))
+
+	default:
+		if tunable, ok := kvstore.config.findTunable(requestedFlag); ok {
+			result = encodeArray([][]byte{[]byte(tunable.name), tunable.format()})
+		} else {
+			result = encodeArray(nil)
+		}
 	}
 
 	return result
@@ -45,61 +58,52 @@ func handleCONFIGGET(messages [][]byte) []byte{
 
 
 func (kvstore *KVStore) handleGET(messages [][]byte) []byte{
-	var results []byte
-	key := messages[1]
-	expiredFlag := false
-
-	kvstore.RLock()
-	value := kvstore.store[string(key)] 
-	if value.expiryTime.Before(time.Now()){
-		expiredFlag = true
-		delete(kvstore.store,string(key))
+	if len(messages) != 2 {
+		return wrongArgumentsError("get")
 	}
-	kvstore.RUnlock()
 
-	if expiredFlag{
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
 
-		return []byte("$-1\r\n")
+	entry, err := kvstore.lookupTypedRead(string(messages[1]), stringType)
+	if err != nil {
+		return encodeError(err)
 	}
-
-
-
-	valueLength := strconv.Itoa(len(string(value.entry)))
-
-	results = append(results, '$')
-	results = append(results, []byte(valueLength)...)
-	results = append(results, []byte("\r\n")...)
-	results = append(results, []byte(value.entry)...)
-	results = append(results, []byte("\r\n")...)
-
-
-	return results
+	if entry == nil {
+		return nullBulkReply
+	}
+	return encodeBulkString(entry.bytes())
 }
 
 func (kvstore *KVStore) handleSET(messages [][]byte) ([]byte, error){
+	if len(messages) < 3 {
+		return wrongArgumentsError("set"), nil
+	}
 	key := messages[1]
 	value := messages[2]
 	var liveDuration int
 	currentTime := time.Now()
 	expiryTime := currentTime.Add(time.Duration(int(time.Hour)*10000))
 
-	if (len(messages) > 4 && bytes.Equal(messages[3],[]byte("px"))){
+	if (len(messages) > 4 && bytes.EqualFold(messages[3],[]byte("px"))){
 		var err error
 		liveDuration, err = strconv.Atoi(string(messages[4]))
 		if err!=nil{
-			return nil,err
+			return encodeError(errNotInteger),nil
 		}
 		expiryTime = currentTime.Add(time.Duration(int(time.Millisecond)*liveDuration))
 	}
 
 	
-	kvstore.Lock()
-	kvstore.store[string(key)] = &Entry{
-		entry: value,
+	entry := &Entry{
 		creationTime: currentTime,
 		expiryTime: expiryTime,
 	}
-	kvstore.Unlock()
+	entry.setString(value)
+
+	kvstore.lockKeys(string(key))
+	kvstore.setKey(string(key), entry)
+	kvstore.unlockKeys(string(key))
 
 	return []byte("+OK\r\n"),nil
 
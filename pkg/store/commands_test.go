@@ -0,0 +1,56 @@
+package store
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommandsCheckArity(t *testing.T) {
+	kvstore := newKVStore()
+	client := newTestClient()
+	for _, arguments := range [][]string{
+		{"ECHO"},
+		{"ECHO", "a", "b"},
+		{"SET", "key"},
+		{"CONFIG"},
+		{"CONFIG", "GET"},
+		{"CONFIG", "SET", "hz"},
+	} {
+		if got := execute(t, kvstore, client, arguments...); !strings.HasPrefix(got, "-ERR wrong number of arguments") {
+			t.Errorf("%v: expected a wrong number of arguments error, got %q", arguments, got)
+		}
+	}
+	if got := execute(t, kvstore, client, "CONFIG", "RESETSTAT"); !strings.HasPrefix(got, "-ERR unknown subcommand") {
+		t.Errorf("expected an unknown subcommand error, got %q", got)
+	}
+	if got := execute(t, kvstore, client, "ECHO", "hello"); got != "+hello\r\n" {
+		t.Errorf("expected ECHO to echo, got %q", got)
+	}
+}
+
+func TestCommandErrorsAreReplies(t *testing.T) {
+	kvstore := newKVStore()
+	client := newTestClient()
+	if got := execute(t, kvstore, client, "NOSUCHCOMMAND", "key"); got != "-ERR unknown command 'NOSUCHCOMMAND'\r\n" {
+		t.Errorf("expected an unknown command error, got %q", got)
+	}
+	if got := execute(t, kvstore, client); got != "-"+errEmptyCommand.Error()+"\r\n" {
+		t.Errorf("expected an empty command error, got %q", got)
+	}
+	if got := execute(t, kvstore, client, "SET", "key", "value", "px", "soon"); got != "-"+errNotInteger.Error()+"\r\n" {
+		t.Errorf("expected a bad px to be refused, got %q", got)
+	}
+	if got := execute(t, kvstore, client, "CONFIG", "GET", "nosuchparameter"); got != "*0\r\n" {
+		t.Errorf("expected an empty array for an unknown parameter, got %q", got)
+	}
+}
+
+func TestSETMatchesPXCaseInsensitively(t *testing.T) {
+	kvstore := newKVStore()
+	client := newTestClient()
+	execute(t, kvstore, client, "SET", "key", "value", "PX", "60000")
+	if ttl := time.Until(kvstore.find("key").expiryTime); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("expected PX to set a one minute TTL, got %v", ttl)
+	}
+}
@@ -0,0 +1,153 @@
+package store
+
+import (
+	"errors"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+var errUnsupportedParameter = errors.New("ERR Unsupported CONFIG parameter")
+
+// tunable is an integer setting that can be read and changed at runtime
+// with CONFIG GET / CONFIG SET. CONFIG SET locks every shard, so holding
+// any one shard lock is enough to read a tunable, code holding none must
+// read it with atomic.LoadInt64
+type tunable struct {
+	name  string
+	value *int64
+	min   int64
+	max   int64
+	// set for tunables taking one of a list of names, value is the index
+	// of the name
+	names []string
+	// set for sizes, which can be given with a unit such as 100mb
+	memory bool
+}
+
+func (config *Config) tunables() []tunable {
+	return []tunable{
+		{"hash-max-listpack-entries", &config.hashMaxListpackEntries, 0, 1 << 31, nil, false},
+		{"hash-max-listpack-value", &config.hashMaxListpackValue, 0, 1 << 31, nil, false},
+		{"set-max-intset-entries", &config.setMaxIntsetEntries, 0, 1 << 31, nil, false},
+		{"stream-node-max-entries", &config.streamNodeMaxEntries, 0, 1 << 31, nil, false},
+		{"stream-node-max-bytes", &config.streamNodeMaxBytes, 0, 1 << 31, nil, false},
+		{"hll-sparse-max-bytes", &config.hllSparseMaxBytes, 0, 1 << 31, nil, false},
+		{"hz", &config.hz, 1, 500, nil, false},
+		{"maxmemory", &config.maxmemory, 0, math.MaxInt64, nil, true},
+		{"maxmemory-policy", &config.maxmemoryPolicy, 0, policyNoEviction, maxmemoryPolicies, false},
+		{"maxmemory-samples", &config.maxmemorySamples, 1, 64, nil, false},
+		{"lfu-log-factor", &config.lfuLogFactor, 0, math.MaxInt32, nil, false},
+		{"lfu-decay-time", &config.lfuDecayTime, 0, math.MaxInt32, nil, false},
+	}
+}
+
+func (config *Config) findTunable(name string) (tunable, bool) {
+	for _, tunable := range config.tunables() {
+		if strings.EqualFold(tunable.name, name) {
+			return tunable, true
+		}
+	}
+	return tunable{}, false
+}
+
+// handleCONFIG supports CONFIG GET and CONFIG SET
+func (kvstore *KVStore) handleCONFIG(messages [][]byte) []byte {
+	if len(messages) < 2 {
+		return wrongArgumentsError("config")
+	}
+	switch strings.ToUpper(string(messages[1])) {
+	case "GET":
+		kvstore.rlockAll()
+		defer kvstore.runlockAll()
+		return kvstore.handleCONFIGGET(messages)
+	case "SET":
+		return kvstore.handleCONFIGSET(messages)
+	default:
+		return encodeError(errors.New("ERR unknown subcommand '" + string(messages[1]) + "'. Try CONFIG HELP."))
+	}
+}
+
+func (kvstore *KVStore) handleCONFIGSET(messages [][]byte) []byte {
+	if len(messages) != 4 {
+		return wrongArgumentsError("config|set")
+	}
+	tunable, value, err := kvstore.config.parseSetting(string(messages[2]), string(messages[3]))
+	if err != nil {
+		return encodeError(err)
+	}
+
+	kvstore.lockAll()
+	atomic.StoreInt64(tunable.value, value)
+	kvstore.unlockAll()
+	return okReply
+}
+
+// parseSetting finds the tunable called name and the value to set it to,
+// refusing what CONFIG SET would
+func (config *Config) parseSetting(name string, value string) (tunable, int64, error) {
+	tunable, ok := config.findTunable(name)
+	if !ok {
+		return tunable, 0, errUnsupportedParameter
+	}
+	parsed, err := tunable.parse(value)
+	if err != nil || parsed < tunable.min || parsed > tunable.max {
+		return tunable, 0, errors.New("ERR Invalid argument '" + value + "' for CONFIG SET '" + tunable.name + "'")
+	}
+	return tunable, parsed, nil
+}
+
+func (tunable tunable) parse(value string) (int64, error) {
+	if tunable.names != nil {
+		index := slices.IndexFunc(tunable.names, func(name string) bool {
+			return strings.EqualFold(name, value)
+		})
+		if index < 0 {
+			return 0, errSyntax
+		}
+		return int64(index), nil
+	}
+	if tunable.memory {
+		return parseMemory(value)
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// format is the value as CONFIG GET shows it
+func (tunable tunable) format() []byte {
+	if tunable.names != nil {
+		return []byte(tunable.names[*tunable.value])
+	}
+	return strconv.AppendInt(nil, *tunable.value, 10)
+}
+
+// memoryUnits are the units a size can be given in, same as redis.conf
+var memoryUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"kb", 1 << 10},
+	{"mb", 1 << 20},
+	{"gb", 1 << 30},
+	{"k", 1000},
+	{"m", 1000 * 1000},
+	{"g", 1000 * 1000 * 1000},
+	{"b", 1},
+}
+
+// parseMemory reads a size in bytes such as 1048576, 1mb or 1m
+func parseMemory(value string) (int64, error) {
+	lower := strings.ToLower(value)
+	for _, unit := range memoryUnits {
+		if number, ok := strings.CutSuffix(lower, unit.suffix); ok {
+			size, err := strconv.ParseInt(number, 10, 64)
+			if err != nil || size > math.MaxInt64/unit.multiplier {
+				return 0, errSyntax
+			}
+			return size * unit.multiplier, nil
+		}
+	}
+	return strconv.ParseInt(lower, 10, 64)
+}
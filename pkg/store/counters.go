@@ -0,0 +1,151 @@
+package store
+
+import (
+	"errors"
+	"math"
+	"strconv"
+)
+
+var (
+	errNotInteger = errors.New("ERR value is not an integer or out of range")
+	errNotFloat   = errors.New("ERR value is not a valid float")
+	errOverflow   = errors.New("ERR increment or decrement would overflow")
+	errNaNOrInf   = errors.New("ERR increment would produce NaN or Infinity")
+)
+
+func (kvstore *KVStore) handleINCR(messages [][]byte) []byte {
+	if len(messages) != 2 {
+		return wrongArgumentsError("incr")
+	}
+	return kvstore.incrementBy(string(messages[1]), 1)
+}
+
+func (kvstore *KVStore) handleDECR(messages [][]byte) []byte {
+	if len(messages) != 2 {
+		return wrongArgumentsError("decr")
+	}
+	return kvstore.incrementBy(string(messages[1]), -1)
+}
+
+func (kvstore *KVStore) handleINCRBY(messages [][]byte) []byte {
+	if len(messages) != 3 {
+		return wrongArgumentsError("incrby")
+	}
+	increment, err := strconv.ParseInt(string(messages[2]), 10, 64)
+	if err != nil {
+		return encodeError(errNotInteger)
+	}
+	return kvstore.incrementBy(string(messages[1]), increment)
+}
+
+func (kvstore *KVStore) handleDECRBY(messages [][]byte) []byte {
+	if len(messages) != 3 {
+		return wrongArgumentsError("decrby")
+	}
+	decrement, err := strconv.ParseInt(string(messages[2]), 10, 64)
+	if err != nil {
+		return encodeError(errNotInteger)
+	}
+	// -MinInt64 doesn't fit in an int64
+	if decrement == math.MinInt64 {
+		return encodeError(errOverflow)
+	}
+	return kvstore.incrementBy(string(messages[1]), -decrement)
+}
+
+func (kvstore *KVStore) handleINCRBYFLOAT(messages [][]byte) []byte {
+	if len(messages) != 3 {
+		return wrongArgumentsError("incrbyfloat")
+	}
+	increment, err := parseFloat(messages[2])
+	if err != nil {
+		return encodeError(errNotFloat)
+	}
+
+	key := string(messages[1])
+	kvstore.lockKeys(key)
+	defer kvstore.unlockKeys(key)
+
+	entry := kvstore.lookupKeyWrite(key)
+	var current float64
+	if entry != nil {
+		if entry.objectType != stringType {
+			return encodeError(errWrongType)
+		}
+		current, err = parseFloat(entry.bytes())
+		if err != nil {
+			return encodeError(errNotFloat)
+		}
+	}
+
+	result := current + increment
+	if math.IsNaN(result) || math.IsInf(result, 0) {
+		return encodeError(errNaNOrInf)
+	}
+	if entry == nil {
+		entry = newEntry()
+		kvstore.setKey(key, entry)
+	}
+
+	// stored as a raw string like redis so the reply and GET agree
+	value := []byte(strconv.FormatFloat(result, 'f', -1, 64))
+	entry.entry = value
+	entry.intValue = 0
+	entry.encoding = encodingRaw
+	return encodeBulkString(value)
+}
+
+// incrementBy adds increment to the integer at key, creating it at 0 first
+// if it doesn't exist. An existing ttl on the key is kept
+func (kvstore *KVStore) incrementBy(key string, increment int64) []byte {
+	kvstore.lockKeys(key)
+	defer kvstore.unlockKeys(key)
+
+	entry := kvstore.lookupKeyWrite(key)
+	var current int64
+	if entry != nil {
+		if entry.objectType != stringType {
+			return encodeError(errWrongType)
+		}
+		if entry.encoding == encodingInt {
+			current = entry.intValue
+		} else {
+			parsed, err := strconv.ParseInt(string(entry.entry), 10, 64)
+			if err != nil {
+				return encodeError(errNotInteger)
+			}
+			current = parsed
+		}
+	}
+
+	if (increment > 0 && current > math.MaxInt64-increment) || (increment < 0 && current < math.MinInt64-increment) {
+		return encodeError(errOverflow)
+	}
+	if entry == nil {
+		entry = newEntry()
+		kvstore.setKey(key, entry)
+	}
+
+	entry.setInt(current + increment)
+	return encodeInteger(entry.intValue)
+}
+
+// parseFloat rejects the NaN and empty inputs strconv would otherwise let through
+func parseFloat(value []byte) (float64, error) {
+	if len(value) == 0 {
+		return 0, errNotFloat
+	}
+	parsed, err := strconv.ParseFloat(string(value), 64)
+	if err != nil || math.IsNaN(parsed) {
+		return 0, errNotFloat
+	}
+	return parsed, nil
+}
+
+func parseInteger(value []byte) (int64, error) {
+	parsed, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		return 0, errNotInteger
+	}
+	return parsed, nil
+}
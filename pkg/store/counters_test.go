@@ -0,0 +1,113 @@
+package store
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestIncrementOverflow(t *testing.T) {
+	kvstore := newKVStore()
+	client := newTestClient()
+	max := strconv.FormatInt(1<<63-1, 10)
+	min := strconv.FormatInt(-1<<63, 10)
+
+	execute(t, kvstore, client, "SET", "counter", max)
+	for _, arguments := range [][]string{
+		{"INCR", "counter"},
+		{"INCRBY", "counter", "1"},
+	} {
+		if got := execute(t, kvstore, client, arguments...); got != string(encodeError(errOverflow)) {
+			t.Errorf("%v: expected an overflow error, got %q", arguments, got)
+		}
+	}
+	if got := execute(t, kvstore, client, "GET", "counter"); got != string(encodeBulkString([]byte(max))) {
+		t.Errorf("a refused increment shouldn't change the value, got %q", got)
+	}
+
+	execute(t, kvstore, client, "SET", "counter", min)
+	for _, arguments := range [][]string{
+		{"DECR", "counter"},
+		{"DECRBY", "counter", "1"},
+		{"INCRBY", "counter", "-1"},
+	} {
+		if got := execute(t, kvstore, client, arguments...); got != string(encodeError(errOverflow)) {
+			t.Errorf("%v: expected an overflow error, got %q", arguments, got)
+		}
+	}
+	if got := execute(t, kvstore, client, "DECRBY", "other", min); got != string(encodeError(errOverflow)) {
+		t.Errorf("DECRBY by MinInt64 can't be negated, got %q", got)
+	}
+	if got := execute(t, kvstore, client, "INCRBY", "other", "9223372036854775808"); got != string(encodeError(errNotInteger)) {
+		t.Errorf("an increment past int64 should be refused, got %q", got)
+	}
+}
+
+func TestIncrementNonInteger(t *testing.T) {
+	kvstore := newKVStore()
+	client := newTestClient()
+	for _, value := range []string{"abc", "1.5", " 1", "1 ", ""} {
+		execute(t, kvstore, client, "SET", "counter", value)
+		if got := execute(t, kvstore, client, "INCR", "counter"); got != string(encodeError(errNotInteger)) {
+			t.Errorf("INCR on %q: expected a not an integer error, got %q", value, got)
+		}
+	}
+	for _, increment := range []string{"one", "1.0", ""} {
+		if got := execute(t, kvstore, client, "INCRBY", "fresh", increment); got != string(encodeError(errNotInteger)) {
+			t.Errorf("INCRBY by %q: expected a not an integer error, got %q", increment, got)
+		}
+	}
+	if kvstore.find("fresh") != nil {
+		t.Errorf("a refused INCRBY shouldn't create the key")
+	}
+
+	kvstore.handleLPUSH(command("LPUSH", "list", "a"))
+	if got := execute(t, kvstore, client, "INCR", "list"); got != string(encodeError(errWrongType)) {
+		t.Errorf("expected a wrong type error, got %q", got)
+	}
+	if got := execute(t, kvstore, client, "INCRBYFLOAT", "list", "1"); got != string(encodeError(errWrongType)) {
+		t.Errorf("expected a wrong type error, got %q", got)
+	}
+}
+
+func TestIncrementByFloat(t *testing.T) {
+	kvstore := newKVStore()
+	client := newTestClient()
+	for _, step := range []struct {
+		increment string
+		expected  string
+	}{
+		{"10.5", "10.5"},
+		{"0.1", "10.6"},
+		{"-5", "5.6"},
+		{"5.0e3", "5005.6"},
+		{"-5005.6", "0"},
+		{"3", "3"},
+	} {
+		if got := execute(t, kvstore, client, "INCRBYFLOAT", "counter", step.increment); got != string(encodeBulkString([]byte(step.expected))) {
+			t.Errorf("INCRBYFLOAT %s: expected %q, got %q", step.increment, step.expected, got)
+		}
+	}
+	if got := execute(t, kvstore, client, "GET", "counter"); got != string(encodeBulkString([]byte("3"))) {
+		t.Errorf("GET should agree with the reply, got %q", got)
+	}
+	if got := execute(t, kvstore, client, "INCR", "counter"); got != ":4\r\n" {
+		t.Errorf("a whole float result should stay usable by INCR, got %q", got)
+	}
+
+	for _, increment := range []string{"nan", "abc", ""} {
+		if got := execute(t, kvstore, client, "INCRBYFLOAT", "counter", increment); got != string(encodeError(errNotFloat)) {
+			t.Errorf("INCRBYFLOAT by %q: expected a not a float error, got %q", increment, got)
+		}
+	}
+	if got := execute(t, kvstore, client, "INCRBYFLOAT", "counter", "+inf"); got != string(encodeError(errNaNOrInf)) {
+		t.Errorf("expected an infinity error, got %q", got)
+	}
+	execute(t, kvstore, client, "SET", "counter", "1.7976931348623157e308")
+	if got := execute(t, kvstore, client, "INCRBYFLOAT", "counter", "1.7976931348623157e308"); got != string(encodeError(errNaNOrInf)) {
+		t.Errorf("expected an overflow to infinity to be refused, got %q", got)
+	}
+	execute(t, kvstore, client, "SET", "counter", "text")
+	if got := execute(t, kvstore, client, "INCRBYFLOAT", "counter", "1"); got != string(encodeError(errNotFloat)) {
+		t.Errorf("expected a not a float error, got %q", got)
+	}
+}
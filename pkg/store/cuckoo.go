@@ -0,0 +1,359 @@
+package store
+
+import (
+	"errors"
+	"math/bits"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+var (
+	errCuckooFull          = errors.New("ERR Filter is full")
+	errCuckooNotFound      = errors.New("ERR Not found")
+	errCuckooCapacity      = errors.New("ERR Bad capacity")
+	errCuckooSmallCapacity = errors.New("ERR Capacity must be at least (BucketSize * 2)")
+	errCuckooBucketSize    = errors.New("ERR Bad bucket size")
+	errCuckooIterations    = errors.New("ERR Bad maxIterations")
+	errCuckooExpansion     = errors.New("ERR Bad expansion")
+)
+
+// defaults for filters CF.ADD creates, same as RedisBloom
+const (
+	cuckooDefaultCapacity   = 1024
+	cuckooDefaultBucketSize = 2
+	cuckooDefaultIterations = 20
+	cuckooDefaultExpansion  = 1
+	cuckooMaxBucketSize     = 255
+	cuckooMaxIterations     = 65535
+	cuckooMaxExpansion      = 32768
+)
+
+// cuckooTable holds 8 bit fingerprints in buckets of bucketSize slots,
+// zero marks an empty slot. The bucket count is a power of two so an
+// item's two buckets can be found from each other with the fingerprint
+type cuckooTable struct {
+	slots      []uint8
+	buckets    uint64
+	bucketSize int
+}
+
+func newCuckooTable(buckets uint64, bucketSize int) *cuckooTable {
+	return &cuckooTable{
+		slots:      make([]uint8, buckets*uint64(bucketSize)),
+		buckets:    buckets,
+		bucketSize: bucketSize,
+	}
+}
+
+func (table *cuckooTable) bucket(index uint64) []uint8 {
+	start := index * uint64(table.bucketSize)
+	return table.slots[start : start+uint64(table.bucketSize)]
+}
+
+func (table *cuckooTable) alternate(index uint64, fingerprint uint8) uint64 {
+	return (index ^ uint64(fingerprint)*0x5bd1e995) % table.buckets
+}
+
+// indexes returns the two buckets hash can live in
+func (table *cuckooTable) indexes(hash uint64, fingerprint uint8) (uint64, uint64) {
+	first := hash % table.buckets
+	return first, table.alternate(first, fingerprint)
+}
+
+func (table *cuckooTable) insertInto(index uint64, fingerprint uint8) bool {
+	for i, slot := range table.bucket(index) {
+		if slot == 0 {
+			table.bucket(index)[i] = fingerprint
+			return true
+		}
+	}
+	return false
+}
+
+// cuckooKick is one displacement, undone if the chain fails
+type cuckooKick struct {
+	index    uint64
+	slot     int
+	previous uint8
+}
+
+// insert places fingerprint in one of its buckets, moving existing
+// fingerprints to their other bucket to make room for up to maxIterations
+// moves. When that isn't enough every move is undone and it returns false
+func (table *cuckooTable) insert(hash uint64, fingerprint uint8, maxIterations int) bool {
+	first, second := table.indexes(hash, fingerprint)
+	if table.insertInto(first, fingerprint) || table.insertInto(second, fingerprint) {
+		return true
+	}
+
+	var kicks []cuckooKick
+	index := first
+	if rand.Intn(2) == 1 {
+		index = second
+	}
+	for i := 0; i < maxIterations; i++ {
+		slot := rand.Intn(table.bucketSize)
+		bucket := table.bucket(index)
+		kicks = append(kicks, cuckooKick{index: index, slot: slot, previous: bucket[slot]})
+		fingerprint, bucket[slot] = bucket[slot], fingerprint
+		index = table.alternate(index, fingerprint)
+		if table.insertInto(index, fingerprint) {
+			return true
+		}
+	}
+	for i := len(kicks) - 1; i >= 0; i-- {
+		table.bucket(kicks[i].index)[kicks[i].slot] = kicks[i].previous
+	}
+	return false
+}
+
+func (table *cuckooTable) count(hash uint64, fingerprint uint8) int {
+	first, second := table.indexes(hash, fingerprint)
+	count := 0
+	for _, index := range []uint64{first, second} {
+		for _, slot := range table.bucket(index) {
+			if slot == fingerprint {
+				count++
+			}
+		}
+		if first == second {
+			break
+		}
+	}
+	return count
+}
+
+func (table *cuckooTable) remove(hash uint64, fingerprint uint8) bool {
+	first, second := table.indexes(hash, fingerprint)
+	for _, index := range []uint64{first, second} {
+		bucket := table.bucket(index)
+		for i, slot := range bucket {
+			if slot == fingerprint {
+				bucket[i] = 0
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// cuckooFilter is a list of tables, a new one expansion times larger is
+// added when an item doesn't fit in the newest
+type cuckooFilter struct {
+	tables        []*cuckooTable
+	bucketSize    int
+	maxIterations int
+	expansion     uint64
+	items         int64
+	deletes       int64
+}
+
+// cuckooBuckets is how many buckets the first table of a filter for
+// capacity items has, a power of two. capacity must be at most
+// maxAllocationSize
+func cuckooBuckets(capacity uint64, bucketSize int) uint64 {
+	buckets := max(capacity/uint64(bucketSize), 1)
+	return 1 << (64 - bits.LeadingZeros64(buckets-1))
+}
+
+func newCuckooFilter(capacity uint64, bucketSize int, maxIterations int, expansion uint64) *cuckooFilter {
+	return &cuckooFilter{
+		tables:        []*cuckooTable{newCuckooTable(cuckooBuckets(capacity, bucketSize), bucketSize)},
+		bucketSize:    bucketSize,
+		maxIterations: maxIterations,
+		expansion:     expansion,
+	}
+}
+
+// hashCuckooItem returns the hash and fingerprint of item, fingerprints
+// are never 0 since that is an empty slot
+func hashCuckooItem(item []byte) (uint64, uint8) {
+	hash := murmurHash64A(item, 0)
+	return hash, uint8(hash%255 + 1)
+}
+
+func (filter *cuckooFilter) add(item []byte) error {
+	hash, fingerprint := hashCuckooItem(item)
+	last := filter.tables[len(filter.tables)-1]
+	if !last.insert(hash, fingerprint, filter.maxIterations) {
+		// a filter that can't grow any more is as full as one that may not
+		if filter.expansion == 0 || float64(last.buckets)*float64(filter.expansion)*float64(filter.bucketSize) > maxAllocationSize {
+			return errCuckooFull
+		}
+		last = newCuckooTable(last.buckets*filter.expansion, filter.bucketSize)
+		filter.tables = append(filter.tables, last)
+		if !last.insert(hash, fingerprint, filter.maxIterations) {
+			return errCuckooFull
+		}
+	}
+	filter.items++
+	return nil
+}
+
+func (filter *cuckooFilter) count(item []byte) int {
+	hash, fingerprint := hashCuckooItem(item)
+	count := 0
+	for _, table := range filter.tables {
+		count += table.count(hash, fingerprint)
+	}
+	return count
+}
+
+// remove deletes one copy of item, newest tables first
+func (filter *cuckooFilter) remove(item []byte) bool {
+	hash, fingerprint := hashCuckooItem(item)
+	for i := len(filter.tables) - 1; i >= 0; i-- {
+		if filter.tables[i].remove(hash, fingerprint) {
+			filter.items--
+			filter.deletes++
+			return true
+		}
+	}
+	return false
+}
+
+func (entry *Entry) cuckoo() *cuckooFilter {
+	return entry.value.(*cuckooFilter)
+}
+
+func newCuckooEntry(filter *cuckooFilter) *Entry {
+	entry := newEntry()
+	entry.objectType = cuckooType
+	entry.encoding = encodingCuckoo
+	entry.value = filter
+	return entry
+}
+
+func (kvstore *KVStore) handleCFRESERVE(messages [][]byte) []byte {
+	if len(messages) < 3 || len(messages)%2 != 1 {
+		return wrongArgumentsError("cf.reserve")
+	}
+	capacity, err := strconv.ParseUint(string(messages[2]), 10, 64)
+	if err != nil || capacity == 0 {
+		return encodeError(errCuckooCapacity)
+	}
+	bucketSize, maxIterations, expansion := uint64(cuckooDefaultBucketSize), uint64(cuckooDefaultIterations), uint64(cuckooDefaultExpansion)
+	for position := 3; position < len(messages); position += 2 {
+		value, err := strconv.ParseUint(string(messages[position+1]), 10, 64)
+		switch strings.ToUpper(string(messages[position])) {
+		case "BUCKETSIZE":
+			if err != nil || value == 0 || value > cuckooMaxBucketSize {
+				return encodeError(errCuckooBucketSize)
+			}
+			bucketSize = value
+		case "MAXITERATIONS":
+			if err != nil || value == 0 || value > cuckooMaxIterations {
+				return encodeError(errCuckooIterations)
+			}
+			maxIterations = value
+		case "EXPANSION":
+			if err != nil || value > cuckooMaxExpansion {
+				return encodeError(errCuckooExpansion)
+			}
+			// keeps the bucket counts of new tables powers of two
+			expansion = value
+			if expansion > 1 {
+				expansion = 1 << (64 - bits.LeadingZeros64(expansion-1))
+			}
+		default:
+			return encodeError(errSyntax)
+		}
+	}
+	if capacity < bucketSize*2 {
+		return encodeError(errCuckooSmallCapacity)
+	}
+	// each item takes at least a byte
+	if capacity > maxAllocationSize {
+		return encodeError(errTooLarge)
+	}
+
+	key := string(messages[1])
+	kvstore.lockKeys(key)
+	defer kvstore.unlockKeys(key)
+
+	if kvstore.lookupKeyWrite(key) != nil {
+		return encodeError(errItemExists)
+	}
+	if err := kvstore.checkAllocation(float64(cuckooBuckets(capacity, int(bucketSize)) * bucketSize)); err != nil {
+		return encodeError(err)
+	}
+	kvstore.setKey(key, newCuckooEntry(newCuckooFilter(capacity, int(bucketSize), int(maxIterations), expansion)))
+	return okReply
+}
+
+// handleCFADD serves CF.ADD, which adds item even if it is there already,
+// and CF.ADDNX which doesn't
+func (kvstore *KVStore) handleCFADD(messages [][]byte) []byte {
+	if len(messages) != 3 {
+		return wrongArgumentsError(string(messages[0]))
+	}
+	onlyNew := strings.ToUpper(string(messages[0])) == "CF.ADDNX"
+
+	key := string(messages[1])
+	kvstore.lockKeys(key)
+	defer kvstore.unlockKeys(key)
+
+	entry, err := kvstore.lookupTypedWrite(key, cuckooType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		entry = newCuckooEntry(newCuckooFilter(cuckooDefaultCapacity, cuckooDefaultBucketSize, cuckooDefaultIterations, cuckooDefaultExpansion))
+		kvstore.setKey(key, entry)
+	}
+	filter := entry.cuckoo()
+	if onlyNew && filter.count(messages[2]) > 0 {
+		return encodeInteger(0)
+	}
+	if err := filter.add(messages[2]); err != nil {
+		return encodeError(err)
+	}
+	return encodeInteger(1)
+}
+
+// handleCFCOUNT serves CF.EXISTS and CF.COUNT, the number of copies of
+// item the filter may hold
+func (kvstore *KVStore) handleCFCOUNT(messages [][]byte) []byte {
+	if len(messages) != 3 {
+		return wrongArgumentsError(string(messages[0]))
+	}
+	exists := strings.ToUpper(string(messages[0])) == "CF.EXISTS"
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedRead(string(messages[1]), cuckooType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return encodeInteger(0)
+	}
+	count := entry.cuckoo().count(messages[2])
+	if exists {
+		count = min(count, 1)
+	}
+	return encodeInteger(int64(count))
+}
+
+func (kvstore *KVStore) handleCFDEL(messages [][]byte) []byte {
+	if len(messages) != 3 {
+		return wrongArgumentsError("cf.del")
+	}
+
+	kvstore.lockKeys(string(messages[1]))
+	defer kvstore.unlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedWrite(string(messages[1]), cuckooType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return encodeError(errCuckooNotFound)
+	}
+	if entry.cuckoo().remove(messages[2]) {
+		return encodeInteger(1)
+	}
+	return encodeInteger(0)
+}
@@ -0,0 +1,79 @@
+package store
+
+import (
+	"strconv"
+	"testing"
+)
+
+// TestCuckooGrowsWithoutLosingItems adds far more than the first table
+// holds, then checks every item is still counted and can be deleted
+func TestCuckooGrowsWithoutLosingItems(t *testing.T) {
+	kvstore := newKVStore()
+	kvstore.handleCFRESERVE(command("CF.RESERVE", "cf", "64", "EXPANSION", "3"))
+	for i := 0; i < 1000; i++ {
+		if reply := kvstore.handleCFADD(command("CF.ADD", "cf", "item"+strconv.Itoa(i))); string(reply) != ":1\r\n" {
+			t.Fatalf("adding item%d failed with %q", i, reply)
+		}
+	}
+	filter := kvstore.find("cf").cuckoo()
+	if len(filter.tables) < 2 || filter.expansion != 4 {
+		t.Errorf("expected growth by 4, got %d tables expanding by %d", len(filter.tables), filter.expansion)
+	}
+	for i := 0; i < 1000; i++ {
+		if reply := kvstore.handleCFCOUNT(command("CF.EXISTS", "cf", "item"+strconv.Itoa(i))); string(reply) != ":1\r\n" {
+			t.Fatalf("item%d went missing", i)
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		if reply := kvstore.handleCFDEL(command("CF.DEL", "cf", "item"+strconv.Itoa(i))); string(reply) != ":1\r\n" {
+			t.Fatalf("deleting item%d replied %q", i, reply)
+		}
+	}
+	if filter.items != 0 {
+		t.Errorf("expected an empty filter, %d items left", filter.items)
+	}
+}
+
+func TestCuckooCounts(t *testing.T) {
+	kvstore := newKVStore()
+	kvstore.handleCFADD(command("CF.ADD", "cf", "a"))
+	kvstore.handleCFADD(command("CF.ADD", "cf", "a"))
+	if reply := kvstore.handleCFADD(command("CF.ADDNX", "cf", "a")); string(reply) != ":0\r\n" {
+		t.Errorf("ADDNX of a present item should reply 0, got %q", reply)
+	}
+	if reply := kvstore.handleCFCOUNT(command("CF.COUNT", "cf", "a")); string(reply) != ":2\r\n" {
+		t.Errorf("expected 2 copies, got %q", reply)
+	}
+	kvstore.handleCFDEL(command("CF.DEL", "cf", "a"))
+	if reply := kvstore.handleCFCOUNT(command("CF.COUNT", "cf", "a")); string(reply) != ":1\r\n" {
+		t.Errorf("expected 1 copy after a delete, got %q", reply)
+	}
+	if reply := kvstore.handleCFDEL(command("CF.DEL", "missing", "a")); string(reply) != string(encodeError(errCuckooNotFound)) {
+		t.Errorf("deleting from a missing filter should fail, got %q", reply)
+	}
+
+	full := newCuckooFilter(4, 2, 10, 0)
+	var err error
+	for i := 0; i < 100 && err == nil; i++ {
+		err = full.add([]byte(strconv.Itoa(i)))
+	}
+	if err != errCuckooFull {
+		t.Errorf("a filter with no expansion should fill up, got %v", err)
+	}
+}
+
+func TestCuckooSizeLimits(t *testing.T) {
+	kvstore := newKVStore()
+	for _, arguments := range [][]string{
+		{"CF.RESERVE", "cf", "18446744073709551615"},
+		{"CF.RESERVE", "cf", "9223372036854775809", "BUCKETSIZE", "255"},
+	} {
+		if reply := kvstore.handleCFRESERVE(command(arguments...)); string(reply) != "-"+errTooLarge.Error()+"\r\n" {
+			t.Errorf("%v: expected the filter to be refused, got %q", arguments, reply)
+		}
+	}
+	configure(t, kvstore, "maxmemory", "1mb")
+	if reply := kvstore.handleCFRESERVE(command("CF.RESERVE", "cf", "10000000")); string(reply) != "-"+errOOM.Error()+"\r\n" {
+		t.Errorf("expected the filter to be refused over maxmemory, got %q", reply)
+	}
+}
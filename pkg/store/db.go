@@ -0,0 +1,140 @@
+package store
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	errWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+	errSyntax    = errors.New("ERR syntax error")
+)
+
+// keys without a ttl are given an expiry far enough out to never matter,
+// same as handleSET does when no px is passed
+const noExpiry = time.Hour * 10000
+
+func newEntry() *Entry {
+	currentTime := time.Now()
+	return &Entry{
+		creationTime: currentTime,
+		expiryTime:   currentTime.Add(noExpiry),
+	}
+}
+
+func (entry *Entry) isExpired(now time.Time) bool {
+	return entry.expiryTime.Before(now)
+}
+
+// lookupKeyRead returns nil for missing or expired keys. Expired keys
+// can't be removed under the read lock, so they are queued for runlockKeys
+// to remove. Caller must hold at least the read lock of key's shard
+func (kvstore *KVStore) lookupKeyRead(key string) *Entry {
+	entry := kvstore.lookupKeyReadNoTouch(key)
+	if entry != nil {
+		entry.touch(&kvstore.config)
+	}
+	return entry
+}
+
+// lookupKeyReadNoTouch is lookupKeyRead for commands that inspect a key
+// without it counting as an access, such as OBJECT
+func (kvstore *KVStore) lookupKeyReadNoTouch(key string) *Entry {
+	entry := kvstore.find(key)
+	if entry == nil {
+		return nil
+	}
+	if entry.isExpired(time.Now()) {
+		kvstore.lazyExpired.add(key)
+		return nil
+	}
+	// a hash whose fields have all expired no longer exists
+	if entry.objectType == hashType && len(entry.hash().expires) > 0 && entry.hash().Len() == 0 {
+		kvstore.lazyExpired.add(key)
+		return nil
+	}
+	return entry
+}
+
+// lookupKeyWrite returns nil for missing or expired keys, removing the
+// expired ones. Caller must hold the write lock of key's shard
+func (kvstore *KVStore) lookupKeyWrite(key string) *Entry {
+	entry := kvstore.find(key)
+	if entry == nil {
+		return nil
+	}
+	now := time.Now()
+	if entry.isExpired(now) {
+		kvstore.deleteKey(key)
+		return nil
+	}
+	if entry.objectType == hashType && len(entry.hash().expires) > 0 {
+		hash := entry.hash()
+		if hash.purgeExpired(now.UnixMilli()) > 0 {
+			kvstore.signalModifiedKey(key)
+		}
+		if hash.Len() == 0 {
+			kvstore.deleteKey(key)
+			return nil
+		}
+	}
+	entry.touch(&kvstore.config)
+	return entry
+}
+
+// lookupTypedRead is lookupKeyRead that also checks the key holds objectType,
+// a missing key is returned as a nil entry with no error
+func (kvstore *KVStore) lookupTypedRead(key string, objectType objectType) (*Entry, error) {
+	entry := kvstore.lookupKeyRead(key)
+	if entry != nil && entry.objectType != objectType {
+		return nil, errWrongType
+	}
+	return entry, nil
+}
+
+// lookupTypedWrite is the write lock counterpart of lookupTypedRead
+func (kvstore *KVStore) lookupTypedWrite(key string, objectType objectType) (*Entry, error) {
+	entry := kvstore.lookupKeyWrite(key)
+	if entry != nil && entry.objectType != objectType {
+		return nil, errWrongType
+	}
+	return entry, nil
+}
+
+// setKey stores entry at key, replacing whatever was there. Every write
+// that adds or replaces a key goes through here. Caller must hold the
+// write lock of key's shard
+func (kvstore *KVStore) setKey(key string, entry *Entry) {
+	shard := kvstore.shardFor(key)
+	if existing := shard.store[key]; existing != entry {
+		if existing != nil {
+			kvstore.usedMemory.Add(-existing.memory)
+		}
+		entry.initAccess(&kvstore.config)
+		entry.memory = 0
+	}
+	shard.store[key] = entry
+	kvstore.updateMemory(key)
+	kvstore.signalModifiedKey(key)
+}
+
+// deleteKey removes key, whether deleted or expired. Caller must hold the
+// write lock of key's shard
+func (kvstore *KVStore) deleteKey(key string) {
+	if entry := kvstore.find(key); entry != nil {
+		kvstore.usedMemory.Add(-entry.memory)
+	}
+	delete(kvstore.shardFor(key).store, key)
+	kvstore.signalModifiedKey(key)
+}
+
+// signalModifiedKey keeps search indexes and the expires index in step
+// with key. setKey and deleteKey call it, writes that change a hash in
+// place must call it themselves. Caller must hold the write lock of key's
+// shard
+func (kvstore *KVStore) signalModifiedKey(key string) {
+	for _, index := range kvstore.indexes {
+		index.update(key, kvstore.find(key))
+	}
+	kvstore.updateExpires(key)
+}
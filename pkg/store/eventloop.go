@@ -0,0 +1,64 @@
+package store
+
+// Options are the choices fixed when a store is created
+type Options struct {
+	// EventLoop runs every command on a single goroutine, one after the
+	// other as Redis does, instead of on the caller's goroutine under shard
+	// locks. Handlers then take no locks at all and every command is
+	// atomic with respect to all the others
+	EventLoop bool
+	// Config sets tunables by their CONFIG SET name, such as "maxmemory"
+	// to "100mb". The rest keep their defaults
+	Config map[string]string
+	// Dir and DBFilename locate the RDB file SAVE writes, dump.rdb in the
+	// working directory unless given. When DBFilename is given the store
+	// starts with the keys saved there, if the file exists
+	Dir        string
+	DBFilename string
+}
+
+// eventLoop runs the jobs sent by run in arrival order for as long as the
+// process lives. The keyspace stays usable after Close, so unlike the
+// other background tasks it doesn't stop
+func (kvstore *KVStore) eventLoop() {
+	for job := range kvstore.jobs {
+		job()
+	}
+}
+
+// run is how work reaches the keyspace. In event loop mode job is handed
+// to the loop and run waits for it to finish, otherwise job runs straight
+// away on the calling goroutine and locks the shards it needs
+func (kvstore *KVStore) run(job func()) {
+	if !kvstore.options.EventLoop {
+		job()
+		return
+	}
+	done := make(chan struct{})
+	kvstore.jobs <- func() {
+		defer close(done)
+		job()
+	}
+	<-done
+}
+
+// borrowLoop lets the Go API run on the caller's goroutine as if it were
+// on the loop. In event loop mode it parks the loop until the returned
+// func is called, so nothing else runs in between, as with
+//
+//	defer kvstore.borrowLoop()()
+func (kvstore *KVStore) borrowLoop() func() {
+	if !kvstore.options.EventLoop {
+		return func() {}
+	}
+	parked := make(chan struct{})
+	resume := make(chan struct{})
+	kvstore.jobs <- func() {
+		close(parked)
+		<-resume
+	}
+	<-parked
+	return func() {
+		close(resume)
+	}
+}
@@ -0,0 +1,102 @@
+package store
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func newEventLoopStore(t testing.TB) *KVStore {
+	kvstore, err := NewWithOptions(Options{EventLoop: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(kvstore.Close)
+	return kvstore
+}
+
+func execute(t testing.TB, kvstore *KVStore, client *Client, arguments ...string) string {
+	reply, err := kvstore.Execute(client, command(arguments...))
+	if err != nil {
+		t.Fatalf("%v: %v", arguments, err)
+	}
+	return string(reply)
+}
+
+// Meant to be run with go test -race, handlers take no locks in event
+// loop mode so any command running off the loop is a data race
+func TestEventLoopSerializesClients(t *testing.T) {
+	kvstore := newEventLoopStore(t)
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client := newTestClient()
+			for i := 0; i < 200; i++ {
+				execute(t, kvstore, client, "INCR", "counter")
+				execute(t, kvstore, client, "HSET", "hash", strconv.Itoa(worker), strconv.Itoa(i))
+				kvstore.RPush("list", []byte("x"))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if reply := execute(t, kvstore, newTestClient(), "GET", "counter"); reply != "$4\r\n1600\r\n" {
+		t.Errorf("expected every INCR to count, got %q", reply)
+	}
+	if length, _ := kvstore.LLen("list"); length != 1600 {
+		t.Errorf("expected every RPush to count, got %d", length)
+	}
+}
+
+func TestEventLoopBlockingCommands(t *testing.T) {
+	kvstore := newEventLoopStore(t)
+	reply := make(chan string, 1)
+	go func() {
+		reply <- execute(t, kvstore, newTestClient(), "BLPOP", "queue", "0")
+	}()
+	waitForBlocked(t, kvstore, "queue", 1)
+
+	// the loop carries on while the client waits
+	execute(t, kvstore, newTestClient(), "SET", "other", "v")
+	execute(t, kvstore, newTestClient(), "RPUSH", "queue", "job")
+	if got := <-reply; got != "*2\r\n$5\r\nqueue\r\n$3\r\njob\r\n" {
+		t.Errorf("BLPOP should be served by RPUSH, got %q", got)
+	}
+
+	if got := execute(t, kvstore, newTestClient(), "BLPOP", "queue", "0.01"); got != string(nullArrayReply) {
+		t.Errorf("BLPOP should time out with a null array, got %q", got)
+	}
+	waitForBlocked(t, kvstore, "queue", 0)
+}
+
+func BenchmarkExecute(b *testing.B) {
+	for _, mode := range []struct {
+		name    string
+		options Options
+	}{
+		{"sharded", Options{}},
+		{"event-loop", Options{EventLoop: true}},
+	} {
+		b.Run(mode.name, func(b *testing.B) {
+			kvstore, err := NewWithOptions(mode.options)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer kvstore.Close()
+			var workers atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				client := newTestClient()
+				prefix := "key:" + strconv.FormatInt(workers.Add(1), 10) + ":"
+				for i := 0; pb.Next(); i++ {
+					key := []byte(prefix + strconv.Itoa(i%1024))
+					kvstore.Execute(client, [][]byte{[]byte("SET"), key, []byte("value")})
+					kvstore.Execute(client, [][]byte{[]byte("GET"), key})
+				}
+			})
+		})
+	}
+}
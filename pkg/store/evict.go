@@ -0,0 +1,340 @@
+package store
+
+import (
+	"cmp"
+	"errors"
+	"math"
+	"math/rand"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errOOM = errors.New("OOM command not allowed when used memory > 'maxmemory'.")
+
+// maxmemory-policy values, in the order Redis lists them
+const (
+	policyVolatileLRU int64 = iota
+	policyAllkeysLRU
+	policyVolatileLFU
+	policyAllkeysLFU
+	policyVolatileRandom
+	policyAllkeysRandom
+	policyVolatileTTL
+	policyNoEviction
+)
+
+var maxmemoryPolicies = []string{
+	"volatile-lru",
+	"allkeys-lru",
+	"volatile-lfu",
+	"allkeys-lfu",
+	"volatile-random",
+	"allkeys-random",
+	"volatile-ttl",
+	"noeviction",
+}
+
+func isVolatilePolicy(policy int64) bool {
+	return policy == policyVolatileLRU || policy == policyVolatileLFU || policy == policyVolatileRandom || policy == policyVolatileTTL
+}
+
+func isLFUPolicy(policy int64) bool {
+	return policy == policyVolatileLFU || policy == policyAllkeysLFU
+}
+
+// Every entry keeps 24 bits of access metadata in Entry.lru, as Redis
+// does. Under an LRU policy it is the LRU clock, in seconds, when the key
+// was last accessed. Under an LFU policy the top 16 bits are the minutes
+// when the counter was last decremented and the low 8 bits a logarithmic
+// access counter. How fast the counter grows and decays is set by the
+// lfu-log-factor and lfu-decay-time tunables
+const (
+	lruClockMax = 1<<24 - 1
+	// what a new key's counter starts at, so it isn't evicted before it
+	// gets a chance to be accessed
+	lfuInitValue = 5
+)
+
+func lruClock() uint32 {
+	return uint32(time.Now().Unix()) & lruClockMax
+}
+
+// idleSeconds is how long ago the LRU clock read lru, allowing for the
+// clock wrapping around every 194 days
+func idleSeconds(lru uint32) uint32 {
+	now := lruClock()
+	if now >= lru {
+		return now - lru
+	}
+	return now + lruClockMax + 1 - lru
+}
+
+func lfuMinutes() uint32 {
+	return uint32(time.Now().Unix()/60) & math.MaxUint16
+}
+
+// lfuDecrAndReturn is the counter in lru less one for every lfu-decay-time
+// minutes since it was last decremented
+func (config *Config) lfuDecrAndReturn(lru uint32) uint32 {
+	counter := lru & 0xff
+	if config.lfuDecayTime == 0 {
+		return counter
+	}
+	now, then := lfuMinutes(), lru>>8
+	elapsed := now - then
+	if now < then {
+		elapsed = now + math.MaxUint16 + 1 - then
+	}
+	periods := int64(elapsed) / config.lfuDecayTime
+	if periods > int64(counter) {
+		return 0
+	}
+	return counter - uint32(periods)
+}
+
+// lfuLogIncr bumps counter with a probability that falls as it grows, so
+// 8 bits are enough to tell keys hit thousands of times from those hit
+// millions of times. With the default lfu-log-factor of 10 the counter
+// saturates at about a million hits
+func (config *Config) lfuLogIncr(counter uint32) uint32 {
+	if counter == 0xff {
+		return counter
+	}
+	base := max(float64(counter)-lfuInitValue, 0)
+	if rand.Float64() < 1/(base*float64(config.lfuLogFactor)+1) {
+		counter++
+	}
+	return counter
+}
+
+// initAccess stamps a new entry. Caller must hold the write lock of its
+// key's shard
+func (entry *Entry) initAccess(config *Config) {
+	if isLFUPolicy(config.maxmemoryPolicy) {
+		entry.lru.Store(lfuMinutes()<<8 | lfuInitValue)
+		return
+	}
+	entry.lru.Store(lruClock())
+}
+
+// touch records an access. Readers only hold the read lock, so concurrent
+// touches may overwrite each other, which only costs a hit now and then.
+// Caller must hold at least the read lock of the entry's key's shard
+func (entry *Entry) touch(config *Config) {
+	if isLFUPolicy(config.maxmemoryPolicy) {
+		counter := config.lfuLogIncr(config.lfuDecrAndReturn(entry.lru.Load()))
+		entry.lru.Store(lfuMinutes()<<8 | counter)
+		return
+	}
+	entry.lru.Store(lruClock())
+}
+
+// idleSeconds is how long since the key was last accessed, only tracked
+// when the policy isn't LFU
+func (entry *Entry) idleSeconds() uint32 {
+	return idleSeconds(entry.lru.Load())
+}
+
+// frequency is the key's decayed LFU counter, only tracked under an LFU
+// policy
+func (entry *Entry) frequency(config *Config) uint32 {
+	return config.lfuDecrAndReturn(entry.lru.Load())
+}
+
+// restoreAccess sets the access metadata a key was saved with, idle or
+// freq being -1 when it wasn't saved. Only the one the current policy
+// tracks is used, as Redis does when loading. Caller must hold the write
+// lock of the entry's key's shard
+func (entry *Entry) restoreAccess(config *Config, idle int64, freq int64) {
+	if isLFUPolicy(config.maxmemoryPolicy) {
+		if freq >= 0 {
+			entry.lru.Store(lfuMinutes()<<8 | uint32(min(freq, 0xff)))
+		}
+		return
+	}
+	if idle >= 0 {
+		clock := int64(lruClock()) - min(idle, lruClockMax)
+		if clock < 0 {
+			clock += lruClockMax + 1
+		}
+		entry.lru.Store(uint32(clock))
+	}
+}
+
+// evictionPoolSize is how many of the best candidates seen so far are
+// kept between evictions
+const evictionPoolSize = 16
+
+type evictionCandidate struct {
+	key string
+	// the higher the score the sooner the key is evicted
+	score uint64
+}
+
+// evictionPool approximates LRU, LFU and TTL eviction the way Redis does.
+// Each round samples maxmemory-samples keys and keeps the best candidates
+// across rounds, so the key evicted is the best of many more samples than
+// a single round takes
+type evictionPool struct {
+	sync.Mutex
+	// ordered by ascending score, best candidate last
+	candidates []evictionCandidate
+	// the shard sampled next
+	cursor int
+}
+
+func (pool *evictionPool) insert(key string, score uint64) {
+	pool.candidates = slices.DeleteFunc(pool.candidates, func(candidate evictionCandidate) bool {
+		return candidate.key == key
+	})
+	if len(pool.candidates) == evictionPoolSize && score <= pool.candidates[0].score {
+		return
+	}
+	position, _ := slices.BinarySearchFunc(pool.candidates, score, func(candidate evictionCandidate, score uint64) int {
+		return cmp.Compare(candidate.score, score)
+	})
+	pool.candidates = slices.Insert(pool.candidates, position, evictionCandidate{key, score})
+	if len(pool.candidates) > evictionPoolSize {
+		pool.candidates = slices.Delete(pool.candidates, 0, 1)
+	}
+}
+
+// nextShard returns the shard to sample next, visiting them in turn
+func (kvstore *KVStore) nextShard() *shard {
+	shard := kvstore.shards[kvstore.eviction.cursor]
+	kvstore.eviction.cursor = (kvstore.eviction.cursor + 1) % shardCount
+	return shard
+}
+
+func evictionScore(entry *Entry, policy int64, config *Config) uint64 {
+	switch policy {
+	case policyVolatileTTL:
+		return math.MaxUint64 - uint64(entry.expiryTime.UnixMilli())
+	case policyVolatileLFU, policyAllkeysLFU:
+		return 0xff - uint64(entry.frequency(config))
+	default:
+		return uint64(entry.idleSeconds())
+	}
+}
+
+// performEvictions evicts keys under the maxmemory-policy until used
+// memory is back under maxmemory. It reports false if that can't be done,
+// because the policy is noeviction or there is nothing left it may evict.
+// Execute and the Go API writes run it first. The tunables are read
+// atomically as no shard lock is held, caller must hold none
+func (kvstore *KVStore) performEvictions() bool {
+	limit := atomic.LoadInt64(&kvstore.config.maxmemory)
+	if limit == 0 || kvstore.usedMemory.Load() <= limit {
+		return true
+	}
+	policy := atomic.LoadInt64(&kvstore.config.maxmemoryPolicy)
+	if policy == policyNoEviction {
+		return false
+	}
+	samples := int(atomic.LoadInt64(&kvstore.config.maxmemorySamples))
+
+	kvstore.eviction.Lock()
+	defer kvstore.eviction.Unlock()
+	for kvstore.usedMemory.Load() > limit {
+		evicted := false
+		if policy == policyAllkeysRandom || policy == policyVolatileRandom {
+			evicted = kvstore.evictRandomKey(policy)
+		} else {
+			kvstore.populateEvictionPool(policy, samples)
+			evicted = kvstore.evictBestCandidate(policy)
+		}
+		if !evicted {
+			return false
+		}
+	}
+	return true
+}
+
+// populateEvictionPool samples keys from shards in turn until it has
+// samples of them or has been through every shard
+func (kvstore *KVStore) populateEvictionPool(policy int64, samples int) {
+	sampled := 0
+	for range kvstore.shards {
+		if sampled >= samples {
+			return
+		}
+		shard := kvstore.nextShard()
+		kvstore.rlockShard(shard)
+		if isVolatilePolicy(policy) {
+			// picks are random so may repeat, no more than the shard holds
+			// are taken to spread the samples over shards
+			picks := min(samples-sampled, len(shard.expires.keys))
+			for i := 0; i < picks; i++ {
+				key := shard.expires.random()
+				// the index also has keys with hash field ttls alone
+				if entry := shard.store[key]; entry != nil && entry.hasExpiry() {
+					kvstore.eviction.insert(key, evictionScore(entry, policy, &kvstore.config))
+				}
+			}
+			sampled += picks
+		} else {
+			for key, entry := range shard.store {
+				if sampled >= samples {
+					break
+				}
+				kvstore.eviction.insert(key, evictionScore(entry, policy, &kvstore.config))
+				sampled++
+			}
+		}
+		kvstore.runlockShard(shard)
+	}
+}
+
+// evictBestCandidate evicts the best candidate in the pool still around,
+// candidates are left behind by earlier rounds and may have been deleted
+// or lost their ttl since
+func (kvstore *KVStore) evictBestCandidate(policy int64) bool {
+	for len(kvstore.eviction.candidates) > 0 {
+		last := len(kvstore.eviction.candidates) - 1
+		key := kvstore.eviction.candidates[last].key
+		kvstore.eviction.candidates = kvstore.eviction.candidates[:last]
+
+		shard := kvstore.shardFor(key)
+		kvstore.lockShard(shard)
+		entry := shard.store[key]
+		evicted := entry != nil && (!isVolatilePolicy(policy) || entry.hasExpiry())
+		if evicted {
+			kvstore.deleteKey(key)
+		}
+		kvstore.unlockShard(shard)
+		if evicted {
+			return true
+		}
+	}
+	return false
+}
+
+func (kvstore *KVStore) evictRandomKey(policy int64) bool {
+	for range kvstore.shards {
+		shard := kvstore.nextShard()
+		kvstore.lockShard(shard)
+		key, ok := "", false
+		if isVolatilePolicy(policy) {
+			if len(shard.expires.keys) > 0 {
+				key = shard.expires.random()
+				entry := shard.store[key]
+				ok = entry != nil && entry.hasExpiry()
+			}
+		} else {
+			for key = range shard.store {
+				ok = true
+				break
+			}
+		}
+		if ok {
+			kvstore.deleteKey(key)
+		}
+		kvstore.unlockShard(shard)
+		if ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,239 @@
+package store
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// configure applies CONFIG SET name value
+func configure(t *testing.T, kvstore *KVStore, settings ...string) {
+	t.Helper()
+	for i := 0; i < len(settings); i += 2 {
+		if reply := string(kvstore.handleCONFIGSET(command("CONFIG", "SET", settings[i], settings[i+1]))); reply != string(okReply) {
+			t.Fatalf("CONFIG SET %s %s: %q", settings[i], settings[i+1], reply)
+		}
+	}
+}
+
+// keyspaceMemory sizes every key from scratch, usedMemory must always
+// match it
+func keyspaceMemory(kvstore *KVStore) int64 {
+	total := int64(0)
+	kvstore.forEachKey(func(key string, entry *Entry) bool {
+		total += keyMemory(key, entry, int(kvstore.config.maxmemorySamples))
+		return true
+	})
+	return total
+}
+
+func TestMemoryAccounting(t *testing.T) {
+	kvstore := newKVStore()
+	client := newTestClient()
+	execute(t, kvstore, client, "SET", "string", "value")
+	for i := 0; i < 300; i++ {
+		execute(t, kvstore, client, "RPUSH", "list", strings.Repeat("x", 100))
+		// fields of one length, so a sampled size doesn't depend on
+		// which fields were sampled
+		execute(t, kvstore, client, "HSET", "hash", strconv.Itoa(1000+i), "value")
+	}
+	execute(t, kvstore, client, "SET", "string", strings.Repeat("y", 1000))
+	if used, expected := kvstore.UsedMemory(), keyspaceMemory(kvstore); used != expected {
+		t.Errorf("expected used memory %d, got %d", expected, used)
+	}
+	if used := kvstore.UsedMemory(); used < 300*100+1000 {
+		t.Errorf("expected used memory to cover the values, got %d", used)
+	}
+
+	execute(t, kvstore, client, "LTRIM", "list", "0", "9")
+	if used, expected := kvstore.UsedMemory(), keyspaceMemory(kvstore); used != expected {
+		t.Errorf("expected used memory %d after LTRIM, got %d", expected, used)
+	}
+	execute(t, kvstore, client, "DEL", "string", "list", "hash")
+	if used := kvstore.UsedMemory(); used != 0 {
+		t.Errorf("expected no used memory once every key is gone, got %d", used)
+	}
+}
+
+func TestMemoryUsage(t *testing.T) {
+	kvstore := newKVStore()
+	client := newTestClient()
+	execute(t, kvstore, client, "SET", "key", strings.Repeat("x", 1000))
+	reply := execute(t, kvstore, client, "MEMORY", "USAGE", "key")
+	usage, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(reply, ":"), "\r\n"))
+	if err != nil || usage < 1000 {
+		t.Errorf("expected the usage to cover the value, got %q", reply)
+	}
+	if reply := execute(t, kvstore, client, "MEMORY", "USAGE", "missing"); reply != string(nullBulkReply) {
+		t.Errorf("expected a null reply for a missing key, got %q", reply)
+	}
+	kvstore.find("key").lru.Store(lruClock() - 1000)
+	execute(t, kvstore, client, "MEMORY", "USAGE", "key")
+	if got := execute(t, kvstore, client, "OBJECT", "IDLETIME", "key"); !within(got, 1000, 1001) {
+		t.Errorf("expected MEMORY USAGE to leave the idle time alone, got %q", got)
+	}
+}
+
+func TestConfigMaxmemory(t *testing.T) {
+	kvstore := newKVStore()
+	configure(t, kvstore, "maxmemory", "2mb", "maxmemory-policy", "ALLKEYS-LRU")
+	if kvstore.config.maxmemory != 2<<20 {
+		t.Errorf("expected 2mb to be 2097152 bytes, got %d", kvstore.config.maxmemory)
+	}
+	if got := string(kvstore.handleCONFIGGET(command("CONFIG", "GET", "maxmemory-policy"))); got != "*2\r\n$16\r\nmaxmemory-policy\r\n$11\r\nallkeys-lru\r\n" {
+		t.Errorf("expected the policy by name, got %q", got)
+	}
+	if got := string(kvstore.handleCONFIGSET(command("CONFIG", "SET", "maxmemory-policy", "lru"))); !strings.HasPrefix(got, "-ERR Invalid argument") {
+		t.Errorf("expected an unknown policy to be refused, got %q", got)
+	}
+}
+
+func TestConfigIsPerStore(t *testing.T) {
+	limited, err := NewWithOptions(Options{Config: map[string]string{"maxmemory": "1mb", "maxmemory-policy": "allkeys-lfu"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer limited.Close()
+	other := New()
+	defer other.Close()
+	configure(t, other, "maxmemory", "2mb")
+
+	if limited.config.maxmemory != 1<<20 || limited.config.maxmemoryPolicy != policyAllkeysLFU {
+		t.Errorf("expected the options to set maxmemory and the policy, got %d %d", limited.config.maxmemory, limited.config.maxmemoryPolicy)
+	}
+	if other.config.maxmemoryPolicy != policyNoEviction {
+		t.Errorf("expected the other store to keep the default policy")
+	}
+	if _, err := NewWithOptions(Options{Config: map[string]string{"maxmemory-samples": "0"}}); err == nil {
+		t.Errorf("expected a setting CONFIG SET refuses to be refused")
+	}
+	if _, err := NewWithOptions(Options{Config: map[string]string{"no-such-tunable": "1"}}); err != errUnsupportedParameter {
+		t.Errorf("expected an unknown tunable to be refused, got %v", err)
+	}
+}
+
+func TestNoEvictionRefusesWrites(t *testing.T) {
+	kvstore := newKVStore()
+	client := newTestClient()
+	execute(t, kvstore, client, "SET", "a", "1")
+	execute(t, kvstore, client, "SET", "b", "2")
+	configure(t, kvstore, "maxmemory", "1", "maxmemory-policy", "noeviction")
+
+	if got := execute(t, kvstore, client, "SET", "c", "3"); got != "-"+errOOM.Error()+"\r\n" {
+		t.Errorf("expected SET to be refused, got %q", got)
+	}
+	if got := execute(t, kvstore, client, "GET", "a"); got != "$1\r\n1\r\n" {
+		t.Errorf("expected reads to carry on, got %q", got)
+	}
+	// aliases are refused like the commands they share a handler with
+	for _, arguments := range [][]string{
+		{"HMSET", "hash", "field", "value"},
+		{"SUNIONSTORE", "set", "a"},
+		{"SDIFFSTORE", "set", "a"},
+		{"ZINTERSTORE", "zset", "1", "a"},
+		{"ZDIFFSTORE", "zset", "1", "a"},
+		{"CF.ADDNX", "cuckoo", "item"},
+	} {
+		if got := execute(t, kvstore, client, arguments...); got != "-"+errOOM.Error()+"\r\n" {
+			t.Errorf("expected %s to be refused, got %q", arguments[0], got)
+		}
+	}
+	if set, err := kvstore.Set("c", []byte("3"), SetOptions{}); set || !errors.Is(err, ErrOOM) {
+		t.Errorf("expected Set to return ErrOOM, got %v, %v", set, err)
+	}
+	if _, err := kvstore.HSet("hash", "field", []byte("value")); !errors.Is(err, ErrOOM) {
+		t.Errorf("expected HSet to return ErrOOM, got %v", err)
+	}
+	if got := execute(t, kvstore, client, "DEL", "a"); got != ":1\r\n" {
+		t.Errorf("expected deletes to carry on, got %q", got)
+	}
+}
+
+func TestEvictionPolicies(t *testing.T) {
+	for _, test := range []struct {
+		policy string
+		// add stores key, which the policy should prefer to keep when keep
+		// is set
+		add func(kvstore *KVStore, client *Client, key string, keep bool)
+	}{
+		{"allkeys-lru", func(kvstore *KVStore, client *Client, key string, keep bool) {
+			execute(t, kvstore, client, "SET", key, "value")
+			if !keep {
+				kvstore.find(key).lru.Store(lruClock() - 1000)
+			}
+		}},
+		{"allkeys-lfu", func(kvstore *KVStore, client *Client, key string, keep bool) {
+			execute(t, kvstore, client, "SET", key, "value")
+			if keep {
+				kvstore.find(key).lru.Store(lfuMinutes()<<8 | 200)
+			}
+		}},
+		{"volatile-lru", func(kvstore *KVStore, client *Client, key string, keep bool) {
+			// keys without a ttl are never evicted however idle
+			if keep {
+				execute(t, kvstore, client, "SET", key, "value")
+				kvstore.find(key).lru.Store(lruClock() - 1000)
+			} else {
+				execute(t, kvstore, client, "SET", key, "value", "px", "3600000")
+			}
+		}},
+		{"volatile-ttl", func(kvstore *KVStore, client *Client, key string, keep bool) {
+			ttl := "10000"
+			if keep {
+				ttl = "3600000"
+			}
+			execute(t, kvstore, client, "SET", key, "value", "px", ttl)
+		}},
+	} {
+		t.Run(test.policy, func(t *testing.T) {
+			kvstore := newKVStore()
+			client := newTestClient()
+			configure(t, kvstore, "maxmemory-policy", test.policy, "maxmemory-samples", "64")
+			for i := 0; i < 50; i++ {
+				test.add(kvstore, client, "keep:"+strconv.Itoa(i), true)
+				test.add(kvstore, client, "evict:"+strconv.Itoa(i), false)
+			}
+			keySize := kvstore.UsedMemory() / 100
+			limit := kvstore.UsedMemory() - 10*keySize
+			configure(t, kvstore, "maxmemory", strconv.FormatInt(limit, 10))
+
+			if got := execute(t, kvstore, client, "SET", "new", "value"); got != string(okReply) {
+				t.Fatalf("expected SET to evict to make room, got %q", got)
+			}
+			evicted := 0
+			for i := 0; i < 50; i++ {
+				if kvstore.find("keep:"+strconv.Itoa(i)) == nil {
+					t.Errorf("keep:%d was evicted", i)
+				}
+				if kvstore.find("evict:"+strconv.Itoa(i)) == nil {
+					evicted++
+				}
+			}
+			if evicted < 10 {
+				t.Errorf("expected at least 10 keys evicted, got %d", evicted)
+			}
+		})
+	}
+}
+
+func TestRandomEviction(t *testing.T) {
+	kvstore := newKVStore()
+	client := newTestClient()
+	for i := 0; i < 100; i++ {
+		execute(t, kvstore, client, "SET", "key:"+strconv.Itoa(i), "value")
+	}
+	limit := kvstore.UsedMemory() / 2
+	configure(t, kvstore, "maxmemory", strconv.FormatInt(limit, 10), "maxmemory-policy", "volatile-random")
+	if got := execute(t, kvstore, client, "SET", "new", "value"); got != "-"+errOOM.Error()+"\r\n" {
+		t.Errorf("expected SET to be refused with no volatile keys, got %q", got)
+	}
+
+	configure(t, kvstore, "maxmemory-policy", "allkeys-random")
+	if got := execute(t, kvstore, client, "SET", "new", "value"); got != string(okReply) {
+		t.Fatalf("expected SET to evict to make room, got %q", got)
+	}
+	if used := kvstore.UsedMemory() - keyMemory("new", kvstore.find("new"), 0); used > limit {
+		t.Errorf("expected used memory under %d before the SET, got %d", limit, used)
+	}
+}
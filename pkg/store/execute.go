@@ -0,0 +1,268 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var errEmptyCommand = errors.New("ERR empty command")
+
+const unknownCommandFormat = "ERR unknown command '%s'"
+
+// commandHandler runs a command, an error meaning it could not be run at all
+type commandHandler func(kvstore *KVStore, client *Client, messages [][]byte) ([]byte, error)
+
+type commandSpec struct {
+	handler commandHandler
+	// set for commands that can grow the keyspace. Once eviction can't
+	// get used memory under maxmemory they are refused, everything else,
+	// deletes included, still runs
+	denyOOM bool
+}
+
+// reply adapts the usual handler, which only needs the arguments
+func reply(handler func(kvstore *KVStore, messages [][]byte) []byte) commandHandler {
+	return func(kvstore *KVStore, _ *Client, messages [][]byte) ([]byte, error) {
+		return handler(kvstore, messages), nil
+	}
+}
+
+// blocking adapts handlers that may park the client
+func blocking(handler func(kvstore *KVStore, messages [][]byte, client *Client) []byte) commandHandler {
+	return func(kvstore *KVStore, client *Client, messages [][]byte) ([]byte, error) {
+		return handler(kvstore, messages, client), nil
+	}
+}
+
+// static adapts handlers that don't touch the keyspace
+func static(handler func(messages [][]byte) []byte) commandHandler {
+	return func(_ *KVStore, _ *Client, messages [][]byte) ([]byte, error) {
+		return handler(messages), nil
+	}
+}
+
+// commands maps every command name, aliases included, to how it runs
+var commands = map[string]commandSpec{
+	"CONFIG": {handler: reply((*KVStore).handleCONFIG)},
+	"SAVE":   {handler: reply((*KVStore).handleSAVE)},
+	"MEMORY": {handler: reply((*KVStore).handleMEMORY)},
+	"OBJECT": {handler: reply((*KVStore).handleOBJECT)},
+	"ECHO":   {handler: static(handleECHO)},
+	"PING":   {handler: static(func([][]byte) []byte { return handlePING() })},
+	"SET": {handler: func(kvstore *KVStore, _ *Client, messages [][]byte) ([]byte, error) {
+		return kvstore.handleSET(messages)
+	}, denyOOM: true},
+	"GET":              {handler: reply((*KVStore).handleGET)},
+	"INCR":             {handler: reply((*KVStore).handleINCR), denyOOM: true},
+	"DECR":             {handler: reply((*KVStore).handleDECR), denyOOM: true},
+	"INCRBY":           {handler: reply((*KVStore).handleINCRBY), denyOOM: true},
+	"DECRBY":           {handler: reply((*KVStore).handleDECRBY), denyOOM: true},
+	"INCRBYFLOAT":      {handler: reply((*KVStore).handleINCRBYFLOAT), denyOOM: true},
+	"LPUSH":            {handler: reply((*KVStore).handleLPUSH), denyOOM: true},
+	"RPUSH":            {handler: reply((*KVStore).handleRPUSH), denyOOM: true},
+	"LPOP":             {handler: reply((*KVStore).handleLPOP)},
+	"RPOP":             {handler: reply((*KVStore).handleRPOP)},
+	"LLEN":             {handler: reply((*KVStore).handleLLEN)},
+	"LRANGE":           {handler: reply((*KVStore).handleLRANGE)},
+	"LINDEX":           {handler: reply((*KVStore).handleLINDEX)},
+	"LSET":             {handler: reply((*KVStore).handleLSET), denyOOM: true},
+	"LINSERT":          {handler: reply((*KVStore).handleLINSERT), denyOOM: true},
+	"LREM":             {handler: reply((*KVStore).handleLREM)},
+	"LTRIM":            {handler: reply((*KVStore).handleLTRIM)},
+	"LMOVE":            {handler: reply((*KVStore).handleLMOVE), denyOOM: true},
+	"LMPOP":            {handler: reply((*KVStore).handleLMPOP)},
+	"BLPOP":            {handler: blocking((*KVStore).handleBLPOP)},
+	"BRPOP":            {handler: blocking((*KVStore).handleBRPOP)},
+	"BLMOVE":           {handler: blocking((*KVStore).handleBLMOVE), denyOOM: true},
+	"BLMPOP":           {handler: blocking((*KVStore).handleBLMPOP)},
+	"HSET":             {handler: reply((*KVStore).handleHSET), denyOOM: true},
+	"HMSET":            {handler: reply((*KVStore).handleHSET), denyOOM: true},
+	"HSETNX":           {handler: reply((*KVStore).handleHSETNX), denyOOM: true},
+	"HGET":             {handler: reply((*KVStore).handleHGET)},
+	"HMGET":            {handler: reply((*KVStore).handleHMGET)},
+	"HDEL":             {handler: reply((*KVStore).handleHDEL)},
+	"HLEN":             {handler: reply((*KVStore).handleHLEN)},
+	"HEXISTS":          {handler: reply((*KVStore).handleHEXISTS)},
+	"HSTRLEN":          {handler: reply((*KVStore).handleHSTRLEN)},
+	"HGETALL":          {handler: reply((*KVStore).handleHGETALL)},
+	"HKEYS":            {handler: reply((*KVStore).handleHGETALL)},
+	"HVALS":            {handler: reply((*KVStore).handleHGETALL)},
+	"HINCRBY":          {handler: reply((*KVStore).handleHINCRBY), denyOOM: true},
+	"HINCRBYFLOAT":     {handler: reply((*KVStore).handleHINCRBYFLOAT), denyOOM: true},
+	"HRANDFIELD":       {handler: reply((*KVStore).handleHRANDFIELD)},
+	"HSCAN":            {handler: reply((*KVStore).handleHSCAN)},
+	"HEXPIRE":          {handler: reply((*KVStore).handleHEXPIRE)},
+	"HPEXPIRE":         {handler: reply((*KVStore).handleHEXPIRE)},
+	"HEXPIREAT":        {handler: reply((*KVStore).handleHEXPIRE)},
+	"HPEXPIREAT":       {handler: reply((*KVStore).handleHEXPIRE)},
+	"HTTL":             {handler: reply((*KVStore).handleHTTL)},
+	"HPTTL":            {handler: reply((*KVStore).handleHTTL)},
+	"HEXPIRETIME":      {handler: reply((*KVStore).handleHTTL)},
+	"HPEXPIRETIME":     {handler: reply((*KVStore).handleHTTL)},
+	"HPERSIST":         {handler: reply((*KVStore).handleHPERSIST)},
+	"SADD":             {handler: reply((*KVStore).handleSADD), denyOOM: true},
+	"SREM":             {handler: reply((*KVStore).handleSREM)},
+	"SCARD":            {handler: reply((*KVStore).handleSCARD)},
+	"SMEMBERS":         {handler: reply((*KVStore).handleSMEMBERS)},
+	"SISMEMBER":        {handler: reply((*KVStore).handleSISMEMBER)},
+	"SMISMEMBER":       {handler: reply((*KVStore).handleSMISMEMBER)},
+	"SMOVE":            {handler: reply((*KVStore).handleSMOVE)},
+	"SINTER":           {handler: reply((*KVStore).handleSINTER)},
+	"SUNION":           {handler: reply((*KVStore).handleSINTER)},
+	"SDIFF":            {handler: reply((*KVStore).handleSINTER)},
+	"SINTERSTORE":      {handler: reply((*KVStore).handleSINTERSTORE), denyOOM: true},
+	"SUNIONSTORE":      {handler: reply((*KVStore).handleSINTERSTORE), denyOOM: true},
+	"SDIFFSTORE":       {handler: reply((*KVStore).handleSINTERSTORE), denyOOM: true},
+	"SINTERCARD":       {handler: reply((*KVStore).handleSINTERCARD)},
+	"SRANDMEMBER":      {handler: reply((*KVStore).handleSRANDMEMBER)},
+	"SPOP":             {handler: reply((*KVStore).handleSPOP)},
+	"SSCAN":            {handler: reply((*KVStore).handleSSCAN)},
+	"ZADD":             {handler: reply((*KVStore).handleZADD), denyOOM: true},
+	"ZINCRBY":          {handler: reply((*KVStore).handleZINCRBY), denyOOM: true},
+	"ZREM":             {handler: reply((*KVStore).handleZREM)},
+	"ZCARD":            {handler: reply((*KVStore).handleZCARD)},
+	"ZSCORE":           {handler: reply((*KVStore).handleZSCORE)},
+	"ZMSCORE":          {handler: reply((*KVStore).handleZMSCORE)},
+	"ZRANK":            {handler: reply((*KVStore).handleZRANK)},
+	"ZREVRANK":         {handler: reply((*KVStore).handleZRANK)},
+	"ZCOUNT":           {handler: reply((*KVStore).handleZCOUNT)},
+	"ZLEXCOUNT":        {handler: reply((*KVStore).handleZLEXCOUNT)},
+	"ZRANGE":           {handler: reply((*KVStore).handleZRANGE)},
+	"ZREVRANGE":        {handler: reply((*KVStore).handleZRANGELEGACY)},
+	"ZRANGEBYSCORE":    {handler: reply((*KVStore).handleZRANGELEGACY)},
+	"ZREVRANGEBYSCORE": {handler: reply((*KVStore).handleZRANGELEGACY)},
+	"ZRANGEBYLEX":      {handler: reply((*KVStore).handleZRANGELEGACY)},
+	"ZREVRANGEBYLEX":   {handler: reply((*KVStore).handleZRANGELEGACY)},
+	"ZRANGESTORE":      {handler: reply((*KVStore).handleZRANGESTORE), denyOOM: true},
+	"ZPOPMIN":          {handler: reply((*KVStore).handleZPOPMIN)},
+	"ZPOPMAX":          {handler: reply((*KVStore).handleZPOPMIN)},
+	"ZUNION":           {handler: reply((*KVStore).handleZUNION)},
+	"ZINTER":           {handler: reply((*KVStore).handleZUNION)},
+	"ZDIFF":            {handler: reply((*KVStore).handleZUNION)},
+	"ZUNIONSTORE":      {handler: reply((*KVStore).handleZUNIONSTORE), denyOOM: true},
+	"ZINTERSTORE":      {handler: reply((*KVStore).handleZUNIONSTORE), denyOOM: true},
+	"ZDIFFSTORE":       {handler: reply((*KVStore).handleZUNIONSTORE), denyOOM: true},
+	"ZMPOP":            {handler: reply((*KVStore).handleZMPOP)},
+	"BZPOPMIN":         {handler: blocking((*KVStore).handleBZPOPMIN)},
+	"BZPOPMAX":         {handler: blocking((*KVStore).handleBZPOPMIN)},
+	"BZMPOP":           {handler: blocking((*KVStore).handleBZMPOP)},
+	"XADD":             {handler: reply((*KVStore).handleXADD), denyOOM: true},
+	"XLEN":             {handler: reply((*KVStore).handleXLEN)},
+	"XRANGE":           {handler: reply((*KVStore).handleXRANGE)},
+	"XREVRANGE":        {handler: reply((*KVStore).handleXRANGE)},
+	"XDEL":             {handler: reply((*KVStore).handleXDEL)},
+	"XTRIM":            {handler: reply((*KVStore).handleXTRIM)},
+	"XGROUP":           {handler: reply((*KVStore).handleXGROUP), denyOOM: true},
+	"XREAD":            {handler: blocking((*KVStore).handleXREAD)},
+	"XREADGROUP":       {handler: blocking((*KVStore).handleXREAD)},
+	"XACK":             {handler: reply((*KVStore).handleXACK)},
+	"XPENDING":         {handler: reply((*KVStore).handleXPENDING)},
+	"XCLAIM":           {handler: reply((*KVStore).handleXCLAIM)},
+	"XAUTOCLAIM":       {handler: reply((*KVStore).handleXAUTOCLAIM)},
+	"XINFO":            {handler: reply((*KVStore).handleXINFO)},
+	"SETBIT":           {handler: reply((*KVStore).handleSETBIT), denyOOM: true},
+	"GETBIT":           {handler: reply((*KVStore).handleGETBIT)},
+	"BITCOUNT":         {handler: reply((*KVStore).handleBITCOUNT)},
+	"BITPOS":           {handler: reply((*KVStore).handleBITPOS)},
+	"BITOP":            {handler: reply((*KVStore).handleBITOP), denyOOM: true},
+	"BITFIELD":         {handler: reply((*KVStore).handleBITFIELD), denyOOM: true},
+	"BITFIELD_RO":      {handler: reply((*KVStore).handleBITFIELD)},
+	"PFADD":            {handler: reply((*KVStore).handlePFADD), denyOOM: true},
+	"PFCOUNT":          {handler: reply((*KVStore).handlePFCOUNT)},
+	"PFMERGE":          {handler: reply((*KVStore).handlePFMERGE), denyOOM: true},
+	"GEOADD":           {handler: reply((*KVStore).handleGEOADD), denyOOM: true},
+	"GEODIST":          {handler: reply((*KVStore).handleGEODIST)},
+	"GEOPOS":           {handler: reply((*KVStore).handleGEOPOS)},
+	"GEOHASH":          {handler: reply((*KVStore).handleGEOHASH)},
+	"GEOSEARCH":        {handler: reply((*KVStore).handleGEOSEARCH)},
+	"GEOSEARCHSTORE":   {handler: reply((*KVStore).handleGEOSEARCHSTORE), denyOOM: true},
+	"JSON.SET":         {handler: reply((*KVStore).handleJSONSET), denyOOM: true},
+	"JSON.GET":         {handler: reply((*KVStore).handleJSONGET)},
+	"JSON.MGET":        {handler: reply((*KVStore).handleJSONMGET)},
+	"JSON.DEL":         {handler: reply((*KVStore).handleJSONDEL)},
+	"JSON.FORGET":      {handler: reply((*KVStore).handleJSONDEL)},
+	"JSON.TYPE":        {handler: reply((*KVStore).handleJSONTYPE)},
+	"JSON.STRLEN":      {handler: reply((*KVStore).handleJSONSTRLEN)},
+	"JSON.ARRLEN":      {handler: reply((*KVStore).handleJSONARRLEN)},
+	"JSON.OBJLEN":      {handler: reply((*KVStore).handleJSONOBJLEN)},
+	"JSON.OBJKEYS":     {handler: reply((*KVStore).handleJSONOBJKEYS)},
+	"JSON.ARRAPPEND":   {handler: reply((*KVStore).handleJSONARRAPPEND), denyOOM: true},
+	"JSON.NUMINCRBY":   {handler: reply((*KVStore).handleJSONNUMINCRBY), denyOOM: true},
+	"JSON.NUMMULTBY":   {handler: reply((*KVStore).handleJSONNUMMULTBY), denyOOM: true},
+	"BF.RESERVE":       {handler: reply((*KVStore).handleBFRESERVE), denyOOM: true},
+	"BF.ADD":           {handler: reply((*KVStore).handleBFADD), denyOOM: true},
+	"BF.MADD":          {handler: reply((*KVStore).handleBFMADD), denyOOM: true},
+	"BF.EXISTS":        {handler: reply((*KVStore).handleBFEXISTS)},
+	"BF.MEXISTS":       {handler: reply((*KVStore).handleBFMEXISTS)},
+	"BF.CARD":          {handler: reply((*KVStore).handleBFCARD)},
+	"CF.RESERVE":       {handler: reply((*KVStore).handleCFRESERVE), denyOOM: true},
+	"CF.ADD":           {handler: reply((*KVStore).handleCFADD), denyOOM: true},
+	"CF.ADDNX":         {handler: reply((*KVStore).handleCFADD), denyOOM: true},
+	"CF.EXISTS":        {handler: reply((*KVStore).handleCFCOUNT)},
+	"CF.COUNT":         {handler: reply((*KVStore).handleCFCOUNT)},
+	"CF.DEL":           {handler: reply((*KVStore).handleCFDEL)},
+	"CMS.INITBYDIM":    {handler: reply((*KVStore).handleCMSINITBYDIM), denyOOM: true},
+	"CMS.INITBYPROB":   {handler: reply((*KVStore).handleCMSINITBYPROB), denyOOM: true},
+	"CMS.INCRBY":       {handler: reply((*KVStore).handleCMSINCRBY), denyOOM: true},
+	"CMS.QUERY":        {handler: reply((*KVStore).handleCMSQUERY)},
+	"CMS.INFO":         {handler: reply((*KVStore).handleCMSINFO)},
+	"TS.CREATE":        {handler: reply((*KVStore).handleTSCREATE), denyOOM: true},
+	"TS.ADD":           {handler: reply((*KVStore).handleTSADD), denyOOM: true},
+	"TS.GET":           {handler: reply((*KVStore).handleTSGET)},
+	"TS.RANGE":         {handler: reply((*KVStore).handleTSRANGE)},
+	"TS.REVRANGE":      {handler: reply((*KVStore).handleTSRANGE)},
+	"TS.MRANGE":        {handler: reply((*KVStore).handleTSMRANGE)},
+	"TS.MREVRANGE":     {handler: reply((*KVStore).handleTSMRANGE)},
+	"TS.CREATERULE":    {handler: reply((*KVStore).handleTSCREATERULE), denyOOM: true},
+	"TS.DELETERULE":    {handler: reply((*KVStore).handleTSDELETERULE)},
+	"TS.INFO":          {handler: reply((*KVStore).handleTSINFO)},
+	"VADD":             {handler: reply((*KVStore).handleVADD), denyOOM: true},
+	"VSIM":             {handler: reply((*KVStore).handleVSIM)},
+	"VREM":             {handler: reply((*KVStore).handleVREM)},
+	"VCARD":            {handler: reply((*KVStore).handleVCARD)},
+	"VDIM":             {handler: reply((*KVStore).handleVDIM)},
+	"VEMB":             {handler: reply((*KVStore).handleVEMB)},
+	"VINFO":            {handler: reply((*KVStore).handleVINFO)},
+	"DEL":              {handler: reply((*KVStore).handleDEL)},
+	"UNLINK":           {handler: reply((*KVStore).handleDEL)},
+	"MSET":             {handler: reply((*KVStore).handleMSET), denyOOM: true},
+	"RENAME":           {handler: reply((*KVStore).handleRENAME)},
+	"RENAMENX":         {handler: reply((*KVStore).handleRENAME)},
+	"FT.CREATE":        {handler: reply((*KVStore).handleFTCREATE), denyOOM: true},
+	"FT.SEARCH":        {handler: reply((*KVStore).handleFTSEARCH)},
+	"FT.DROPINDEX":     {handler: reply((*KVStore).handleFTDROPINDEX)},
+	"FT.INFO":          {handler: reply((*KVStore).handleFTINFO)},
+	"FT._LIST":         {handler: reply((*KVStore).handleFTLIST)},
+}
+
+// Execute runs one command, messages[0] being its name, and returns the
+// RESP reply. Blocking commands park client until they are served or it
+// goes away. Unknown commands and bad arguments are error replies, an
+// error means the command could not be run at all
+func (kvstore *KVStore) Execute(client *Client, messages [][]byte) ([]byte, error) {
+	if len(messages) == 0 {
+		return encodeError(errEmptyCommand), nil
+	}
+	spec, ok := commands[strings.ToUpper(string(messages[0]))]
+	if !ok {
+		return encodeError(fmt.Errorf(unknownCommandFormat, messages[0])), nil
+	}
+
+	var message []byte
+	var err error
+	kvstore.run(func() {
+		if !kvstore.performEvictions() && spec.denyOOM {
+			message = encodeError(errOOM)
+			return
+		}
+		message, err = spec.handler(kvstore, client, messages)
+	})
+	// in event loop mode a blocking command leaves the waiting to the
+	// client's own goroutine so the loop can carry on
+	if wait := client.wait; wait != nil {
+		client.wait = nil
+		return wait(), nil
+	}
+	return message, err
+}
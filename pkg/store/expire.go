@@ -0,0 +1,200 @@
+package store
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the active expire cycle samples this many keys with a ttl per round and
+// goes for another round while more than activeExpireAcceptableStale
+// percent of them had expired, spending at most activeExpireCyclePercent
+// of each tick doing so
+const (
+	activeExpireKeysPerLoop     = 20
+	activeExpireAcceptableStale = 25
+	activeExpireCyclePercent    = 25
+)
+
+// expiresIndex holds the keys that can expire, either through their own
+// ttl or through hash field ttls. Keys sit in a slice so a random one can
+// be picked in constant time, positions finds a key's slot for removal
+type expiresIndex struct {
+	keys      []string
+	positions map[string]int
+}
+
+func newExpiresIndex() *expiresIndex {
+	return &expiresIndex{positions: make(map[string]int)}
+}
+
+func (index *expiresIndex) add(key string) {
+	if _, ok := index.positions[key]; ok {
+		return
+	}
+	index.positions[key] = len(index.keys)
+	index.keys = append(index.keys, key)
+}
+
+// remove swaps the last key into key's slot
+func (index *expiresIndex) remove(key string) {
+	position, ok := index.positions[key]
+	if !ok {
+		return
+	}
+	last := len(index.keys) - 1
+	index.keys[position] = index.keys[last]
+	index.positions[index.keys[position]] = position
+	index.keys = index.keys[:last]
+	delete(index.positions, key)
+}
+
+func (index *expiresIndex) random() string {
+	return index.keys[rand.Intn(len(index.keys))]
+}
+
+// hasExpiry reports whether entry was given a ttl, entries without one
+// expire noExpiry after they were created
+func (entry *Entry) hasExpiry() bool {
+	return entry.expiryTime.Sub(entry.creationTime) < noExpiry
+}
+
+// updateExpires adds key to its shard's expires index if it can expire
+// and removes it otherwise. signalModifiedKey calls it, so every write
+// keeps the index current. Caller must hold the write lock of key's shard
+func (kvstore *KVStore) updateExpires(key string) {
+	shard := kvstore.shardFor(key)
+	entry, ok := shard.store[key]
+	if ok && (entry.hasExpiry() || entry.objectType == hashType && len(entry.hash().expires) > 0) {
+		shard.expires.add(key)
+		return
+	}
+	shard.expires.remove(key)
+}
+
+// expireSample checks up to activeExpireKeysPerLoop random keys from the
+// shard's expires index, removing expired keys and hash fields. It
+// returns how many keys were checked and how many of them had expired
+func (kvstore *KVStore) expireSample(shard *shard, now time.Time) (int, int) {
+	kvstore.lockShard(shard)
+	defer kvstore.unlockShard(shard)
+
+	sampled, expired := 0, 0
+	for ; sampled < activeExpireKeysPerLoop && len(shard.expires.keys) > 0; sampled++ {
+		key := shard.expires.random()
+		entry, ok := shard.store[key]
+		switch {
+		case !ok:
+			// removed by a write that did not go through deleteKey
+		case entry.isExpired(now):
+			kvstore.deleteKey(key)
+			expired++
+		case entry.objectType == hashType && len(entry.hash().expires) > 0:
+			hash := entry.hash()
+			if hash.purgeExpired(now.UnixMilli()) > 0 {
+				kvstore.signalModifiedKey(key)
+				kvstore.removeIfEmptyHash(key, hash)
+				expired++
+			}
+		}
+		kvstore.updateExpires(key)
+		kvstore.updateMemory(key)
+	}
+	return sampled, expired
+}
+
+// activeExpireCycle removes keys nobody reads again after they expire.
+// Like Redis it samples rather than scanning the keyspace, and keeps
+// sampling a shard while the expired share suggests many more are
+// waiting. Shards are visited in turn, picking up where the last cycle
+// ran out of budget, and each is locked a round at a time so clients are
+// never held up for the whole budget
+func (kvstore *KVStore) activeExpireCycle(budget time.Duration) {
+	start := time.Now()
+	for range kvstore.shards {
+		shard := kvstore.shards[int(kvstore.expireCursor.Add(1))%shardCount]
+		for {
+			sampled, expired := kvstore.expireSample(shard, time.Now())
+			if time.Since(start) > budget {
+				return
+			}
+			if sampled == 0 || expired*100 <= sampled*activeExpireAcceptableStale {
+				break
+			}
+		}
+	}
+}
+
+// activeExpireLoop runs activeExpireCycle hz times a second until the
+// store is closed, hz is read each tick so CONFIG SET hz applies straight
+// away
+func (kvstore *KVStore) activeExpireLoop() {
+	for {
+		var tick time.Duration
+		kvstore.run(func() {
+			// the config only changes with every shard locked, any one
+			// will do
+			kvstore.rlockShard(kvstore.shards[0])
+			tick = time.Second / time.Duration(kvstore.config.hz)
+			kvstore.runlockShard(kvstore.shards[0])
+		})
+
+		select {
+		case <-time.After(tick):
+		case <-kvstore.closed:
+			return
+		}
+		kvstore.run(func() {
+			kvstore.activeExpireCycle(tick * activeExpireCyclePercent / 100)
+		})
+	}
+}
+
+// lazyExpireQueue collects expired keys seen by readers. Readers only
+// hold read locks, so it has a mutex of its own, and pending lets every
+// other command skip that mutex
+type lazyExpireQueue struct {
+	sync.Mutex
+	keys    map[string]struct{}
+	pending atomic.Bool
+}
+
+func newLazyExpireQueue() *lazyExpireQueue {
+	return &lazyExpireQueue{keys: make(map[string]struct{})}
+}
+
+func (queue *lazyExpireQueue) add(key string) {
+	queue.Lock()
+	queue.keys[key] = struct{}{}
+	queue.pending.Store(true)
+	queue.Unlock()
+}
+
+func (queue *lazyExpireQueue) take() []string {
+	if !queue.pending.Load() {
+		return nil
+	}
+	queue.Lock()
+	defer queue.Unlock()
+	keys := make([]string, 0, len(queue.keys))
+	for key := range queue.keys {
+		keys = append(keys, key)
+	}
+	clear(queue.keys)
+	queue.pending.Store(false)
+	return keys
+}
+
+// expireLazily removes the expired keys readers came across. Each key is
+// looked up again under its shard's write lock, as another client may
+// have replaced it since. runlockKeys calls it once the read locks are
+// released
+func (kvstore *KVStore) expireLazily() {
+	for _, key := range kvstore.lazyExpired.take() {
+		kvstore.lockKeys(key)
+		// lookupKeyWrite removes the key only if it is still expired
+		kvstore.lookupKeyWrite(key)
+		kvstore.releaseKeys([]string{key})
+	}
+}
@@ -0,0 +1,114 @@
+package store
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// expiring lists the keys in every shard's expires index
+func expiring(kvstore *KVStore) []string {
+	var keys []string
+	for _, shard := range kvstore.shards {
+		keys = append(keys, shard.expires.keys...)
+	}
+	return keys
+}
+
+// isExpiring reports whether key is in its shard's expires index
+func isExpiring(kvstore *KVStore, key string) bool {
+	_, ok := kvstore.shardFor(key).expires.positions[key]
+	return ok
+}
+
+func TestExpiresIndexTracksTTLs(t *testing.T) {
+	kvstore := newKVStore()
+	kvstore.handleSET(command("SET", "a", "1", "px", "100000"))
+	kvstore.handleSET(command("SET", "b", "1"))
+	if !isExpiring(kvstore, "a") {
+		t.Errorf("a key set with px should be in the expires index")
+	}
+	if isExpiring(kvstore, "b") {
+		t.Errorf("a key without a ttl should not be in the expires index")
+	}
+
+	kvstore.handleSET(command("SET", "a", "2"))
+	if keys := expiring(kvstore); len(keys) != 0 {
+		t.Errorf("overwriting without px should drop the ttl, index has %v", keys)
+	}
+
+	kvstore.handleHSET(command("HSET", "h", "f", "v", "g", "v"))
+	kvstore.handleHEXPIRE(command("HEXPIRE", "h", "100", "FIELDS", "1", "f"))
+	if !isExpiring(kvstore, "h") {
+		t.Errorf("a hash with field ttls should be in the expires index")
+	}
+	kvstore.handleHPERSIST(command("HPERSIST", "h", "FIELDS", "1", "f"))
+	if isExpiring(kvstore, "h") {
+		t.Errorf("a hash whose last field ttl is removed should leave the expires index")
+	}
+	kvstore.handleHEXPIRE(command("HEXPIRE", "h", "100", "FIELDS", "1", "f"))
+	kvstore.handleDEL(command("DEL", "h"))
+	for _, shard := range kvstore.shards {
+		if len(shard.expires.keys) != 0 || len(shard.expires.positions) != 0 {
+			t.Errorf("deleted keys should leave the expires index")
+		}
+	}
+}
+
+func TestActiveExpireCycle(t *testing.T) {
+	kvstore := newKVStore()
+	for i := 0; i < 1000; i++ {
+		kvstore.handleSET(command("SET", "volatile:"+strconv.Itoa(i), "v", "px", "1"))
+		kvstore.handleSET(command("SET", "persistent:"+strconv.Itoa(i), "v"))
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	// while most of each sample is expired the cycle keeps going, only the
+	// last rounds can leave a few behind
+	kvstore.activeExpireCycle(time.Second)
+	left := expiring(kvstore)
+	if len(left) > activeExpireKeysPerLoop*10 {
+		t.Errorf("expected nearly all expired keys removed, %d left", len(left))
+	}
+	if kvstore.keyCount() != 1000+len(left) {
+		t.Errorf("keys without a ttl should be kept, store has %d keys", kvstore.keyCount())
+	}
+	for _, key := range left {
+		expires := kvstore.shardFor(key).expires
+		if expires.keys[expires.positions[key]] != key {
+			t.Fatalf("positions out of step for %s", key)
+		}
+	}
+}
+
+func TestActiveExpireCycleStopsWhenFewExpired(t *testing.T) {
+	kvstore := newKVStore()
+	for i := 0; i < 1000; i++ {
+		kvstore.handleSET(command("SET", strconv.Itoa(i), "v", "px", "100000"))
+	}
+	kvstore.find("0").expiryTime = time.Now().Add(-time.Second)
+
+	sampled, _ := kvstore.expireSample(kvstore.shardFor("0"), time.Now())
+	if sampled != activeExpireKeysPerLoop {
+		t.Errorf("expected a sample of %d keys, got %d", activeExpireKeysPerLoop, sampled)
+	}
+	kvstore.activeExpireCycle(time.Second)
+	if kvstore.keyCount() < 999 {
+		t.Errorf("live keys should never be removed, %d left", kvstore.keyCount())
+	}
+}
+
+func TestActiveExpireHashFields(t *testing.T) {
+	kvstore := newKVStore()
+	kvstore.handleHSET(command("HSET", "h", "f", "v", "g", "v"))
+	kvstore.handleHEXPIRE(command("HPEXPIRE", "h", "1", "FIELDS", "2", "f", "g"))
+	time.Sleep(5 * time.Millisecond)
+
+	kvstore.activeExpireCycle(time.Second)
+	if kvstore.find("h") != nil {
+		t.Errorf("a hash whose fields all expired should be removed")
+	}
+	if keys := expiring(kvstore); len(keys) != 0 {
+		t.Errorf("expires index should be empty, has %v", keys)
+	}
+}
@@ -0,0 +1,634 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	errGeoaddSyntax     = errors.New("ERR syntax error. Try GEOADD key [x1] [y1] [name1] [x2] [y2] [name2] ... ")
+	errGeoUnit          = errors.New("ERR unsupported unit provided. please use M, KM, FT, MI")
+	errRadiusNotNumeric = errors.New("ERR need numeric radius")
+	errWidthNotNumeric  = errors.New("ERR need numeric width")
+	errHeightNotNumeric = errors.New("ERR need numeric height")
+	errNegativeRadius   = errors.New("ERR radius cannot be negative")
+	errNegativeBox      = errors.New("ERR height or width cannot be negative")
+	errCountNotPositive = errors.New("ERR COUNT must be > 0")
+	errAnyWithoutCount  = errors.New("ERR the ANY argument requires COUNT argument")
+	errUnknownGeoMember = errors.New("ERR could not decode requested zset member")
+	errStoreWithOptions = errors.New("ERR GEOSEARCHSTORE is not compatible with WITHDIST, WITHHASH and WITHCOORD options")
+)
+
+const (
+	geoSearchFromFormat     = "ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for %s"
+	geoSearchByFormat       = "ERR exactly one of BYRADIUS and BYBOX can be specified for %s"
+	invalidCoordinateFormat = "ERR invalid longitude,latitude pair %s,%s"
+)
+
+func invalidCoordinatesError(longitude float64, latitude float64) error {
+	return fmt.Errorf(invalidCoordinateFormat, strconv.FormatFloat(longitude, 'f', 6, 64), strconv.FormatFloat(latitude, 'f', 6, 64))
+}
+
+// parseCoordinates parses a longitude latitude pair, checking it can be
+// indexed
+func parseCoordinates(longitude []byte, latitude []byte) (float64, float64, error) {
+	x, err := parseFloat(longitude)
+	if err != nil {
+		return 0, 0, errNotFloat
+	}
+	y, err := parseFloat(latitude)
+	if err != nil {
+		return 0, 0, errNotFloat
+	}
+	if !validCoordinates(x, y) {
+		return 0, 0, invalidCoordinatesError(x, y)
+	}
+	return x, y, nil
+}
+
+// parseGeoUnit returns how many meters one unit is
+func parseGeoUnit(unit []byte) (float64, error) {
+	switch strings.ToLower(string(unit)) {
+	case "m":
+		return 1, nil
+	case "km":
+		return 1000, nil
+	case "ft":
+		return 0.3048, nil
+	case "mi":
+		return 1609.34, nil
+	}
+	return 0, errGeoUnit
+}
+
+func formatCoordinate(value float64) []byte {
+	formatted := strconv.AppendFloat(nil, value, 'f', 17, 64)
+	formatted = bytes.TrimRight(formatted, "0")
+	return bytes.TrimSuffix(formatted, []byte("."))
+}
+
+func formatDistance(distance float64) []byte {
+	return strconv.AppendFloat(nil, distance, 'f', 4, 64)
+}
+
+func encodeCoordinates(longitude float64, latitude float64) []byte {
+	return encodeArray([][]byte{formatCoordinate(longitude), formatCoordinate(latitude)})
+}
+
+// geoShape is the area searched by GEOSEARCH, a circle of radius or a
+// width by height box around a center. Sizes are in the request's unit,
+// conversion turns them into meters
+type geoShape struct {
+	longitude  float64
+	latitude   float64
+	box        bool
+	radius     float64
+	width      float64
+	height     float64
+	conversion float64
+}
+
+// bounds returns the smallest box of coordinates holding the shape as
+// min longitude, min latitude, max longitude, max latitude
+func (shape geoShape) bounds() (float64, float64, float64, float64) {
+	height, width := shape.radius, shape.radius
+	if shape.box {
+		height, width = shape.height/2, shape.width/2
+	}
+	height *= shape.conversion
+	width *= shape.conversion
+
+	latDelta := radiansToDegrees(height / earthRadius)
+	longDeltaTop := radiansToDegrees(width / earthRadius / math.Cos(degreesToRadians(shape.latitude+latDelta)))
+	longDeltaBottom := radiansToDegrees(width / earthRadius / math.Cos(degreesToRadians(shape.latitude-latDelta)))
+	// the widest edge is the one nearer the equator
+	longDelta := longDeltaTop
+	if shape.latitude < 0 {
+		longDelta = longDeltaBottom
+	}
+	return shape.longitude - longDelta, shape.latitude - latDelta, shape.longitude + longDelta, shape.latitude + latDelta
+}
+
+// contains returns the distance in meters from the center to a point,
+// ok is false when the point is outside the shape
+func (shape geoShape) contains(longitude float64, latitude float64) (float64, bool) {
+	if !shape.box {
+		distance := geoDistance(shape.longitude, shape.latitude, longitude, latitude)
+		return distance, distance <= shape.radius*shape.conversion
+	}
+	// the latitude distance is the cheaper one so it goes first
+	if latitudeDistance(latitude, shape.latitude) > shape.height*shape.conversion/2 {
+		return 0, false
+	}
+	if geoDistance(longitude, latitude, shape.longitude, latitude) > shape.width*shape.conversion/2 {
+		return 0, false
+	}
+	return geoDistance(shape.longitude, shape.latitude, longitude, latitude), true
+}
+
+// areas returns the cells to scan to find every member in the shape, a
+// cell at the estimated step around the center and its neighbors minus
+// the ones outside the bounding box
+func (shape geoShape) areas() []geohash {
+	minLong, minLat, maxLong, maxLat := shape.bounds()
+	radius := shape.radius
+	if shape.box {
+		radius = math.Sqrt(shape.width/2*shape.width/2 + shape.height/2*shape.height/2)
+	}
+	steps := estimateSteps(radius*shape.conversion, shape.latitude)
+
+	hash, _ := geohashEncode(geoLongRange, geoLatRange, shape.longitude, shape.latitude, steps)
+	neighbors := neighborsOf(hash)
+	area := geohashDecode(geoLongRange, geoLatRange, hash)
+
+	// near the edge of a cell the neighbors may not reach far enough, go
+	// a step coarser when they don't
+	north := geohashDecode(geoLongRange, geoLatRange, neighbors.north)
+	south := geohashDecode(geoLongRange, geoLatRange, neighbors.south)
+	east := geohashDecode(geoLongRange, geoLatRange, neighbors.east)
+	west := geohashDecode(geoLongRange, geoLatRange, neighbors.west)
+	decrease := north.latitude.max < maxLat || south.latitude.min > minLat || east.longitude.max < maxLong || west.longitude.min > minLong
+	if steps > 1 && decrease {
+		steps--
+		hash, _ = geohashEncode(geoLongRange, geoLatRange, shape.longitude, shape.latitude, steps)
+		neighbors = neighborsOf(hash)
+		area = geohashDecode(geoLongRange, geoLatRange, hash)
+	}
+
+	if steps >= 2 {
+		if area.latitude.min < minLat {
+			neighbors.south, neighbors.southWest, neighbors.southEast = geohash{}, geohash{}, geohash{}
+		}
+		if area.latitude.max > maxLat {
+			neighbors.north, neighbors.northEast, neighbors.northWest = geohash{}, geohash{}, geohash{}
+		}
+		if area.longitude.min < minLong {
+			neighbors.west, neighbors.southWest, neighbors.northWest = geohash{}, geohash{}, geohash{}
+		}
+		if area.longitude.max > maxLong {
+			neighbors.east, neighbors.southEast, neighbors.northEast = geohash{}, geohash{}, geohash{}
+		}
+	}
+	return neighbors.all()
+}
+
+// geoPoint is a member found by a search
+type geoPoint struct {
+	member    string
+	score     float64
+	distance  float64
+	longitude float64
+	latitude  float64
+}
+
+// search returns the members of zset inside shape, stopping once limit
+// are found when limit is positive. Distances are in the shape's unit
+func (zset *zsetValue) search(shape geoShape, limit int) []geoPoint {
+	var points []geoPoint
+	cells := shape.areas()
+	last := 0
+	for i, cell := range cells {
+		if cell.isZero() {
+			continue
+		}
+		// very large areas can have the same cell as several neighbors
+		if last > 0 && cell == cells[last] {
+			continue
+		}
+		if limit > 0 && len(points) >= limit {
+			break
+		}
+		last = i
+
+		shift := 52 - cell.step*2
+		r := scoreRange{
+			min:          float64(cell.bits << shift),
+			max:          float64((cell.bits + 1) << shift),
+			maxExclusive: true,
+		}
+		for node := zset.list.first(r.aboveMin, r.belowMax); node != nil && r.belowMax(node); node = node.levels[0].forward {
+			longitude, latitude := geoDecodeScore(node.score)
+			distance, ok := shape.contains(longitude, latitude)
+			if !ok {
+				continue
+			}
+			points = append(points, geoPoint{
+				member:    node.member,
+				score:     node.score,
+				distance:  distance / shape.conversion,
+				longitude: longitude,
+				latitude:  latitude,
+			})
+			if limit > 0 && len(points) >= limit {
+				break
+			}
+		}
+	}
+	return points
+}
+
+func (kvstore *KVStore) handleGEOADD(messages [][]byte) []byte {
+	if len(messages) < 5 {
+		return wrongArgumentsError("geoadd")
+	}
+
+	var flags zaddFlags
+	position := 2
+flagLoop:
+	for ; position < len(messages); position++ {
+		switch strings.ToUpper(string(messages[position])) {
+		case "NX":
+			flags.nx = true
+		case "XX":
+			flags.xx = true
+		case "CH":
+			flags.ch = true
+		default:
+			break flagLoop
+		}
+	}
+	triples := messages[position:]
+	if len(triples) == 0 || len(triples)%3 != 0 {
+		return encodeError(errGeoaddSyntax)
+	}
+	if flags.nx && flags.xx {
+		return encodeError(errXXAndNX)
+	}
+
+	scores := make([]float64, len(triples)/3)
+	for i := range scores {
+		longitude, latitude, err := parseCoordinates(triples[i*3], triples[i*3+1])
+		if err != nil {
+			return encodeError(err)
+		}
+		scores[i], _ = geoScore(longitude, latitude)
+	}
+
+	key := string(messages[1])
+	kvstore.lockKeys(key)
+	defer kvstore.unlockKeys(key)
+
+	entry, err := kvstore.lookupOrCreateZset(key)
+	if err != nil {
+		return encodeError(err)
+	}
+	zset := entry.zset()
+
+	added, changed := 0, 0
+	for i, score := range scores {
+		_, isNew, isUpdated, _, _ := zset.add(score, string(triples[i*3+2]), flags)
+		if isNew {
+			added++
+		}
+		if isUpdated {
+			changed++
+		}
+	}
+	kvstore.removeIfEmptyZset(key, zset)
+	if added > 0 {
+		kvstore.signalKeyAsReady(key)
+	}
+
+	if flags.ch {
+		return encodeInteger(int64(added + changed))
+	}
+	return encodeInteger(int64(added))
+}
+
+// lookupGeoZset returns the sorted set at key for reading, nil if missing
+func (kvstore *KVStore) lookupGeoZset(key string) (*zsetValue, error) {
+	entry, err := kvstore.lookupTypedRead(key, zsetType)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	return entry.zset(), nil
+}
+
+func (kvstore *KVStore) handleGEODIST(messages [][]byte) []byte {
+	if len(messages) != 4 && len(messages) != 5 {
+		return wrongArgumentsError("geodist")
+	}
+	conversion := 1.0
+	if len(messages) == 5 {
+		var err error
+		if conversion, err = parseGeoUnit(messages[4]); err != nil {
+			return encodeError(err)
+		}
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	zset, err := kvstore.lookupGeoZset(string(messages[1]))
+	if err != nil {
+		return encodeError(err)
+	}
+	if zset == nil {
+		return nullBulkReply
+	}
+	first, ok := zset.score(string(messages[2]))
+	if !ok {
+		return nullBulkReply
+	}
+	second, ok := zset.score(string(messages[3]))
+	if !ok {
+		return nullBulkReply
+	}
+	long1, lat1 := geoDecodeScore(first)
+	long2, lat2 := geoDecodeScore(second)
+	return encodeBulkString(formatDistance(geoDistance(long1, lat1, long2, lat2) / conversion))
+}
+
+func (kvstore *KVStore) handleGEOPOS(messages [][]byte) []byte {
+	if len(messages) < 2 {
+		return wrongArgumentsError("geopos")
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	zset, err := kvstore.lookupGeoZset(string(messages[1]))
+	if err != nil {
+		return encodeError(err)
+	}
+	items := make([][]byte, 0, len(messages)-2)
+	for _, member := range messages[2:] {
+		score, ok := 0.0, false
+		if zset != nil {
+			score, ok = zset.score(string(member))
+		}
+		if !ok {
+			items = append(items, nullArrayReply)
+			continue
+		}
+		items = append(items, encodeCoordinates(geoDecodeScore(score)))
+	}
+	return encodeRawArray(items)
+}
+
+func (kvstore *KVStore) handleGEOHASH(messages [][]byte) []byte {
+	if len(messages) < 2 {
+		return wrongArgumentsError("geohash")
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	zset, err := kvstore.lookupGeoZset(string(messages[1]))
+	if err != nil {
+		return encodeError(err)
+	}
+	items := make([][]byte, 0, len(messages)-2)
+	for _, member := range messages[2:] {
+		score, ok := 0.0, false
+		if zset != nil {
+			score, ok = zset.score(string(member))
+		}
+		if !ok {
+			items = append(items, nullBulkReply)
+			continue
+		}
+		items = append(items, encodeBulkString(geohashString(score)))
+	}
+	return encodeRawArray(items)
+}
+
+type geoSearchRequest struct {
+	shape      geoShape
+	fromMember []byte
+	sortOrder  int
+	count      int
+	any        bool
+	withDist   bool
+	withHash   bool
+	withCoord  bool
+	storeDist  bool
+}
+
+const (
+	geoSortNone = iota
+	geoSortAsc
+	geoSortDesc
+)
+
+func parseGeoSearch(command string, arguments [][]byte, store bool) (geoSearchRequest, error) {
+	var request geoSearchRequest
+	fromLonLat, byRadius, byBox := false, false, false
+	for i := 0; i < len(arguments); i++ {
+		remaining := len(arguments) - i - 1
+		switch option := strings.ToUpper(string(arguments[i])); {
+		case option == "WITHDIST":
+			request.withDist = true
+		case option == "WITHHASH":
+			request.withHash = true
+		case option == "WITHCOORD":
+			request.withCoord = true
+		case option == "ANY":
+			request.any = true
+		case option == "ASC":
+			request.sortOrder = geoSortAsc
+		case option == "DESC":
+			request.sortOrder = geoSortDesc
+		case option == "STOREDIST" && store:
+			request.storeDist = true
+		case option == "COUNT" && remaining >= 1:
+			count, err := strconv.Atoi(string(arguments[i+1]))
+			if err != nil {
+				return request, errNotInteger
+			}
+			if count <= 0 {
+				return request, errCountNotPositive
+			}
+			request.count = count
+			i++
+		case option == "FROMMEMBER" && remaining >= 1:
+			if request.fromMember != nil || fromLonLat {
+				return request, errSyntax
+			}
+			request.fromMember = arguments[i+1]
+			i++
+		case option == "FROMLONLAT" && remaining >= 2:
+			if request.fromMember != nil || fromLonLat {
+				return request, errSyntax
+			}
+			longitude, latitude, err := parseCoordinates(arguments[i+1], arguments[i+2])
+			if err != nil {
+				return request, err
+			}
+			request.shape.longitude, request.shape.latitude = longitude, latitude
+			fromLonLat = true
+			i += 2
+		case option == "BYRADIUS" && remaining >= 2:
+			if byRadius || byBox {
+				return request, errSyntax
+			}
+			radius, err := parseFloat(arguments[i+1])
+			if err != nil {
+				return request, errRadiusNotNumeric
+			}
+			if radius < 0 {
+				return request, errNegativeRadius
+			}
+			if request.shape.conversion, err = parseGeoUnit(arguments[i+2]); err != nil {
+				return request, err
+			}
+			request.shape.radius = radius
+			byRadius = true
+			i += 2
+		case option == "BYBOX" && remaining >= 3:
+			if byRadius || byBox {
+				return request, errSyntax
+			}
+			width, err := parseFloat(arguments[i+1])
+			if err != nil {
+				return request, errWidthNotNumeric
+			}
+			height, err := parseFloat(arguments[i+2])
+			if err != nil {
+				return request, errHeightNotNumeric
+			}
+			if width < 0 || height < 0 {
+				return request, errNegativeBox
+			}
+			if request.shape.conversion, err = parseGeoUnit(arguments[i+3]); err != nil {
+				return request, err
+			}
+			request.shape.box = true
+			request.shape.width, request.shape.height = width, height
+			byBox = true
+			i += 3
+		default:
+			return request, errSyntax
+		}
+	}
+
+	if store && (request.withDist || request.withHash || request.withCoord) {
+		return request, errStoreWithOptions
+	}
+	if request.fromMember == nil && !fromLonLat {
+		return request, fmt.Errorf(geoSearchFromFormat, command)
+	}
+	if !byRadius && !byBox {
+		return request, fmt.Errorf(geoSearchByFormat, command)
+	}
+	if request.any && request.count == 0 {
+		return request, errAnyWithoutCount
+	}
+	// the closest N only makes sense sorted, ANY takes whatever is found
+	if request.count > 0 && request.sortOrder == geoSortNone && !request.any {
+		request.sortOrder = geoSortAsc
+	}
+	return request, nil
+}
+
+// geoSearch runs request against zset. Caller must hold a lock
+func (zset *zsetValue) geoSearch(request geoSearchRequest) ([]geoPoint, error) {
+	shape := request.shape
+	if request.fromMember != nil {
+		score, ok := zset.score(string(request.fromMember))
+		if !ok {
+			return nil, errUnknownGeoMember
+		}
+		shape.longitude, shape.latitude = geoDecodeScore(score)
+	}
+
+	limit := 0
+	if request.any {
+		limit = request.count
+	}
+	points := zset.search(shape, limit)
+	switch request.sortOrder {
+	case geoSortAsc:
+		sort.Slice(points, func(i, j int) bool { return points[i].distance < points[j].distance })
+	case geoSortDesc:
+		sort.Slice(points, func(i, j int) bool { return points[i].distance > points[j].distance })
+	}
+	if request.count > 0 && len(points) > request.count {
+		points = points[:request.count]
+	}
+	return points, nil
+}
+
+func (kvstore *KVStore) handleGEOSEARCH(messages [][]byte) []byte {
+	if len(messages) < 7 {
+		return wrongArgumentsError("geosearch")
+	}
+	request, err := parseGeoSearch("geosearch", messages[2:], false)
+	if err != nil {
+		return encodeError(err)
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	zset, err := kvstore.lookupGeoZset(string(messages[1]))
+	if err != nil {
+		return encodeError(err)
+	}
+	if zset == nil {
+		return encodeArray(nil)
+	}
+	points, err := zset.geoSearch(request)
+	if err != nil {
+		return encodeError(err)
+	}
+
+	items := make([][]byte, 0, len(points))
+	for _, point := range points {
+		if !request.withDist && !request.withHash && !request.withCoord {
+			items = append(items, encodeBulkString([]byte(point.member)))
+			continue
+		}
+		fields := [][]byte{encodeBulkString([]byte(point.member))}
+		if request.withDist {
+			fields = append(fields, encodeBulkString(formatDistance(point.distance)))
+		}
+		if request.withHash {
+			fields = append(fields, encodeInteger(int64(point.score)))
+		}
+		if request.withCoord {
+			fields = append(fields, encodeCoordinates(point.longitude, point.latitude))
+		}
+		items = append(items, encodeRawArray(fields))
+	}
+	return encodeRawArray(items)
+}
+
+func (kvstore *KVStore) handleGEOSEARCHSTORE(messages [][]byte) []byte {
+	if len(messages) < 8 {
+		return wrongArgumentsError("geosearchstore")
+	}
+	request, err := parseGeoSearch("geosearchstore", messages[3:], true)
+	if err != nil {
+		return encodeError(err)
+	}
+
+	keys := []string{string(messages[1]), string(messages[2])}
+	kvstore.lockKeys(keys...)
+	defer kvstore.unlockKeys(keys...)
+
+	zset, err := kvstore.lookupGeoZset(string(messages[2]))
+	if err != nil {
+		return encodeError(err)
+	}
+	result := newZsetValue()
+	if zset != nil {
+		points, err := zset.geoSearch(request)
+		if err != nil {
+			return encodeError(err)
+		}
+		for _, point := range points {
+			score := point.score
+			if request.storeDist {
+				score = point.distance
+			}
+			result.set(score, point.member)
+		}
+	}
+	return encodeInteger(int64(kvstore.storeZset(string(messages[1]), result)))
+}
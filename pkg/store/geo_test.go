@@ -0,0 +1,93 @@
+package store
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+// the expected replies come from the examples in the redis documentation
+func TestGeoSicily(t *testing.T) {
+	kvstore := newKVStore()
+	kvstore.handleGEOADD(command("GEOADD", "Sicily", "13.361389", "38.115556", "Palermo", "15.087269", "37.502669", "Catania"))
+
+	cases := []struct {
+		handler   func([][]byte) []byte
+		arguments []string
+		expected  string
+	}{
+		{kvstore.handleGEODIST, []string{"GEODIST", "Sicily", "Palermo", "Catania"}, "$11\r\n166274.1516\r\n"},
+		{kvstore.handleGEODIST, []string{"GEODIST", "Sicily", "Palermo", "Catania", "mi"}, "$8\r\n103.3182\r\n"},
+		{kvstore.handleGEODIST, []string{"GEODIST", "Sicily", "Foo", "Bar"}, "$-1\r\n"},
+		{kvstore.handleGEOHASH, []string{"GEOHASH", "Sicily", "Palermo", "Catania"}, "*2\r\n$11\r\nsqc8b49rny0\r\n$11\r\nsqdtr74hyu0\r\n"},
+		{kvstore.handleGEOPOS, []string{"GEOPOS", "Sicily", "Palermo", "NonExisting"}, "*2\r\n*2\r\n$20\r\n13.36138933897018433\r\n$20\r\n38.11555639549629859\r\n*-1\r\n"},
+		{kvstore.handleGEOSEARCH, []string{"GEOSEARCH", "Sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "ASC"}, "*2\r\n$7\r\nCatania\r\n$7\r\nPalermo\r\n"},
+		{kvstore.handleGEOSEARCH, []string{"GEOSEARCH", "Sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "100", "km", "WITHDIST", "WITHHASH"}, "*1\r\n*3\r\n$7\r\nCatania\r\n$7\r\n56.4413\r\n:3479447370796909\r\n"},
+		{kvstore.handleGEOSEARCH, []string{"GEOSEARCH", "Sicily", "FROMMEMBER", "Palermo", "BYBOX", "400", "400", "km", "DESC", "COUNT", "1"}, "*1\r\n$7\r\nCatania\r\n"},
+		{kvstore.handleGEOSEARCH, []string{"GEOSEARCH", "Sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "ANY"}, string(encodeError(errAnyWithoutCount))},
+		{kvstore.handleGEOSEARCH, []string{"GEOSEARCH", "Sicily", "FROMLONLAT", "15", "37", "COUNT", "1"}, "-ERR exactly one of BYRADIUS and BYBOX can be specified for geosearch\r\n"},
+		{kvstore.handleGEOADD, []string{"GEOADD", "Sicily", "0", "86", "north"}, "-ERR invalid longitude,latitude pair 0.000000,86.000000\r\n"},
+		{kvstore.handleGEOADD, []string{"GEOADD", "Sicily", "XX", "CH", "13.361389", "38.115556", "Palermo", "1", "1", "new"}, ":0\r\n"},
+	}
+	for _, tc := range cases {
+		if reply := tc.handler(command(tc.arguments...)); string(reply) != tc.expected {
+			t.Errorf("%v expected %q, got %q", tc.arguments, tc.expected, reply)
+		}
+	}
+
+	reply := kvstore.handleGEOSEARCHSTORE(command("GEOSEARCHSTORE", "near", "Sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "STOREDIST"))
+	if string(reply) != ":2\r\n" {
+		t.Fatalf("expected 2 stored, got %q", reply)
+	}
+	if score, _ := kvstore.find("near").zset().score("Catania"); string(formatDistance(score)) != "56.4413" {
+		t.Errorf("STOREDIST should store the distance, got %v", score)
+	}
+}
+
+// TestGeoSearchMatchesScan checks the cells searched around the center
+// never miss a member, against measuring the distance to every member
+func TestGeoSearchMatchesScan(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	zset := newZsetValue()
+	for i := 0; i < 2000; i++ {
+		longitude := random.Float64()*20 - 10
+		latitude := random.Float64()*20 + 40
+		score, _ := geoScore(longitude, latitude)
+		zset.set(score, strconv.Itoa(i))
+	}
+
+	for i := 0; i < 50; i++ {
+		shape := geoShape{
+			longitude:  random.Float64()*20 - 10,
+			latitude:   random.Float64()*20 + 40,
+			conversion: 1000,
+		}
+		if i%2 == 0 {
+			shape.radius = random.Float64() * 500
+		} else {
+			shape.box = true
+			shape.width, shape.height = random.Float64()*800, random.Float64()*800
+		}
+
+		var found, expected []string
+		for _, point := range zset.search(shape, 0) {
+			found = append(found, point.member)
+		}
+		for member, score := range zset.dict {
+			if _, ok := shape.contains(geoDecodeScore(score)); ok {
+				expected = append(expected, member)
+			}
+		}
+		sort.Strings(found)
+		sort.Strings(expected)
+		if len(found) != len(expected) {
+			t.Fatalf("shape %+v found %d members, expected %d", shape, len(found), len(expected))
+		}
+		for j := range found {
+			if found[j] != expected[j] {
+				t.Fatalf("shape %+v found %s, expected %s", shape, found[j], expected[j])
+			}
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package store
+
+import "math"
+
+// Geo members are stored in sorted sets with their position interleaved
+// into a 52 bit geohash used as the score, so members close to each other
+// sort close to each other and an area is a handful of score ranges. The
+// encoding matches redis, latitudes are limited to what web mercator can
+// project
+const (
+	geoStepMax      = 26
+	geoLatMin       = -85.05112878
+	geoLatMax       = 85.05112878
+	geoLongMin      = -180.0
+	geoLongMax      = 180.0
+	earthRadius     = 6372797.560856
+	mercatorMax     = 20037726.37
+	geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+)
+
+type geoRange struct {
+	min float64
+	max float64
+}
+
+var (
+	geoLongRange = geoRange{geoLongMin, geoLongMax}
+	geoLatRange  = geoRange{geoLatMin, geoLatMax}
+)
+
+// geohash is the interleaved bits of a position, latitude in the even
+// bits and longitude in the odd ones, at step bits per coordinate
+type geohash struct {
+	bits uint64
+	step uint
+}
+
+func (hash geohash) isZero() bool {
+	return hash.bits == 0 && hash.step == 0
+}
+
+// area is the box of coordinates the hash stands for
+type geohashArea struct {
+	hash      geohash
+	longitude geoRange
+	latitude  geoRange
+}
+
+func interleave(x uint32, y uint32) uint64 {
+	var result uint64
+	for i := uint(0); i < 32; i++ {
+		result |= uint64(x>>i&1) << (2 * i)
+		result |= uint64(y>>i&1) << (2*i + 1)
+	}
+	return result
+}
+
+func deinterleave(interleaved uint64) (uint32, uint32) {
+	var x, y uint32
+	for i := uint(0); i < 32; i++ {
+		x |= uint32(interleaved>>(2*i)&1) << i
+		y |= uint32(interleaved>>(2*i+1)&1) << i
+	}
+	return x, y
+}
+
+func validCoordinates(longitude float64, latitude float64) bool {
+	return longitude >= geoLongMin && longitude <= geoLongMax && latitude >= geoLatMin && latitude <= geoLatMax
+}
+
+func geohashEncode(longRange geoRange, latRange geoRange, longitude float64, latitude float64, step uint) (geohash, bool) {
+	if !validCoordinates(longitude, latitude) {
+		return geohash{}, false
+	}
+	if latitude < latRange.min || latitude > latRange.max || longitude < longRange.min || longitude > longRange.max {
+		return geohash{}, false
+	}
+	latOffset := (latitude - latRange.min) / (latRange.max - latRange.min)
+	longOffset := (longitude - longRange.min) / (longRange.max - longRange.min)
+	latOffset *= float64(uint64(1) << step)
+	longOffset *= float64(uint64(1) << step)
+	return geohash{bits: interleave(uint32(latOffset), uint32(longOffset)), step: step}, true
+}
+
+func geohashDecode(longRange geoRange, latRange geoRange, hash geohash) geohashArea {
+	latBits, longBits := deinterleave(hash.bits)
+	cells := float64(uint64(1) << hash.step)
+	latScale := latRange.max - latRange.min
+	longScale := longRange.max - longRange.min
+	return geohashArea{
+		hash: hash,
+		latitude: geoRange{
+			min: latRange.min + float64(latBits)/cells*latScale,
+			max: latRange.min + float64(latBits+1)/cells*latScale,
+		},
+		longitude: geoRange{
+			min: longRange.min + float64(longBits)/cells*longScale,
+			max: longRange.min + float64(longBits+1)/cells*longScale,
+		},
+	}
+}
+
+// center returns the middle of the area, clamped to the valid coordinates
+func (area geohashArea) center() (float64, float64) {
+	longitude := min(max((area.longitude.min+area.longitude.max)/2, geoLongMin), geoLongMax)
+	latitude := min(max((area.latitude.min+area.latitude.max)/2, geoLatMin), geoLatMax)
+	return longitude, latitude
+}
+
+// geoScore returns the score a member at longitude, latitude is stored with
+func geoScore(longitude float64, latitude float64) (float64, bool) {
+	hash, ok := geohashEncode(geoLongRange, geoLatRange, longitude, latitude, geoStepMax)
+	return float64(hash.bits), ok
+}
+
+// geoDecodeScore returns the longitude and latitude a score stands for,
+// the center of its cell
+func geoDecodeScore(score float64) (float64, float64) {
+	return geohashDecode(geoLongRange, geoLatRange, geohash{bits: uint64(score), step: geoStepMax}).center()
+}
+
+// geohashString re-encodes the position of score against the standard
+// -90,90 latitude range as the usual 11 character geohash, the 11th is
+// always 0 since there are only 52 bits
+func geohashString(score float64) []byte {
+	longitude, latitude := geoDecodeScore(score)
+	hash, _ := geohashEncode(geoRange{-180, 180}, geoRange{-90, 90}, longitude, latitude, geoStepMax)
+	result := make([]byte, 11)
+	for i := range result {
+		index := 0
+		if i < 10 {
+			index = int(hash.bits >> (52 - (i+1)*5) & 0x1f)
+		}
+		result[i] = geohashAlphabet[index]
+	}
+	return result
+}
+
+func (hash geohash) moveX(direction int) geohash {
+	x := hash.bits & 0xaaaaaaaaaaaaaaaa
+	y := hash.bits & 0x5555555555555555
+	zz := uint64(0x5555555555555555) >> (64 - hash.step*2)
+	if direction > 0 {
+		x += zz + 1
+	} else {
+		x |= zz
+		x -= zz + 1
+	}
+	x &= uint64(0xaaaaaaaaaaaaaaaa) >> (64 - hash.step*2)
+	return geohash{bits: x | y, step: hash.step}
+}
+
+func (hash geohash) moveY(direction int) geohash {
+	x := hash.bits & 0xaaaaaaaaaaaaaaaa
+	y := hash.bits & 0x5555555555555555
+	zz := uint64(0xaaaaaaaaaaaaaaaa) >> (64 - hash.step*2)
+	if direction > 0 {
+		y += zz + 1
+	} else {
+		y |= zz
+		y -= zz + 1
+	}
+	y &= uint64(0x5555555555555555) >> (64 - hash.step*2)
+	return geohash{bits: x | y, step: hash.step}
+}
+
+// geohashNeighbors holds a cell and the eight around it, in the order
+// they are searched
+type geohashNeighbors struct {
+	center    geohash
+	north     geohash
+	south     geohash
+	east      geohash
+	west      geohash
+	northEast geohash
+	northWest geohash
+	southEast geohash
+	southWest geohash
+}
+
+func neighborsOf(hash geohash) geohashNeighbors {
+	return geohashNeighbors{
+		center:    hash,
+		north:     hash.moveY(1),
+		south:     hash.moveY(-1),
+		east:      hash.moveX(1),
+		west:      hash.moveX(-1),
+		northEast: hash.moveX(1).moveY(1),
+		northWest: hash.moveX(-1).moveY(1),
+		southEast: hash.moveX(1).moveY(-1),
+		southWest: hash.moveX(-1).moveY(-1),
+	}
+}
+
+func (neighbors geohashNeighbors) all() []geohash {
+	return []geohash{
+		neighbors.center, neighbors.north, neighbors.south, neighbors.east, neighbors.west,
+		neighbors.northEast, neighbors.northWest, neighbors.southEast, neighbors.southWest,
+	}
+}
+
+func degreesToRadians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
+
+func radiansToDegrees(radians float64) float64 {
+	return radians * 180 / math.Pi
+}
+
+func latitudeDistance(lat1 float64, lat2 float64) float64 {
+	return earthRadius * math.Abs(degreesToRadians(lat2)-degreesToRadians(lat1))
+}
+
+// geoDistance is the haversine distance in meters between two points
+func geoDistance(long1 float64, lat1 float64, long2 float64, lat2 float64) float64 {
+	v := math.Sin((degreesToRadians(long2) - degreesToRadians(long1)) / 2)
+	// on the same meridian only the latitudes matter
+	if v == 0 {
+		return latitudeDistance(lat1, lat2)
+	}
+	lat1r, lat2r := degreesToRadians(lat1), degreesToRadians(lat2)
+	u := math.Sin((lat2r - lat1r) / 2)
+	a := u*u + math.Cos(lat1r)*math.Cos(lat2r)*v*v
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+// estimateSteps picks the coarsest step whose cells still cover
+// rangeMeters, cells get narrower towards the poles so it goes one or two
+// steps coarser there
+func estimateSteps(rangeMeters float64, latitude float64) uint {
+	if rangeMeters == 0 {
+		return geoStepMax
+	}
+	step := 1
+	for rangeMeters < mercatorMax {
+		rangeMeters *= 2
+		step++
+	}
+	step -= 2
+	if latitude > 66 || latitude < -66 {
+		step--
+		if latitude > 80 || latitude < -80 {
+			step--
+		}
+	}
+	return uint(min(max(step, 1), geoStepMax))
+}
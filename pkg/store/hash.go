@@ -0,0 +1,648 @@
+package store
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errHashNotInteger = errors.New("ERR hash value is not an integer")
+	errHashNotFloat   = errors.New("ERR hash value is not a float")
+	// a negative count can't be negated when it is the smallest int64
+	errCountOutRange = errors.New("ERR value is out of range")
+)
+
+type hashPair struct {
+	field string
+	value []byte
+}
+
+// hashValue starts out as a flat slice of pairs searched linearly, which
+// for a handful of fields is smaller and faster than a map. Once the
+// hash-max-listpack-* limits are passed it is converted to a map for good
+type hashValue struct {
+	pairs []hashPair
+	dict  map[string][]byte
+	// the dict's fields bucketed for HSCAN, nil with pairs
+	index *scanIndex
+	// per field expiry as unix milliseconds, nil until a field gets a ttl.
+	// Expired fields are invisible to every method and physically removed
+	// by purgeExpired or when they are next written
+	expires map[string]int64
+}
+
+func newHashValue() *hashValue {
+	return &hashValue{}
+}
+
+func (hash *hashValue) isListpack() bool {
+	return hash.dict == nil
+}
+
+func (hash *hashValue) Len() int {
+	length := len(hash.dict)
+	if hash.isListpack() {
+		length = len(hash.pairs)
+	}
+	if len(hash.expires) > 0 {
+		now := time.Now().UnixMilli()
+		for _, expiry := range hash.expires {
+			if expiry <= now {
+				length--
+			}
+		}
+	}
+	return length
+}
+
+func (hash *hashValue) isFieldExpired(field string, now int64) bool {
+	expiry, ok := hash.expires[field]
+	return ok && expiry <= now
+}
+
+func (hash *hashValue) get(field string) ([]byte, bool) {
+	if len(hash.expires) > 0 && hash.isFieldExpired(field, time.Now().UnixMilli()) {
+		return nil, false
+	}
+	return hash.getRaw(field)
+}
+
+// getRaw looks field up without checking its ttl
+func (hash *hashValue) getRaw(field string) ([]byte, bool) {
+	if hash.isListpack() {
+		for _, pair := range hash.pairs {
+			if pair.field == field {
+				return pair.value, true
+			}
+		}
+		return nil, false
+	}
+	value, ok := hash.dict[field]
+	return value, ok
+}
+
+// set returns true if field is new. Like redis, overwriting a field clears its ttl
+func (hash *hashValue) set(field string, value []byte) bool {
+	if len(hash.expires) > 0 {
+		if hash.isFieldExpired(field, time.Now().UnixMilli()) {
+			hash.delete(field)
+		}
+		delete(hash.expires, field)
+	}
+	if hash.isListpack() {
+		for i := range hash.pairs {
+			if hash.pairs[i].field == field {
+				hash.pairs[i].value = value
+				return false
+			}
+		}
+		hash.pairs = append(hash.pairs, hashPair{field, value})
+		return true
+	}
+	_, exists := hash.dict[field]
+	hash.dict[field] = value
+	if !exists {
+		hash.index.add(field)
+	}
+	return !exists
+}
+
+// delete returns true if a live field was removed
+func (hash *hashValue) delete(field string) bool {
+	if len(hash.expires) > 0 {
+		expired := hash.isFieldExpired(field, time.Now().UnixMilli())
+		delete(hash.expires, field)
+		if expired {
+			hash.deleteRaw(field)
+			return false
+		}
+	}
+	return hash.deleteRaw(field)
+}
+
+func (hash *hashValue) deleteRaw(field string) bool {
+	if hash.isListpack() {
+		for i := range hash.pairs {
+			if hash.pairs[i].field == field {
+				hash.pairs = append(hash.pairs[:i], hash.pairs[i+1:]...)
+				return true
+			}
+		}
+		return false
+	}
+	if _, ok := hash.dict[field]; !ok {
+		return false
+	}
+	delete(hash.dict, field)
+	hash.index.remove(field)
+	return true
+}
+
+// forEach visits every live field until visit returns false
+func (hash *hashValue) forEach(visit func(field string, value []byte) bool) {
+	now := time.Now().UnixMilli()
+	if hash.isListpack() {
+		for _, pair := range hash.pairs {
+			if hash.isFieldExpired(pair.field, now) {
+				continue
+			}
+			if !visit(pair.field, pair.value) {
+				return
+			}
+		}
+		return
+	}
+	for field, value := range hash.dict {
+		if hash.isFieldExpired(field, now) {
+			continue
+		}
+		if !visit(field, value) {
+			return
+		}
+	}
+}
+
+// purgeExpired physically removes fields whose ttl has passed
+func (hash *hashValue) purgeExpired(now int64) int {
+	removed := 0
+	for field, expiry := range hash.expires {
+		if expiry <= now {
+			delete(hash.expires, field)
+			hash.deleteRaw(field)
+			removed++
+		}
+	}
+	return removed
+}
+
+func (hash *hashValue) convertToDict() {
+	hash.dict = make(map[string][]byte, len(hash.pairs))
+	hash.index = newScanIndex()
+	for _, pair := range hash.pairs {
+		hash.dict[pair.field] = pair.value
+		hash.index.add(pair.field)
+	}
+	hash.pairs = nil
+}
+
+func (entry *Entry) hash() *hashValue {
+	return entry.value.(*hashValue)
+}
+
+// hashSet sets field on the hash held by entry, converting it to a map when
+// the field, value or number of fields gets too big for the listpack encoding
+func (entry *Entry) hashSet(field string, value []byte, config *Config) bool {
+	hash := entry.hash()
+	if hash.isListpack() {
+		_, exists := hash.get(field)
+		tooMany := !exists && int64(hash.Len()+1) > config.hashMaxListpackEntries
+		if tooMany || int64(len(field)) > config.hashMaxListpackValue || int64(len(value)) > config.hashMaxListpackValue {
+			hash.convertToDict()
+			entry.encoding = encodingHashtable
+		}
+	}
+	return hash.set(field, value)
+}
+
+// lookupOrCreateHash returns the entry for the hash at key, creating an
+// empty one if needed. Caller must hold the write lock
+func (kvstore *KVStore) lookupOrCreateHash(key string) (*Entry, error) {
+	entry, err := kvstore.lookupTypedWrite(key, hashType)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		entry = newHashEntry()
+		kvstore.setKey(key, entry)
+	}
+	return entry, nil
+}
+
+func newHashEntry() *Entry {
+	entry := newEntry()
+	entry.objectType = hashType
+	entry.encoding = encodingListpack
+	entry.value = newHashValue()
+	return entry
+}
+
+func (kvstore *KVStore) removeIfEmptyHash(key string, hash *hashValue) {
+	if hash.Len() == 0 {
+		kvstore.deleteKey(key)
+	}
+}
+
+func (kvstore *KVStore) handleHSET(messages [][]byte) []byte {
+	if len(messages) < 4 || len(messages)%2 != 0 {
+		return wrongArgumentsError(string(messages[0]))
+	}
+
+	kvstore.lockKeys(string(messages[1]))
+	defer kvstore.unlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupOrCreateHash(string(messages[1]))
+	if err != nil {
+		return encodeError(err)
+	}
+	created := 0
+	for i := 2; i < len(messages); i += 2 {
+		if entry.hashSet(string(messages[i]), messages[i+1], &kvstore.config) {
+			created++
+		}
+	}
+	kvstore.signalModifiedKey(string(messages[1]))
+
+	if strings.ToUpper(string(messages[0])) == "HMSET" {
+		return okReply
+	}
+	return encodeInteger(int64(created))
+}
+
+func (kvstore *KVStore) handleHSETNX(messages [][]byte) []byte {
+	if len(messages) != 4 {
+		return wrongArgumentsError("hsetnx")
+	}
+
+	kvstore.lockKeys(string(messages[1]))
+	defer kvstore.unlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupOrCreateHash(string(messages[1]))
+	if err != nil {
+		return encodeError(err)
+	}
+	field := string(messages[2])
+	if _, exists := entry.hash().get(field); exists {
+		return encodeInteger(0)
+	}
+	entry.hashSet(field, messages[3], &kvstore.config)
+	kvstore.signalModifiedKey(string(messages[1]))
+	return encodeInteger(1)
+}
+
+func (kvstore *KVStore) handleHGET(messages [][]byte) []byte {
+	if len(messages) != 3 {
+		return wrongArgumentsError("hget")
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedRead(string(messages[1]), hashType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return nullBulkReply
+	}
+	value, ok := entry.hash().get(string(messages[2]))
+	if !ok {
+		return nullBulkReply
+	}
+	return encodeBulkString(value)
+}
+
+func (kvstore *KVStore) handleHMGET(messages [][]byte) []byte {
+	if len(messages) < 3 {
+		return wrongArgumentsError("hmget")
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedRead(string(messages[1]), hashType)
+	if err != nil {
+		return encodeError(err)
+	}
+
+	fields := messages[2:]
+	result := encodeArrayHeader(len(fields))
+	for _, field := range fields {
+		if entry == nil {
+			result = append(result, nullBulkReply...)
+			continue
+		}
+		value, ok := entry.hash().get(string(field))
+		if !ok {
+			result = append(result, nullBulkReply...)
+			continue
+		}
+		result = append(result, encodeBulkString(value)...)
+	}
+	return result
+}
+
+func (kvstore *KVStore) handleHDEL(messages [][]byte) []byte {
+	if len(messages) < 3 {
+		return wrongArgumentsError("hdel")
+	}
+
+	key := string(messages[1])
+	kvstore.lockKeys(key)
+	defer kvstore.unlockKeys(key)
+
+	entry, err := kvstore.lookupTypedWrite(key, hashType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return encodeInteger(0)
+	}
+	hash := entry.hash()
+	deleted := 0
+	for _, field := range messages[2:] {
+		if hash.delete(string(field)) {
+			deleted++
+		}
+	}
+	if deleted > 0 {
+		kvstore.signalModifiedKey(key)
+	}
+	kvstore.removeIfEmptyHash(key, hash)
+	return encodeInteger(int64(deleted))
+}
+
+func (kvstore *KVStore) handleHLEN(messages [][]byte) []byte {
+	if len(messages) != 2 {
+		return wrongArgumentsError("hlen")
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedRead(string(messages[1]), hashType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return encodeInteger(0)
+	}
+	return encodeInteger(int64(entry.hash().Len()))
+}
+
+func (kvstore *KVStore) handleHEXISTS(messages [][]byte) []byte {
+	if len(messages) != 3 {
+		return wrongArgumentsError("hexists")
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedRead(string(messages[1]), hashType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return encodeInteger(0)
+	}
+	if _, ok := entry.hash().get(string(messages[2])); ok {
+		return encodeInteger(1)
+	}
+	return encodeInteger(0)
+}
+
+func (kvstore *KVStore) handleHSTRLEN(messages [][]byte) []byte {
+	if len(messages) != 3 {
+		return wrongArgumentsError("hstrlen")
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedRead(string(messages[1]), hashType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return encodeInteger(0)
+	}
+	value, _ := entry.hash().get(string(messages[2]))
+	return encodeInteger(int64(len(value)))
+}
+
+// handleHGETALL also serves HKEYS and HVALS, which only differ in what
+// half of each pair ends up in the reply
+func (kvstore *KVStore) handleHGETALL(messages [][]byte) []byte {
+	if len(messages) != 2 {
+		return wrongArgumentsError(string(messages[0]))
+	}
+	command := strings.ToUpper(string(messages[0]))
+	withFields := command != "HVALS"
+	withValues := command != "HKEYS"
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedRead(string(messages[1]), hashType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return encodeArray(nil)
+	}
+
+	var items [][]byte
+	entry.hash().forEach(func(field string, value []byte) bool {
+		if withFields {
+			items = append(items, []byte(field))
+		}
+		if withValues {
+			items = append(items, value)
+		}
+		return true
+	})
+	return encodeArray(items)
+}
+
+func (kvstore *KVStore) handleHINCRBY(messages [][]byte) []byte {
+	if len(messages) != 4 {
+		return wrongArgumentsError("hincrby")
+	}
+	increment, err := parseInteger(messages[3])
+	if err != nil {
+		return encodeError(err)
+	}
+
+	kvstore.lockKeys(string(messages[1]))
+	defer kvstore.unlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupOrCreateHash(string(messages[1]))
+	if err != nil {
+		return encodeError(err)
+	}
+	field := string(messages[2])
+	var current int64
+	if value, ok := entry.hash().get(field); ok {
+		current, err = strconv.ParseInt(string(value), 10, 64)
+		if err != nil {
+			return encodeError(errHashNotInteger)
+		}
+	}
+	if (increment > 0 && current > math.MaxInt64-increment) || (increment < 0 && current < math.MinInt64-increment) {
+		kvstore.removeIfEmptyHash(string(messages[1]), entry.hash())
+		return encodeError(errOverflow)
+	}
+
+	result := current + increment
+	entry.hashSet(field, strconv.AppendInt(nil, result, 10), &kvstore.config)
+	kvstore.signalModifiedKey(string(messages[1]))
+	return encodeInteger(result)
+}
+
+func (kvstore *KVStore) handleHINCRBYFLOAT(messages [][]byte) []byte {
+	if len(messages) != 4 {
+		return wrongArgumentsError("hincrbyfloat")
+	}
+	increment, err := parseFloat(messages[3])
+	if err != nil {
+		return encodeError(err)
+	}
+
+	kvstore.lockKeys(string(messages[1]))
+	defer kvstore.unlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupOrCreateHash(string(messages[1]))
+	if err != nil {
+		return encodeError(err)
+	}
+	field := string(messages[2])
+	var current float64
+	if value, ok := entry.hash().get(field); ok {
+		current, err = parseFloat(value)
+		if err != nil {
+			return encodeError(errHashNotFloat)
+		}
+	}
+	result := current + increment
+	if math.IsNaN(result) || math.IsInf(result, 0) {
+		kvstore.removeIfEmptyHash(string(messages[1]), entry.hash())
+		return encodeError(errNaNOrInf)
+	}
+
+	value := []byte(strconv.FormatFloat(result, 'f', -1, 64))
+	entry.hashSet(field, value, &kvstore.config)
+	kvstore.signalModifiedKey(string(messages[1]))
+	return encodeBulkString(value)
+}
+
+func (kvstore *KVStore) handleHRANDFIELD(messages [][]byte) []byte {
+	if len(messages) < 2 || len(messages) > 4 {
+		return wrongArgumentsError("hrandfield")
+	}
+	hasCount := len(messages) >= 3
+	var count int64
+	if hasCount {
+		var err error
+		count, err = parseInteger(messages[2])
+		if err != nil {
+			return encodeError(err)
+		}
+		if count == math.MinInt64 {
+			return encodeError(errCountOutRange)
+		}
+	}
+	withValues := false
+	if len(messages) == 4 {
+		if strings.ToUpper(string(messages[3])) != "WITHVALUES" {
+			return encodeError(errSyntax)
+		}
+		withValues = true
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedRead(string(messages[1]), hashType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		if hasCount {
+			return encodeArray(nil)
+		}
+		return nullBulkReply
+	}
+
+	var pairs []hashPair
+	entry.hash().forEach(func(field string, value []byte) bool {
+		pairs = append(pairs, hashPair{field, value})
+		return true
+	})
+
+	if !hasCount {
+		return encodeBulkString([]byte(pairs[rand.Intn(len(pairs))].field))
+	}
+
+	var picked []hashPair
+	if count < 0 {
+		// negative counts may return the same field several times
+		for i := int64(0); i < -count; i++ {
+			picked = append(picked, pairs[rand.Intn(len(pairs))])
+		}
+	} else {
+		rand.Shuffle(len(pairs), func(i, j int) {
+			pairs[i], pairs[j] = pairs[j], pairs[i]
+		})
+		if count < int64(len(pairs)) {
+			pairs = pairs[:count]
+		}
+		picked = pairs
+	}
+
+	var items [][]byte
+	for _, pair := range picked {
+		items = append(items, []byte(pair.field))
+		if withValues {
+			items = append(items, pair.value)
+		}
+	}
+	return encodeArray(items)
+}
+
+func (kvstore *KVStore) handleHSCAN(messages [][]byte) []byte {
+	if len(messages) < 3 {
+		return wrongArgumentsError("hscan")
+	}
+	options, err := parseScanOptions(messages[2:], true)
+	if err != nil {
+		return encodeError(err)
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedRead(string(messages[1]), hashType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return encodeScanReply(0, nil)
+	}
+	hash := entry.hash()
+
+	var items [][]byte
+	add := func(field string, value []byte) bool {
+		if options.pattern != nil && !stringMatch(options.pattern, []byte(field)) {
+			return true
+		}
+		items = append(items, []byte(field))
+		if !options.noValues {
+			items = append(items, value)
+		}
+		return true
+	}
+	// listpacks are small enough to return in one go, like redis does
+	if hash.isListpack() {
+		hash.forEach(add)
+		return encodeScanReply(0, items)
+	}
+	cursor := hash.index.scan(options.cursor, options.count, func(field string) {
+		if value, ok := hash.get(field); ok {
+			add(field, value)
+		}
+	})
+	return encodeScanReply(cursor, items)
+}
@@ -0,0 +1,276 @@
+package store
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"time"
+)
+
+var (
+	errNumFieldsPositive = errors.New("ERR Parameter `numFields` should be greater than 0")
+	errNumFieldsMismatch = errors.New("ERR The `numfields` parameter must match the number of arguments")
+	errFieldsMissing     = errors.New("ERR Mandatory argument FIELDS is missing or not at the right position")
+)
+
+// per field reply codes shared by the HEXPIRE and HTTL families
+const (
+	fieldMissing      = -2
+	fieldNoTTL        = -1
+	fieldConditionNot = 0
+	fieldUpdated      = 1
+	fieldDeleted      = 2
+)
+
+type expireCondition int
+
+const (
+	expireAlways expireCondition = iota
+	expireNX
+	expireXX
+	expireGT
+	expireLT
+)
+
+// parseFieldsArgument reads FIELDS numfields field [field ...] which has to
+// make up the rest of the command
+func parseFieldsArgument(arguments [][]byte) ([]string, error) {
+	if len(arguments) < 2 || strings.ToUpper(string(arguments[0])) != "FIELDS" {
+		return nil, errFieldsMissing
+	}
+	numFields, err := parseInteger(arguments[1])
+	if err != nil {
+		return nil, err
+	}
+	if numFields <= 0 {
+		return nil, errNumFieldsPositive
+	}
+	if numFields != int64(len(arguments)-2) {
+		return nil, errNumFieldsMismatch
+	}
+	var fields []string
+	for _, field := range arguments[2:] {
+		fields = append(fields, string(field))
+	}
+	return fields, nil
+}
+
+func encodeIntegerArray(values []int64) []byte {
+	result := encodeArrayHeader(len(values))
+	for _, value := range values {
+		result = append(result, encodeInteger(value)...)
+	}
+	return result
+}
+
+// handleHEXPIRE serves HEXPIRE, HPEXPIRE, HEXPIREAT and HPEXPIREAT
+func (kvstore *KVStore) handleHEXPIRE(messages [][]byte) []byte {
+	command := strings.ToLower(string(messages[0]))
+	if len(messages) < 6 {
+		return wrongArgumentsError(command)
+	}
+	amount, err := parseInteger(messages[2])
+	if err != nil {
+		return encodeError(err)
+	}
+
+	now := time.Now().UnixMilli()
+	var expiry int64
+	invalid := errors.New("ERR invalid expire time in '" + command + "' command")
+	switch command {
+	case "hexpire", "hexpireat":
+		if amount < 0 || amount > math.MaxInt64/1000 {
+			return encodeError(invalid)
+		}
+		expiry = amount * 1000
+	default:
+		if amount < 0 {
+			return encodeError(invalid)
+		}
+		expiry = amount
+	}
+	if command == "hexpire" || command == "hpexpire" {
+		if expiry > math.MaxInt64-now {
+			return encodeError(invalid)
+		}
+		expiry += now
+	}
+
+	arguments := messages[3:]
+	condition := expireAlways
+	switch strings.ToUpper(string(arguments[0])) {
+	case "NX":
+		condition = expireNX
+	case "XX":
+		condition = expireXX
+	case "GT":
+		condition = expireGT
+	case "LT":
+		condition = expireLT
+	}
+	if condition != expireAlways {
+		arguments = arguments[1:]
+	}
+	fields, err := parseFieldsArgument(arguments)
+	if err != nil {
+		return encodeError(err)
+	}
+
+	key := string(messages[1])
+	kvstore.lockKeys(key)
+	defer kvstore.unlockKeys(key)
+
+	entry, err := kvstore.lookupTypedWrite(key, hashType)
+	if err != nil {
+		return encodeError(err)
+	}
+
+	results := make([]int64, len(fields))
+	for i, field := range fields {
+		if entry == nil {
+			results[i] = fieldMissing
+			continue
+		}
+		results[i] = entry.hash().expireField(field, expiry, condition, now)
+	}
+	if entry != nil {
+		// fields given a ttl in the past are deleted straight away
+		kvstore.signalModifiedKey(key)
+		kvstore.removeIfEmptyHash(key, entry.hash())
+	}
+	return encodeIntegerArray(results)
+}
+
+// expireField applies a ttl to a single field and returns its reply code
+func (hash *hashValue) expireField(field string, expiry int64, condition expireCondition, now int64) int64 {
+	if _, ok := hash.get(field); !ok {
+		return fieldMissing
+	}
+	current, hasTTL := hash.expires[field]
+
+	switch condition {
+	case expireNX:
+		if hasTTL {
+			return fieldConditionNot
+		}
+	case expireXX:
+		if !hasTTL {
+			return fieldConditionNot
+		}
+	case expireGT:
+		// no ttl counts as an infinite one
+		if !hasTTL || expiry <= current {
+			return fieldConditionNot
+		}
+	case expireLT:
+		if hasTTL && expiry >= current {
+			return fieldConditionNot
+		}
+	}
+
+	if expiry <= now {
+		hash.delete(field)
+		return fieldDeleted
+	}
+	if hash.expires == nil {
+		hash.expires = make(map[string]int64)
+	}
+	hash.expires[field] = expiry
+	return fieldUpdated
+}
+
+// handleHTTL serves HTTL, HPTTL, HEXPIRETIME and HPEXPIRETIME
+func (kvstore *KVStore) handleHTTL(messages [][]byte) []byte {
+	command := strings.ToLower(string(messages[0]))
+	if len(messages) < 5 {
+		return wrongArgumentsError(command)
+	}
+	fields, err := parseFieldsArgument(messages[2:])
+	if err != nil {
+		return encodeError(err)
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedRead(string(messages[1]), hashType)
+	if err != nil {
+		return encodeError(err)
+	}
+
+	now := time.Now().UnixMilli()
+	results := make([]int64, len(fields))
+	for i, field := range fields {
+		if entry == nil {
+			results[i] = fieldMissing
+			continue
+		}
+		hash := entry.hash()
+		if _, ok := hash.get(field); !ok {
+			results[i] = fieldMissing
+			continue
+		}
+		expiry, ok := hash.expires[field]
+		if !ok {
+			results[i] = fieldNoTTL
+			continue
+		}
+		switch command {
+		case "httl":
+			results[i] = (expiry - now + 500) / 1000
+		case "hpttl":
+			results[i] = expiry - now
+		case "hexpiretime":
+			results[i] = expiry / 1000
+		default:
+			results[i] = expiry
+		}
+	}
+	return encodeIntegerArray(results)
+}
+
+func (kvstore *KVStore) handleHPERSIST(messages [][]byte) []byte {
+	if len(messages) < 5 {
+		return wrongArgumentsError("hpersist")
+	}
+	fields, err := parseFieldsArgument(messages[2:])
+	if err != nil {
+		return encodeError(err)
+	}
+
+	key := string(messages[1])
+
+	kvstore.lockKeys(key)
+	defer kvstore.unlockKeys(key)
+
+	entry, err := kvstore.lookupTypedWrite(key, hashType)
+	if err != nil {
+		return encodeError(err)
+	}
+
+	persisted := false
+	results := make([]int64, len(fields))
+	for i, field := range fields {
+		if entry == nil {
+			results[i] = fieldMissing
+			continue
+		}
+		hash := entry.hash()
+		if _, ok := hash.get(field); !ok {
+			results[i] = fieldMissing
+			continue
+		}
+		if _, ok := hash.expires[field]; !ok {
+			results[i] = fieldNoTTL
+			continue
+		}
+		delete(hash.expires, field)
+		results[i] = fieldUpdated
+		persisted = true
+	}
+	if persisted {
+		// a hash left without field ttls leaves the expires index
+		kvstore.signalModifiedKey(key)
+	}
+	return encodeIntegerArray(results)
+}
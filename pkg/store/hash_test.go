@@ -0,0 +1,113 @@
+package store
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHashSetConvertsEncoding(t *testing.T) {
+	config := defaultConfig()
+	config.hashMaxListpackEntries = 2
+	config.hashMaxListpackValue = 8
+
+	newHashEntry := func() *Entry {
+		entry := newEntry()
+		entry.objectType = hashType
+		entry.encoding = encodingListpack
+		entry.value = newHashValue()
+		return entry
+	}
+
+	entry := newHashEntry()
+	entry.hashSet("a", []byte("1"), &config)
+	entry.hashSet("b", []byte("2"), &config)
+	entry.hashSet("a", []byte("3"), &config)
+	if entry.encoding != encodingListpack || !entry.hash().isListpack() {
+		t.Fatalf("expected listpack encoding at the entry limit")
+	}
+	if !entry.hashSet("c", []byte("4"), &config) {
+		t.Errorf("expected c to be reported as a new field")
+	}
+	if entry.encoding != encodingHashtable || entry.hash().isListpack() {
+		t.Fatalf("expected hashtable encoding past the entry limit")
+	}
+	if value, _ := entry.hash().get("a"); string(value) != "3" {
+		t.Errorf("expected a to survive conversion as 3, got %s", value)
+	}
+	if entry.hash().Len() != 3 {
+		t.Errorf("expected 3 fields, got %d", entry.hash().Len())
+	}
+
+	entry = newHashEntry()
+	entry.hashSet("field", []byte(strings.Repeat("x", 9)), &config)
+	if entry.encoding != encodingHashtable {
+		t.Errorf("expected hashtable encoding for a value past the size limit")
+	}
+}
+
+func TestHashFieldExpiry(t *testing.T) {
+	hash := newHashValue()
+	hash.set("live", []byte("1"))
+	hash.set("ttl", []byte("2"))
+	hash.set("gone", []byte("3"))
+	now := time.Now().UnixMilli()
+
+	tests := []struct {
+		field     string
+		expiry    int64
+		condition expireCondition
+		expected  int64
+	}{
+		{"missing", now + 1000, expireAlways, fieldMissing},
+		{"ttl", now + 1000, expireNX, fieldUpdated},
+		{"ttl", now + 2000, expireNX, fieldConditionNot},
+		{"ttl", now + 500, expireGT, fieldConditionNot},
+		{"ttl", now + 3000, expireGT, fieldUpdated},
+		{"live", now + 1000, expireXX, fieldConditionNot},
+		{"live", now + 1000, expireGT, fieldConditionNot},
+		{"gone", now - 1, expireAlways, fieldDeleted},
+	}
+	for _, test := range tests {
+		if result := hash.expireField(test.field, test.expiry, test.condition, now); result != test.expected {
+			t.Errorf("expireField(%s) expected %d, got %d", test.field, test.expected, result)
+		}
+	}
+
+	if hash.Len() != 2 {
+		t.Errorf("expected 2 live fields, got %d", hash.Len())
+	}
+
+	// an expired field is hidden straight away and purged later
+	hash.expires["live"] = now - 1
+	if _, ok := hash.get("live"); ok {
+		t.Errorf("expected expired field to be hidden")
+	}
+	if hash.Len() != 1 {
+		t.Errorf("expected 1 live field, got %d", hash.Len())
+	}
+	if removed := hash.purgeExpired(now); removed != 1 {
+		t.Errorf("expected 1 field purged, got %d", removed)
+	}
+	if _, ok := hash.getRaw("live"); ok {
+		t.Errorf("expected purged field to be physically removed")
+	}
+
+	// overwriting a field drops its ttl
+	hash.set("ttl", []byte("4"))
+	if _, ok := hash.expires["ttl"]; ok {
+		t.Errorf("expected set to clear the field ttl")
+	}
+}
+
+func TestHRANDFIELDCounts(t *testing.T) {
+	kvstore := newKVStore()
+	client := newTestClient()
+	execute(t, kvstore, client, "HSET", "hash", "a", "1", "b", "2")
+	if got := execute(t, kvstore, client, "HRANDFIELD", "hash", "-3"); !strings.HasPrefix(got, "*3\r\n") {
+		t.Errorf("expected a negative count to repeat fields, got %q", got)
+	}
+	if got := execute(t, kvstore, client, "HRANDFIELD", "hash", "-9223372036854775808"); got != "-"+errCountOutRange.Error()+"\r\n" {
+		t.Errorf("expected the smallest count to be out of range, got %q", got)
+	}
+}
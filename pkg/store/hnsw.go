@@ -0,0 +1,372 @@
+package store
+
+import (
+	"container/heap"
+	"math"
+	"math/rand"
+	"slices"
+)
+
+// vectorMetric is how the distance between two vectors is measured,
+// smaller always meaning closer
+type vectorMetric int
+
+const (
+	metricCosine vectorMetric = iota
+	metricL2
+	metricIP
+)
+
+var vectorMetricNames = []string{"COSINE", "L2", "IP"}
+
+// vector is an embedding with its norm kept for cosine distances
+type vector struct {
+	values []float32
+	norm   float32
+}
+
+func newVector(values []float32) vector {
+	return vector{values: values, norm: float32(math.Sqrt(float64(dot(values, values))))}
+}
+
+func dot(a []float32, b []float32) float32 {
+	var sum float32
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+	return sum
+}
+
+// distance is 1 - cosine similarity for cosine, the squared euclidean
+// distance for L2 and the negated dot product for IP
+func (metric vectorMetric) distance(a vector, b vector) float32 {
+	switch metric {
+	case metricL2:
+		var sum float32
+		for i := range a.values {
+			difference := a.values[i] - b.values[i]
+			sum += difference * difference
+		}
+		return sum
+	case metricIP:
+		return -dot(a.values, b.values)
+	}
+	if a.norm == 0 || b.norm == 0 {
+		return 1
+	}
+	return 1 - dot(a.values, b.values)/(a.norm*b.norm)
+}
+
+// score turns a distance into what VSIM WITHSCORES reports, a similarity
+// from 0 to 1 for cosine like redis vector sets, the euclidean distance
+// for L2 and the dot product for IP
+func (metric vectorMetric) score(distance float32) float64 {
+	switch metric {
+	case metricL2:
+		return math.Sqrt(float64(distance))
+	case metricIP:
+		return float64(-distance)
+	}
+	return 1 - float64(distance)/2
+}
+
+type hnswNode struct {
+	element string
+	vector  vector
+	// neighbors holds the links of each layer the node is on, from layer 0
+	neighbors [][]*hnswNode
+	// linkedFrom holds the nodes linking to this one on each layer. Links
+	// are directed after pruning, so removal needs these to find every
+	// node pointing at the removed one. Only changed through setLinks
+	linkedFrom []map[*hnswNode]struct{}
+}
+
+func newHNSWNode(element string, value vector, level int) *hnswNode {
+	node := &hnswNode{
+		element:    element,
+		vector:     value,
+		neighbors:  make([][]*hnswNode, level+1),
+		linkedFrom: make([]map[*hnswNode]struct{}, level+1),
+	}
+	for i := range node.linkedFrom {
+		node.linkedFrom[i] = make(map[*hnswNode]struct{})
+	}
+	return node
+}
+
+// setLinks replaces the links of node on a layer, keeping linkedFrom of
+// the nodes it stops and starts linking to in step
+func setLinks(node *hnswNode, level int, links []*hnswNode) {
+	for _, neighbor := range node.neighbors[level] {
+		delete(neighbor.linkedFrom[level], node)
+	}
+	node.neighbors[level] = links
+	for _, neighbor := range links {
+		neighbor.linkedFrom[level][node] = struct{}{}
+	}
+}
+
+// hnsw is a hierarchical navigable small world graph. Every node is on
+// layer 0 and on each layer above with probability 1/m, searches start at
+// the top layer and greedily descend towards the query
+type hnsw struct {
+	nodes          map[string]*hnswNode
+	entry          *hnswNode
+	metric         vectorMetric
+	dimension      int
+	m              int
+	efConstruction int
+}
+
+func newHNSW(metric vectorMetric, dimension int, m int, efConstruction int) *hnsw {
+	return &hnsw{
+		nodes:          make(map[string]*hnswNode),
+		metric:         metric,
+		dimension:      dimension,
+		m:              m,
+		efConstruction: efConstruction,
+	}
+}
+
+// maxLinks is how many neighbors a node keeps on a layer, twice as many on
+// layer 0 which every search ends on
+func (graph *hnsw) maxLinks(level int) int {
+	if level == 0 {
+		return graph.m * 2
+	}
+	return graph.m
+}
+
+func (graph *hnsw) randomLevel() int {
+	return int(-math.Log(1-rand.Float64()) / math.Log(float64(graph.m)))
+}
+
+func (graph *hnsw) maxLevel() int {
+	if graph.entry == nil {
+		return -1
+	}
+	return len(graph.entry.neighbors) - 1
+}
+
+type hnswCandidate struct {
+	node     *hnswNode
+	distance float32
+}
+
+// candidateHeap is a min heap on distance, or a max heap when farthest is
+// set
+type candidateHeap struct {
+	items    []hnswCandidate
+	farthest bool
+}
+
+func (h *candidateHeap) Len() int { return len(h.items) }
+func (h *candidateHeap) Less(i, j int) bool {
+	return (h.items[i].distance < h.items[j].distance) != h.farthest
+}
+func (h *candidateHeap) Swap(i, j int)      { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *candidateHeap) Push(item any)      { h.items = append(h.items, item.(hnswCandidate)) }
+func (h *candidateHeap) top() hnswCandidate { return h.items[0] }
+func (h *candidateHeap) Pop() any {
+	item := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return item
+}
+
+func sortCandidates(candidates []hnswCandidate) {
+	slices.SortFunc(candidates, func(a, b hnswCandidate) int {
+		switch {
+		case a.distance < b.distance:
+			return -1
+		case a.distance > b.distance:
+			return 1
+		}
+		return 0
+	})
+}
+
+// searchLayer returns up to ef of the closest nodes to query on a layer,
+// closest first, exploring out from the entry points
+func (graph *hnsw) searchLayer(query vector, entries []hnswCandidate, ef int, level int) []hnswCandidate {
+	visited := make(map[*hnswNode]bool, ef*graph.m)
+	candidates := &candidateHeap{}
+	results := &candidateHeap{farthest: true}
+	for _, entry := range entries {
+		visited[entry.node] = true
+		heap.Push(candidates, entry)
+		heap.Push(results, entry)
+	}
+	for results.Len() > ef {
+		heap.Pop(results)
+	}
+
+	for candidates.Len() > 0 {
+		closest := heap.Pop(candidates).(hnswCandidate)
+		if results.Len() >= ef && closest.distance > results.top().distance {
+			break
+		}
+		for _, neighbor := range closest.node.neighbors[level] {
+			if visited[neighbor] {
+				continue
+			}
+			visited[neighbor] = true
+			distance := graph.metric.distance(query, neighbor.vector)
+			if results.Len() < ef || distance < results.top().distance {
+				candidate := hnswCandidate{node: neighbor, distance: distance}
+				heap.Push(candidates, candidate)
+				heap.Push(results, candidate)
+				if results.Len() > ef {
+					heap.Pop(results)
+				}
+			}
+		}
+	}
+	sortCandidates(results.items)
+	return results.items
+}
+
+// selectNeighbors picks up to count links for a node from candidates sorted
+// closest first. A candidate is skipped when it is closer to an already
+// picked neighbor than to the node, which keeps links spread out in
+// different directions, then skipped ones fill any remaining room
+func (graph *hnsw) selectNeighbors(candidates []hnswCandidate, count int) []*hnswNode {
+	selected := make([]*hnswNode, 0, count)
+	var skipped []*hnswNode
+	for _, candidate := range candidates {
+		if len(selected) == count {
+			break
+		}
+		diverse := true
+		for _, neighbor := range selected {
+			if graph.metric.distance(candidate.node.vector, neighbor.vector) < candidate.distance {
+				diverse = false
+				break
+			}
+		}
+		if diverse {
+			selected = append(selected, candidate.node)
+		} else {
+			skipped = append(skipped, candidate.node)
+		}
+	}
+	for _, node := range skipped {
+		if len(selected) == count {
+			break
+		}
+		selected = append(selected, node)
+	}
+	return selected
+}
+
+// relink chooses the links of node on a layer from candidates
+func (graph *hnsw) relink(node *hnswNode, candidates []*hnswNode, level int) {
+	ranked := make([]hnswCandidate, 0, len(candidates))
+	for _, candidate := range candidates {
+		if candidate != node && !slices.ContainsFunc(ranked, func(c hnswCandidate) bool { return c.node == candidate }) {
+			ranked = append(ranked, hnswCandidate{node: candidate, distance: graph.metric.distance(node.vector, candidate.vector)})
+		}
+	}
+	sortCandidates(ranked)
+	setLinks(node, level, graph.selectNeighbors(ranked, graph.maxLinks(level)))
+}
+
+// descend greedily walks the layers above level towards query, returning
+// where to start searching level from
+func (graph *hnsw) descend(query vector, level int) []hnswCandidate {
+	entries := []hnswCandidate{{node: graph.entry, distance: graph.metric.distance(query, graph.entry.vector)}}
+	for current := graph.maxLevel(); current > level; current-- {
+		entries = graph.searchLayer(query, entries, 1, current)
+	}
+	return entries
+}
+
+// insert adds element, which must not be in the graph already
+func (graph *hnsw) insert(element string, value vector) {
+	level := graph.randomLevel()
+	node := newHNSWNode(element, value, level)
+	graph.nodes[element] = node
+	if graph.entry == nil {
+		graph.entry = node
+		return
+	}
+
+	entries := graph.descend(value, level)
+	for current := min(level, graph.maxLevel()); current >= 0; current-- {
+		entries = graph.searchLayer(value, entries, graph.efConstruction, current)
+		setLinks(node, current, graph.selectNeighbors(entries, graph.maxLinks(current)))
+		for _, neighbor := range node.neighbors[current] {
+			links := append(slices.Clone(neighbor.neighbors[current]), node)
+			if len(links) > graph.maxLinks(current) {
+				graph.relink(neighbor, links, current)
+			} else {
+				setLinks(neighbor, current, links)
+			}
+		}
+	}
+	if level > graph.maxLevel() {
+		graph.entry = node
+	}
+}
+
+// remove takes element out of the graph. Only the nodes linking to it
+// are touched, each is relinked from its own and the removed node's
+// neighbors
+func (graph *hnsw) remove(element string) bool {
+	removed, ok := graph.nodes[element]
+	if !ok {
+		return false
+	}
+	delete(graph.nodes, element)
+	if graph.entry == removed {
+		graph.entry = graph.replacementEntry(removed)
+	}
+
+	for level := range removed.neighbors {
+		linkedFrom := make([]*hnswNode, 0, len(removed.linkedFrom[level]))
+		for node := range removed.linkedFrom[level] {
+			linkedFrom = append(linkedFrom, node)
+		}
+		for _, node := range linkedFrom {
+			links := slices.DeleteFunc(slices.Clone(node.neighbors[level]), func(neighbor *hnswNode) bool {
+				return neighbor == removed
+			})
+			graph.relink(node, append(links, removed.neighbors[level]...), level)
+		}
+		setLinks(removed, level, nil)
+	}
+	return true
+}
+
+// replacementEntry picks a new entry point once removed, the old one, is
+// gone: the neighbor on the most layers, searching from removed's top
+// layer down. Only a removed node with no links at all, left behind on
+// its own by pruning, leads to a scan of the graph
+func (graph *hnsw) replacementEntry(removed *hnswNode) *hnswNode {
+	var entry *hnswNode
+	for level := len(removed.neighbors) - 1; level >= 0 && entry == nil; level-- {
+		for _, neighbor := range removed.neighbors[level] {
+			if entry == nil || len(neighbor.neighbors) > len(entry.neighbors) {
+				entry = neighbor
+			}
+		}
+	}
+	if entry != nil {
+		return entry
+	}
+	for _, node := range graph.nodes {
+		if entry == nil || len(node.neighbors) > len(entry.neighbors) {
+			entry = node
+		}
+	}
+	return entry
+}
+
+// search returns the count nodes closest to query, closest first, ef being
+// how many candidates are kept while searching
+func (graph *hnsw) search(query vector, count int, ef int) []hnswCandidate {
+	if graph.entry == nil || count == 0 {
+		return nil
+	}
+	results := graph.searchLayer(query, graph.descend(query, 0), max(ef, count), 0)
+	return results[:min(count, len(results))]
+}
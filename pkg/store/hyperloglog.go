@@ -0,0 +1,639 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+var (
+	errNotHyperLogLog = errors.New("WRONGTYPE Key is not a valid HyperLogLog string value.")
+	errCorruptedHLL   = errors.New("INVALIDOBJ Corrupted HLL object detected")
+)
+
+// HyperLogLogs are stored as plain strings in the same layout redis uses,
+// so the values can be moved between the two with GET / SET or RDB.
+//
+// The 16 byte header is the "HYLL" magic, the encoding, three unused bytes
+// and the cached cardinality as a little endian uint64 whose top bit marks
+// the cache as stale. Dense values follow with 16384 registers of 6 bits,
+// packed least significant bit first. Sparse values follow with a run
+// length encoding of the registers made of three opcodes:
+//
+//	ZERO  00xxxxxx          xxxxxx+1 registers set to 0, up to 64
+//	XZERO 01xxxxxx yyyyyyyy 14 bit length+1 registers set to 0, up to 16384
+//	VAL   1vvvvvxx          xx+1 registers set to vvvvv+1, up to 4 of up to 32
+const (
+	hllP              = 14
+	hllQ              = 64 - hllP
+	hllRegisters      = 1 << hllP
+	hllPMask          = hllRegisters - 1
+	hllBits           = 6
+	hllRegisterMax    = 1<<hllBits - 1
+	hllHeaderSize     = 16
+	hllDenseSize      = hllHeaderSize + (hllRegisters*hllBits+7)/8
+	hllDense          = 0
+	hllSparse         = 1
+	hllAlphaInf       = 0.721347520444481703680
+	hllSparseValBit   = 0x80
+	hllSparseXzeroBit = 0x40
+	hllSparseValMax   = 32
+	hllSparseValLen   = 4
+	hllSparseZeroMax  = 64
+	hllSparseXzeroMax = 16384
+	hllHashSeed       = 0xadc83b19
+)
+
+var hllMagic = []byte("HYLL")
+
+func sparseIsZero(b byte) bool {
+	return b&0xc0 == 0
+}
+
+func sparseIsXzero(b byte) bool {
+	return b&0xc0 == hllSparseXzeroBit
+}
+
+func sparseIsVal(b byte) bool {
+	return b&hllSparseValBit != 0
+}
+
+func sparseZeroLen(b byte) int {
+	return int(b&0x3f) + 1
+}
+
+func sparseXzeroLen(first byte, second byte) int {
+	return (int(first&0x3f)<<8 | int(second)) + 1
+}
+
+func sparseValValue(b byte) int {
+	return int(b>>2&0x1f) + 1
+}
+
+func sparseValLen(b byte) int {
+	return int(b&0x3) + 1
+}
+
+func sparseVal(value int, length int) byte {
+	return byte((value-1)<<2|(length-1)) | hllSparseValBit
+}
+
+func sparseZero(length int) byte {
+	return byte(length - 1)
+}
+
+func sparseXzero(length int) []byte {
+	length--
+	return []byte{byte(length>>8) | hllSparseXzeroBit, byte(length & 0xff)}
+}
+
+// appendSparseZeros writes a run of zero registers with whichever zero
+// opcode fits
+func appendSparseZeros(sequence []byte, length int) []byte {
+	if length > hllSparseZeroMax {
+		return append(sequence, sparseXzero(length)...)
+	}
+	return append(sequence, sparseZero(length))
+}
+
+// murmurHash64A is the hash redis uses to pick registers, it has to match
+// bit for bit for the registers to be compatible
+func murmurHash64A(key []byte, seed uint64) uint64 {
+	const m = 0xc6a4a7935bd1e995
+	const r = 47
+	h := seed ^ uint64(len(key))*m
+
+	data := key
+	for len(data) >= 8 {
+		k := binary.LittleEndian.Uint64(data)
+		k *= m
+		k ^= k >> r
+		k *= m
+		h ^= k
+		h *= m
+		data = data[8:]
+	}
+	if len(data) > 0 {
+		for i := len(data) - 1; i >= 0; i-- {
+			h ^= uint64(data[i]) << (8 * uint(i))
+		}
+		h *= m
+	}
+
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+	return h
+}
+
+// hllPatternLength returns the register for element and the length of the
+// run of zeros, plus one, in the rest of its hash
+func hllPatternLength(element []byte) (int, int) {
+	hash := murmurHash64A(element, hllHashSeed)
+	index := int(hash & hllPMask)
+	hash >>= hllP
+	// guarantees the loop ends with count <= Q+1
+	hash |= 1 << hllQ
+	count := 1
+	for bit := uint64(1); hash&bit == 0; bit <<= 1 {
+		count++
+	}
+	return index, count
+}
+
+func denseGetRegister(registers []byte, index int) int {
+	byteIndex := index * hllBits / 8
+	shift := uint(index * hllBits & 7)
+	value := int(registers[byteIndex]) >> shift
+	if byteIndex+1 < len(registers) {
+		value |= int(registers[byteIndex+1]) << (8 - shift)
+	}
+	return value & hllRegisterMax
+}
+
+func denseSetRegister(registers []byte, index int, value int) {
+	byteIndex := index * hllBits / 8
+	shift := uint(index * hllBits & 7)
+	registers[byteIndex] &^= byte(hllRegisterMax << shift)
+	registers[byteIndex] |= byte(value << shift)
+	if byteIndex+1 < len(registers) {
+		registers[byteIndex+1] &^= byte(hllRegisterMax >> (8 - shift))
+		registers[byteIndex+1] |= byte(value >> (8 - shift))
+	}
+}
+
+// hyperLogLog wraps the string value of a key holding an HLL
+type hyperLogLog struct {
+	value []byte
+	// the sparse encoding is promoted to dense past this many bytes, from
+	// hll-sparse-max-bytes
+	sparseMaxBytes int64
+}
+
+func newHyperLogLog(sparseMaxBytes int64) *hyperLogLog {
+	value := make([]byte, hllHeaderSize, hllHeaderSize+2)
+	copy(value, hllMagic)
+	value[4] = hllSparse
+	// a single XZERO covering every register
+	value = append(value, sparseXzero(hllRegisters)...)
+	return &hyperLogLog{value: value, sparseMaxBytes: sparseMaxBytes}
+}
+
+// isValidHyperLogLog is the cheap check redis does before treating a
+// string as an HLL, the sparse opcodes are only validated when walked
+func isValidHyperLogLog(value []byte) bool {
+	if len(value) < hllHeaderSize || !bytes.Equal(value[:4], hllMagic) || value[4] > hllSparse {
+		return false
+	}
+	return value[4] != hllDense || len(value) == hllDenseSize
+}
+
+func (hll *hyperLogLog) encoding() byte {
+	return hll.value[4]
+}
+
+func (hll *hyperLogLog) invalidateCache() {
+	hll.value[15] |= 1 << 7
+}
+
+func (hll *hyperLogLog) cachedCardinality() (uint64, bool) {
+	if hll.value[15]&(1<<7) != 0 {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint64(hll.value[8:16]), true
+}
+
+func (hll *hyperLogLog) setCachedCardinality(cardinality uint64) {
+	binary.LittleEndian.PutUint64(hll.value[8:16], cardinality)
+}
+
+// registers fills max with the larger of its own and the HLL's registers
+func (hll *hyperLogLog) mergeInto(max []int) error {
+	if hll.encoding() == hllDense {
+		registers := hll.value[hllHeaderSize:]
+		for i := range max {
+			if value := denseGetRegister(registers, i); value > max[i] {
+				max[i] = value
+			}
+		}
+		return nil
+	}
+
+	sparse := hll.value[hllHeaderSize:]
+	index := 0
+	for p := 0; p < len(sparse); {
+		switch {
+		case sparseIsZero(sparse[p]):
+			index += sparseZeroLen(sparse[p])
+			p++
+		case sparseIsXzero(sparse[p]):
+			if p+1 >= len(sparse) {
+				return errCorruptedHLL
+			}
+			index += sparseXzeroLen(sparse[p], sparse[p+1])
+			p += 2
+		default:
+			length, value := sparseValLen(sparse[p]), sparseValValue(sparse[p])
+			if index+length > hllRegisters {
+				return errCorruptedHLL
+			}
+			for ; length > 0; length-- {
+				if value > max[index] {
+					max[index] = value
+				}
+				index++
+			}
+			p++
+		}
+	}
+	if index != hllRegisters {
+		return errCorruptedHLL
+	}
+	return nil
+}
+
+// toDense converts a sparse HLL to the dense encoding in place
+func (hll *hyperLogLog) toDense() error {
+	if hll.encoding() == hllDense {
+		return nil
+	}
+	registers := make([]int, hllRegisters)
+	if err := hll.mergeInto(registers); err != nil {
+		return err
+	}
+	dense := make([]byte, hllDenseSize)
+	copy(dense, hll.value[:hllHeaderSize])
+	dense[4] = hllDense
+	for i, value := range registers {
+		if value > 0 {
+			denseSetRegister(dense[hllHeaderSize:], i, value)
+		}
+	}
+	hll.value = dense
+	return nil
+}
+
+func (hll *hyperLogLog) denseSet(index int, count int) bool {
+	registers := hll.value[hllHeaderSize:]
+	if count > denseGetRegister(registers, index) {
+		denseSetRegister(registers, index, count)
+		return true
+	}
+	return false
+}
+
+// set raises register index to count if it is lower, returning whether
+// anything changed. Sparse HLLs are edited in place the way redis does it
+// so the bytes come out identical, and promoted to dense once a value no
+// longer fits the VAL opcode or the encoding grows past the limit
+func (hll *hyperLogLog) set(index int, count int) (bool, error) {
+	if hll.encoding() == hllDense {
+		return hll.denseSet(index, count), nil
+	}
+	if count > hllSparseValMax {
+		return hll.promote(index, count)
+	}
+
+	sparse := hll.value[hllHeaderSize:]
+	// find the opcode covering the register
+	first, span, p, prev := 0, 0, 0, -1
+	for p < len(sparse) {
+		oplen := 1
+		switch {
+		case sparseIsZero(sparse[p]):
+			span = sparseZeroLen(sparse[p])
+		case sparseIsVal(sparse[p]):
+			span = sparseValLen(sparse[p])
+		default:
+			if p+1 >= len(sparse) {
+				return false, errCorruptedHLL
+			}
+			span = sparseXzeroLen(sparse[p], sparse[p+1])
+			oplen = 2
+		}
+		if index <= first+span-1 {
+			break
+		}
+		prev = p
+		p += oplen
+		first += span
+	}
+	if span == 0 || p >= len(sparse) {
+		return false, errCorruptedHLL
+	}
+
+	op := sparse[p]
+	isXzero := sparseIsXzero(op)
+	updated := false
+	if sparseIsVal(op) {
+		if sparseValValue(op) >= count {
+			return false, nil
+		}
+		if sparseValLen(op) == 1 {
+			sparse[p] = sparseVal(count, 1)
+			updated = true
+		}
+	}
+	if !updated && sparseIsZero(op) && sparseZeroLen(op) == 1 {
+		sparse[p] = sparseVal(count, 1)
+		updated = true
+	}
+
+	if !updated {
+		// split the run around the register, at worst XZERO VAL XZERO
+		last := first + span - 1
+		var sequence []byte
+		if sparseIsVal(op) {
+			current := sparseValValue(op)
+			if index != first {
+				sequence = append(sequence, sparseVal(current, index-first))
+			}
+			sequence = append(sequence, sparseVal(count, 1))
+			if index != last {
+				sequence = append(sequence, sparseVal(current, last-index))
+			}
+		} else {
+			if index != first {
+				sequence = appendSparseZeros(sequence, index-first)
+			}
+			sequence = append(sequence, sparseVal(count, 1))
+			if index != last {
+				sequence = appendSparseZeros(sequence, last-index)
+			}
+		}
+
+		oldLength := 1
+		if isXzero {
+			oldLength = 2
+		}
+		if delta := len(sequence) - oldLength; delta > 0 && int64(len(hll.value)+delta) > hll.sparseMaxBytes {
+			return hll.promote(index, count)
+		}
+		replaced := make([]byte, 0, len(sparse)+len(sequence))
+		replaced = append(replaced, sparse[:p]...)
+		replaced = append(replaced, sequence...)
+		replaced = append(replaced, sparse[p+oldLength:]...)
+		hll.value = append(hll.value[:hllHeaderSize], replaced...)
+		sparse = hll.value[hllHeaderSize:]
+	}
+
+	// merge adjacent VAL opcodes with the same value, looking at up to 5
+	// opcodes from the one before the change
+	p = 0
+	if prev >= 0 {
+		p = prev
+	}
+	for scan := 5; p < len(sparse) && scan > 0; scan-- {
+		if sparseIsXzero(sparse[p]) {
+			p += 2
+			continue
+		}
+		if sparseIsZero(sparse[p]) {
+			p++
+			continue
+		}
+		if p+1 < len(sparse) && sparseIsVal(sparse[p+1]) && sparseValValue(sparse[p]) == sparseValValue(sparse[p+1]) {
+			if length := sparseValLen(sparse[p]) + sparseValLen(sparse[p+1]); length <= hllSparseValLen {
+				sparse[p+1] = sparseVal(sparseValValue(sparse[p]), length)
+				copy(sparse[p:], sparse[p+1:])
+				hll.value = hll.value[:len(hll.value)-1]
+				sparse = hll.value[hllHeaderSize:]
+				// try merging the result with what is on its right
+				continue
+			}
+		}
+		p++
+	}
+	return true, nil
+}
+
+func (hll *hyperLogLog) promote(index int, count int) (bool, error) {
+	if err := hll.toDense(); err != nil {
+		return false, err
+	}
+	return hll.denseSet(index, count), nil
+}
+
+// add hashes element into the HLL, returning whether a register changed
+func (hll *hyperLogLog) add(element []byte) (bool, error) {
+	index, count := hllPatternLength(element)
+	return hll.set(index, count)
+}
+
+func hllTau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	y, z := 1.0, 1-x
+	for {
+		x = math.Sqrt(x)
+		previous := z
+		y *= 0.5
+		z -= math.Pow(1-x, 2) * y
+		if previous == z {
+			return z / 3
+		}
+	}
+}
+
+func hllSigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	y, z := 1.0, x
+	for {
+		x *= x
+		previous := z
+		z += x * y
+		y += y
+		if previous == z {
+			return z
+		}
+	}
+}
+
+// hllCount estimates the cardinality from the registers with the improved
+// estimator from Otmar Ertl's "New cardinality estimation algorithms for
+// HyperLogLog sketches", the one redis has used since 5.0
+func hllCount(registers []int) uint64 {
+	var histogram [64]int
+	for _, value := range registers {
+		histogram[value]++
+	}
+	m := float64(hllRegisters)
+	z := m * hllTau((m-float64(histogram[hllQ+1]))/m)
+	for j := hllQ; j >= 1; j-- {
+		z += float64(histogram[j])
+		z *= 0.5
+	}
+	z += m * hllSigma(float64(histogram[0])/m)
+	return uint64(math.Round(hllAlphaInf * m * m / z))
+}
+
+// cardinality returns the cached estimate, working it out and caching it
+// when the cache is stale
+func (hll *hyperLogLog) cardinality() (uint64, error) {
+	if cached, ok := hll.cachedCardinality(); ok {
+		return cached, nil
+	}
+	registers := make([]int, hllRegisters)
+	if err := hll.mergeInto(registers); err != nil {
+		return 0, err
+	}
+	cardinality := hllCount(registers)
+	hll.setCachedCardinality(cardinality)
+	return cardinality, nil
+}
+
+// lookupHyperLogLog returns the HLL stored at key, nil if the key is
+// missing. Caller must hold the write lock
+func (kvstore *KVStore) lookupHyperLogLog(key string) (*Entry, *hyperLogLog, error) {
+	entry, err := kvstore.lookupTypedWrite(key, stringType)
+	if err != nil {
+		return nil, nil, err
+	}
+	if entry == nil {
+		return nil, nil, nil
+	}
+	if !isValidHyperLogLog(entry.bytes()) {
+		return nil, nil, errNotHyperLogLog
+	}
+	return entry, &hyperLogLog{value: entry.mutableString(0), sparseMaxBytes: kvstore.config.hllSparseMaxBytes}, nil
+}
+
+func (kvstore *KVStore) handlePFADD(messages [][]byte) []byte {
+	if len(messages) < 2 {
+		return wrongArgumentsError("pfadd")
+	}
+
+	key := string(messages[1])
+	kvstore.lockKeys(key)
+	defer kvstore.unlockKeys(key)
+
+	entry, hll, err := kvstore.lookupHyperLogLog(key)
+	if err != nil {
+		return encodeError(err)
+	}
+	updated := false
+	if entry == nil {
+		entry = newEntry()
+		kvstore.setKey(key, entry)
+		hll = newHyperLogLog(kvstore.config.hllSparseMaxBytes)
+		updated = true
+	}
+
+	for _, element := range messages[2:] {
+		changed, err := hll.add(element)
+		if err != nil {
+			entry.entry = hll.value
+			return encodeError(err)
+		}
+		updated = updated || changed
+	}
+	if updated {
+		hll.invalidateCache()
+	}
+	// set may have reallocated the value
+	entry.entry = hll.value
+	if updated {
+		return encodeInteger(1)
+	}
+	return encodeInteger(0)
+}
+
+func (kvstore *KVStore) handlePFCOUNT(messages [][]byte) []byte {
+	if len(messages) < 2 {
+		return wrongArgumentsError("pfcount")
+	}
+
+	// counting a single key caches the result in the value
+	keys := keyStrings(messages[1:])
+	kvstore.lockKeys(keys...)
+	defer kvstore.unlockKeys(keys...)
+
+	if len(messages) == 2 {
+		_, hll, err := kvstore.lookupHyperLogLog(string(messages[1]))
+		if err != nil {
+			return encodeError(err)
+		}
+		if hll == nil {
+			return encodeInteger(0)
+		}
+		cardinality, err := hll.cardinality()
+		if err != nil {
+			return encodeError(err)
+		}
+		return encodeInteger(int64(cardinality))
+	}
+
+	// the union of several keys is counted without touching any of them
+	registers := make([]int, hllRegisters)
+	for _, key := range messages[1:] {
+		_, hll, err := kvstore.lookupHyperLogLog(string(key))
+		if err != nil {
+			return encodeError(err)
+		}
+		if hll == nil {
+			continue
+		}
+		if err := hll.mergeInto(registers); err != nil {
+			return encodeError(err)
+		}
+	}
+	return encodeInteger(int64(hllCount(registers)))
+}
+
+func (kvstore *KVStore) handlePFMERGE(messages [][]byte) []byte {
+	if len(messages) < 2 {
+		return wrongArgumentsError("pfmerge")
+	}
+
+	keys := keyStrings(messages[1:])
+	kvstore.lockKeys(keys...)
+	defer kvstore.unlockKeys(keys...)
+
+	// the destination takes part in the union too
+	registers := make([]int, hllRegisters)
+	useDense := false
+	for _, key := range messages[1:] {
+		_, hll, err := kvstore.lookupHyperLogLog(string(key))
+		if err != nil {
+			return encodeError(err)
+		}
+		if hll == nil {
+			continue
+		}
+		if hll.encoding() == hllDense {
+			useDense = true
+		}
+		if err := hll.mergeInto(registers); err != nil {
+			return encodeError(err)
+		}
+	}
+
+	destination := string(messages[1])
+	entry, hll, _ := kvstore.lookupHyperLogLog(destination)
+	if entry == nil {
+		entry = newEntry()
+		kvstore.setKey(destination, entry)
+		hll = newHyperLogLog(kvstore.config.hllSparseMaxBytes)
+	}
+	if useDense {
+		if err := hll.toDense(); err != nil {
+			return encodeError(err)
+		}
+	}
+	for i, value := range registers {
+		if value == 0 {
+			continue
+		}
+		if _, err := hll.set(i, value); err != nil {
+			entry.entry = hll.value
+			return encodeError(err)
+		}
+	}
+	hll.invalidateCache()
+	entry.entry = hll.value
+	return okReply
+}
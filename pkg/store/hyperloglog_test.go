@@ -0,0 +1,119 @@
+package store
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+func TestEmptyHyperLogLogLayout(t *testing.T) {
+	expected := "HYLL\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x7f\xff"
+	if value := string(newHyperLogLog(defaultConfig().hllSparseMaxBytes).value); value != expected {
+		t.Errorf("expected %q, got %q", expected, value)
+	}
+}
+
+// TestSparseSetMatchesRegisters edits a sparse HLL in place at random and
+// checks the opcodes always decode to the same registers as a plain array
+func TestSparseSetMatchesRegisters(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	hll := newHyperLogLog(defaultConfig().hllSparseMaxBytes)
+	model := make([]int, hllRegisters)
+	for i := 0; i < 300; i++ {
+		// keep indexes close together so VAL runs get split and merged
+		index := random.Intn(64) * 3
+		if i%2 == 0 {
+			index = random.Intn(hllRegisters)
+		}
+		count := random.Intn(hllSparseValMax) + 1
+		changed, err := hll.set(index, count)
+		if err != nil {
+			t.Fatalf("set %d %d: %v", index, count, err)
+		}
+		if changed != (count > model[index]) {
+			t.Fatalf("set %d %d over %d reported changed %v", index, count, model[index], changed)
+		}
+		model[index] = max(model[index], count)
+
+		registers := make([]int, hllRegisters)
+		if err := hll.mergeInto(registers); err != nil {
+			t.Fatalf("decoding after set %d %d: %v", index, count, err)
+		}
+		for j := range registers {
+			if registers[j] != model[j] {
+				t.Fatalf("register %d expected %d, got %d", j, model[j], registers[j])
+			}
+		}
+	}
+	if hll.encoding() != hllSparse {
+		t.Errorf("expected the HLL to still be sparse at %d bytes", len(hll.value))
+	}
+
+	// a value past what VAL can hold promotes to dense
+	if _, err := hll.set(5, hllSparseValMax+1); err != nil || hll.encoding() != hllDense || len(hll.value) != hllDenseSize {
+		t.Fatalf("expected promotion to dense, got encoding %d size %d err %v", hll.encoding(), len(hll.value), err)
+	}
+	model[5] = hllSparseValMax + 1
+	registers := make([]int, hllRegisters)
+	hll.mergeInto(registers)
+	for j := range registers {
+		if registers[j] != model[j] {
+			t.Fatalf("dense register %d expected %d, got %d", j, model[j], registers[j])
+		}
+	}
+}
+
+func TestPFADDAndPFCOUNT(t *testing.T) {
+	kvstore := newKVStore()
+	if reply := kvstore.handlePFADD(command("PFADD", "hll", "a", "b", "c", "d", "e", "f", "g")); string(reply) != ":1\r\n" {
+		t.Fatalf("expected 1, got %q", reply)
+	}
+	if reply := kvstore.handlePFADD(command("PFADD", "hll", "a")); string(reply) != ":0\r\n" {
+		t.Errorf("adding a seen element should reply 0, got %q", reply)
+	}
+	if reply := kvstore.handlePFCOUNT(command("PFCOUNT", "hll")); string(reply) != ":7\r\n" {
+		t.Errorf("expected 7, got %q", reply)
+	}
+	hll := &hyperLogLog{value: kvstore.find("hll").bytes()}
+	if cached, ok := hll.cachedCardinality(); !ok || cached != 7 {
+		t.Errorf("PFCOUNT should cache 7, got %d %v", cached, ok)
+	}
+
+	// enough elements to go dense, the estimate should stay within 2%
+	elements := [][]byte{[]byte("PFADD"), []byte("big")}
+	for i := 0; i < 100000; i++ {
+		elements = append(elements, []byte("element:"+strconv.Itoa(i)))
+	}
+	kvstore.handlePFADD(elements)
+	if value := kvstore.find("big").bytes(); value[4] != hllDense {
+		t.Errorf("expected a dense HLL")
+	}
+	reply := kvstore.handlePFCOUNT(command("PFCOUNT", "big"))
+	count, _ := strconv.Atoi(string(reply[1 : len(reply)-2]))
+	if count < 98000 || count > 102000 {
+		t.Errorf("expected about 100000, got %d", count)
+	}
+
+	setString(kvstore, "plain", "hello")
+	if reply := kvstore.handlePFADD(command("PFADD", "plain", "a")); string(reply) != string(encodeError(errNotHyperLogLog)) {
+		t.Errorf("a plain string is not an HLL, got %q", reply)
+	}
+}
+
+func TestPFMERGE(t *testing.T) {
+	kvstore := newKVStore()
+	kvstore.handlePFADD(command("PFADD", "first", "foo", "bar", "zap", "a"))
+	kvstore.handlePFADD(command("PFADD", "second", "a", "b", "c", "foo"))
+	if reply := kvstore.handlePFMERGE(command("PFMERGE", "union", "first", "second", "missing")); string(reply) != string(okReply) {
+		t.Fatalf("expected OK, got %q", reply)
+	}
+	if reply := kvstore.handlePFCOUNT(command("PFCOUNT", "union")); string(reply) != ":6\r\n" {
+		t.Errorf("expected 6, got %q", reply)
+	}
+	if reply := kvstore.handlePFCOUNT(command("PFCOUNT", "first", "second")); string(reply) != ":6\r\n" {
+		t.Errorf("counting several keys should count the union, got %q", reply)
+	}
+	if value := kvstore.find("union").bytes(); value[4] != hllSparse {
+		t.Errorf("merging sparse HLLs should stay sparse")
+	}
+}
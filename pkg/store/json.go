@@ -0,0 +1,788 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var errInvalidJSON = errors.New("ERR invalid JSON value")
+
+type jsonKind int
+
+const (
+	jsonNull jsonKind = iota
+	jsonBoolean
+	jsonInteger
+	jsonNumber
+	jsonString
+	jsonArray
+	jsonObject
+)
+
+// String returns the name JSON.TYPE reports for the kind
+func (kind jsonKind) String() string {
+	switch kind {
+	case jsonBoolean:
+		return "boolean"
+	case jsonInteger:
+		return "integer"
+	case jsonNumber:
+		return "number"
+	case jsonString:
+		return "string"
+	case jsonArray:
+		return "array"
+	case jsonObject:
+		return "object"
+	default:
+		return "null"
+	}
+}
+
+// jsonValue is a node of a JSON document. Documents are kept parsed so
+// paths can update them in place, objects remember the order their
+// members were added in
+type jsonValue struct {
+	kind    jsonKind
+	boolean bool
+	integer int64
+	number  float64
+	str     string
+	items   []*jsonValue
+	keys    []string
+	members map[string]*jsonValue
+}
+
+func newJSONObject() *jsonValue {
+	return &jsonValue{kind: jsonObject, members: make(map[string]*jsonValue)}
+}
+
+func (value *jsonValue) isNumeric() bool {
+	return value.kind == jsonInteger || value.kind == jsonNumber
+}
+
+func (value *jsonValue) float() float64 {
+	if value.kind == jsonInteger {
+		return float64(value.integer)
+	}
+	return value.number
+}
+
+// set adds or replaces the member key of an object
+func (value *jsonValue) set(key string, member *jsonValue) {
+	if _, ok := value.members[key]; !ok {
+		value.keys = append(value.keys, key)
+	}
+	value.members[key] = member
+}
+
+func (value *jsonValue) removeMember(key string) bool {
+	if _, ok := value.members[key]; !ok {
+		return false
+	}
+	delete(value.members, key)
+	for i, existing := range value.keys {
+		if existing == key {
+			value.keys = append(value.keys[:i], value.keys[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+func (value *jsonValue) clone() *jsonValue {
+	copied := *value
+	if value.items != nil {
+		copied.items = make([]*jsonValue, len(value.items))
+		for i, item := range value.items {
+			copied.items[i] = item.clone()
+		}
+	}
+	if value.members != nil {
+		copied.keys = append([]string(nil), value.keys...)
+		copied.members = make(map[string]*jsonValue, len(value.members))
+		for key, member := range value.members {
+			copied.members[key] = member.clone()
+		}
+	}
+	return &copied
+}
+
+// parseJSON parses a complete JSON text. Numbers without a fraction or
+// exponent that fit an int64 are kept as integers
+func parseJSON(text []byte) (*jsonValue, error) {
+	decoder := json.NewDecoder(bytes.NewReader(text))
+	decoder.UseNumber()
+	value, err := decodeJSONValue(decoder)
+	if err != nil {
+		return nil, errInvalidJSON
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, errInvalidJSON
+	}
+	return value, nil
+}
+
+func decodeJSONValue(decoder *json.Decoder) (*jsonValue, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch token := token.(type) {
+	case nil:
+		return &jsonValue{kind: jsonNull}, nil
+	case bool:
+		return &jsonValue{kind: jsonBoolean, boolean: token}, nil
+	case string:
+		return &jsonValue{kind: jsonString, str: token}, nil
+	case json.Number:
+		return parseJSONNumber(string(token))
+	case json.Delim:
+		if token == '[' {
+			array := &jsonValue{kind: jsonArray, items: []*jsonValue{}}
+			for decoder.More() {
+				item, err := decodeJSONValue(decoder)
+				if err != nil {
+					return nil, err
+				}
+				array.items = append(array.items, item)
+			}
+			_, err := decoder.Token()
+			return array, err
+		}
+		object := newJSONObject()
+		for decoder.More() {
+			key, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			member, err := decodeJSONValue(decoder)
+			if err != nil {
+				return nil, err
+			}
+			object.set(key.(string), member)
+		}
+		_, err := decoder.Token()
+		return object, err
+	}
+	return nil, errInvalidJSON
+}
+
+func parseJSONNumber(text string) (*jsonValue, error) {
+	if !strings.ContainsAny(text, ".eE") {
+		if integer, err := strconv.ParseInt(text, 10, 64); err == nil {
+			return &jsonValue{kind: jsonInteger, integer: integer}, nil
+		}
+	}
+	number, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonValue{kind: jsonNumber, number: number}, nil
+}
+
+// jsonFormat is the INDENT, NEWLINE and SPACE options of JSON.GET, the
+// zero value writes compact JSON
+type jsonFormat struct {
+	indent  string
+	newline string
+	space   string
+}
+
+func (value *jsonValue) serialize() []byte {
+	return value.appendTo(nil, jsonFormat{}, 0)
+}
+
+func (value *jsonValue) appendTo(result []byte, format jsonFormat, depth int) []byte {
+	switch value.kind {
+	case jsonNull:
+		return append(result, "null"...)
+	case jsonBoolean:
+		return strconv.AppendBool(result, value.boolean)
+	case jsonInteger:
+		return strconv.AppendInt(result, value.integer, 10)
+	case jsonNumber:
+		return appendJSONFloat(result, value.number)
+	case jsonString:
+		return appendJSONString(result, value.str)
+	case jsonArray:
+		if len(value.items) == 0 {
+			return append(result, "[]"...)
+		}
+		result = append(result, '[')
+		for i, item := range value.items {
+			if i > 0 {
+				result = append(result, ',')
+			}
+			result = format.appendLine(result, depth+1)
+			result = item.appendTo(result, format, depth+1)
+		}
+		result = format.appendLine(result, depth)
+		return append(result, ']')
+	default:
+		if len(value.keys) == 0 {
+			return append(result, "{}"...)
+		}
+		result = append(result, '{')
+		for i, key := range value.keys {
+			if i > 0 {
+				result = append(result, ',')
+			}
+			result = format.appendLine(result, depth+1)
+			result = appendJSONString(result, key)
+			result = append(result, ':')
+			result = append(result, format.space...)
+			result = value.members[key].appendTo(result, format, depth+1)
+		}
+		result = format.appendLine(result, depth)
+		return append(result, '}')
+	}
+}
+
+func (format jsonFormat) appendLine(result []byte, depth int) []byte {
+	result = append(result, format.newline...)
+	for ; depth > 0; depth-- {
+		result = append(result, format.indent...)
+	}
+	return result
+}
+
+// serializeJSONValues writes values as a JSON array, the reply shape of
+// every JSONPath query
+func serializeJSONValues(values []*jsonValue, format jsonFormat) []byte {
+	array := &jsonValue{kind: jsonArray, items: values}
+	return array.appendTo(nil, format, 0)
+}
+
+func appendJSONString(result []byte, value string) []byte {
+	const hex = "0123456789abcdef"
+	result = append(result, '"')
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '"':
+			result = append(result, `\"`...)
+		case '\\':
+			result = append(result, `\\`...)
+		case '\n':
+			result = append(result, `\n`...)
+		case '\r':
+			result = append(result, `\r`...)
+		case '\t':
+			result = append(result, `\t`...)
+		case '\b':
+			result = append(result, `\b`...)
+		case '\f':
+			result = append(result, `\f`...)
+		default:
+			if c < 0x20 {
+				result = append(result, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xf])
+			} else {
+				result = append(result, c)
+			}
+		}
+	}
+	return append(result, '"')
+}
+
+// appendJSONFloat writes floats the way RedisJSON does, always with a
+// fraction or exponent so they read back as floats, switching to an
+// exponent outside 1e-5 to 1e16
+func appendJSONFloat(result []byte, value float64) []byte {
+	scientific := strconv.FormatFloat(value, 'e', -1, 64)
+	mantissa, exponentText, _ := strings.Cut(scientific, "e")
+	exponent, _ := strconv.Atoi(exponentText)
+	if exponent < -5 || exponent > 15 {
+		result = append(result, mantissa...)
+		result = append(result, 'e')
+		return strconv.AppendInt(result, int64(exponent), 10)
+	}
+	formatted := strconv.FormatFloat(value, 'f', -1, 64)
+	result = append(result, formatted...)
+	if !strings.Contains(formatted, ".") {
+		result = append(result, ".0"...)
+	}
+	return result
+}
+
+func (entry *Entry) json() *jsonValue {
+	return entry.value.(*jsonValue)
+}
+
+func newJSONEntry(document *jsonValue) *Entry {
+	entry := newEntry()
+	entry.objectType = jsonType
+	entry.encoding = encodingJSON
+	entry.value = document
+	return entry
+}
+
+var (
+	errJSONNotRoot        = errors.New("ERR new objects must be created at the root")
+	errJSONMissingKey     = errors.New("ERR could not perform this operation on a key that doesn't exist")
+	errJSONNotNumber      = errors.New("ERR expected a number")
+	errJSONNumberOverflow = errors.New("ERR result is not a number or overflows")
+)
+
+// matches evaluates path against root, a legacy path only ever points at
+// the first value it matches
+func (path jsonPath) matches(root *jsonValue) []jsonMatch {
+	matches := path.evaluate(root)
+	if path.legacy && len(matches) > 1 {
+		matches = matches[:1]
+	}
+	return matches
+}
+
+// replyPerMatch answers with reply for each value path matches, reply
+// returns false when the value isn't of the expected type. JSONPaths get
+// an array with a null in those places, legacy paths the reply for the
+// value they point at or an error
+func replyPerMatch(path jsonPath, root *jsonValue, expected string, reply func(*jsonValue) ([]byte, bool)) []byte {
+	matches := path.matches(root)
+	if path.legacy {
+		if len(matches) == 0 {
+			return encodeError(missingPathError(path))
+		}
+		result, ok := reply(matches[0].value)
+		if !ok {
+			return encodeError(wrongPathTypeError(expected, matches[0].value.kind))
+		}
+		return result
+	}
+	items := make([][]byte, len(matches))
+	for i, match := range matches {
+		result, ok := reply(match.value)
+		if !ok {
+			result = nullBulkReply
+		}
+		items[i] = result
+	}
+	return encodeRawArray(items)
+}
+
+// parseOptionalPath returns the path argument at position, the root when
+// it isn't given
+func parseOptionalPath(messages [][]byte, position int) (jsonPath, error) {
+	if position < len(messages) {
+		return parseJSONPath(string(messages[position]))
+	}
+	return parseJSONPath(".")
+}
+
+// jsonRead is the shape of the commands taking a key and an optional path
+// that report something about each value matched
+func (kvstore *KVStore) jsonRead(messages [][]byte, command string, expected string, reply func(*jsonValue) ([]byte, bool)) []byte {
+	if len(messages) != 2 && len(messages) != 3 {
+		return wrongArgumentsError(command)
+	}
+	path, err := parseOptionalPath(messages, 2)
+	if err != nil {
+		return encodeError(err)
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedRead(string(messages[1]), jsonType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return nullBulkReply
+	}
+	return replyPerMatch(path, entry.json(), expected, reply)
+}
+
+func (kvstore *KVStore) handleJSONSET(messages [][]byte) []byte {
+	if len(messages) < 4 {
+		return wrongArgumentsError("json.set")
+	}
+	path, err := parseJSONPath(string(messages[2]))
+	if err != nil {
+		return encodeError(err)
+	}
+	value, err := parseJSON(messages[3])
+	if err != nil {
+		return encodeError(err)
+	}
+	nx, xx := false, false
+	for _, option := range messages[4:] {
+		switch strings.ToUpper(string(option)) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		default:
+			return encodeError(errSyntax)
+		}
+	}
+	if nx && xx {
+		return encodeError(errSyntax)
+	}
+
+	key := string(messages[1])
+	kvstore.lockKeys(key)
+	defer kvstore.unlockKeys(key)
+
+	entry, err := kvstore.lookupTypedWrite(key, jsonType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		if xx {
+			return nullBulkReply
+		}
+		if !path.isRoot() {
+			return encodeError(errJSONNotRoot)
+		}
+		kvstore.setKey(key, newJSONEntry(value))
+		return okReply
+	}
+
+	// values are replaced in place so anything holding them sees the change
+	if matches := path.matches(entry.json()); len(matches) > 0 {
+		if nx {
+			return nullBulkReply
+		}
+		for i, match := range matches {
+			replacement := value
+			if i > 0 {
+				replacement = value.clone()
+			}
+			*match.value = *replacement
+		}
+		return okReply
+	}
+
+	// a missing member of an existing object is added to it
+	last := path.steps[len(path.steps)-1]
+	if xx || last.kind != stepName || last.recursive {
+		return nullBulkReply
+	}
+	added := 0
+	for _, parent := range evaluateSteps(path.steps[:len(path.steps)-1], entry.json()) {
+		if parent.value.kind != jsonObject {
+			continue
+		}
+		replacement := value
+		if added > 0 {
+			replacement = value.clone()
+		}
+		parent.value.set(last.name, replacement)
+		added++
+		if path.legacy {
+			break
+		}
+	}
+	if added == 0 {
+		return nullBulkReply
+	}
+	return okReply
+}
+
+// selectMatches is the JSON.GET result for one path, every match in a
+// JSON array for a JSONPath or the single value for a legacy path
+func selectMatches(path jsonPath, root *jsonValue) (*jsonValue, error) {
+	matches := path.matches(root)
+	if path.legacy {
+		if len(matches) == 0 {
+			return nil, missingPathError(path)
+		}
+		return matches[0].value, nil
+	}
+	values := make([]*jsonValue, len(matches))
+	for i, match := range matches {
+		values[i] = match.value
+	}
+	return &jsonValue{kind: jsonArray, items: values}, nil
+}
+
+func (kvstore *KVStore) handleJSONGET(messages [][]byte) []byte {
+	if len(messages) < 2 {
+		return wrongArgumentsError("json.get")
+	}
+	var format jsonFormat
+	position := 2
+optionLoop:
+	for ; position+1 < len(messages); position += 2 {
+		switch strings.ToUpper(string(messages[position])) {
+		case "INDENT":
+			format.indent = string(messages[position+1])
+		case "NEWLINE":
+			format.newline = string(messages[position+1])
+		case "SPACE":
+			format.space = string(messages[position+1])
+		default:
+			break optionLoop
+		}
+	}
+	var paths []jsonPath
+	legacy := true
+	for _, text := range messages[position:] {
+		path, err := parseJSONPath(string(text))
+		if err != nil {
+			return encodeError(err)
+		}
+		legacy = legacy && path.legacy
+		paths = append(paths, path)
+	}
+	if len(paths) == 0 {
+		root, _ := parseJSONPath(".")
+		paths = append(paths, root)
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedRead(string(messages[1]), jsonType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return nullBulkReply
+	}
+
+	if len(paths) == 1 {
+		result, err := selectMatches(paths[0], entry.json())
+		if err != nil {
+			return encodeError(err)
+		}
+		return encodeBulkString(result.appendTo(nil, format, 0))
+	}
+
+	// several paths reply with an object keyed by path, as JSONPath
+	// results unless every path is a legacy one
+	result := newJSONObject()
+	for _, path := range paths {
+		if !legacy {
+			path.legacy = false
+		}
+		value, err := selectMatches(path, entry.json())
+		if err != nil {
+			return encodeError(err)
+		}
+		result.set(path.text, value)
+	}
+	return encodeBulkString(result.appendTo(nil, format, 0))
+}
+
+func (kvstore *KVStore) handleJSONMGET(messages [][]byte) []byte {
+	if len(messages) < 3 {
+		return wrongArgumentsError("json.mget")
+	}
+	path, err := parseJSONPath(string(messages[len(messages)-1]))
+	if err != nil {
+		return encodeError(err)
+	}
+
+	keys := keyStrings(messages[1 : len(messages)-1])
+	kvstore.rlockKeys(keys...)
+	defer kvstore.runlockKeys(keys...)
+
+	items := make([][]byte, len(keys))
+	for i, key := range keys {
+		items[i] = nullBulkReply
+		entry, err := kvstore.lookupTypedRead(key, jsonType)
+		if err != nil || entry == nil {
+			continue
+		}
+		if value, err := selectMatches(path, entry.json()); err == nil {
+			items[i] = encodeBulkString(value.serialize())
+		}
+	}
+	return encodeRawArray(items)
+}
+
+func (kvstore *KVStore) handleJSONDEL(messages [][]byte) []byte {
+	if len(messages) != 2 && len(messages) != 3 {
+		return wrongArgumentsError(string(messages[0]))
+	}
+	path, err := parseOptionalPath(messages, 2)
+	if err != nil {
+		return encodeError(err)
+	}
+
+	key := string(messages[1])
+	kvstore.lockKeys(key)
+	defer kvstore.unlockKeys(key)
+
+	entry, err := kvstore.lookupTypedWrite(key, jsonType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return encodeInteger(0)
+	}
+	if path.isRoot() {
+		kvstore.deleteKey(key)
+		return encodeInteger(1)
+	}
+	deleted := 0
+	for _, match := range path.matches(entry.json()) {
+		if match.remove() {
+			deleted++
+		}
+	}
+	return encodeInteger(int64(deleted))
+}
+
+func (kvstore *KVStore) handleJSONTYPE(messages [][]byte) []byte {
+	return kvstore.jsonRead(messages, "json.type", "", func(value *jsonValue) ([]byte, bool) {
+		return encodeBulkString([]byte(value.kind.String())), true
+	})
+}
+
+func (kvstore *KVStore) handleJSONSTRLEN(messages [][]byte) []byte {
+	return kvstore.jsonRead(messages, "json.strlen", "string", func(value *jsonValue) ([]byte, bool) {
+		return encodeInteger(int64(len(value.str))), value.kind == jsonString
+	})
+}
+
+func (kvstore *KVStore) handleJSONARRLEN(messages [][]byte) []byte {
+	return kvstore.jsonRead(messages, "json.arrlen", "array", func(value *jsonValue) ([]byte, bool) {
+		return encodeInteger(int64(len(value.items))), value.kind == jsonArray
+	})
+}
+
+func (kvstore *KVStore) handleJSONOBJLEN(messages [][]byte) []byte {
+	return kvstore.jsonRead(messages, "json.objlen", "object", func(value *jsonValue) ([]byte, bool) {
+		return encodeInteger(int64(len(value.keys))), value.kind == jsonObject
+	})
+}
+
+func (kvstore *KVStore) handleJSONOBJKEYS(messages [][]byte) []byte {
+	return kvstore.jsonRead(messages, "json.objkeys", "object", func(value *jsonValue) ([]byte, bool) {
+		keys := make([][]byte, len(value.keys))
+		for i, key := range value.keys {
+			keys[i] = []byte(key)
+		}
+		return encodeArray(keys), value.kind == jsonObject
+	})
+}
+
+func (kvstore *KVStore) handleJSONARRAPPEND(messages [][]byte) []byte {
+	if len(messages) < 4 {
+		return wrongArgumentsError("json.arrappend")
+	}
+	path, err := parseJSONPath(string(messages[2]))
+	if err != nil {
+		return encodeError(err)
+	}
+	values := make([]*jsonValue, len(messages)-3)
+	for i, text := range messages[3:] {
+		if values[i], err = parseJSON(text); err != nil {
+			return encodeError(err)
+		}
+	}
+
+	kvstore.lockKeys(string(messages[1]))
+	defer kvstore.unlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedWrite(string(messages[1]), jsonType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return encodeError(errJSONMissingKey)
+	}
+	return replyPerMatch(path, entry.json(), "array", func(array *jsonValue) ([]byte, bool) {
+		if array.kind != jsonArray {
+			return nil, false
+		}
+		for _, value := range values {
+			array.items = append(array.items, value.clone())
+		}
+		return encodeInteger(int64(len(array.items))), true
+	})
+}
+
+// applyNumber combines two JSON numbers, staying with integers unless
+// either side is a float or the integer result overflows
+func applyNumber(current *jsonValue, operand *jsonValue, multiply bool) (*jsonValue, error) {
+	if current.kind == jsonInteger && operand.kind == jsonInteger {
+		a, b := current.integer, operand.integer
+		if multiply {
+			if result := a * b; a == 0 || (result/a == b && !(a == -1 && b == math.MinInt64) && !(b == -1 && a == math.MinInt64)) {
+				return &jsonValue{kind: jsonInteger, integer: result}, nil
+			}
+		} else if result := a + b; (result > a) == (b > 0) {
+			return &jsonValue{kind: jsonInteger, integer: result}, nil
+		}
+	}
+	result := current.float() + operand.float()
+	if multiply {
+		result = current.float() * operand.float()
+	}
+	if math.IsNaN(result) || math.IsInf(result, 0) {
+		return nil, errJSONNumberOverflow
+	}
+	return &jsonValue{kind: jsonNumber, number: result}, nil
+}
+
+// numberOperation is JSON.NUMINCRBY and JSON.NUMMULTBY. JSONPaths reply
+// with a JSON array of the new values, null where the value wasn't a number
+func (kvstore *KVStore) numberOperation(messages [][]byte, command string, multiply bool) []byte {
+	if len(messages) != 4 {
+		return wrongArgumentsError(command)
+	}
+	path, err := parseJSONPath(string(messages[2]))
+	if err != nil {
+		return encodeError(err)
+	}
+	operand, err := parseJSON(messages[3])
+	if err != nil || !operand.isNumeric() {
+		return encodeError(errJSONNotNumber)
+	}
+
+	kvstore.lockKeys(string(messages[1]))
+	defer kvstore.unlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedWrite(string(messages[1]), jsonType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return encodeError(errJSONMissingKey)
+	}
+
+	matches := path.matches(entry.json())
+	if path.legacy && len(matches) == 0 {
+		return encodeError(missingPathError(path))
+	}
+	// work out every result first so an overflow leaves the document as is
+	results := make([]*jsonValue, len(matches))
+	for i, match := range matches {
+		if !match.value.isNumeric() {
+			if path.legacy {
+				return encodeError(wrongPathTypeError("number", match.value.kind))
+			}
+			results[i] = &jsonValue{kind: jsonNull}
+			continue
+		}
+		if results[i], err = applyNumber(match.value, operand, multiply); err != nil {
+			return encodeError(err)
+		}
+	}
+	for i, match := range matches {
+		if results[i].kind != jsonNull {
+			*match.value = *results[i]
+		}
+	}
+	if path.legacy {
+		return encodeBulkString(results[0].serialize())
+	}
+	return encodeBulkString(serializeJSONValues(results, jsonFormat{}))
+}
+
+func (kvstore *KVStore) handleJSONNUMINCRBY(messages [][]byte) []byte {
+	return kvstore.numberOperation(messages, "json.numincrby", false)
+}
+
+func (kvstore *KVStore) handleJSONNUMMULTBY(messages [][]byte) []byte {
+	return kvstore.numberOperation(messages, "json.nummultby", true)
+}
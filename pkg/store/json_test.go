@@ -0,0 +1,124 @@
+package store
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestJSONPaths(t *testing.T) {
+	kvstore := newKVStore()
+	kvstore.handleJSONSET(command("JSON.SET", "doc", "$", `{"a":2,"b":{"a":3.5,"c":[1,2,3]},"s":"x\ny"}`))
+
+	cases := []struct {
+		handler   func([][]byte) []byte
+		arguments []string
+		expected  string
+	}{
+		{kvstore.handleJSONGET, []string{"JSON.GET", "doc", "$..a"}, "[2,3.5]"},
+		{kvstore.handleJSONGET, []string{"JSON.GET", "doc", "$.b.c[-1]"}, "[3]"},
+		{kvstore.handleJSONGET, []string{"JSON.GET", "doc", "$.b.c[:2]"}, "[1,2]"},
+		{kvstore.handleJSONGET, []string{"JSON.GET", "doc", "$['b'][\"c\"][1]"}, "[2]"},
+		{kvstore.handleJSONGET, []string{"JSON.GET", "doc", "$.b.*"}, "[3.5,[1,2,3]]"},
+		{kvstore.handleJSONGET, []string{"JSON.GET", "doc", ".s"}, `"x\ny"`},
+		{kvstore.handleJSONGET, []string{"JSON.GET", "doc", "b.c"}, "[1,2,3]"},
+		{kvstore.handleJSONGET, []string{"JSON.GET", "doc", "$.missing"}, "[]"},
+		{kvstore.handleJSONGET, []string{"JSON.GET", "doc", ".a", ".b.a"}, `{".a":2,".b.a":3.5}`},
+		{kvstore.handleJSONNUMINCRBY, []string{"JSON.NUMINCRBY", "doc", "$..a", "1"}, "[3,4.5]"},
+		{kvstore.handleJSONNUMMULTBY, []string{"JSON.NUMMULTBY", "doc", "$.*", "2"}, "[6,null,null]"},
+		{kvstore.handleJSONNUMINCRBY, []string{"JSON.NUMINCRBY", "doc", ".a", "9223372036854775807"}, "9.223372036854776e18"},
+	}
+	for _, tc := range cases {
+		if reply := tc.handler(command(tc.arguments...)); string(reply) != string(encodeBulkString([]byte(tc.expected))) {
+			t.Errorf("%v expected %q, got %q", tc.arguments, tc.expected, reply)
+		}
+	}
+
+	if reply := kvstore.handleJSONGET(command("JSON.GET", "doc", ".missing")); string(reply) != "-ERR Path '$.missing' does not exist\r\n" {
+		t.Errorf("a missing legacy path should be an error, got %q", reply)
+	}
+	if reply := kvstore.handleJSONGET(command("JSON.GET", "doc", "$.b[")); string(reply) != "-ERR invalid JSONPath '$.b['\r\n" {
+		t.Errorf("expected an invalid path error, got %q", reply)
+	}
+	if reply := kvstore.handleJSONSTRLEN(command("JSON.STRLEN", "doc", ".b")); string(reply) != "-WRONGTYPE wrong type of path value - expected string but found object\r\n" {
+		t.Errorf("expected a wrong type error, got %q", reply)
+	}
+}
+
+func TestJSONUpdatesInPlace(t *testing.T) {
+	kvstore := newKVStore()
+	kvstore.handleJSONSET(command("JSON.SET", "doc", ".", `{"user":{"name":"ann"},"tags":[]}`))
+	document := kvstore.find("doc").json()
+	user := document.members["user"]
+
+	kvstore.handleJSONSET(command("JSON.SET", "doc", "$.user.age", "30"))
+	kvstore.handleJSONSET(command("JSON.SET", "doc", "$.user.name", `"bob"`))
+	kvstore.handleJSONARRAPPEND(command("JSON.ARRAPPEND", "doc", "$.tags", `"a"`, `{"b":1}`))
+	if got := string(user.serialize()); got != `{"name":"bob","age":30}` {
+		t.Errorf("the cached user object should see the updates, got %s", got)
+	}
+	if reply := kvstore.handleJSONSET(command("JSON.SET", "doc", "$.user.age", "1", "NX")); string(reply) != string(nullBulkReply) {
+		t.Errorf("NX on an existing path should reply nil, got %q", reply)
+	}
+	if reply := kvstore.handleJSONSET(command("JSON.SET", "other", "$.a", "1")); string(reply) != string(encodeError(errJSONNotRoot)) {
+		t.Errorf("new keys must start at the root, got %q", reply)
+	}
+
+	if reply := kvstore.handleJSONDEL(command("JSON.DEL", "doc", "$..name")); string(reply) != ":1\r\n" {
+		t.Errorf("expected 1 deleted, got %q", reply)
+	}
+	if reply := kvstore.handleJSONOBJKEYS(command("JSON.OBJKEYS", "doc", "$.user")); string(reply) != "*1\r\n"+string(encodeArray(command("age"))) {
+		t.Errorf("unexpected keys %q", reply)
+	}
+	if got := string(document.serialize()); got != `{"user":{"age":30},"tags":["a",{"b":1}]}` {
+		t.Errorf("unexpected document %s", got)
+	}
+}
+
+func TestJSONModuleRDBRoundTrip(t *testing.T) {
+	if id := jsonModuleType.id(); id != 0x45e25238df912c03 {
+		t.Fatalf("unexpected ReJSON-RL module id %x", id)
+	}
+	if name, version := decodeModuleID(jsonModuleType.id()); name != "ReJSON-RL" || version != 3 {
+		t.Errorf("decoded %s version %d", name, version)
+	}
+
+	document, _ := parseJSON([]byte(`{"a":[1,2.5,"three",null,true],"b":{}}`))
+	var writer rdbWriter
+	if !writer.writeModuleObject("doc", newJSONEntry(document)) {
+		t.Fatalf("JSON should be saved as a module value")
+	}
+	reader := &rdbReader{bytes.NewReader(writer.Bytes())}
+	if valueType, _ := reader.ReadByte(); valueType != rdbTypeModule2 {
+		t.Fatalf("expected value type %d, got %d", rdbTypeModule2, valueType)
+	}
+	key, entry, err := reader.readModuleObject()
+	if err != nil {
+		t.Fatalf("reading back: %v", err)
+	}
+	if key != "doc" || string(entry.json().serialize()) != string(document.serialize()) {
+		t.Errorf("round trip gave %s = %s", key, entry.json().serialize())
+	}
+}
+
+func TestJSONSurvivesSaveAndRestart(t *testing.T) {
+	options := Options{Dir: t.TempDir(), DBFilename: "dump.rdb"}
+	source := reopen(t, options)
+	client := newTestClient()
+	execute(t, source, client, "JSON.SET", "doc", "$", `{"name":"Ada","tags":["a","b"],"visits":3}`)
+	execute(t, source, client, "JSON.NUMINCRBY", "doc", "$.visits", "1")
+	execute(t, source, client, "SET", "plain", "value")
+	if got := execute(t, source, client, "SAVE"); got != string(okReply) {
+		t.Fatalf("expected SAVE to succeed, got %q", got)
+	}
+
+	loaded := reopen(t, options)
+	if got := execute(t, loaded, client, "JSON.GET", "doc"); got != string(encodeBulkString([]byte(`{"name":"Ada","tags":["a","b"],"visits":4}`))) {
+		t.Errorf("expected the document to survive, got %q", got)
+	}
+	if got := execute(t, loaded, client, "JSON.ARRAPPEND", "doc", "$.tags", `"c"`); got != "*1\r\n:3\r\n" {
+		t.Errorf("expected the loaded document to be mutable, got %q", got)
+	}
+	if got := execute(t, loaded, client, "GET", "plain"); got != "$5\r\nvalue\r\n" {
+		t.Errorf("expected the string next to it to survive, got %q", got)
+	}
+}
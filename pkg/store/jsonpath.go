@@ -0,0 +1,295 @@
+package store
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The JSON commands take either a JSONPath starting with $, which can
+// match any number of values and replies with all of them, or a legacy
+// path such as .a.b[0] that stands for the single value it points at.
+// The JSONPath subset supported is
+//
+//	$            the root
+//	.name        a member, also ['name'] or ["name"]
+//	[n]          an array element, negative counts from the end
+//	[start:end]  a slice of an array, either bound can be left out
+//	.* or [*]    every member or element
+//	..step       step applied to the value and all of its descendants
+type jsonPathStepKind int
+
+const (
+	stepName jsonPathStepKind = iota
+	stepIndex
+	stepSlice
+	stepWildcard
+)
+
+type jsonPathStep struct {
+	kind      jsonPathStepKind
+	recursive bool
+	name      string
+	index     int
+	start     *int
+	end       *int
+}
+
+type jsonPath struct {
+	text   string
+	legacy bool
+	steps  []jsonPathStep
+}
+
+func invalidPathError(text string) error {
+	return fmt.Errorf("ERR invalid JSONPath '%s'", text)
+}
+
+func missingPathError(path jsonPath) error {
+	return fmt.Errorf("ERR Path '%s' does not exist", path.normalized())
+}
+
+func wrongPathTypeError(expected string, found jsonKind) error {
+	return fmt.Errorf("WRONGTYPE wrong type of path value - expected %s but found %s", expected, found)
+}
+
+// normalized is the JSONPath form of the path, what errors report
+func (path jsonPath) normalized() string {
+	if !path.legacy {
+		return path.text
+	}
+	switch {
+	case path.text == ".":
+		return "$"
+	case strings.HasPrefix(path.text, ".") || strings.HasPrefix(path.text, "["):
+		return "$" + path.text
+	}
+	return "$." + path.text
+}
+
+func (path jsonPath) isRoot() bool {
+	return len(path.steps) == 0
+}
+
+func parseJSONPath(text string) (jsonPath, error) {
+	path := jsonPath{text: text, legacy: !strings.HasPrefix(text, "$")}
+	rest := strings.TrimPrefix(path.normalized(), "$")
+
+	for len(rest) > 0 {
+		var step jsonPathStep
+		// ..name and ..[n] are .name and [n] applied recursively
+		if strings.HasPrefix(rest, "..") {
+			step.recursive = true
+			rest = rest[1:]
+			if strings.HasPrefix(rest, ".[") {
+				rest = rest[1:]
+			}
+		}
+
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			name := rest[:end]
+			rest = rest[end:]
+			switch {
+			case name == "":
+				return path, invalidPathError(text)
+			case name == "*":
+				step.kind = stepWildcard
+			default:
+				step.kind = stepName
+				step.name = name
+			}
+		case '[':
+			var err error
+			if step, rest, err = parseBracketStep(rest, step); err != nil {
+				return path, invalidPathError(text)
+			}
+		default:
+			return path, invalidPathError(text)
+		}
+		path.steps = append(path.steps, step)
+	}
+	return path, nil
+}
+
+// parseBracketStep parses a [...] selector at the start of rest
+func parseBracketStep(rest string, step jsonPathStep) (jsonPathStep, string, error) {
+	rest = rest[1:]
+	if len(rest) > 0 && (rest[0] == '\'' || rest[0] == '"') {
+		quote := rest[0]
+		var name strings.Builder
+		i := 1
+		for ; i < len(rest) && rest[i] != quote; i++ {
+			if rest[i] == '\\' && i+1 < len(rest) {
+				i++
+			}
+			name.WriteByte(rest[i])
+		}
+		if i+1 >= len(rest) || rest[i+1] != ']' {
+			return step, "", errSyntax
+		}
+		step.kind = stepName
+		step.name = name.String()
+		return step, rest[i+2:], nil
+	}
+
+	end := strings.IndexByte(rest, ']')
+	if end < 0 {
+		return step, "", errSyntax
+	}
+	selector := strings.TrimSpace(rest[:end])
+	rest = rest[end+1:]
+	if selector == "*" {
+		step.kind = stepWildcard
+		return step, rest, nil
+	}
+	if startText, endText, ok := strings.Cut(selector, ":"); ok {
+		step.kind = stepSlice
+		for _, bound := range []struct {
+			text  string
+			value **int
+		}{{startText, &step.start}, {endText, &step.end}} {
+			if text := strings.TrimSpace(bound.text); text != "" {
+				parsed, err := strconv.Atoi(text)
+				if err != nil {
+					return step, "", err
+				}
+				*bound.value = &parsed
+			}
+		}
+		return step, rest, nil
+	}
+	index, err := strconv.Atoi(selector)
+	if err != nil {
+		return step, "", err
+	}
+	step.kind = stepIndex
+	step.index = index
+	return step, rest, nil
+}
+
+// jsonMatch is a value a path matched along with where it sits, parent is
+// nil for the root
+type jsonMatch struct {
+	value  *jsonValue
+	parent *jsonValue
+	key    string
+}
+
+func (path jsonPath) evaluate(root *jsonValue) []jsonMatch {
+	return evaluateSteps(path.steps, root)
+}
+
+func evaluateSteps(steps []jsonPathStep, root *jsonValue) []jsonMatch {
+	matches := []jsonMatch{{value: root}}
+	for _, step := range steps {
+		var next []jsonMatch
+		for _, match := range matches {
+			if step.recursive {
+				for _, descendant := range descendants(match) {
+					next = step.apply(descendant.value, next)
+				}
+				continue
+			}
+			next = step.apply(match.value, next)
+		}
+		matches = next
+	}
+	return matches
+}
+
+// descendants returns match and everything below it, depth first
+func descendants(match jsonMatch) []jsonMatch {
+	result := []jsonMatch{match}
+	switch match.value.kind {
+	case jsonArray:
+		for _, item := range match.value.items {
+			result = append(result, descendants(jsonMatch{value: item, parent: match.value})...)
+		}
+	case jsonObject:
+		for _, key := range match.value.keys {
+			result = append(result, descendants(jsonMatch{value: match.value.members[key], parent: match.value, key: key})...)
+		}
+	}
+	return result
+}
+
+// apply appends the children of value the step selects to matches
+func (step jsonPathStep) apply(value *jsonValue, matches []jsonMatch) []jsonMatch {
+	switch step.kind {
+	case stepName:
+		if value.kind == jsonObject {
+			if member, ok := value.members[step.name]; ok {
+				matches = append(matches, jsonMatch{value: member, parent: value, key: step.name})
+			}
+		}
+	case stepIndex:
+		if value.kind == jsonArray {
+			index := step.index
+			if index < 0 {
+				index += len(value.items)
+			}
+			if index >= 0 && index < len(value.items) {
+				matches = append(matches, jsonMatch{value: value.items[index], parent: value})
+			}
+		}
+	case stepSlice:
+		if value.kind == jsonArray {
+			start, end := 0, len(value.items)
+			if step.start != nil {
+				start = clampSliceBound(*step.start, len(value.items))
+			}
+			if step.end != nil {
+				end = clampSliceBound(*step.end, len(value.items))
+			}
+			for i := start; i < end; i++ {
+				matches = append(matches, jsonMatch{value: value.items[i], parent: value})
+			}
+		}
+	case stepWildcard:
+		switch value.kind {
+		case jsonArray:
+			for _, item := range value.items {
+				matches = append(matches, jsonMatch{value: item, parent: value})
+			}
+		case jsonObject:
+			for _, key := range value.keys {
+				matches = append(matches, jsonMatch{value: value.members[key], parent: value, key: key})
+			}
+		}
+	}
+	return matches
+}
+
+func clampSliceBound(bound int, length int) int {
+	if bound < 0 {
+		bound += length
+	}
+	return min(max(bound, 0), length)
+}
+
+// remove takes the matched value out of its parent, returning false for
+// the root or a value already removed
+func (match jsonMatch) remove() bool {
+	switch {
+	case match.parent == nil:
+		return false
+	case match.parent.kind == jsonObject:
+		if match.parent.members[match.key] != match.value {
+			return false
+		}
+		return match.parent.removeMember(match.key)
+	}
+	for i, item := range match.parent.items {
+		if item == match.value {
+			match.parent.items = append(match.parent.items[:i], match.parent.items[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package store
+
+import "strings"
+
+// handleDEL serves DEL and UNLINK, values are freed by the garbage
+// collector either way
+func (kvstore *KVStore) handleDEL(messages [][]byte) []byte {
+	if len(messages) < 2 {
+		return wrongArgumentsError(string(messages[0]))
+	}
+
+	keys := keyStrings(messages[1:])
+	kvstore.lockKeys(keys...)
+	defer kvstore.unlockKeys(keys...)
+
+	var deleted int64
+	for _, key := range keys {
+		if kvstore.lookupKeyWrite(key) != nil {
+			kvstore.deleteKey(key)
+			deleted++
+		}
+	}
+	return encodeInteger(deleted)
+}
+
+// handleMSET sets every key to its value at once, the shards of all the
+// keys are locked together so no reader sees some of the keys set and
+// others not
+func (kvstore *KVStore) handleMSET(messages [][]byte) []byte {
+	if len(messages) < 3 || len(messages)%2 == 0 {
+		return wrongArgumentsError("mset")
+	}
+
+	var keys []string
+	for i := 1; i < len(messages); i += 2 {
+		keys = append(keys, string(messages[i]))
+	}
+	kvstore.lockKeys(keys...)
+	defer kvstore.unlockKeys(keys...)
+
+	for i, key := range keys {
+		entry := newEntry()
+		entry.setString(messages[2*i+2])
+		kvstore.setKey(key, entry)
+	}
+	return okReply
+}
+
+// handleRENAME serves RENAME and RENAMENX, moving the value at the first
+// key, ttl and access metadata included, to the second
+func (kvstore *KVStore) handleRENAME(messages [][]byte) []byte {
+	if len(messages) != 3 {
+		return wrongArgumentsError(string(messages[0]))
+	}
+	onlyIfMissing := strings.EqualFold(string(messages[0]), "RENAMENX")
+	source := string(messages[1])
+	destination := string(messages[2])
+
+	kvstore.lockKeys(source, destination)
+	defer kvstore.unlockKeys(source, destination)
+
+	entry := kvstore.lookupKeyWrite(source)
+	if entry == nil {
+		return encodeError(errNoSuchKey)
+	}
+	if source == destination || (onlyIfMissing && kvstore.lookupKeyWrite(destination) != nil) {
+		if onlyIfMissing {
+			return encodeInteger(0)
+		}
+		return okReply
+	}
+
+	// setKey resets access metadata for a new entry, the renamed key keeps
+	// its own so eviction sees it as it was
+	access := entry.lru.Load()
+	kvstore.deleteKey(source)
+	kvstore.setKey(destination, entry)
+	entry.lru.Store(access)
+	kvstore.signalKeyAsReady(destination)
+	if onlyIfMissing {
+		return encodeInteger(1)
+	}
+	return okReply
+}
@@ -0,0 +1,109 @@
+package store
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestMSET(t *testing.T) {
+	kvstore := newKVStore()
+	client := newTestClient()
+	execute(t, kvstore, client, "LPUSH", "b", "old")
+	if got := execute(t, kvstore, client, "MSET", "a", "1", "b", "2", "a", "3"); got != string(okReply) {
+		t.Fatalf("expected OK, got %q", got)
+	}
+	for key, expected := range map[string]string{"a": "3", "b": "2"} {
+		if got := execute(t, kvstore, client, "GET", key); got != string(encodeBulkString([]byte(expected))) {
+			t.Errorf("expected %s to be %s, got %q", key, expected, got)
+		}
+	}
+	for _, arguments := range [][]string{{"MSET"}, {"MSET", "a"}, {"MSET", "a", "1", "b"}} {
+		if got := execute(t, kvstore, client, arguments...); got != string(wrongArgumentsError("mset")) {
+			t.Errorf("%v: expected a wrong number of arguments error, got %q", arguments, got)
+		}
+	}
+}
+
+func TestRENAME(t *testing.T) {
+	kvstore := newKVStore()
+	client := newTestClient()
+	execute(t, kvstore, client, "SET", "source", "value", "px", "60000")
+	expiry := kvstore.find("source").expiryTime
+	execute(t, kvstore, client, "LPUSH", "destination", "replaced")
+
+	if got := execute(t, kvstore, client, "RENAME", "source", "destination"); got != string(okReply) {
+		t.Fatalf("expected OK, got %q", got)
+	}
+	if kvstore.find("source") != nil {
+		t.Errorf("expected source to be gone")
+	}
+	if got := execute(t, kvstore, client, "GET", "destination"); got != string(encodeBulkString([]byte("value"))) {
+		t.Errorf("expected the value to replace the list, got %q", got)
+	}
+	if entry := kvstore.find("destination"); !entry.expiryTime.Equal(expiry) {
+		t.Errorf("expected the ttl to move with the key, got %v", entry.expiryTime)
+	}
+	if got := execute(t, kvstore, client, "RENAME", "destination", "destination"); got != string(okReply) {
+		t.Errorf("renaming a key to itself should succeed, got %q", got)
+	}
+	if got := execute(t, kvstore, client, "RENAME", "missing", "other"); got != string(encodeError(errNoSuchKey)) {
+		t.Errorf("expected a no such key error, got %q", got)
+	}
+
+	execute(t, kvstore, client, "SET", "taken", "1")
+	if got := execute(t, kvstore, client, "RENAMENX", "destination", "taken"); got != ":0\r\n" {
+		t.Errorf("RENAMENX shouldn't replace an existing key, got %q", got)
+	}
+	if got := execute(t, kvstore, client, "RENAMENX", "destination", "free"); got != ":1\r\n" {
+		t.Errorf("expected RENAMENX to rename, got %q", got)
+	}
+	if got := execute(t, kvstore, client, "GET", "free"); got != string(encodeBulkString([]byte("value"))) {
+		t.Errorf("expected the value under its new name, got %q", got)
+	}
+}
+
+func TestRENAMEServesBlockedClients(t *testing.T) {
+	kvstore := newKVStore()
+	client := newTestClient()
+	reply := executeBlocked(t, kvstore, "queue", 1, "BLPOP", "queue", "0")
+	execute(t, kvstore, client, "RPUSH", "staging", "job")
+	execute(t, kvstore, client, "RENAME", "staging", "queue")
+	if got := <-reply; got != string(encodeArray(command("queue", "job"))) {
+		t.Errorf("expected the renamed list to serve BLPOP, got %q", got)
+	}
+}
+
+func TestMSETAndRENAMEUnderMaxmemory(t *testing.T) {
+	kvstore := newKVStore()
+	client := newTestClient()
+	execute(t, kvstore, client, "SET", "a", "1")
+	configure(t, kvstore, "maxmemory", "1", "maxmemory-policy", "noeviction")
+	if got := execute(t, kvstore, client, "MSET", "b", "2"); got != string(encodeError(errOOM)) {
+		t.Errorf("expected MSET to be refused, got %q", got)
+	}
+	if got := execute(t, kvstore, client, "RENAME", "a", "b"); got != string(okReply) {
+		t.Errorf("RENAME doesn't grow the keyspace and should be allowed, got %q", got)
+	}
+}
+
+// Meant to be run with go test -race, MSET and RENAME on keys spread
+// over many shards would deadlock if they took locks out of order
+func TestMultiKeyCommandsDontDeadlock(t *testing.T) {
+	kvstore := newKVStore()
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client := newTestClient()
+			for i := 0; i < 200; i++ {
+				first := "key" + strconv.Itoa((worker+i)%16)
+				second := "key" + strconv.Itoa((worker*7+i)%16)
+				execute(t, kvstore, client, "MSET", second, "x", first, "y")
+				execute(t, kvstore, client, "RENAME", first, second)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,153 @@
+package store
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// These tests are meant to be run with go test -race, which fails them if
+// a reader ever writes the keyspace under the read lock
+
+// expireNow makes key expired without waiting on a real ttl
+func expireNow(kvstore *KVStore, key string) {
+	kvstore.lockKeys(key)
+	kvstore.find(key).expiryTime = time.Now().Add(-time.Second)
+	kvstore.unlockKeys(key)
+}
+
+func TestGETMissingAndWrongType(t *testing.T) {
+	kvstore := newKVStore()
+	if reply := string(kvstore.handleGET(command("GET", "missing"))); reply != "$-1\r\n" {
+		t.Errorf("GET of a missing key should be a null bulk string, got %q", reply)
+	}
+	kvstore.handleLPUSH(command("LPUSH", "list", "a"))
+	if reply := string(kvstore.handleGET(command("GET", "list"))); reply != string(encodeError(errWrongType)) {
+		t.Errorf("GET of a list should be WRONGTYPE, got %q", reply)
+	}
+	setString(kvstore, "k", "v")
+	if reply := string(kvstore.handleGET(command("GET", "k"))); reply != "$1\r\nv\r\n" {
+		t.Errorf("GET k = %q", reply)
+	}
+}
+
+func TestReadsRemoveExpiredKeys(t *testing.T) {
+	tests := []struct {
+		name   string
+		setup  []string
+		read   func(*KVStore, [][]byte) []byte
+		args   []string
+		expect string
+	}{
+		{"GET", []string{"SET", "k", "v"}, (*KVStore).handleGET, []string{"GET", "k"}, "$-1\r\n"},
+		{"HGET", []string{"HSET", "k", "f", "v"}, (*KVStore).handleHGET, []string{"HGET", "k", "f"}, "$-1\r\n"},
+		{"LRANGE", []string{"LPUSH", "k", "a"}, (*KVStore).handleLRANGE, []string{"LRANGE", "k", "0", "-1"}, "*0\r\n"},
+		{"SMEMBERS", []string{"SADD", "k", "a"}, (*KVStore).handleSMEMBERS, []string{"SMEMBERS", "k"}, "*0\r\n"},
+		{"ZSCORE", []string{"ZADD", "k", "1", "a"}, (*KVStore).handleZSCORE, []string{"ZSCORE", "k", "a"}, "$-1\r\n"},
+	}
+	writers := map[string]func(*KVStore, [][]byte) []byte{
+		"HSET":  (*KVStore).handleHSET,
+		"LPUSH": (*KVStore).handleLPUSH,
+		"SADD":  (*KVStore).handleSADD,
+		"ZADD":  (*KVStore).handleZADD,
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			kvstore := newKVStore()
+			if write, ok := writers[test.setup[0]]; ok {
+				write(kvstore, command(test.setup...))
+			} else {
+				kvstore.handleSET(command(test.setup...))
+			}
+			expireNow(kvstore, "k")
+
+			if reply := string(test.read(kvstore, command(test.args...))); reply != test.expect {
+				t.Errorf("%s of an expired key = %q, want %q", test.name, reply, test.expect)
+			}
+			if kvstore.find("k") != nil {
+				t.Errorf("%s should remove the expired key", test.name)
+			}
+		})
+	}
+}
+
+func TestLazyExpireRechecksUnderWriteLock(t *testing.T) {
+	kvstore := newKVStore()
+	setString(kvstore, "k", "old")
+	expireNow(kvstore, "k")
+
+	// a reader finds k expired, then a writer replaces it before the
+	// reader gets the write lock
+	kvstore.rlockKeys("k")
+	if kvstore.lookupKeyRead("k") != nil {
+		t.Fatalf("expired key should not be returned")
+	}
+	kvstore.shardFor("k").RUnlock()
+	kvstore.handleSET(command("SET", "k", "new"))
+	kvstore.expireLazily()
+
+	if reply := string(kvstore.handleGET(command("GET", "k"))); reply != "$3\r\nnew\r\n" {
+		t.Errorf("the replacement should survive, got %q", reply)
+	}
+}
+
+func TestConcurrentExpiringReadsAndWrites(t *testing.T) {
+	kvstore := newKVStore()
+	const keys = 16
+	deadline := time.Now().Add(200 * time.Millisecond)
+	var wg sync.WaitGroup
+	run := func(work func(key string)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; time.Now().Before(deadline); i++ {
+				work(strconv.Itoa(i % keys))
+			}
+		}()
+	}
+
+	for i := 0; i < 4; i++ {
+		run(func(key string) {
+			reply := string(kvstore.handleGET(command("GET", "s"+key)))
+			if reply != "$-1\r\n" && reply != "$1\r\nv\r\n" {
+				t.Errorf("unexpected GET reply %q", reply)
+			}
+		})
+		run(func(key string) {
+			kvstore.handleHGET(command("HGET", "h"+key, "f"))
+			kvstore.handleLRANGE(command("LRANGE", "l"+key, "0", "-1"))
+		})
+	}
+	run(func(key string) {
+		kvstore.handleSET(command("SET", "s"+key, "v", "px", "1"))
+	})
+	run(func(key string) {
+		kvstore.handleHSET(command("HSET", "h"+key, "f", "v"))
+		kvstore.handleHEXPIRE(command("HPEXPIRE", "h"+key, "1", "FIELDS", "1", "f"))
+	})
+	run(func(key string) {
+		kvstore.handleLPUSH(command("LPUSH", "l"+key, "a"))
+		kvstore.lockKeys("l" + key)
+		if entry := kvstore.find("l" + key); entry != nil {
+			entry.expiryTime = time.Now().Add(time.Millisecond)
+		}
+		kvstore.unlockKeys("l" + key)
+	})
+	run(func(key string) {
+		kvstore.handleDEL(command("DEL", "s"+key, "h"+key))
+	})
+	run(func(string) {
+		kvstore.activeExpireCycle(time.Millisecond)
+	})
+	wg.Wait()
+
+	// whatever is left must be consistent with the expires index
+	time.Sleep(5 * time.Millisecond)
+	kvstore.activeExpireCycle(time.Second)
+	for _, key := range expiring(kvstore) {
+		if kvstore.find(key) == nil {
+			t.Errorf("expires index holds removed key %s", key)
+		}
+	}
+}
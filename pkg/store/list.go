@@ -0,0 +1,626 @@
+package store
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	errNoSuchKey     = errors.New("ERR no such key")
+	errIndexOutRange = errors.New("ERR index out of range")
+	errNotPositive   = errors.New("ERR value is out of range, must be positive")
+	errNumkeys       = errors.New("ERR numkeys should be greater than 0")
+	errCount         = errors.New("ERR count should be greater than 0")
+)
+
+type listEnd int
+
+const (
+	listHead listEnd = iota
+	listTail
+)
+
+func parseListEnd(value []byte) (listEnd, error) {
+	switch strings.ToUpper(string(value)) {
+	case "LEFT":
+		return listHead, nil
+	case "RIGHT":
+		return listTail, nil
+	}
+	return 0, errSyntax
+}
+
+func (list *quicklist) push(end listEnd, value []byte) {
+	if end == listHead {
+		list.pushHead(value)
+	} else {
+		list.pushTail(value)
+	}
+}
+
+func (list *quicklist) pop(end listEnd) ([]byte, bool) {
+	if end == listHead {
+		return list.popHead()
+	}
+	return list.popTail()
+}
+
+// lookupOrCreateList returns the list at key, creating an empty one if the
+// key doesn't exist. Caller must hold the write lock
+func (kvstore *KVStore) lookupOrCreateList(key string) (*quicklist, error) {
+	entry, err := kvstore.lookupTypedWrite(key, listType)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		entry = newListEntry()
+		kvstore.setKey(key, entry)
+	}
+	return entry.list(), nil
+}
+
+func newListEntry() *Entry {
+	entry := newEntry()
+	entry.objectType = listType
+	entry.encoding = encodingQuicklist
+	entry.value = newQuicklist()
+	return entry
+}
+
+// removeIfEmptyList drops key once its list has no elements left, redis
+// never keeps empty collections around
+func (kvstore *KVStore) removeIfEmptyList(key string, list *quicklist) {
+	if list.Len() == 0 {
+		kvstore.deleteKey(key)
+	}
+}
+
+func (kvstore *KVStore) handleLPUSH(messages [][]byte) []byte {
+	return kvstore.pushGeneric(messages, listHead)
+}
+
+func (kvstore *KVStore) handleRPUSH(messages [][]byte) []byte {
+	return kvstore.pushGeneric(messages, listTail)
+}
+
+func (kvstore *KVStore) pushGeneric(messages [][]byte, end listEnd) []byte {
+	if len(messages) < 3 {
+		return wrongArgumentsError(string(messages[0]))
+	}
+
+	key := string(messages[1])
+	kvstore.lockKeys(key)
+	defer kvstore.unlockKeys(key)
+
+	list, err := kvstore.lookupOrCreateList(key)
+	if err != nil {
+		return encodeError(err)
+	}
+	for _, value := range messages[2:] {
+		list.push(end, value)
+	}
+	// the reply counts the elements before any blocked client takes them
+	reply := encodeInteger(int64(list.Len()))
+	kvstore.signalKeyAsReady(key)
+	return reply
+}
+
+func (kvstore *KVStore) handleLPOP(messages [][]byte) []byte {
+	return kvstore.popGeneric(messages, listHead)
+}
+
+func (kvstore *KVStore) handleRPOP(messages [][]byte) []byte {
+	return kvstore.popGeneric(messages, listTail)
+}
+
+func (kvstore *KVStore) popGeneric(messages [][]byte, end listEnd) []byte {
+	if len(messages) != 2 && len(messages) != 3 {
+		return wrongArgumentsError(string(messages[0]))
+	}
+
+	// with a count the reply is always an array, even for a single element
+	count := int64(-1)
+	if len(messages) == 3 {
+		var err error
+		count, err = parseInteger(messages[2])
+		if err != nil {
+			return encodeError(err)
+		}
+		if count < 0 {
+			return encodeError(errNotPositive)
+		}
+	}
+
+	key := string(messages[1])
+	kvstore.lockKeys(key)
+	defer kvstore.unlockKeys(key)
+
+	entry, err := kvstore.lookupTypedWrite(key, listType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		if count >= 0 {
+			return nullArrayReply
+		}
+		return nullBulkReply
+	}
+	list := entry.list()
+
+	if count < 0 {
+		value, _ := list.pop(end)
+		kvstore.removeIfEmptyList(key, list)
+		return encodeBulkString(value)
+	}
+
+	values := list.popMany(end, int(count))
+	kvstore.removeIfEmptyList(key, list)
+	return encodeArray(values)
+}
+
+func (kvstore *KVStore) handleLLEN(messages [][]byte) []byte {
+	if len(messages) != 2 {
+		return wrongArgumentsError("llen")
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedRead(string(messages[1]), listType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return encodeInteger(0)
+	}
+	return encodeInteger(int64(entry.list().Len()))
+}
+
+func (kvstore *KVStore) handleLRANGE(messages [][]byte) []byte {
+	if len(messages) != 4 {
+		return wrongArgumentsError("lrange")
+	}
+	start, err := parseInteger(messages[2])
+	if err != nil {
+		return encodeError(err)
+	}
+	end, err := parseInteger(messages[3])
+	if err != nil {
+		return encodeError(err)
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedRead(string(messages[1]), listType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return encodeArray(nil)
+	}
+	return encodeArray(entry.list().rangeOf(int(start), int(end)))
+}
+
+func (kvstore *KVStore) handleLINDEX(messages [][]byte) []byte {
+	if len(messages) != 3 {
+		return wrongArgumentsError("lindex")
+	}
+	index, err := parseInteger(messages[2])
+	if err != nil {
+		return encodeError(err)
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedRead(string(messages[1]), listType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return nullBulkReply
+	}
+	value, ok := entry.list().index(int(index))
+	if !ok {
+		return nullBulkReply
+	}
+	return encodeBulkString(value)
+}
+
+func (kvstore *KVStore) handleLSET(messages [][]byte) []byte {
+	if len(messages) != 4 {
+		return wrongArgumentsError("lset")
+	}
+	index, err := parseInteger(messages[2])
+	if err != nil {
+		return encodeError(err)
+	}
+
+	kvstore.lockKeys(string(messages[1]))
+	defer kvstore.unlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedWrite(string(messages[1]), listType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return encodeError(errNoSuchKey)
+	}
+	if !entry.list().set(int(index), messages[3]) {
+		return encodeError(errIndexOutRange)
+	}
+	return okReply
+}
+
+func (kvstore *KVStore) handleLINSERT(messages [][]byte) []byte {
+	if len(messages) != 5 {
+		return wrongArgumentsError("linsert")
+	}
+	var after bool
+	switch strings.ToUpper(string(messages[2])) {
+	case "BEFORE":
+		after = false
+	case "AFTER":
+		after = true
+	default:
+		return encodeError(errSyntax)
+	}
+
+	kvstore.lockKeys(string(messages[1]))
+	defer kvstore.unlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedWrite(string(messages[1]), listType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return encodeInteger(0)
+	}
+	list := entry.list()
+	if !list.insertByPivot(messages[3], messages[4], after) {
+		return encodeInteger(-1)
+	}
+	return encodeInteger(int64(list.Len()))
+}
+
+func (kvstore *KVStore) handleLREM(messages [][]byte) []byte {
+	if len(messages) != 4 {
+		return wrongArgumentsError("lrem")
+	}
+	count, err := parseInteger(messages[2])
+	if err != nil {
+		return encodeError(err)
+	}
+
+	key := string(messages[1])
+	kvstore.lockKeys(key)
+	defer kvstore.unlockKeys(key)
+
+	entry, err := kvstore.lookupTypedWrite(key, listType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return encodeInteger(0)
+	}
+	list := entry.list()
+	removed := list.removeMatching(messages[3], int(count))
+	kvstore.removeIfEmptyList(key, list)
+	return encodeInteger(int64(removed))
+}
+
+func (kvstore *KVStore) handleLTRIM(messages [][]byte) []byte {
+	if len(messages) != 4 {
+		return wrongArgumentsError("ltrim")
+	}
+	start, err := parseInteger(messages[2])
+	if err != nil {
+		return encodeError(err)
+	}
+	end, err := parseInteger(messages[3])
+	if err != nil {
+		return encodeError(err)
+	}
+
+	key := string(messages[1])
+	kvstore.lockKeys(key)
+	defer kvstore.unlockKeys(key)
+
+	entry, err := kvstore.lookupTypedWrite(key, listType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return okReply
+	}
+	list := entry.list()
+	list.trim(int(start), int(end))
+	kvstore.removeIfEmptyList(key, list)
+	return okReply
+}
+
+func (kvstore *KVStore) handleLMOVE(messages [][]byte) []byte {
+	if len(messages) != 5 {
+		return wrongArgumentsError("lmove")
+	}
+	from, err := parseListEnd(messages[3])
+	if err != nil {
+		return encodeError(err)
+	}
+	to, err := parseListEnd(messages[4])
+	if err != nil {
+		return encodeError(err)
+	}
+
+	source := string(messages[1])
+	destination := string(messages[2])
+	kvstore.lockKeys(source, destination)
+	defer kvstore.unlockKeys(source, destination)
+
+	value, err := kvstore.listMove(source, destination, from, to)
+	if err != nil {
+		return encodeError(err)
+	}
+	if value == nil {
+		return nullBulkReply
+	}
+	return encodeBulkString(value)
+}
+
+// listMove pops from one end of source and pushes onto destination,
+// returning nil if source is empty. Caller must hold the write locks of
+// both keys
+func (kvstore *KVStore) listMove(source string, destination string, from listEnd, to listEnd) ([]byte, error) {
+	sourceEntry, err := kvstore.lookupTypedWrite(source, listType)
+	if err != nil {
+		return nil, err
+	}
+	if sourceEntry == nil {
+		return nil, nil
+	}
+	// check the destination type before anything is popped off source
+	if _, err := kvstore.lookupTypedWrite(destination, listType); err != nil {
+		return nil, err
+	}
+
+	sourceList := sourceEntry.list()
+	value, _ := sourceList.pop(from)
+	kvstore.removeIfEmptyList(source, sourceList)
+
+	destinationList, err := kvstore.lookupOrCreateList(destination)
+	if err != nil {
+		return nil, err
+	}
+	destinationList.push(to, value)
+	kvstore.signalKeyAsReady(destination)
+	return value, nil
+}
+
+func (list *quicklist) popMany(end listEnd, count int) [][]byte {
+	var values [][]byte
+	for ; count > 0; count-- {
+		value, ok := list.pop(end)
+		if !ok {
+			break
+		}
+		values = append(values, value)
+	}
+	return values
+}
+
+// parseMultiPopArguments parses the numkeys key [key ...] where [COUNT count]
+// tail shared by the *MPOP commands, where is left for the caller to interpret
+func parseMultiPopArguments(arguments [][]byte) ([]string, []byte, int, error) {
+	if len(arguments) < 3 {
+		return nil, nil, 0, errSyntax
+	}
+	numkeys, err := parseInteger(arguments[0])
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if numkeys <= 0 {
+		return nil, nil, 0, errNumkeys
+	}
+	if int64(len(arguments)-2) < numkeys {
+		return nil, nil, 0, errSyntax
+	}
+
+	var keys []string
+	for _, key := range arguments[1 : numkeys+1] {
+		keys = append(keys, string(key))
+	}
+	where := arguments[numkeys+1]
+	rest := arguments[numkeys+2:]
+
+	count := int64(1)
+	if len(rest) > 0 {
+		if len(rest) != 2 || strings.ToUpper(string(rest[0])) != "COUNT" {
+			return nil, nil, 0, errSyntax
+		}
+		count, err = parseInteger(rest[1])
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		if count <= 0 {
+			return nil, nil, 0, errCount
+		}
+	}
+	return keys, where, int(count), nil
+}
+
+// encodeKeyAndValues is the [key, [values...]] reply used by the *MPOP commands
+func encodeKeyAndValues(key string, values [][]byte) []byte {
+	result := encodeArrayHeader(2)
+	result = append(result, encodeBulkString([]byte(key))...)
+	result = append(result, encodeArray(values)...)
+	return result
+}
+
+// popFromFirstNonEmpty pops up to count elements from the first key holding
+// a non empty list, ok is false if all of them were empty.
+// Caller must hold the write lock
+func (kvstore *KVStore) popFromFirstNonEmpty(keys []string, end listEnd, count int) (string, [][]byte, bool, error) {
+	for _, key := range keys {
+		entry, err := kvstore.lookupTypedWrite(key, listType)
+		if err != nil {
+			return "", nil, false, err
+		}
+		if entry == nil {
+			continue
+		}
+		list := entry.list()
+		values := list.popMany(end, count)
+		kvstore.removeIfEmptyList(key, list)
+		return key, values, true, nil
+	}
+	return "", nil, false, nil
+}
+
+// servePop builds the serve function for blocked clients that pop from a
+// list, replying through encode when something was popped
+func (kvstore *KVStore) servePop(end listEnd, count int, encode func(key string, values [][]byte) []byte) func(key string) ([]byte, bool) {
+	return func(key string) ([]byte, bool) {
+		_, values, ok, err := kvstore.popFromFirstNonEmpty([]string{key}, end, count)
+		if err != nil || !ok {
+			return nil, false
+		}
+		return encode(key, values), true
+	}
+}
+
+func (kvstore *KVStore) handleLMPOP(messages [][]byte) []byte {
+	keys, where, count, err := parseMultiPopArguments(messages[1:])
+	if err != nil {
+		return encodeError(err)
+	}
+	end, err := parseListEnd(where)
+	if err != nil {
+		return encodeError(err)
+	}
+
+	kvstore.lockKeys(keys...)
+	defer kvstore.unlockKeys(keys...)
+
+	key, values, ok, err := kvstore.popFromFirstNonEmpty(keys, end, count)
+	if err != nil {
+		return encodeError(err)
+	}
+	if !ok {
+		return nullArrayReply
+	}
+	return encodeKeyAndValues(key, values)
+}
+
+func (kvstore *KVStore) handleBLPOP(messages [][]byte, client *Client) []byte {
+	return kvstore.blockingPopGeneric(messages, listHead, client)
+}
+
+func (kvstore *KVStore) handleBRPOP(messages [][]byte, client *Client) []byte {
+	return kvstore.blockingPopGeneric(messages, listTail, client)
+}
+
+func (kvstore *KVStore) blockingPopGeneric(messages [][]byte, end listEnd, client *Client) []byte {
+	if len(messages) < 3 {
+		return wrongArgumentsError(string(messages[0]))
+	}
+	timeout, err := parseTimeout(messages[len(messages)-1])
+	if err != nil {
+		return encodeError(err)
+	}
+	var keys []string
+	for _, key := range messages[1 : len(messages)-1] {
+		keys = append(keys, string(key))
+	}
+
+	// BLPOP replies with a flat [key, value] pair
+	encode := func(key string, values [][]byte) []byte {
+		return encodeArray([][]byte{[]byte(key), values[0]})
+	}
+
+	kvstore.lockKeys(keys...)
+	key, values, ok, err := kvstore.popFromFirstNonEmpty(keys, end, 1)
+	if err != nil || ok {
+		kvstore.unlockKeys(keys...)
+		if err != nil {
+			return encodeError(err)
+		}
+		return encode(key, values)
+	}
+	blocked := kvstore.blockForKeys(keys, nil, kvstore.servePop(end, 1, encode))
+	kvstore.unlockKeys(keys...)
+
+	return kvstore.waitUntilServed(blocked, client, timeout, nullArrayReply)
+}
+
+func (kvstore *KVStore) handleBLMPOP(messages [][]byte, client *Client) []byte {
+	if len(messages) < 2 {
+		return wrongArgumentsError("blmpop")
+	}
+	timeout, err := parseTimeout(messages[1])
+	if err != nil {
+		return encodeError(err)
+	}
+	keys, where, count, err := parseMultiPopArguments(messages[2:])
+	if err != nil {
+		return encodeError(err)
+	}
+	end, err := parseListEnd(where)
+	if err != nil {
+		return encodeError(err)
+	}
+
+	kvstore.lockKeys(keys...)
+	key, values, ok, err := kvstore.popFromFirstNonEmpty(keys, end, count)
+	if err != nil || ok {
+		kvstore.unlockKeys(keys...)
+		if err != nil {
+			return encodeError(err)
+		}
+		return encodeKeyAndValues(key, values)
+	}
+	blocked := kvstore.blockForKeys(keys, nil, kvstore.servePop(end, count, encodeKeyAndValues))
+	kvstore.unlockKeys(keys...)
+
+	return kvstore.waitUntilServed(blocked, client, timeout, nullArrayReply)
+}
+
+func (kvstore *KVStore) handleBLMOVE(messages [][]byte, client *Client) []byte {
+	if len(messages) != 6 {
+		return wrongArgumentsError("blmove")
+	}
+	from, err := parseListEnd(messages[3])
+	if err != nil {
+		return encodeError(err)
+	}
+	to, err := parseListEnd(messages[4])
+	if err != nil {
+		return encodeError(err)
+	}
+	timeout, err := parseTimeout(messages[5])
+	if err != nil {
+		return encodeError(err)
+	}
+	source := string(messages[1])
+	destination := string(messages[2])
+
+	kvstore.lockKeys(source, destination)
+	value, err := kvstore.listMove(source, destination, from, to)
+	if err != nil || value != nil {
+		kvstore.unlockKeys(source, destination)
+		if err != nil {
+			return encodeError(err)
+		}
+		return encodeBulkString(value)
+	}
+	blocked := kvstore.blockForKeys([]string{source}, []string{destination}, func(key string) ([]byte, bool) {
+		value, err := kvstore.listMove(source, destination, from, to)
+		if err != nil || value == nil {
+			return nil, false
+		}
+		return encodeBulkString(value), true
+	})
+	kvstore.unlockKeys(source, destination)
+
+	return kvstore.waitUntilServed(blocked, client, timeout, nullBulkReply)
+}
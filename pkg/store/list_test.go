@@ -0,0 +1,156 @@
+package store
+
+import (
+	"strings"
+	"testing"
+)
+
+// listCase is a command, split on spaces, run through Execute and the
+// reply it should get
+type listCase struct {
+	command  string
+	expected string
+}
+
+func runListCases(t *testing.T, kvstore *KVStore, cases []listCase) {
+	t.Helper()
+	client := newTestClient()
+	for _, c := range cases {
+		if got := execute(t, kvstore, client, strings.Fields(c.command)...); got != c.expected {
+			t.Errorf("%s: expected %q, got %q", c.command, c.expected, got)
+		}
+	}
+}
+
+func listReply(values ...string) string {
+	return string(encodeArray(command(values...)))
+}
+
+func TestLINDEX(t *testing.T) {
+	kvstore := newKVStore()
+	runListCases(t, kvstore, []listCase{
+		{"RPUSH list a b c", ":3\r\n"},
+		{"LINDEX list 0", "$1\r\na\r\n"},
+		{"LINDEX list -1", "$1\r\nc\r\n"},
+		{"LINDEX list 3", string(nullBulkReply)},
+		{"LINDEX list -4", string(nullBulkReply)},
+		{"LINDEX missing 0", string(nullBulkReply)},
+		{"LINDEX list one", string(encodeError(errNotInteger))},
+		{"SET string value", string(okReply)},
+		{"LINDEX string 0", string(encodeError(errWrongType))},
+	})
+}
+
+func TestLSET(t *testing.T) {
+	kvstore := newKVStore()
+	runListCases(t, kvstore, []listCase{
+		{"RPUSH list a b c", ":3\r\n"},
+		{"LSET list 1 B", string(okReply)},
+		{"LSET list -1 C", string(okReply)},
+		{"LRANGE list 0 -1", listReply("a", "B", "C")},
+		{"LSET list 3 d", string(encodeError(errIndexOutRange))},
+		{"LSET list -4 d", string(encodeError(errIndexOutRange))},
+		{"LSET missing 0 d", string(encodeError(errNoSuchKey))},
+		{"SET string value", string(okReply)},
+		{"LSET string 0 d", string(encodeError(errWrongType))},
+	})
+	if kvstore.find("missing") != nil {
+		t.Errorf("LSET on a missing key shouldn't create it")
+	}
+}
+
+func TestLINSERT(t *testing.T) {
+	kvstore := newKVStore()
+	runListCases(t, kvstore, []listCase{
+		{"RPUSH list a c", ":2\r\n"},
+		{"LINSERT list BEFORE c b", ":3\r\n"},
+		{"LINSERT list after c d", ":4\r\n"},
+		{"LRANGE list 0 -1", listReply("a", "b", "c", "d")},
+		{"LINSERT list BEFORE z x", ":-1\r\n"},
+		{"LINSERT missing BEFORE a x", ":0\r\n"},
+		{"LINSERT list BESIDE a x", string(encodeError(errSyntax))},
+		{"SET string value", string(okReply)},
+		{"LINSERT string BEFORE a x", string(encodeError(errWrongType))},
+	})
+	if kvstore.find("missing") != nil {
+		t.Errorf("LINSERT on a missing key shouldn't create it")
+	}
+}
+
+func TestLREM(t *testing.T) {
+	kvstore := newKVStore()
+	runListCases(t, kvstore, []listCase{
+		{"RPUSH list x a x b x c x", ":7\r\n"},
+		{"LREM list 2 x", ":2\r\n"},
+		{"LRANGE list 0 -1", listReply("a", "b", "x", "c", "x")},
+		{"LREM list -1 x", ":1\r\n"},
+		{"LRANGE list 0 -1", listReply("a", "b", "x", "c")},
+		{"LREM list 0 x", ":1\r\n"},
+		{"LREM list 0 z", ":0\r\n"},
+		{"LREM missing 0 x", ":0\r\n"},
+		{"LREM list all x", string(encodeError(errNotInteger))},
+
+		// removing every element deletes the key, checked below
+		{"LREM list 0 a", ":1\r\n"},
+		{"LREM list 0 b", ":1\r\n"},
+		{"LREM list 0 c", ":1\r\n"},
+
+		{"SET string value", string(okReply)},
+		{"LREM string 0 x", string(encodeError(errWrongType))},
+	})
+	if kvstore.find("list") != nil {
+		t.Errorf("removing every element should delete the key")
+	}
+}
+
+func TestLTRIM(t *testing.T) {
+	kvstore := newKVStore()
+	runListCases(t, kvstore, []listCase{
+		{"RPUSH list a b c d e", ":5\r\n"},
+		{"LTRIM list 1 -2", string(okReply)},
+		{"LRANGE list 0 -1", listReply("b", "c", "d")},
+		{"LTRIM list -100 100", string(okReply)},
+		{"LRANGE list 0 -1", listReply("b", "c", "d")},
+		{"LTRIM list 0 one", string(encodeError(errNotInteger))},
+		{"LTRIM missing 0 1", string(okReply)},
+
+		// a range past the end empties and deletes the list
+		{"LTRIM list 5 10", string(okReply)},
+
+		{"SET string value", string(okReply)},
+		{"LTRIM string 0 1", string(encodeError(errWrongType))},
+	})
+	if kvstore.find("list") != nil {
+		t.Errorf("trimming every element should delete the key")
+	}
+}
+
+func TestLMOVE(t *testing.T) {
+	kvstore := newKVStore()
+	runListCases(t, kvstore, []listCase{
+		{"RPUSH source a b c", ":3\r\n"},
+		{"LMOVE source destination LEFT RIGHT", "$1\r\na\r\n"},
+		{"LMOVE source destination RIGHT LEFT", "$1\r\nc\r\n"},
+		{"LRANGE destination 0 -1", listReply("c", "a")},
+
+		// the same key rotates the list
+		{"LMOVE destination destination LEFT RIGHT", "$1\r\nc\r\n"},
+		{"LRANGE destination 0 -1", listReply("a", "c")},
+
+		{"LMOVE missing destination LEFT RIGHT", string(nullBulkReply)},
+		{"LMOVE source destination UP RIGHT", string(encodeError(errSyntax))},
+
+		// a wrong type destination leaves source untouched
+		{"SET string value", string(okReply)},
+		{"LMOVE source string LEFT RIGHT", string(encodeError(errWrongType))},
+		{"LRANGE source 0 -1", listReply("b")},
+		{"LMOVE string destination LEFT RIGHT", string(encodeError(errWrongType))},
+
+		// moving the last element deletes source
+		{"LMOVE source destination LEFT LEFT", "$1\r\nb\r\n"},
+		{"LRANGE destination 0 -1", listReply("b", "a", "c")},
+	})
+	if kvstore.find("source") != nil {
+		t.Errorf("moving the last element should delete source")
+	}
+}
@@ -0,0 +1,300 @@
+package store
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var errTooLarge = errors.New("ERR requested size is too large")
+
+// Memory accounting for maxmemory. A key's size is an estimate of the Go
+// memory behind it, close enough to track the total against the limit
+// rather than an exact count. Like Redis, large collections are sized
+// from a sample of their elements scaled up to their length
+
+const (
+	stringHeaderSize = 16
+	sliceHeaderSize  = 24
+	pointerSize      = 8
+	// what a map spends on each element on top of its key and value
+	mapElementOverhead = 8
+	// the Entry struct and the key's slot in its shard map
+	entryOverhead = 128
+	// a skiplist node with the average 4/3 levels
+	skiplistNodeSize = 80
+	// a jsonValue struct
+	jsonValueSize = 104
+	// a radix tree node and its link from the parent
+	radixNodeSize = 64
+	// a member's slot in a scanIndex bucket and its share of the buckets
+	scanIndexEntrySize = stringHeaderSize + sliceHeaderSize
+	// what MEMORY USAGE samples without a SAMPLES option
+	memoryUsageSamples = 5
+	// the most a single value sized up front, such as a bloom filter or
+	// count-min sketch, may allocate at once
+	maxAllocationSize = 1 << 30
+)
+
+// sampler sizes up to limit elements of a collection and scales their
+// average size up to the whole collection, a limit of 0 sizes them all
+type sampler struct {
+	limit int
+	seen  int
+	total int64
+}
+
+// add counts the size of one element and reports whether to go on
+func (sampler *sampler) add(size int64) bool {
+	sampler.total += size
+	sampler.seen++
+	return sampler.limit == 0 || sampler.seen < sampler.limit
+}
+
+func (sampler *sampler) estimate(length int) int64 {
+	if sampler.seen == 0 {
+		return 0
+	}
+	return sampler.total * int64(length) / int64(sampler.seen)
+}
+
+// keyMemory estimates what key and its entry take up, sampling up to
+// samples elements of each collection, 0 meaning all of them
+func keyMemory(key string, entry *Entry, samples int) int64 {
+	return entryOverhead + stringHeaderSize + int64(len(key)) + valueMemory(entry, samples)
+}
+
+func valueMemory(entry *Entry, samples int) int64 {
+	switch entry.objectType {
+	case listType:
+		return listMemory(entry.list(), samples)
+	case hashType:
+		return hashMemory(entry.hash(), samples)
+	case setType:
+		return setMemory(entry.set(), samples)
+	case zsetType:
+		return zsetMemory(entry.zset(), samples)
+	case streamType:
+		return streamMemory(entry.stream(), samples)
+	case jsonType:
+		return jsonMemory(entry.json(), samples)
+	case bloomType:
+		size := int64(0)
+		for _, layer := range entry.bloom().layers {
+			size += pointerSize + 64 + int64(cap(layer.bits))*8
+		}
+		return size
+	case cuckooType:
+		size := int64(0)
+		for _, table := range entry.cuckoo().tables {
+			size += pointerSize + 48 + int64(cap(table.slots))
+		}
+		return size
+	case cmsType:
+		return 56 + int64(cap(entry.sketch().counters))*4
+	case timeSeriesType:
+		return timeSeriesMemory(entry.timeSeries())
+	case vectorSetType:
+		return vectorSetMemory(entry.vectorSet(), samples)
+	default:
+		return int64(cap(entry.entry))
+	}
+}
+
+func listMemory(list *quicklist, samples int) int64 {
+	nodes := (list.Len() + list.chunkSize - 1) / list.chunkSize
+	sampler := sampler{limit: samples}
+sampling:
+	for node := list.head; node != nil; node = node.next {
+		for _, value := range node.entries {
+			if !sampler.add(sliceHeaderSize + int64(cap(value))) {
+				break sampling
+			}
+		}
+	}
+	return int64(nodes)*(2*pointerSize+sliceHeaderSize) + sampler.estimate(list.Len())
+}
+
+func hashMemory(hash *hashValue, samples int) int64 {
+	overhead := int64(stringHeaderSize + sliceHeaderSize)
+	if !hash.isListpack() {
+		overhead += mapElementOverhead + scanIndexEntrySize
+	}
+	sampler := sampler{limit: samples}
+	hash.forEach(func(field string, value []byte) bool {
+		return sampler.add(overhead + int64(len(field)+cap(value)))
+	})
+	ttls := int64(len(hash.expires)) * (stringHeaderSize + 8 + mapElementOverhead)
+	return sampler.estimate(hash.Len()) + ttls
+}
+
+func setMemory(set *setValue, samples int) int64 {
+	if set.isIntset() {
+		return int64(cap(set.intset)) * 8
+	}
+	// each member is in the members slice, keys positions and sits in a
+	// scan index bucket
+	sampler := sampler{limit: samples}
+	for _, member := range set.members {
+		if !sampler.add(2*stringHeaderSize + 8 + mapElementOverhead + scanIndexEntrySize + int64(len(member))) {
+			break
+		}
+	}
+	return sampler.estimate(set.Len())
+}
+
+func zsetMemory(zset *zsetValue, samples int) int64 {
+	sampler := sampler{limit: samples}
+	for member := range zset.dict {
+		if !sampler.add(stringHeaderSize + 8 + mapElementOverhead + skiplistNodeSize + int64(len(member))) {
+			break
+		}
+	}
+	return sampler.estimate(zset.Len())
+}
+
+func streamMemory(stream *streamValue, samples int) int64 {
+	sampler := sampler{limit: samples}
+	stream.blocks.ascend(nil, func(_ []byte, value interface{}) bool {
+		for _, entry := range value.(*streamBlock).entries {
+			if entry.deleted {
+				continue
+			}
+			size := int64(48)
+			for _, value := range entry.values {
+				size += sliceHeaderSize + int64(cap(value))
+			}
+			if !sampler.add(size) {
+				return false
+			}
+		}
+		return true
+	})
+	size := int64(stream.blocks.nodeCount())*radixNodeSize + sampler.estimate(stream.length)
+	// every pending entry sits in the group PEL and its consumer's
+	for _, group := range stream.groups {
+		size += 64 + int64(group.pending.Len())*(32+2*radixNodeSize)
+		for name := range group.consumers {
+			size += 64 + int64(len(name))
+		}
+	}
+	return size
+}
+
+func jsonMemory(value *jsonValue, samples int) int64 {
+	size := jsonValueSize + int64(len(value.str))
+	sampler := sampler{limit: samples}
+	switch value.kind {
+	case jsonArray:
+		for _, item := range value.items {
+			if !sampler.add(pointerSize + jsonMemory(item, samples)) {
+				break
+			}
+		}
+		size += sampler.estimate(len(value.items))
+	case jsonObject:
+		// each key is in keys, for member order, and keys members
+		for _, key := range value.keys {
+			if !sampler.add(2*stringHeaderSize + pointerSize + mapElementOverhead + int64(len(key)) + jsonMemory(value.members[key], samples)) {
+				break
+			}
+		}
+		size += sampler.estimate(len(value.keys))
+	}
+	return size
+}
+
+func timeSeriesMemory(series *timeSeries) int64 {
+	size := 128 + int64(cap(series.samples))*16 + int64(len(series.source))
+	for _, label := range series.labels {
+		size += 2*stringHeaderSize + int64(len(label.name)+len(label.value))
+	}
+	for _, rule := range series.rules {
+		size += 64 + int64(len(rule.destination))
+	}
+	return size
+}
+
+func vectorSetMemory(vectorSet *hnsw, samples int) int64 {
+	sampler := sampler{limit: samples}
+	for element, node := range vectorSet.nodes {
+		size := stringHeaderSize + pointerSize + mapElementOverhead + 72 + int64(len(element)) + int64(cap(node.vector.values))*4
+		for level, layer := range node.neighbors {
+			size += sliceHeaderSize + int64(cap(layer))*pointerSize
+			size += 48 + int64(len(node.linkedFrom[level]))*(pointerSize+mapElementOverhead)
+		}
+		if !sampler.add(size) {
+			break
+		}
+	}
+	return sampler.estimate(len(vectorSet.nodes))
+}
+
+// updateMemory sizes key again after a write and adds the difference to
+// usedMemory. setKey and releaseKeys call it, so every write is counted.
+// Caller must hold the write lock of key's shard
+func (kvstore *KVStore) updateMemory(key string) {
+	entry := kvstore.find(key)
+	if entry == nil {
+		return
+	}
+	size := keyMemory(key, entry, int(kvstore.config.maxmemorySamples))
+	kvstore.usedMemory.Add(size - entry.memory)
+	entry.memory = size
+}
+
+// checkAllocation refuses a value that would allocate size bytes up front
+// when that is past maxAllocationSize, or would take used memory past
+// maxmemory since eviction only makes room before a command runs. size
+// is a float so sizes computed from absurd arguments can't overflow.
+// Caller must hold a shard lock
+func (kvstore *KVStore) checkAllocation(size float64) error {
+	if size > maxAllocationSize {
+		return errTooLarge
+	}
+	if limit := kvstore.config.maxmemory; limit > 0 && kvstore.usedMemory.Load()+int64(size) > limit {
+		return errOOM
+	}
+	return nil
+}
+
+// UsedMemory returns the estimated memory taken by the keyspace, the
+// figure maxmemory is compared against
+func (kvstore *KVStore) UsedMemory() int64 {
+	return kvstore.usedMemory.Load()
+}
+
+// handleMEMORY supports MEMORY USAGE key [SAMPLES count]
+func (kvstore *KVStore) handleMEMORY(messages [][]byte) []byte {
+	if len(messages) < 2 {
+		return wrongArgumentsError("memory")
+	}
+	if !strings.EqualFold(string(messages[1]), "USAGE") {
+		return encodeError(errSyntax)
+	}
+	if len(messages) != 3 && len(messages) != 5 {
+		return wrongArgumentsError("memory|usage")
+	}
+	samples := memoryUsageSamples
+	if len(messages) == 5 {
+		if !strings.EqualFold(string(messages[3]), "SAMPLES") {
+			return encodeError(errSyntax)
+		}
+		count, err := strconv.Atoi(string(messages[4]))
+		if err != nil || count < 0 {
+			return encodeError(errNotInteger)
+		}
+		samples = count
+	}
+	key := string(messages[2])
+
+	kvstore.rlockKeys(key)
+	defer kvstore.runlockKeys(key)
+
+	// sizing a key isn't an access to it
+	entry := kvstore.lookupKeyReadNoTouch(key)
+	if entry == nil {
+		return nullBulkReply
+	}
+	return encodeInteger(keyMemory(key, entry, samples))
+}
@@ -0,0 +1,184 @@
+package store
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var (
+	errLFUNotSelected = errors.New("ERR An LFU maxmemory policy is not selected, access frequency not tracked. Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust.")
+	errLFUSelected    = errors.New("ERR An LFU maxmemory policy is selected, idle time not tracked. Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust.")
+)
+
+type objectType int
+
+const (
+	stringType objectType = iota
+	listType
+	hashType
+	setType
+	zsetType
+	streamType
+	jsonType
+	bloomType
+	cuckooType
+	cmsType
+	timeSeriesType
+	vectorSetType
+)
+
+func (objectType objectType) String() string {
+	switch objectType {
+	case listType:
+		return "list"
+	case hashType:
+		return "hash"
+	case setType:
+		return "set"
+	case zsetType:
+		return "zset"
+	case streamType:
+		return "stream"
+	case jsonType:
+		return "ReJSON-RL"
+	case bloomType:
+		return "MBbloom--"
+	case cuckooType:
+		return "MBbloomCF"
+	case cmsType:
+		return "CMSk-TYPE"
+	case timeSeriesType:
+		return "TSDB-TYPE"
+	case vectorSetType:
+		return "vectorset"
+	default:
+		return "string"
+	}
+}
+
+type encoding int
+
+const (
+	encodingRaw encoding = iota
+	encodingInt
+	encodingQuicklist
+	encodingListpack
+	encodingHashtable
+	encodingIntset
+	encodingSkiplist
+	encodingStream
+	encodingJSON
+	encodingBloom
+	encodingCuckoo
+	encodingCMS
+	encodingTimeSeries
+	encodingHNSW
+)
+
+// embstrSizeLimit is the longest string Redis allocates together with its
+// object header, OBJECT ENCODING reports shorter raw strings as embstr
+const embstrSizeLimit = 44
+
+// encodingName is what OBJECT ENCODING reports for entry. Types Redis
+// provides through modules, JSON and the probabilistic structures among
+// them, are reported as raw as Redis reports every module value
+func encodingName(entry *Entry) string {
+	switch entry.encoding {
+	case encodingInt:
+		return "int"
+	case encodingRaw:
+		if len(entry.entry) <= embstrSizeLimit {
+			return "embstr"
+		}
+		return "raw"
+	case encodingQuicklist:
+		return "quicklist"
+	case encodingListpack:
+		return "listpack"
+	case encodingHashtable:
+		return "hashtable"
+	case encodingIntset:
+		return "intset"
+	case encodingSkiplist:
+		return "skiplist"
+	case encodingStream:
+		return "stream"
+	default:
+		return "raw"
+	}
+}
+
+// longest base 10 int64 is 20 bytes, anything longer can't be int encoded
+const maxIntEncodedLength = 20
+
+// bytes returns the string value of the entry regardless of how it is encoded
+func (entry *Entry) bytes() []byte {
+	if entry.encoding == encodingInt {
+		return strconv.AppendInt(nil, entry.intValue, 10)
+	}
+	return entry.entry
+}
+
+// setString stores value on the entry, int encoding it when the value
+// round trips exactly through an int64 so "007" or "+1" stay raw
+func (entry *Entry) setString(value []byte) {
+	if len(value) <= maxIntEncodedLength {
+		if parsed, err := strconv.ParseInt(string(value), 10, 64); err == nil && strconv.FormatInt(parsed, 10) == string(value) {
+			entry.setInt(parsed)
+			return
+		}
+	}
+	entry.entry = value
+	entry.intValue = 0
+	entry.encoding = encodingRaw
+}
+
+func (entry *Entry) setInt(value int64) {
+	entry.entry = nil
+	entry.intValue = value
+	entry.encoding = encodingInt
+}
+
+func (entry *Entry) list() *quicklist {
+	return entry.value.(*quicklist)
+}
+
+// handleOBJECT supports OBJECT ENCODING|FREQ|IDLETIME key. Inspecting a
+// key this way doesn't count as an access to it
+func (kvstore *KVStore) handleOBJECT(messages [][]byte) []byte {
+	if len(messages) < 2 {
+		return wrongArgumentsError("object")
+	}
+	subcommand := strings.ToUpper(string(messages[1]))
+	switch {
+	case (subcommand == "ENCODING" || subcommand == "FREQ" || subcommand == "IDLETIME") && len(messages) == 3:
+	case subcommand == "ENCODING" || subcommand == "FREQ" || subcommand == "IDLETIME":
+		return wrongArgumentsError("object|" + strings.ToLower(subcommand))
+	default:
+		return encodeError(errors.New("ERR unknown subcommand '" + string(messages[1]) + "'. Try OBJECT HELP."))
+	}
+	key := string(messages[2])
+
+	kvstore.rlockKeys(key)
+	defer kvstore.runlockKeys(key)
+
+	entry := kvstore.lookupKeyReadNoTouch(key)
+	if entry == nil {
+		return nullBulkReply
+	}
+	switch subcommand {
+	case "FREQ":
+		if !isLFUPolicy(kvstore.config.maxmemoryPolicy) {
+			return encodeError(errLFUNotSelected)
+		}
+		return encodeInteger(int64(entry.frequency(&kvstore.config)))
+	case "IDLETIME":
+		if isLFUPolicy(kvstore.config.maxmemoryPolicy) {
+			return encodeError(errLFUSelected)
+		}
+		return encodeInteger(int64(entry.idleSeconds()))
+	default:
+		return encodeBulkString([]byte(encodingName(entry)))
+	}
+}
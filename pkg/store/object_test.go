@@ -0,0 +1,178 @@
+package store
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// within reports whether reply is an integer reply from low to high, the
+// clocks may tick over while a test runs
+func within(reply string, low int64, high int64) bool {
+	value, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(reply, ":"), "\r\n"), 10, 64)
+	return err == nil && strings.HasPrefix(reply, ":") && value >= low && value <= high
+}
+
+func TestObjectEncoding(t *testing.T) {
+	kvstore := newKVStore()
+	client := newTestClient()
+	execute(t, kvstore, client, "SET", "int", "12345")
+	execute(t, kvstore, client, "SET", "embstr", "value")
+	execute(t, kvstore, client, "SET", "raw", strings.Repeat("x", embstrSizeLimit+1))
+	execute(t, kvstore, client, "RPUSH", "list", "a")
+	execute(t, kvstore, client, "HSET", "hash", "field", "value")
+	execute(t, kvstore, client, "SADD", "intset", "1", "2")
+	execute(t, kvstore, client, "SADD", "set", "a")
+	execute(t, kvstore, client, "ZADD", "zset", "1", "a")
+	execute(t, kvstore, client, "XADD", "stream", "*", "field", "value")
+	execute(t, kvstore, client, "JSON.SET", "json", "$", `{"a":1}`)
+
+	for key, expected := range map[string]string{
+		"int":    "int",
+		"embstr": "embstr",
+		"raw":    "raw",
+		"list":   "quicklist",
+		"hash":   "listpack",
+		"intset": "intset",
+		"set":    "hashtable",
+		"zset":   "skiplist",
+		"stream": "stream",
+		"json":   "raw",
+	} {
+		if got := execute(t, kvstore, client, "OBJECT", "ENCODING", key); got != string(encodeBulkString([]byte(expected))) {
+			t.Errorf("expected %s encoded as %s, got %q", key, expected, got)
+		}
+	}
+	if got := execute(t, kvstore, client, "OBJECT", "ENCODING", "missing"); got != string(nullBulkReply) {
+		t.Errorf("expected a null reply for a missing key, got %q", got)
+	}
+	if got := execute(t, kvstore, client, "OBJECT", "REFS", "int"); !strings.HasPrefix(got, "-ERR unknown subcommand") {
+		t.Errorf("expected an unknown subcommand error, got %q", got)
+	}
+}
+
+func TestObjectIdleTime(t *testing.T) {
+	kvstore := newKVStore()
+	client := newTestClient()
+	execute(t, kvstore, client, "SET", "key", "value")
+	kvstore.find("key").lru.Store(lruClock() - 1000)
+
+	// OBJECT itself isn't an access
+	for i := 0; i < 2; i++ {
+		if got := execute(t, kvstore, client, "OBJECT", "IDLETIME", "key"); !within(got, 1000, 1001) {
+			t.Errorf("expected 1000 seconds idle, got %q", got)
+		}
+	}
+	execute(t, kvstore, client, "GET", "key")
+	if got := execute(t, kvstore, client, "OBJECT", "IDLETIME", "key"); !within(got, 0, 1) {
+		t.Errorf("expected GET to reset the idle time, got %q", got)
+	}
+	if got := execute(t, kvstore, client, "OBJECT", "FREQ", "key"); got != "-"+errLFUNotSelected.Error()+"\r\n" {
+		t.Errorf("expected FREQ to need an LFU policy, got %q", got)
+	}
+}
+
+func TestObjectFreq(t *testing.T) {
+	kvstore := newKVStore()
+	client := newTestClient()
+	configure(t, kvstore, "maxmemory-policy", "allkeys-lfu")
+	execute(t, kvstore, client, "SET", "key", "value")
+	if got := execute(t, kvstore, client, "OBJECT", "FREQ", "key"); got != ":5\r\n" {
+		t.Errorf("expected a new key to start at 5, got %q", got)
+	}
+	if got := execute(t, kvstore, client, "OBJECT", "IDLETIME", "key"); got != "-"+errLFUSelected.Error()+"\r\n" {
+		t.Errorf("expected IDLETIME to need an LRU policy, got %q", got)
+	}
+
+	// the counter drops by one for every lfu-decay-time minutes unaccessed
+	kvstore.find("key").lru.Store((lfuMinutes()-3)<<8 | 20)
+	if got := execute(t, kvstore, client, "OBJECT", "FREQ", "key"); !within(got, 16, 17) {
+		t.Errorf("expected the counter to decay to 17, got %q", got)
+	}
+	configure(t, kvstore, "lfu-decay-time", "0")
+	if got := execute(t, kvstore, client, "OBJECT", "FREQ", "key"); got != ":20\r\n" {
+		t.Errorf("expected no decay with lfu-decay-time 0, got %q", got)
+	}
+
+	// with lfu-log-factor 0 every access counts
+	configure(t, kvstore, "lfu-log-factor", "0")
+	for i := 0; i < 10; i++ {
+		execute(t, kvstore, client, "GET", "key")
+	}
+	if got := execute(t, kvstore, client, "OBJECT", "FREQ", "key"); got != ":30\r\n" {
+		t.Errorf("expected 10 GETs to count 10 times, got %q", got)
+	}
+}
+
+func TestLFUCounterIsLogarithmic(t *testing.T) {
+	config := defaultConfig()
+	counter := uint32(lfuInitValue)
+	for i := 0; i < 100000; i++ {
+		counter = config.lfuLogIncr(counter)
+	}
+	// 100k hits with the default log factor land around 140
+	if counter < 50 || counter >= 255 {
+		t.Errorf("expected the counter to grow logarithmically, got %d after 100000 hits", counter)
+	}
+}
+
+func TestRDBAccessMetadataRoundTrip(t *testing.T) {
+	for _, test := range []struct {
+		policy string
+		opcode byte
+		set    func(entry *Entry)
+		check  string
+		value  int64
+	}{
+		{"allkeys-lru", rdbOpcodeIdle, func(entry *Entry) { entry.lru.Store(lruClock() - 1000) }, "IDLETIME", 1000},
+		{"allkeys-lfu", rdbOpcodeFreq, func(entry *Entry) { entry.lru.Store(lfuMinutes()<<8 | 42) }, "FREQ", 42},
+	} {
+		t.Run(test.policy, func(t *testing.T) {
+			source := newKVStore()
+			client := newTestClient()
+			configure(t, source, "maxmemory-policy", test.policy)
+			execute(t, source, client, "SET", "key", "value", "px", "60000")
+			entry := source.find("key")
+			test.set(entry)
+
+			var writer rdbWriter
+			if err := writer.writeKey("key", entry, &source.config); err != nil {
+				t.Fatalf("strings should be saved: %v", err)
+			}
+			if saved := writer.Bytes(); !bytes.Contains(saved, []byte{test.opcode}) {
+				t.Errorf("expected opcode %x in %x", test.opcode, saved)
+			}
+
+			reader := &rdbReader{bytes.NewReader(writer.Bytes())}
+			loaded, err := reader.readKey(&source.config)
+			if err != nil {
+				t.Fatalf("reading back: %v", err)
+			}
+			destination := newKVStore()
+			configure(t, destination, "maxmemory-policy", test.policy)
+			destination.restoreKey(loaded)
+			if got := execute(t, destination, client, "OBJECT", test.check, "key"); !within(got, test.value-1, test.value+1) {
+				t.Errorf("expected OBJECT %s to give about %d after loading, got %q", test.check, test.value, got)
+			}
+			if got := execute(t, destination, client, "GET", "key"); got != "$5\r\nvalue\r\n" {
+				t.Errorf("expected the value to survive, got %q", got)
+			}
+			if ttl := time.Until(destination.find("key").expiryTime); ttl <= 0 || ttl > time.Minute {
+				t.Errorf("expected the ttl to survive, got %v", ttl)
+			}
+		})
+	}
+}
+
+func TestRDBSkipsAccessMetadataWithoutEviction(t *testing.T) {
+	var writer rdbWriter
+	entry := newEntry()
+	entry.setString([]byte("value"))
+	config := defaultConfig()
+	writer.writeKey("key", entry, &config)
+	if saved := writer.Bytes(); saved[0] != rdbTypeString {
+		t.Errorf("expected noeviction to save no access metadata, got %x", saved)
+	}
+}
@@ -0,0 +1,372 @@
+package store
+
+import (
+	"bytes"
+)
+
+// default number of elements held by each quicklist node before it is split
+const quicklistChunkSize = 128
+
+// quicklist is a doubly linked list of small slices, it keeps push/pop at
+// either end O(1) while indexing only has to hop over whole chunks
+type quicklist struct {
+	head      *quicklistNode
+	tail      *quicklistNode
+	length    int
+	chunkSize int
+}
+
+type quicklistNode struct {
+	prev    *quicklistNode
+	next    *quicklistNode
+	entries [][]byte
+}
+
+func newQuicklist() *quicklist {
+	return &quicklist{chunkSize: quicklistChunkSize}
+}
+
+func (list *quicklist) Len() int {
+	return list.length
+}
+
+func (list *quicklist) pushHead(value []byte) {
+	if list.head == nil || len(list.head.entries) >= list.chunkSize {
+		node := &quicklistNode{}
+		list.linkBefore(list.head, node)
+	}
+	list.head.entries = append(list.head.entries, nil)
+	copy(list.head.entries[1:], list.head.entries)
+	list.head.entries[0] = value
+	list.length++
+}
+
+func (list *quicklist) pushTail(value []byte) {
+	if list.tail == nil || len(list.tail.entries) >= list.chunkSize {
+		node := &quicklistNode{}
+		list.linkAfter(list.tail, node)
+	}
+	list.tail.entries = append(list.tail.entries, value)
+	list.length++
+}
+
+func (list *quicklist) popHead() ([]byte, bool) {
+	if list.length == 0 {
+		return nil, false
+	}
+	node := list.head
+	value := node.entries[0]
+	node.entries[0] = nil
+	node.entries = node.entries[1:]
+	list.length--
+	if len(node.entries) == 0 {
+		list.unlink(node)
+	}
+	return value, true
+}
+
+func (list *quicklist) popTail() ([]byte, bool) {
+	if list.length == 0 {
+		return nil, false
+	}
+	node := list.tail
+	last := len(node.entries) - 1
+	value := node.entries[last]
+	node.entries[last] = nil
+	node.entries = node.entries[:last]
+	list.length--
+	if len(node.entries) == 0 {
+		list.unlink(node)
+	}
+	return value, true
+}
+
+// normaliseIndex turns a redis style index (negative counts from the tail)
+// into an offset from the head, ok is false when it is out of range
+func (list *quicklist) normaliseIndex(index int) (int, bool) {
+	if index < 0 {
+		index += list.length
+	}
+	if index < 0 || index >= list.length {
+		return 0, false
+	}
+	return index, true
+}
+
+// locate finds the node holding the element at offset, walking from
+// whichever end is closer
+func (list *quicklist) locate(offset int) (*quicklistNode, int) {
+	if offset < list.length/2 {
+		node := list.head
+		for offset >= len(node.entries) {
+			offset -= len(node.entries)
+			node = node.next
+		}
+		return node, offset
+	}
+
+	node := list.tail
+	fromTail := list.length - 1 - offset
+	for fromTail >= len(node.entries) {
+		fromTail -= len(node.entries)
+		node = node.prev
+	}
+	return node, len(node.entries) - 1 - fromTail
+}
+
+func (list *quicklist) index(index int) ([]byte, bool) {
+	offset, ok := list.normaliseIndex(index)
+	if !ok {
+		return nil, false
+	}
+	node, position := list.locate(offset)
+	return node.entries[position], true
+}
+
+func (list *quicklist) set(index int, value []byte) bool {
+	offset, ok := list.normaliseIndex(index)
+	if !ok {
+		return false
+	}
+	node, position := list.locate(offset)
+	node.entries[position] = value
+	return true
+}
+
+// insertAt places value so that it ends up at offset, offset == length appends
+func (list *quicklist) insertAt(offset int, value []byte) {
+	if offset >= list.length {
+		list.pushTail(value)
+		return
+	}
+	if offset <= 0 {
+		list.pushHead(value)
+		return
+	}
+
+	node, position := list.locate(offset)
+	node.entries = append(node.entries, nil)
+	copy(node.entries[position+1:], node.entries[position:])
+	node.entries[position] = value
+	list.length++
+
+	if len(node.entries) > list.chunkSize {
+		list.split(node)
+	}
+}
+
+// insertByPivot inserts value before or after the first element equal to
+// pivot, returning false if the pivot isn't in the list
+func (list *quicklist) insertByPivot(pivot []byte, value []byte, after bool) bool {
+	offset := 0
+	for node := list.head; node != nil; node = node.next {
+		for position, element := range node.entries {
+			if bytes.Equal(element, pivot) {
+				if after {
+					list.insertAt(offset+position+1, value)
+				} else {
+					list.insertAt(offset+position, value)
+				}
+				return true
+			}
+		}
+		offset += len(node.entries)
+	}
+	return false
+}
+
+// rangeOf returns the elements between start and end inclusive, using the
+// same clamping rules as LRANGE
+func (list *quicklist) rangeOf(start int, end int) [][]byte {
+	start, end, ok := clampRange(start, end, list.length)
+	if !ok {
+		return [][]byte{}
+	}
+
+	result := make([][]byte, 0, end-start+1)
+	node, position := list.locate(start)
+	for remaining := end - start + 1; remaining > 0; {
+		take := len(node.entries) - position
+		if take > remaining {
+			take = remaining
+		}
+		result = append(result, node.entries[position:position+take]...)
+		remaining -= take
+		node = node.next
+		position = 0
+	}
+	return result
+}
+
+// trim keeps only the elements between start and end inclusive
+func (list *quicklist) trim(start int, end int) {
+	start, end, ok := clampRange(start, end, list.length)
+	if !ok {
+		list.head, list.tail, list.length = nil, nil, 0
+		return
+	}
+	list.deleteRange(end+1, list.length-end-1)
+	list.deleteRange(0, start)
+}
+
+// deleteRange removes count elements starting at offset
+func (list *quicklist) deleteRange(offset int, count int) {
+	if count <= 0 || offset >= list.length {
+		return
+	}
+	node, position := list.locate(offset)
+	for count > 0 && node != nil {
+		next := node.next
+		take := len(node.entries) - position
+		if take > count {
+			take = count
+		}
+		node.entries = append(node.entries[:position], node.entries[position+take:]...)
+		list.length -= take
+		count -= take
+		if len(node.entries) == 0 {
+			list.unlink(node)
+		}
+		node = next
+		position = 0
+	}
+}
+
+// removeMatching deletes elements equal to value. count > 0 removes that
+// many from the head, count < 0 from the tail and 0 removes all of them
+func (list *quicklist) removeMatching(value []byte, count int) int {
+	limit := count
+	if limit < 0 {
+		limit = -limit
+	}
+	removed := 0
+
+	if count >= 0 {
+		for node := list.head; node != nil; {
+			next := node.next
+			kept := node.entries[:0]
+			for _, element := range node.entries {
+				if (limit == 0 || removed < limit) && bytes.Equal(element, value) {
+					removed++
+					continue
+				}
+				kept = append(kept, element)
+			}
+			list.shrinkNode(node, kept)
+			node = next
+		}
+	} else {
+		for node := list.tail; node != nil; {
+			prev := node.prev
+			kept := make([][]byte, 0, len(node.entries))
+			for i := len(node.entries) - 1; i >= 0; i-- {
+				if removed < limit && bytes.Equal(node.entries[i], value) {
+					removed++
+					continue
+				}
+				kept = append(kept, node.entries[i])
+			}
+			for i, j := 0, len(kept)-1; i < j; i, j = i+1, j-1 {
+				kept[i], kept[j] = kept[j], kept[i]
+			}
+			list.shrinkNode(node, kept)
+			node = prev
+		}
+	}
+
+	list.length -= removed
+	return removed
+}
+
+func (list *quicklist) shrinkNode(node *quicklistNode, kept [][]byte) {
+	for i := len(kept); i < len(node.entries); i++ {
+		node.entries[i] = nil
+	}
+	node.entries = kept
+	if len(node.entries) == 0 {
+		list.unlink(node)
+	}
+}
+
+func (list *quicklist) split(node *quicklistNode) {
+	half := len(node.entries) / 2
+	newNode := &quicklistNode{entries: append([][]byte{}, node.entries[half:]...)}
+	for i := half; i < len(node.entries); i++ {
+		node.entries[i] = nil
+	}
+	node.entries = node.entries[:half]
+	list.linkAfter(node, newNode)
+}
+
+// linkBefore puts node in front of at, a nil at means the list is empty
+// or node becomes the new head
+func (list *quicklist) linkBefore(at *quicklistNode, node *quicklistNode) {
+	if at == nil {
+		at = list.head
+	}
+	if at == nil {
+		list.head, list.tail = node, node
+		return
+	}
+	node.next = at
+	node.prev = at.prev
+	if at.prev != nil {
+		at.prev.next = node
+	} else {
+		list.head = node
+	}
+	at.prev = node
+}
+
+func (list *quicklist) linkAfter(at *quicklistNode, node *quicklistNode) {
+	if at == nil {
+		at = list.tail
+	}
+	if at == nil {
+		list.head, list.tail = node, node
+		return
+	}
+	node.prev = at
+	node.next = at.next
+	if at.next != nil {
+		at.next.prev = node
+	} else {
+		list.tail = node
+	}
+	at.next = node
+}
+
+func (list *quicklist) unlink(node *quicklistNode) {
+	if node.prev != nil {
+		node.prev.next = node.next
+	} else {
+		list.head = node.next
+	}
+	if node.next != nil {
+		node.next.prev = node.prev
+	} else {
+		list.tail = node.prev
+	}
+	node.prev, node.next = nil, nil
+}
+
+// clampRange applies redis range semantics to start and end for a
+// collection of the given length, ok is false if the range is empty
+func clampRange(start int, end int, length int) (int, int, bool) {
+	if start < 0 {
+		start += length
+	}
+	if end < 0 {
+		end += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end >= length {
+		end = length - 1
+	}
+	if start > end || start >= length {
+		return 0, 0, false
+	}
+	return start, end, true
+}
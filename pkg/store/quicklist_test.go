@@ -0,0 +1,172 @@
+package store
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func newTestQuicklist(chunkSize int, values ...string) *quicklist {
+	list := newQuicklist()
+	list.chunkSize = chunkSize
+	for _, value := range values {
+		list.pushTail([]byte(value))
+	}
+	return list
+}
+
+func toStrings(values [][]byte) []string {
+	result := []string{}
+	for _, value := range values {
+		result = append(result, string(value))
+	}
+	return result
+}
+
+func TestQuicklistRange(t *testing.T) {
+	list := newTestQuicklist(2, "a", "b", "c", "d", "e")
+
+	tests := []struct {
+		start    int
+		end      int
+		expected []string
+	}{
+		{0, -1, []string{"a", "b", "c", "d", "e"}},
+		{1, 3, []string{"b", "c", "d"}},
+		{-2, -1, []string{"d", "e"}},
+		{-100, 100, []string{"a", "b", "c", "d", "e"}},
+		{3, 1, []string{}},
+		{5, 10, []string{}},
+	}
+
+	for _, test := range tests {
+		result := toStrings(list.rangeOf(test.start, test.end))
+		if !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("rangeOf(%d, %d) expected %v, got %v", test.start, test.end, test.expected, result)
+		}
+	}
+}
+
+func TestQuicklistInsertByPivot(t *testing.T) {
+	list := newTestQuicklist(2, "a", "b", "c")
+
+	if !list.insertByPivot([]byte("b"), []byte("x"), false) {
+		t.Fatalf("expected pivot b to be found")
+	}
+	if !list.insertByPivot([]byte("c"), []byte("y"), true) {
+		t.Fatalf("expected pivot c to be found")
+	}
+	if list.insertByPivot([]byte("missing"), []byte("z"), true) {
+		t.Errorf("expected missing pivot to not be found")
+	}
+
+	expected := []string{"a", "x", "b", "c", "y"}
+	if result := toStrings(list.rangeOf(0, -1)); !reflect.DeepEqual(result, expected) {
+		t.Errorf("expected %v, got %v", expected, result)
+	}
+}
+
+func TestQuicklistRemoveMatching(t *testing.T) {
+	tests := []struct {
+		count    int
+		removed  int
+		expected []string
+	}{
+		{0, 3, []string{"b", "c"}},
+		{2, 2, []string{"b", "c", "a"}},
+		{-2, 2, []string{"a", "b", "c"}},
+		{-10, 3, []string{"b", "c"}},
+	}
+
+	for _, test := range tests {
+		list := newTestQuicklist(2, "a", "b", "a", "c", "a")
+		removed := list.removeMatching([]byte("a"), test.count)
+		if removed != test.removed {
+			t.Errorf("removeMatching count %d expected %d removed, got %d", test.count, test.removed, removed)
+		}
+		if result := toStrings(list.rangeOf(0, -1)); !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("removeMatching count %d expected %v, got %v", test.count, test.expected, result)
+		}
+		if list.Len() != len(test.expected) {
+			t.Errorf("removeMatching count %d expected length %d, got %d", test.count, len(test.expected), list.Len())
+		}
+	}
+}
+
+func TestQuicklistTrim(t *testing.T) {
+	list := newTestQuicklist(3, "a", "b", "c", "d", "e", "f", "g")
+	list.trim(2, -2)
+
+	expected := []string{"c", "d", "e", "f"}
+	if result := toStrings(list.rangeOf(0, -1)); !reflect.DeepEqual(result, expected) {
+		t.Errorf("expected %v, got %v", expected, result)
+	}
+
+	list.trim(5, 1)
+	if list.Len() != 0 || list.head != nil || list.tail != nil {
+		t.Errorf("expected empty list after out of range trim, got length %d", list.Len())
+	}
+}
+
+// TestQuicklistAgainstSlice runs random operations against a quicklist
+// with tiny chunks and a plain slice and checks they never disagree
+func TestQuicklistAgainstSlice(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	list := newTestQuicklist(4)
+	var model []string
+
+	for i := 0; i < 5000; i++ {
+		value := fmt.Sprint(random.Intn(10))
+		switch random.Intn(6) {
+		case 0:
+			list.pushHead([]byte(value))
+			model = append([]string{value}, model...)
+		case 1:
+			list.pushTail([]byte(value))
+			model = append(model, value)
+		case 2:
+			popped, ok := list.popHead()
+			if ok != (len(model) > 0) {
+				t.Fatalf("popHead ok mismatch at step %d", i)
+			}
+			if ok {
+				if string(popped) != model[0] {
+					t.Fatalf("popHead expected %s, got %s", model[0], popped)
+				}
+				model = model[1:]
+			}
+		case 3:
+			offset := random.Intn(len(model) + 1)
+			list.insertAt(offset, []byte(value))
+			model = append(model[:offset], append([]string{value}, model[offset:]...)...)
+		case 4:
+			if len(model) > 0 {
+				offset := random.Intn(len(model))
+				count := random.Intn(3) + 1
+				list.deleteRange(offset, count)
+				end := offset + count
+				if end > len(model) {
+					end = len(model)
+				}
+				model = append(model[:offset], model[end:]...)
+			}
+		case 5:
+			if len(model) > 0 {
+				index := random.Intn(len(model))
+				got, _ := list.index(index)
+				if string(got) != model[index] {
+					t.Fatalf("index %d expected %s, got %s", index, model[index], got)
+				}
+			}
+		}
+
+		if list.Len() != len(model) {
+			t.Fatalf("length mismatch at step %d: expected %d, got %d", i, len(model), list.Len())
+		}
+	}
+
+	if result := toStrings(list.rangeOf(0, -1)); !reflect.DeepEqual(result, append([]string{}, model...)) {
+		t.Errorf("expected %v, got %v", model, result)
+	}
+}
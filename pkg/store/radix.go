@@ -0,0 +1,282 @@
+package store
+
+import (
+	"bytes"
+	"sort"
+)
+
+// radixTree is a compressed prefix tree over byte keys. Children are kept
+// sorted by the first byte of their edge so walks come out in key order,
+// which is what streams rely on to find the block holding an ID
+type radixTree struct {
+	root *radixNode
+	size int
+}
+
+type radixNode struct {
+	// edge is the part of the key leading into this node from its parent
+	edge     []byte
+	children []*radixNode
+	value    interface{}
+	hasValue bool
+}
+
+func newRadixTree() *radixTree {
+	return &radixTree{root: &radixNode{}}
+}
+
+func (tree *radixTree) Len() int {
+	return tree.size
+}
+
+func commonPrefixLength(a []byte, b []byte) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// childIndex returns where a child starting with b is or would be inserted
+func (node *radixNode) childIndex(b byte) (int, bool) {
+	i := sort.Search(len(node.children), func(i int) bool {
+		return node.children[i].edge[0] >= b
+	})
+	return i, i < len(node.children) && node.children[i].edge[0] == b
+}
+
+// insert sets key to value, returning true if the key is new
+func (tree *radixTree) insert(key []byte, value interface{}) bool {
+	node := tree.root
+	for {
+		if len(key) == 0 {
+			isNew := !node.hasValue
+			node.value, node.hasValue = value, true
+			if isNew {
+				tree.size++
+			}
+			return isNew
+		}
+
+		i, found := node.childIndex(key[0])
+		if !found {
+			child := &radixNode{edge: append([]byte{}, key...), value: value, hasValue: true}
+			node.children = append(node.children, nil)
+			copy(node.children[i+1:], node.children[i:])
+			node.children[i] = child
+			tree.size++
+			return true
+		}
+
+		child := node.children[i]
+		common := commonPrefixLength(child.edge, key)
+		if common < len(child.edge) {
+			// split the edge, the existing child hangs off the shared prefix
+			split := &radixNode{edge: child.edge[:common:common]}
+			child.edge = child.edge[common:]
+			split.children = []*radixNode{child}
+			node.children[i] = split
+			child = split
+		}
+		node = child
+		key = key[common:]
+	}
+}
+
+func (tree *radixTree) find(key []byte) (interface{}, bool) {
+	node := tree.root
+	for len(key) > 0 {
+		i, found := node.childIndex(key[0])
+		if !found || !bytes.HasPrefix(key, node.children[i].edge) {
+			return nil, false
+		}
+		node = node.children[i]
+		key = key[len(node.edge):]
+	}
+	return node.value, node.hasValue
+}
+
+// remove deletes key, merging nodes left with a single child so the tree
+// stays compressed
+func (tree *radixTree) remove(key []byte) bool {
+	var path []*radixNode
+	node := tree.root
+	for len(key) > 0 {
+		i, found := node.childIndex(key[0])
+		if !found || !bytes.HasPrefix(key, node.children[i].edge) {
+			return false
+		}
+		path = append(path, node)
+		node = node.children[i]
+		key = key[len(node.edge):]
+	}
+	if !node.hasValue {
+		return false
+	}
+	node.value, node.hasValue = nil, false
+	tree.size--
+
+	for len(path) > 0 && node != tree.root {
+		parent := path[len(path)-1]
+		path = path[:len(path)-1]
+		if node.hasValue {
+			break
+		}
+		if len(node.children) == 0 {
+			i, _ := parent.childIndex(node.edge[0])
+			parent.children = append(parent.children[:i], parent.children[i+1:]...)
+			node = parent
+			continue
+		}
+		if len(node.children) == 1 {
+			child := node.children[0]
+			merged := make([]byte, 0, len(node.edge)+len(child.edge))
+			merged = append(append(merged, node.edge...), child.edge...)
+			child.edge = merged
+			i, _ := parent.childIndex(node.edge[0])
+			parent.children[i] = child
+		}
+		break
+	}
+	return true
+}
+
+// ascend visits keys >= from in order until visit returns false, a nil
+// from starts at the first key
+func (tree *radixTree) ascend(from []byte, visit func(key []byte, value interface{}) bool) {
+	tree.root.ascend(nil, from, visit)
+}
+
+func (node *radixNode) ascend(prefix []byte, from []byte, visit func(key []byte, value interface{}) bool) bool {
+	key := append(prefix[:len(prefix):len(prefix)], node.edge...)
+	// compare only as much of from as this subtree's key covers
+	bounded := true
+	if from != nil {
+		limit := len(key)
+		if limit > len(from) {
+			limit = len(from)
+		}
+		switch bytes.Compare(key[:limit], from[:limit]) {
+		case -1:
+			return true
+		case 1:
+			bounded = false
+		default:
+			if len(key) >= len(from) {
+				bounded = false
+			}
+		}
+	} else {
+		bounded = false
+	}
+
+	if node.hasValue && !bounded {
+		if !visit(key, node.value) {
+			return false
+		}
+	}
+	if !bounded {
+		from = nil
+	}
+	for _, child := range node.children {
+		if !child.ascend(key, from, visit) {
+			return false
+		}
+	}
+	return true
+}
+
+// descend visits keys <= from in reverse order until visit returns false,
+// a nil from starts at the last key
+func (tree *radixTree) descend(from []byte, visit func(key []byte, value interface{}) bool) {
+	tree.root.descend(nil, from, visit)
+}
+
+func (node *radixNode) descend(prefix []byte, from []byte, visit func(key []byte, value interface{}) bool) bool {
+	key := append(prefix[:len(prefix):len(prefix)], node.edge...)
+	// bounded means some keys in this subtree may be greater than from
+	bounded := from != nil
+	if from != nil {
+		limit := len(key)
+		if limit > len(from) {
+			limit = len(from)
+		}
+		switch bytes.Compare(key[:limit], from[:limit]) {
+		case 1:
+			return true
+		case -1:
+			bounded = false
+		default:
+			// key is a prefix of from or equal up to from's end
+			if len(key) > len(from) {
+				return true
+			}
+		}
+	}
+
+	childFrom := from
+	if !bounded {
+		childFrom = nil
+	}
+	for i := len(node.children) - 1; i >= 0; i-- {
+		if !node.children[i].descend(key, childFrom, visit) {
+			return false
+		}
+	}
+	// a node's own key sorts before everything below it
+	if node.hasValue {
+		if !visit(key, node.value) {
+			return false
+		}
+	}
+	return true
+}
+
+// first returns the smallest key
+func (tree *radixTree) first() ([]byte, interface{}, bool) {
+	var foundKey []byte
+	var foundValue interface{}
+	found := false
+	tree.ascend(nil, func(key []byte, value interface{}) bool {
+		foundKey, foundValue, found = key, value, true
+		return false
+	})
+	return foundKey, foundValue, found
+}
+
+// last returns the largest key
+func (tree *radixTree) last() ([]byte, interface{}, bool) {
+	var foundKey []byte
+	var foundValue interface{}
+	found := false
+	tree.descend(nil, func(key []byte, value interface{}) bool {
+		foundKey, foundValue, found = key, value, true
+		return false
+	})
+	return foundKey, foundValue, found
+}
+
+// floor returns the largest key <= key
+func (tree *radixTree) floor(key []byte) ([]byte, interface{}, bool) {
+	var foundKey []byte
+	var foundValue interface{}
+	found := false
+	tree.descend(key, func(k []byte, value interface{}) bool {
+		foundKey, foundValue, found = k, value, true
+		return false
+	})
+	return foundKey, foundValue, found
+}
+
+// nodeCount returns how many nodes the tree is made of, root included
+func (tree *radixTree) nodeCount() int {
+	var count func(node *radixNode) int
+	count = func(node *radixNode) int {
+		total := 1
+		for _, child := range node.children {
+			total += count(child)
+		}
+		return total
+	}
+	return count(tree.root)
+}
@@ -0,0 +1,111 @@
+package store
+
+import (
+	"bytes"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// TestRadixTreeAgainstSortedKeys checks lookups, ordered walks and floor
+// stay right through random inserts and removes of overlapping keys
+func TestRadixTreeAgainstSortedKeys(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	tree := newRadixTree()
+	model := make(map[string]int)
+
+	randomKey := func() []byte {
+		key := make([]byte, random.Intn(4))
+		for i := range key {
+			key[i] = byte('a' + random.Intn(3))
+		}
+		return key
+	}
+
+	for i := 0; i < 5000; i++ {
+		key := randomKey()
+		if random.Intn(3) == 0 {
+			_, exists := model[string(key)]
+			if tree.remove(key) != exists {
+				t.Fatalf("remove %q expected %v", key, exists)
+			}
+			delete(model, string(key))
+			continue
+		}
+		_, exists := model[string(key)]
+		if tree.insert(key, i) == exists {
+			t.Fatalf("insert %q expected new %v", key, !exists)
+		}
+		model[string(key)] = i
+	}
+
+	if tree.Len() != len(model) {
+		t.Fatalf("expected %d keys, got %d", len(model), tree.Len())
+	}
+	var sorted []string
+	for key, value := range model {
+		sorted = append(sorted, key)
+		if found, ok := tree.find([]byte(key)); !ok || found != value {
+			t.Errorf("find %q expected %d, got %v %v", key, value, found, ok)
+		}
+	}
+	sort.Strings(sorted)
+
+	var walked []string
+	tree.ascend(nil, func(key []byte, _ interface{}) bool {
+		walked = append(walked, string(key))
+		return true
+	})
+	if len(walked) != len(sorted) {
+		t.Fatalf("ascend walked %d keys, expected %d", len(walked), len(sorted))
+	}
+	for i := range sorted {
+		if walked[i] != sorted[i] {
+			t.Fatalf("ascend order wrong at %d: %q vs %q", i, walked[i], sorted[i])
+		}
+	}
+
+	// every bound, including ones that aren't keys, against the model
+	for i := 0; i < 200; i++ {
+		from := randomKey()
+		var expectedAscend, expectedFloor []string
+		for _, key := range sorted {
+			if bytes.Compare([]byte(key), from) >= 0 {
+				expectedAscend = append(expectedAscend, key)
+			} else if key == string(from) || bytes.Compare([]byte(key), from) < 0 {
+				expectedFloor = append(expectedFloor, key)
+			}
+		}
+		if _, ok := model[string(from)]; ok {
+			expectedFloor = append(expectedFloor, string(from))
+		}
+
+		var ascended []string
+		tree.ascend(from, func(key []byte, _ interface{}) bool {
+			ascended = append(ascended, string(key))
+			return true
+		})
+		if len(ascended) != len(expectedAscend) {
+			t.Fatalf("ascend from %q expected %q, got %q", from, expectedAscend, ascended)
+		}
+
+		var descended []string
+		tree.descend(from, func(key []byte, _ interface{}) bool {
+			descended = append(descended, string(key))
+			return true
+		})
+		if len(descended) != len(expectedFloor) {
+			t.Fatalf("descend from %q expected %d keys, got %q", from, len(expectedFloor), descended)
+		}
+		for j := range descended {
+			if descended[j] != expectedFloor[len(expectedFloor)-1-j] {
+				t.Fatalf("descend from %q out of order: %q", from, descended)
+			}
+		}
+
+		floor, _, ok := tree.floor(from)
+		if ok != (len(expectedFloor) > 0) || (ok && string(floor) != expectedFloor[len(expectedFloor)-1]) {
+			t.Errorf("floor of %q got %q %v", from, floor, ok)
+		}
+	}
+}
@@ -0,0 +1,591 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Yashver1/KVCacheGo/pkg/parser"
+)
+
+var errRDBFormat = errors.New("invalid rdb value")
+
+// value types, opcodes, length encodings and module opcodes as laid out
+// in redis' rdb.h
+const (
+	// the version written, files up to rdbMaxVersion are read
+	rdbVersion    = 11
+	rdbMaxVersion = 12
+
+	rdbTypeString  = 0
+	rdbTypeList    = 1
+	rdbTypeSet     = 2
+	rdbTypeHash    = 4
+	rdbTypeZset2   = 5
+	rdbTypeModule2 = 7
+
+	// written ahead of a key's value, its access metadata for LRU and
+	// LFU eviction and its expiry
+	rdbOpcodeIdle         = 0xF8
+	rdbOpcodeFreq         = 0xF9
+	rdbOpcodeExpireTimeMs = 0xFC
+	rdbOpcodeExpireTime   = 0xFD
+
+	// the rest of the file around the keys
+	rdbOpcodeAux      = 0xFA
+	rdbOpcodeResizeDB = 0xFB
+	rdbOpcodeSelectDB = 0xFE
+	rdbOpcodeEOF      = 0xFF
+
+	rdb14BitLength = 1
+	rdb32BitLength = 0x80
+	rdb64BitLength = 0x81
+
+	rdbModuleOpcodeEOF    = 0
+	rdbModuleOpcodeString = 5
+)
+
+// types with no native RDB representation are written the way redis
+// writes module types, a 64 bit id made of a 9 character name and an
+// encoding version followed by whatever the type saves and an EOF opcode.
+// A server with the matching module loaded can read them back
+type rdbModuleType struct {
+	name            string
+	encodingVersion uint64
+	save            func(entry *Entry, writer *rdbWriter)
+	load            func(reader *rdbReader, encodingVersion uint64) (*Entry, error)
+}
+
+const moduleTypeNameCharset = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+
+// id packs the name 6 bits a character ahead of a 10 bit version
+func (moduleType *rdbModuleType) id() uint64 {
+	var id uint64
+	for i := 0; i < 9; i++ {
+		id = id<<6 | uint64(strings.IndexByte(moduleTypeNameCharset, moduleType.name[i]))
+	}
+	return id<<10 | moduleType.encodingVersion
+}
+
+func decodeModuleID(id uint64) (string, uint64) {
+	name := make([]byte, 9)
+	for i := 8; i >= 0; i-- {
+		name[i] = moduleTypeNameCharset[id>>(10+6*(8-uint(i)))&63]
+	}
+	return string(name), id & 1023
+}
+
+// JSON documents are saved as RedisJSON saves them, the serialized
+// document as a single string
+var jsonModuleType = &rdbModuleType{
+	name:            "ReJSON-RL",
+	encodingVersion: 3,
+	save: func(entry *Entry, writer *rdbWriter) {
+		writer.writeLength(rdbModuleOpcodeString)
+		writer.writeString(entry.json().serialize())
+	},
+	load: func(reader *rdbReader, encodingVersion uint64) (*Entry, error) {
+		if encodingVersion != 3 {
+			return nil, fmt.Errorf("unsupported ReJSON-RL encoding version %d", encodingVersion)
+		}
+		if opcode, err := reader.readLength(); err != nil || opcode != rdbModuleOpcodeString {
+			return nil, errRDBFormat
+		}
+		text, err := reader.readString()
+		if err != nil {
+			return nil, err
+		}
+		document, err := parseJSON(text)
+		if err != nil {
+			return nil, err
+		}
+		return newJSONEntry(document), nil
+	},
+}
+
+var rdbModuleTypes = map[objectType]*rdbModuleType{
+	jsonType: jsonModuleType,
+}
+
+type rdbWriter struct {
+	bytes.Buffer
+}
+
+func (writer *rdbWriter) writeLength(length uint64) {
+	switch {
+	case length < 1<<6:
+		writer.WriteByte(byte(length))
+	case length < 1<<14:
+		writer.WriteByte(byte(length>>8) | rdb14BitLength<<6)
+		writer.WriteByte(byte(length))
+	case length <= 0xffffffff:
+		writer.WriteByte(rdb32BitLength)
+		writer.Write(binary.BigEndian.AppendUint32(nil, uint32(length)))
+	default:
+		writer.WriteByte(rdb64BitLength)
+		writer.Write(binary.BigEndian.AppendUint64(nil, length))
+	}
+}
+
+func (writer *rdbWriter) writeString(value []byte) {
+	writer.writeLength(uint64(len(value)))
+	writer.Write(value)
+}
+
+// writeModuleObject writes key and its value as a module value, returning
+// false if the type isn't saved as one
+func (writer *rdbWriter) writeModuleObject(key string, entry *Entry) bool {
+	moduleType, ok := rdbModuleTypes[entry.objectType]
+	if !ok {
+		return false
+	}
+	writer.WriteByte(rdbTypeModule2)
+	writer.writeString([]byte(key))
+	writer.writeLength(moduleType.id())
+	moduleType.save(entry, writer)
+	writer.writeLength(rdbModuleOpcodeEOF)
+	return true
+}
+
+// checkSavable returns an error if writeKey can't save entry. Lists,
+// sets, hashes and sorted sets are saved in the plain encodings every
+// Redis version reads, types with a module type as module values.
+// Streams, the probabilistic, time series and vector set types and hashes
+// with field ttls aren't saved yet, rather than being dropped or losing
+// their ttls they fail the save
+func checkSavable(key string, entry *Entry) error {
+	switch entry.objectType {
+	case stringType, listType, setType, zsetType:
+		return nil
+	case hashType:
+		if len(entry.hash().expires) > 0 {
+			return fmt.Errorf("ERR can't save '%s', hash field ttls aren't saved to RDB yet", key)
+		}
+		return nil
+	}
+	if rdbModuleTypes[entry.objectType] == nil {
+		return fmt.Errorf("ERR can't save '%s', %s keys aren't saved to RDB yet", key, entry.objectType)
+	}
+	return nil
+}
+
+// writeKey writes key the way Redis saves a key, its expiry and access
+// metadata followed by its value. Like Redis it saves the idle time under
+// an LRU policy and the LFU counter under an LFU one, so eviction picks
+// up where it left off once the key is loaded. It returns an error,
+// writing nothing, if the key can't be saved, see checkSavable
+func (writer *rdbWriter) writeKey(key string, entry *Entry, config *Config) error {
+	if err := checkSavable(key, entry); err != nil {
+		return err
+	}
+	if entry.hasExpiry() {
+		writer.WriteByte(rdbOpcodeExpireTimeMs)
+		writer.Write(binary.LittleEndian.AppendUint64(nil, uint64(entry.expiryTime.UnixMilli())))
+	}
+	switch policy := config.maxmemoryPolicy; {
+	case isLFUPolicy(policy):
+		writer.WriteByte(rdbOpcodeFreq)
+		writer.WriteByte(byte(entry.frequency(config)))
+	case policy == policyAllkeysLRU || policy == policyVolatileLRU:
+		writer.WriteByte(rdbOpcodeIdle)
+		writer.writeLength(uint64(entry.idleSeconds()))
+	}
+
+	switch entry.objectType {
+	case stringType:
+		writer.WriteByte(rdbTypeString)
+		writer.writeString([]byte(key))
+		writer.writeString(entry.bytes())
+	case listType:
+		writer.WriteByte(rdbTypeList)
+		writer.writeString([]byte(key))
+		list := entry.list()
+		writer.writeLength(uint64(list.Len()))
+		for _, value := range list.rangeOf(0, -1) {
+			writer.writeString(value)
+		}
+	case setType:
+		writer.WriteByte(rdbTypeSet)
+		writer.writeString([]byte(key))
+		members := entry.set().all()
+		writer.writeLength(uint64(len(members)))
+		for _, member := range members {
+			writer.writeString([]byte(member))
+		}
+	case hashType:
+		var pairs [][]byte
+		entry.hash().forEach(func(field string, value []byte) bool {
+			pairs = append(pairs, []byte(field), value)
+			return true
+		})
+		writer.WriteByte(rdbTypeHash)
+		writer.writeString([]byte(key))
+		writer.writeLength(uint64(len(pairs) / 2))
+		for _, value := range pairs {
+			writer.writeString(value)
+		}
+	case zsetType:
+		writer.WriteByte(rdbTypeZset2)
+		writer.writeString([]byte(key))
+		nodes := entry.zset().nodesByRank(0, -1, false)
+		writer.writeLength(uint64(len(nodes)))
+		for _, node := range nodes {
+			writer.writeString([]byte(node.member))
+			writer.Write(binary.LittleEndian.AppendUint64(nil, math.Float64bits(node.score)))
+		}
+	default:
+		writer.writeModuleObject(key, entry)
+	}
+	return nil
+}
+
+type rdbReader struct {
+	*bytes.Reader
+}
+
+// readLength and readString decode with the parser package, which reads
+// RDB files too
+
+func (reader *rdbReader) readLength() (uint64, error) {
+	return parser.ReadLength(reader.Reader)
+}
+
+func (reader *rdbReader) readString() ([]byte, error) {
+	return parser.ReadString(reader.Reader)
+}
+
+// readModuleObject reads a module value after its type byte, returning
+// the key and the entry
+func (reader *rdbReader) readModuleObject() (string, *Entry, error) {
+	key, err := reader.readString()
+	if err != nil {
+		return "", nil, err
+	}
+	id, err := reader.readLength()
+	if err != nil {
+		return "", nil, err
+	}
+	name, encodingVersion := decodeModuleID(id)
+	var moduleType *rdbModuleType
+	for _, candidate := range rdbModuleTypes {
+		if candidate.name == name {
+			moduleType = candidate
+		}
+	}
+	if moduleType == nil {
+		return "", nil, fmt.Errorf("unknown module type %s", name)
+	}
+	entry, err := moduleType.load(reader, encodingVersion)
+	if err != nil {
+		return "", nil, err
+	}
+	if opcode, err := reader.readLength(); err != nil || opcode != rdbModuleOpcodeEOF {
+		return "", nil, errRDBFormat
+	}
+	return string(key), entry, nil
+}
+
+// rdbKey is a key read back by readKey. idle and freq are -1 unless it
+// was saved with them, entry is nil for a collection saved empty, which
+// redis would never have written and isn't loaded
+type rdbKey struct {
+	key   string
+	entry *Entry
+	idle  int64
+	freq  int64
+}
+
+// readKey reads a key written by writeKey, along with any expiry and
+// access metadata written ahead of it. Collections are built under config
+// so they get the encodings their size calls for
+func (reader *rdbReader) readKey(config *Config) (rdbKey, error) {
+	loaded := rdbKey{idle: -1, freq: -1}
+	expiry := int64(-1)
+	for {
+		opcode, err := reader.ReadByte()
+		if err != nil {
+			return rdbKey{}, err
+		}
+		switch opcode {
+		case rdbOpcodeExpireTimeMs:
+			buffer := make([]byte, 8)
+			if _, err := io.ReadFull(reader, buffer); err != nil {
+				return rdbKey{}, err
+			}
+			expiry = int64(binary.LittleEndian.Uint64(buffer))
+			continue
+		case rdbOpcodeExpireTime:
+			buffer := make([]byte, 4)
+			if _, err := io.ReadFull(reader, buffer); err != nil {
+				return rdbKey{}, err
+			}
+			expiry = int64(binary.LittleEndian.Uint32(buffer)) * 1000
+			continue
+		case rdbOpcodeIdle:
+			idle, err := reader.readLength()
+			if err != nil {
+				return rdbKey{}, err
+			}
+			loaded.idle = int64(min(idle, lruClockMax))
+			continue
+		case rdbOpcodeFreq:
+			freq, err := reader.ReadByte()
+			if err != nil {
+				return rdbKey{}, err
+			}
+			loaded.freq = int64(freq)
+			continue
+		case rdbTypeString:
+			key, err := reader.readString()
+			if err != nil {
+				return rdbKey{}, err
+			}
+			value, err := reader.readString()
+			if err != nil {
+				return rdbKey{}, err
+			}
+			loaded.key = string(key)
+			loaded.entry = newEntry()
+			loaded.entry.setString(value)
+		case rdbTypeList, rdbTypeSet, rdbTypeHash, rdbTypeZset2:
+			key, err := reader.readString()
+			if err != nil {
+				return rdbKey{}, err
+			}
+			loaded.key = string(key)
+			loaded.entry, err = reader.readCollection(opcode, config)
+			if err != nil {
+				return rdbKey{}, err
+			}
+		case rdbTypeModule2:
+			loaded.key, loaded.entry, err = reader.readModuleObject()
+			if err != nil {
+				return rdbKey{}, err
+			}
+		default:
+			return rdbKey{}, fmt.Errorf("unsupported rdb value type %d", opcode)
+		}
+		if loaded.entry != nil && expiry >= 0 {
+			loaded.entry.expiryTime = time.UnixMilli(expiry)
+		}
+		return loaded, nil
+	}
+}
+
+// readCollection reads the elements of a list, set, hash or sorted set
+// saved as valueType, returning nil if there are none
+func (reader *rdbReader) readCollection(valueType byte, config *Config) (*Entry, error) {
+	length, err := reader.readLength()
+	if err != nil || length == 0 {
+		return nil, err
+	}
+	var entry *Entry
+	switch valueType {
+	case rdbTypeList:
+		entry = newListEntry()
+	case rdbTypeSet:
+		entry = newSetEntry()
+	case rdbTypeHash:
+		entry = newHashEntry()
+	case rdbTypeZset2:
+		entry = newZsetEntry()
+	}
+	for ; length > 0; length-- {
+		element, err := reader.readString()
+		if err != nil {
+			return nil, err
+		}
+		switch valueType {
+		case rdbTypeList:
+			entry.list().pushTail(element)
+		case rdbTypeSet:
+			entry.setAdd(string(element), config)
+		case rdbTypeHash:
+			value, err := reader.readString()
+			if err != nil {
+				return nil, err
+			}
+			entry.hashSet(string(element), value, config)
+		case rdbTypeZset2:
+			buffer := make([]byte, 8)
+			if _, err := io.ReadFull(reader, buffer); err != nil {
+				return nil, err
+			}
+			score := math.Float64frombits(binary.LittleEndian.Uint64(buffer))
+			if math.IsNaN(score) {
+				return nil, errRDBFormat
+			}
+			entry.zset().set(score, string(element))
+		}
+	}
+	return entry, nil
+}
+
+// restoreKey stores a key read back by readKey with the access metadata
+// it was saved with. Caller must hold the write lock of the key's shard
+func (kvstore *KVStore) restoreKey(loaded rdbKey) {
+	kvstore.setKey(loaded.key, loaded.entry)
+	loaded.entry.restoreAccess(&kvstore.config, loaded.idle, loaded.freq)
+}
+
+// writeRDB writes the keyspace as an RDB file holding database 0, failing
+// on the first key writeKey can't save. The checksum is left 0, which
+// tells Redis not to verify it. Caller must hold the read lock of every
+// shard
+func (kvstore *KVStore) writeRDB(writer *rdbWriter) error {
+	var body rdbWriter
+	var keys, expires uint64
+	now := time.Now()
+	for _, shard := range kvstore.shards {
+		for key, entry := range shard.store {
+			if entry.isExpired(now) {
+				continue
+			}
+			if err := body.writeKey(key, entry, &kvstore.config); err != nil {
+				return err
+			}
+			keys++
+			if entry.hasExpiry() {
+				expires++
+			}
+		}
+	}
+
+	writer.WriteString(fmt.Sprintf("REDIS%04d", rdbVersion))
+	writer.WriteByte(rdbOpcodeSelectDB)
+	writer.writeLength(0)
+	writer.WriteByte(rdbOpcodeResizeDB)
+	writer.writeLength(keys)
+	writer.writeLength(expires)
+	writer.Write(body.Bytes())
+	writer.WriteByte(rdbOpcodeEOF)
+	writer.Write(make([]byte, 8))
+	return nil
+}
+
+// loadRDB adds the keys of an RDB file to the keyspace, skipping those
+// that have expired since. Only database 0 can be loaded as the store has
+// no others
+func (kvstore *KVStore) loadRDB(data []byte) error {
+	if len(data) < 9 || string(data[:5]) != "REDIS" {
+		return errors.New("not an rdb file")
+	}
+	if version, err := strconv.Atoi(string(data[5:9])); err != nil || version > rdbMaxVersion {
+		return fmt.Errorf("unsupported rdb version %q", data[5:9])
+	}
+	reader := &rdbReader{bytes.NewReader(data[9:])}
+	for {
+		opcode, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch opcode {
+		case rdbOpcodeEOF:
+			return nil
+		case rdbOpcodeSelectDB:
+			database, err := reader.readLength()
+			if err != nil {
+				return err
+			}
+			if database != 0 {
+				return fmt.Errorf("rdb holds database %d, only database 0 can be loaded", database)
+			}
+		case rdbOpcodeResizeDB:
+			if _, err := reader.readLength(); err != nil {
+				return err
+			}
+			if _, err := reader.readLength(); err != nil {
+				return err
+			}
+		case rdbOpcodeAux:
+			if _, err := reader.readString(); err != nil {
+				return err
+			}
+			if _, err := reader.readString(); err != nil {
+				return err
+			}
+		default:
+			reader.UnreadByte()
+			loaded, err := reader.readKey(&kvstore.config)
+			if err != nil {
+				return err
+			}
+			if loaded.entry == nil || loaded.entry.isExpired(time.Now()) {
+				continue
+			}
+			kvstore.lockKeys(loaded.key)
+			kvstore.restoreKey(loaded)
+			kvstore.unlockKeys(loaded.key)
+		}
+	}
+}
+
+// rdbPath is where SAVE writes and the store loads from
+func (kvstore *KVStore) rdbPath() string {
+	return filepath.Join(kvstore.config.dir, kvstore.config.dbFileName)
+}
+
+// load reads the RDB file at rdbPath if there is one
+func (kvstore *KVStore) load() error {
+	data, err := os.ReadFile(kvstore.rdbPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := kvstore.loadRDB(data); err != nil {
+		return fmt.Errorf("loading %s: %w", kvstore.rdbPath(), err)
+	}
+	return nil
+}
+
+// handleSAVE writes the keyspace to dir/dbfilename. The file is written
+// under a temporary name and renamed over the old one, so a crash midway
+// leaves the last save intact
+func (kvstore *KVStore) handleSAVE(messages [][]byte) []byte {
+	if len(messages) != 1 {
+		return wrongArgumentsError("save")
+	}
+	var writer rdbWriter
+	kvstore.rlockAll()
+	err := kvstore.writeRDB(&writer)
+	kvstore.runlockAll()
+	if err != nil {
+		return encodeError(err)
+	}
+
+	if err := writeFileAtomically(kvstore.rdbPath(), writer.Bytes()); err != nil {
+		return encodeError(errors.New("ERR " + err.Error()))
+	}
+	return okReply
+}
+
+func writeFileAtomically(path string, data []byte) error {
+	file, err := os.CreateTemp(filepath.Dir(path), "temp-*.rdb")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
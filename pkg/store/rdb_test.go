@@ -0,0 +1,182 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// reopen starts a store from the RDB file of options, as a restarted
+// server would
+func reopen(t *testing.T, options Options) *KVStore {
+	t.Helper()
+	kvstore, err := NewWithOptions(options)
+	if err != nil {
+		t.Fatalf("loading: %v", err)
+	}
+	t.Cleanup(kvstore.Close)
+	return kvstore
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	options := Options{Dir: t.TempDir(), DBFilename: "dump.rdb"}
+	source := reopen(t, options)
+	client := newTestClient()
+	for _, arguments := range []string{
+		"SET string value px 60000",
+		"SET counter 12345",
+		"RPUSH list a b c",
+		"SADD numbers 3 1 2",
+		"SADD words x y",
+		"HSET hash field value other 1",
+		"ZADD zset 1.5 a -inf b 2 c",
+		"SET expired value px 1",
+	} {
+		execute(t, source, client, strings.Fields(arguments)...)
+	}
+	time.Sleep(2 * time.Millisecond)
+	if got := execute(t, source, client, "SAVE"); got != string(okReply) {
+		t.Fatalf("expected SAVE to succeed, got %q", got)
+	}
+
+	loaded := reopen(t, options)
+	for _, check := range []struct {
+		command  string
+		expected string
+	}{
+		{"GET string", "$5\r\nvalue\r\n"},
+		{"GET counter", "$5\r\n12345\r\n"},
+		{"LRANGE list 0 -1", string(encodeArray(command("a", "b", "c")))},
+		{"SMEMBERS numbers", string(encodeArray(command("1", "2", "3")))},
+		{"SCARD words", ":2\r\n"},
+		{"HGET hash other", "$1\r\n1\r\n"},
+		{"HLEN hash", ":2\r\n"},
+		{"ZRANGE zset 0 -1 WITHSCORES", string(encodeArray(command("b", "-inf", "a", "1.5", "c", "2")))},
+		{"OBJECT ENCODING numbers", "$6\r\nintset\r\n"},
+		{"OBJECT ENCODING counter", "$3\r\nint\r\n"},
+	} {
+		if got := execute(t, loaded, client, strings.Fields(check.command)...); got != check.expected {
+			t.Errorf("%s: expected %q, got %q", check.command, check.expected, got)
+		}
+	}
+	if ttl := time.Until(loaded.find("string").expiryTime); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("expected the ttl to survive, got %v", ttl)
+	}
+	if loaded.find("expired") != nil {
+		t.Errorf("keys expired before the save shouldn't be loaded")
+	}
+	if loaded.usedMemory.Load() != keyspaceMemory(loaded) {
+		t.Errorf("expected loaded keys to be counted in used memory")
+	}
+}
+
+func TestSaveAndLoadKeepAccessMetadata(t *testing.T) {
+	for _, test := range []struct {
+		policy string
+		set    func(entry *Entry)
+		check  string
+		value  int64
+	}{
+		{"allkeys-lru", func(entry *Entry) { entry.lru.Store(lruClock() - 1000) }, "IDLETIME", 1000},
+		{"allkeys-lfu", func(entry *Entry) { entry.lru.Store(lfuMinutes()<<8 | 42) }, "FREQ", 42},
+	} {
+		t.Run(test.policy, func(t *testing.T) {
+			options := Options{
+				Dir:        t.TempDir(),
+				DBFilename: "dump.rdb",
+				Config:     map[string]string{"maxmemory-policy": test.policy},
+			}
+			source := reopen(t, options)
+			client := newTestClient()
+			execute(t, source, client, "RPUSH", "key", "value")
+			test.set(source.find("key"))
+			execute(t, source, client, "SAVE")
+
+			loaded := reopen(t, options)
+			if got := execute(t, loaded, client, "OBJECT", test.check, "key"); !within(got, test.value-1, test.value+1) {
+				t.Errorf("expected OBJECT %s to give about %d after a restart, got %q", test.check, test.value, got)
+			}
+		})
+	}
+}
+
+func TestLoadRedisRDB(t *testing.T) {
+	// saved by Redis 7.4, aux fields and a checksum included
+	data, err := os.ReadFile("../../cmd/dump.rdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "dump.rdb"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	kvstore := reopen(t, Options{Dir: dir, DBFilename: "dump.rdb"})
+	if got := execute(t, kvstore, newTestClient(), "GET", "mykey"); got != "$5\r\nmyval\r\n" {
+		t.Errorf("expected mykey from the file, got %q", got)
+	}
+}
+
+func TestLoadFailures(t *testing.T) {
+	dir := t.TempDir()
+	if kvstore := reopen(t, Options{Dir: dir, DBFilename: "missing.rdb"}); kvstore.keyCount() != 0 {
+		t.Errorf("a missing file should start an empty store")
+	}
+
+	source := reopen(t, Options{Dir: dir, DBFilename: "dump.rdb"})
+	execute(t, source, newTestClient(), "SET", "key", "value")
+	execute(t, source, newTestClient(), "SAVE")
+	path := filepath.Join(dir, "dump.rdb")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, corrupt := range map[string][]byte{
+		"truncated":   data[:len(data)-12],
+		"not an rdb":  []byte("hello world"),
+		"too new":     append([]byte("REDIS0099"), data[9:]...),
+		"unknown key": append(append([]byte{}, data[:len(data)-9]...), 0x42, 0xff),
+	} {
+		if err := os.WriteFile(path, corrupt, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewWithOptions(Options{Dir: dir, DBFilename: "dump.rdb"}); err == nil {
+			t.Errorf("%s: expected loading to fail", name)
+		}
+	}
+}
+
+func TestSaveRefusesKeysItCantWrite(t *testing.T) {
+	options := Options{Dir: t.TempDir(), DBFilename: "dump.rdb"}
+	client := newTestClient()
+	for _, arguments := range []string{
+		"XADD key * field value",
+		"BF.ADD key item",
+		"CF.ADD key item",
+		"CMS.INITBYDIM key 10 5",
+		"TS.ADD key 1 1",
+		"VADD key VALUES 2 1 0 element",
+		"HSET key field value",
+	} {
+		kvstore := reopen(t, options)
+		execute(t, kvstore, client, "SET", "other", "value")
+		execute(t, kvstore, client, strings.Fields(arguments)...)
+		if strings.HasPrefix(arguments, "HSET") {
+			execute(t, kvstore, client, "HEXPIRE", "key", "100", "FIELDS", "1", "field")
+		}
+		if got := execute(t, kvstore, client, "SAVE"); !strings.HasPrefix(got, "-ERR can't save 'key'") {
+			t.Errorf("%s: expected SAVE to refuse the key, got %q", arguments, got)
+		}
+		if _, err := os.Stat(filepath.Join(options.Dir, options.DBFilename)); err == nil {
+			t.Fatalf("%s: a refused SAVE shouldn't write the file", arguments)
+		}
+	}
+}
+
+func TestSaveReportsWriteErrors(t *testing.T) {
+	kvstore := reopen(t, Options{Dir: filepath.Join(t.TempDir(), "missing"), DBFilename: "dump.rdb"})
+	if got := execute(t, kvstore, newTestClient(), "SAVE"); !strings.HasPrefix(got, "-ERR ") {
+		t.Errorf("expected SAVE into a missing directory to fail, got %q", got)
+	}
+}
@@ -0,0 +1,70 @@
+package store
+
+import (
+	"strconv"
+	"strings"
+)
+
+var (
+	nullBulkReply  = []byte("$-1\r\n")
+	nullArrayReply = []byte("*-1\r\n")
+	okReply        = []byte("+OK\r\n")
+)
+
+func encodeSimpleString(value string) []byte {
+	return []byte(string(simpleStrings) + value + "\r\n")
+}
+
+func encodeError(err error) []byte {
+	return []byte(string(errorString) + err.Error() + "\r\n")
+}
+
+func encodeInteger(value int64) []byte {
+	var result []byte
+	result = append(result, integers)
+	result = strconv.AppendInt(result, value, 10)
+	result = append(result, []byte("\r\n")...)
+	return result
+}
+
+func encodeBulkString(value []byte) []byte {
+	var result []byte
+	result = append(result, bulkStrings)
+	result = strconv.AppendInt(result, int64(len(value)), 10)
+	result = append(result, []byte("\r\n")...)
+	result = append(result, value...)
+	result = append(result, []byte("\r\n")...)
+	return result
+}
+
+func encodeArrayHeader(length int) []byte {
+	var result []byte
+	result = append(result, arrays)
+	result = strconv.AppendInt(result, int64(length), 10)
+	result = append(result, []byte("\r\n")...)
+	return result
+}
+
+// encodeArray writes values as an array of bulk strings
+func encodeArray(values [][]byte) []byte {
+	result := encodeArrayHeader(len(values))
+	for _, value := range values {
+		result = append(result, encodeBulkString(value)...)
+	}
+	return result
+}
+
+// encodeRawArray wraps replies that are already encoded in an array
+func encodeRawArray(replies [][]byte) []byte {
+	result := encodeArrayHeader(len(replies))
+	for _, reply := range replies {
+		result = append(result, reply...)
+	}
+	return result
+}
+
+// wrongArgumentsError mirrors the message redis sends when a command
+// is called with the wrong arity
+func wrongArgumentsError(command string) []byte {
+	return []byte("-ERR wrong number of arguments for '" + strings.ToLower(command) + "' command\r\n")
+}
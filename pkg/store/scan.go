@@ -0,0 +1,240 @@
+package store
+
+import (
+	"errors"
+	"hash/fnv"
+	"math/bits"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const defaultScanCount = 10
+
+var errInvalidCursor = errors.New("ERR invalid cursor")
+
+type scanOptions struct {
+	cursor   uint64
+	pattern  []byte
+	count    int
+	noValues bool
+}
+
+// parseScanOptions reads cursor [MATCH pattern] [COUNT count] for the
+// *SCAN commands, allowNoValues enables HSCAN's NOVALUES flag
+func parseScanOptions(arguments [][]byte, allowNoValues bool) (scanOptions, error) {
+	options := scanOptions{count: defaultScanCount}
+	cursor, err := strconv.ParseUint(string(arguments[0]), 10, 64)
+	if err != nil {
+		return options, errInvalidCursor
+	}
+	options.cursor = cursor
+
+	for i := 1; i < len(arguments); i++ {
+		switch strings.ToUpper(string(arguments[i])) {
+		case "MATCH":
+			if i+1 >= len(arguments) {
+				return options, errSyntax
+			}
+			options.pattern = arguments[i+1]
+			i++
+		case "COUNT":
+			if i+1 >= len(arguments) {
+				return options, errSyntax
+			}
+			count, err := parseInteger(arguments[i+1])
+			if err != nil {
+				return options, err
+			}
+			if count < 1 {
+				return options, errSyntax
+			}
+			options.count = int(count)
+			i++
+		case "NOVALUES":
+			if !allowNoValues {
+				return options, errSyntax
+			}
+			options.noValues = true
+		default:
+			return options, errSyntax
+		}
+	}
+	return options, nil
+}
+
+// scanHash places a member in a scanIndex bucket
+func scanHash(member string) uint64 {
+	hasher := fnv.New64a()
+	hasher.Write([]byte(member))
+	return hasher.Sum64()
+}
+
+// minScanBuckets is the fewest buckets a scanIndex shrinks to
+const minScanBuckets = 4
+
+// scanIndex buckets the members of a hashtable encoded hash or set by
+// scanHash, the way a redis dict does, so each HSCAN or SSCAN call only
+// visits the buckets its cursor covers. The buckets double once there are
+// more members than buckets and halve below one member for every eight
+type scanIndex struct {
+	buckets [][]string
+	length  int
+}
+
+func newScanIndex() *scanIndex {
+	return &scanIndex{buckets: make([][]string, minScanBuckets)}
+}
+
+func (index *scanIndex) bucket(member string) *[]string {
+	return &index.buckets[scanHash(member)&uint64(len(index.buckets)-1)]
+}
+
+// add indexes member, which mustn't be indexed already
+func (index *scanIndex) add(member string) {
+	bucket := index.bucket(member)
+	*bucket = append(*bucket, member)
+	index.length++
+	if index.length > len(index.buckets) {
+		index.resize(len(index.buckets) * 2)
+	}
+}
+
+func (index *scanIndex) remove(member string) {
+	bucket := index.bucket(member)
+	position := slices.Index(*bucket, member)
+	if position < 0 {
+		return
+	}
+	last := len(*bucket) - 1
+	(*bucket)[position] = (*bucket)[last]
+	(*bucket)[last] = ""
+	*bucket = (*bucket)[:last]
+	index.length--
+	if len(index.buckets) > minScanBuckets && index.length*8 < len(index.buckets) {
+		index.resize(len(index.buckets) / 2)
+	}
+}
+
+func (index *scanIndex) resize(size int) {
+	buckets := index.buckets
+	index.buckets = make([][]string, size)
+	for _, bucket := range buckets {
+		for _, member := range bucket {
+			moved := index.bucket(member)
+			*moved = append(*moved, member)
+		}
+	}
+}
+
+// scan visits whole buckets from cursor on until it has seen count members
+// or ten times count buckets, and returns the cursor to continue from, 0
+// once every bucket has been visited. As in redis the cursor counts
+// through bucket numbers with the bits reversed, so when the buckets
+// double or halve between calls the ones already visited still come
+// before the cursor. Members present for the whole scan are visited at
+// least once, and more than once only if the index shrank part way
+func (index *scanIndex) scan(cursor uint64, count int, visit func(member string)) uint64 {
+	mask := uint64(len(index.buckets) - 1)
+	seen := 0
+	for buckets := 0; ; buckets++ {
+		bucket := index.buckets[cursor&mask]
+		for _, member := range bucket {
+			visit(member)
+		}
+		seen += len(bucket)
+
+		cursor |= ^mask
+		cursor = bits.Reverse64(bits.Reverse64(cursor) + 1)
+		if cursor == 0 || seen >= count || buckets >= count*10 {
+			return cursor
+		}
+	}
+}
+
+// encodeScanReply writes the [cursor, [items...]] reply shared by the *SCAN commands
+func encodeScanReply(cursor uint64, items [][]byte) []byte {
+	result := encodeArrayHeader(2)
+	result = append(result, encodeBulkString(strconv.AppendUint(nil, cursor, 10))...)
+	result = append(result, encodeArray(items)...)
+	return result
+}
+
+// stringMatch is redis's glob matching: * ? [abc] [^a-z] and \ escapes
+func stringMatch(pattern []byte, value []byte) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(value); i++ {
+				if stringMatch(pattern[1:], value[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(value) == 0 {
+				return false
+			}
+			value = value[1:]
+		case '[':
+			if len(value) == 0 {
+				return false
+			}
+			pattern = pattern[1:]
+			not := len(pattern) > 0 && pattern[0] == '^'
+			if not {
+				pattern = pattern[1:]
+			}
+			match := false
+			for len(pattern) > 0 && pattern[0] != ']' {
+				if pattern[0] == '\\' && len(pattern) >= 2 {
+					pattern = pattern[1:]
+					if pattern[0] == value[0] {
+						match = true
+					}
+				} else if len(pattern) >= 3 && pattern[1] == '-' {
+					start, end := pattern[0], pattern[2]
+					if start > end {
+						start, end = end, start
+					}
+					if value[0] >= start && value[0] <= end {
+						match = true
+					}
+					pattern = pattern[2:]
+				} else if pattern[0] == value[0] {
+					match = true
+				}
+				pattern = pattern[1:]
+			}
+			if not {
+				match = !match
+			}
+			if !match {
+				return false
+			}
+			value = value[1:]
+			// an unterminated class ends the pattern
+			if len(pattern) == 0 {
+				return len(value) == 0
+			}
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(value) == 0 || pattern[0] != value[0] {
+				return false
+			}
+			value = value[1:]
+		}
+		pattern = pattern[1:]
+	}
+	return len(value) == 0
+}
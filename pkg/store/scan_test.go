@@ -0,0 +1,166 @@
+package store
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestStringMatch(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		value    string
+		expected bool
+	}{
+		{"*", "anything", true},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "heeeello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"user:*:name", "user:42:name", true},
+		{"user:*:name", "user:42:age", false},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"", "", true},
+	}
+
+	for _, test := range tests {
+		if result := stringMatch([]byte(test.pattern), []byte(test.value)); result != test.expected {
+			t.Errorf("stringMatch(%q, %q) expected %v, got %v", test.pattern, test.value, test.expected, result)
+		}
+	}
+}
+
+// TestScanIndexVisitsEverything checks a full scan returns every member
+// present throughout exactly once while members come and go and the index
+// grows, and at least once while it shrinks
+func TestScanIndexVisitsEverything(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		// churn changes the index between calls
+		churn       func(index *scanIndex, members map[string]bool, round int)
+		exactlyOnce bool
+	}{
+		{"churn", func(index *scanIndex, members map[string]bool, round int) {
+			removed := fmt.Sprint("member", round)
+			index.remove(removed)
+			delete(members, removed)
+			index.add(fmt.Sprint("new", round))
+		}, true},
+		{"grow", func(index *scanIndex, members map[string]bool, round int) {
+			for i := 0; i < 20; i++ {
+				index.add(fmt.Sprint("new", round, ":", i))
+			}
+		}, true},
+		{"shrink", func(index *scanIndex, members map[string]bool, round int) {
+			for i := round * 20; i < round*20+20 && i < 480; i++ {
+				removed := fmt.Sprint("member", i)
+				index.remove(removed)
+				delete(members, removed)
+			}
+		}, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			index := newScanIndex()
+			stable := make(map[string]bool)
+			for i := 0; i < 500; i++ {
+				index.add(fmt.Sprint("member", i))
+				stable[fmt.Sprint("member", i)] = true
+			}
+
+			seen := make(map[string]int)
+			cursor := uint64(0)
+			for round := 0; ; round++ {
+				cursor = index.scan(cursor, 7, func(member string) {
+					seen[member]++
+				})
+				if cursor == 0 {
+					break
+				}
+				test.churn(index, stable, round)
+			}
+
+			for member := range stable {
+				if seen[member] == 0 || (test.exactlyOnce && seen[member] != 1) {
+					t.Errorf("expected %s to be returned once, got %d", member, seen[member])
+				}
+			}
+		})
+	}
+}
+
+func TestScanIndexResizes(t *testing.T) {
+	index := newScanIndex()
+	for i := 0; i < 1000; i++ {
+		index.add(fmt.Sprint(i))
+	}
+	if len(index.buckets) != 1024 {
+		t.Errorf("expected 1024 buckets for 1000 members, got %d", len(index.buckets))
+	}
+	for i := 0; i < 990; i++ {
+		index.remove(fmt.Sprint(i))
+	}
+	if len(index.buckets) > 128 || index.length != 10 {
+		t.Errorf("expected the buckets to shrink with 10 members left, got %d buckets for %d", len(index.buckets), index.length)
+	}
+}
+
+// scanAll runs a *SCAN command to the end and counts what each call
+// returned, every other item if pairs is set
+func scanAll(t *testing.T, kvstore *KVStore, pairs bool, arguments ...string) map[string]int {
+	t.Helper()
+	client := newTestClient()
+	seen := make(map[string]int)
+	cursor := "0"
+	for {
+		command := append([]string{arguments[0], arguments[1], cursor}, arguments[2:]...)
+		lines := strings.Split(execute(t, kvstore, client, command...), "\r\n")
+		// *2, $n, cursor, *count, then $n item pairs
+		cursor = lines[2]
+		for i := 5; i < len(lines); i += 2 {
+			if pairs && (i-5)%4 != 0 {
+				continue
+			}
+			seen[lines[i]]++
+		}
+		if cursor == "0" {
+			return seen
+		}
+	}
+}
+
+func TestHSCANAndSSCAN(t *testing.T) {
+	kvstore := newKVStore()
+	client := newTestClient()
+	for i := 0; i < 300; i++ {
+		execute(t, kvstore, client, "HSET", "hash", "field:"+strconv.Itoa(i), "value")
+		execute(t, kvstore, client, "SADD", "set", "member:"+strconv.Itoa(i))
+	}
+
+	for _, test := range []struct {
+		arguments []string
+		pairs     bool
+	}{
+		{[]string{"HSCAN", "hash", "COUNT", "20"}, true},
+		{[]string{"HSCAN", "hash", "NOVALUES"}, false},
+		{[]string{"SSCAN", "set", "COUNT", "20"}, false},
+	} {
+		seen := scanAll(t, kvstore, test.pairs, test.arguments...)
+		if len(seen) != 300 {
+			t.Errorf("%v: expected 300 items, got %d", test.arguments, len(seen))
+		}
+		for item, times := range seen {
+			if times != 1 {
+				t.Errorf("%v: expected %s once, got it %d times", test.arguments, item, times)
+			}
+		}
+	}
+	if seen := scanAll(t, kvstore, false, "SSCAN", "set", "MATCH", "member:1?"); len(seen) != 10 {
+		t.Errorf("expected MATCH to keep 10 members, got %v", seen)
+	}
+}
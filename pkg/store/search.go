@@ -0,0 +1,596 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+var (
+	errIndexExists    = errors.New("ERR Index already exists")
+	errUnknownIndex   = errors.New("ERR Unknown Index name")
+	errOnlyHashes     = errors.New("ERR only ON HASH is supported")
+	errSchemaMissing  = errors.New("ERR Fields arguments are missing")
+	errSortByField    = errors.New("ERR SORTBY field is not in the schema")
+	errLimitArguments = errors.New("ERR LIMIT argument out of range")
+)
+
+const (
+	fieldTypeFormat      = "ERR Invalid field type for field `%s`"
+	duplicateFieldFormat = "ERR Duplicate field in schema - %s"
+)
+
+type searchFieldType int
+
+const (
+	textField searchFieldType = iota
+	tagField
+	numericField
+)
+
+var searchFieldTypeNames = []string{"TEXT", "TAG", "NUMERIC"}
+
+// searchField is a hash field in an index schema, queried by alias
+type searchField struct {
+	name          string
+	alias         string
+	fieldType     searchFieldType
+	sortable      bool
+	separator     string
+	caseSensitive bool
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+// tokenize splits TEXT into lower case words. There is no stemming or
+// stopword list, a query word has to match a whole word or be a prefix
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !isWordRune(r)
+	})
+}
+
+func (field *searchField) splitTags(value string) []string {
+	var tags []string
+	for _, tag := range strings.Split(value, field.separator) {
+		tag = strings.TrimSpace(tag)
+		if !field.caseSensitive {
+			tag = strings.ToLower(tag)
+		}
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// searchIndex indexes the hashes whose keys start with one of prefixes.
+// It is kept up to date by signalModifiedKey, and holds inverted indexes
+// for TEXT and TAG fields and a sorted set per NUMERIC field
+type searchIndex struct {
+	// writers to keys in different shards update the index at the same
+	// time, so update takes mu. Searches run with every shard locked and
+	// need not
+	mu       sync.Mutex
+	name     string
+	prefixes []string
+	fields   []searchField
+	// docs has the values each indexed key had for the schema fields, so
+	// the postings can be removed when the key changes
+	docs    map[string]map[string]string
+	text    map[string]map[string]docSet
+	tags    map[string]map[string]docSet
+	numbers map[string]*zsetValue
+}
+
+func newSearchIndex(name string, prefixes []string, fields []searchField) *searchIndex {
+	index := &searchIndex{
+		name:     name,
+		prefixes: prefixes,
+		fields:   fields,
+		docs:     make(map[string]map[string]string),
+		text:     make(map[string]map[string]docSet),
+		tags:     make(map[string]map[string]docSet),
+		numbers:  make(map[string]*zsetValue),
+	}
+	for _, field := range fields {
+		switch field.fieldType {
+		case textField:
+			index.text[field.alias] = make(map[string]docSet)
+		case tagField:
+			index.tags[field.alias] = make(map[string]docSet)
+		case numericField:
+			index.numbers[field.alias] = newZsetValue()
+		}
+	}
+	return index
+}
+
+// field finds a schema field by alias
+func (index *searchIndex) field(alias string) *searchField {
+	for i := range index.fields {
+		if index.fields[i].alias == alias {
+			return &index.fields[i]
+		}
+	}
+	return nil
+}
+
+func (index *searchIndex) covers(key string) bool {
+	for _, prefix := range index.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// values reads the schema fields of a hash by alias, NUMERIC fields that
+// don't hold a number are left out
+func (index *searchIndex) values(hash *hashValue) map[string]string {
+	values := make(map[string]string)
+	for _, field := range index.fields {
+		value, ok := hash.get(field.name)
+		if !ok {
+			continue
+		}
+		if field.fieldType == numericField {
+			if _, err := parseFloat(value); err != nil {
+				continue
+			}
+		}
+		values[field.alias] = string(value)
+	}
+	return values
+}
+
+func addPosting(postings map[string]docSet, term string, key string) {
+	if postings[term] == nil {
+		postings[term] = make(docSet)
+	}
+	postings[term][key] = struct{}{}
+}
+
+func removePosting(postings map[string]docSet, term string, key string) {
+	delete(postings[term], key)
+	if len(postings[term]) == 0 {
+		delete(postings, term)
+	}
+}
+
+// update reindexes key, entry being what it now holds or nil if it's gone
+func (index *searchIndex) update(key string, entry *Entry) {
+	if !index.covers(key) {
+		return
+	}
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	index.remove(key)
+	if entry == nil || entry.objectType != hashType {
+		return
+	}
+
+	values := index.values(entry.hash())
+	index.docs[key] = values
+	for _, field := range index.fields {
+		value, ok := values[field.alias]
+		if !ok {
+			continue
+		}
+		switch field.fieldType {
+		case textField:
+			for _, term := range tokenize(value) {
+				addPosting(index.text[field.alias], term, key)
+			}
+		case tagField:
+			for _, tag := range field.splitTags(value) {
+				addPosting(index.tags[field.alias], tag, key)
+			}
+		case numericField:
+			number, _ := parseFloat([]byte(value))
+			index.numbers[field.alias].set(number, key)
+		}
+	}
+}
+
+func (index *searchIndex) remove(key string) {
+	values, ok := index.docs[key]
+	if !ok {
+		return
+	}
+	delete(index.docs, key)
+	for _, field := range index.fields {
+		value, ok := values[field.alias]
+		if !ok {
+			continue
+		}
+		switch field.fieldType {
+		case textField:
+			for _, term := range tokenize(value) {
+				removePosting(index.text[field.alias], term, key)
+			}
+		case tagField:
+			for _, tag := range field.splitTags(value) {
+				removePosting(index.tags[field.alias], tag, key)
+			}
+		case numericField:
+			index.numbers[field.alias].remove(key)
+		}
+	}
+}
+
+// parseSchema reads the field definitions after SCHEMA
+func parseSchema(arguments [][]byte) ([]searchField, error) {
+	var fields []searchField
+	for position := 0; position < len(arguments); {
+		field := searchField{name: string(arguments[position]), separator: ","}
+		field.alias = field.name
+		position++
+		if position+1 < len(arguments) && strings.ToUpper(string(arguments[position])) == "AS" {
+			field.alias = string(arguments[position+1])
+			position += 2
+		}
+		if position >= len(arguments) {
+			return nil, fmt.Errorf(fieldTypeFormat, field.name)
+		}
+		fieldType := slices.Index(searchFieldTypeNames, strings.ToUpper(string(arguments[position])))
+		if fieldType < 0 {
+			return nil, fmt.Errorf(fieldTypeFormat, field.name)
+		}
+		field.fieldType = searchFieldType(fieldType)
+		position++
+
+	options:
+		for position < len(arguments) {
+			switch strings.ToUpper(string(arguments[position])) {
+			case "SORTABLE":
+				field.sortable = true
+			case "NOSTEM":
+				// words are never stemmed
+			case "CASESENSITIVE":
+				if field.fieldType != tagField {
+					return nil, errSyntax
+				}
+				field.caseSensitive = true
+			case "SEPARATOR":
+				if field.fieldType != tagField || position+1 >= len(arguments) || len(arguments[position+1]) != 1 {
+					return nil, errSyntax
+				}
+				position++
+				field.separator = string(arguments[position])
+			default:
+				break options
+			}
+			position++
+		}
+		if slices.ContainsFunc(fields, func(other searchField) bool { return other.alias == field.alias }) {
+			return nil, fmt.Errorf(duplicateFieldFormat, field.alias)
+		}
+		fields = append(fields, field)
+	}
+	if len(fields) == 0 {
+		return nil, errSchemaMissing
+	}
+	return fields, nil
+}
+
+// handleFTCREATE creates an index over hashes and indexes the matching keys
+// already in the store. Without PREFIX every hash is indexed
+func (kvstore *KVStore) handleFTCREATE(messages [][]byte) []byte {
+	if len(messages) < 5 {
+		return wrongArgumentsError("ft.create")
+	}
+	prefixes := []string{""}
+	position := 2
+	for position < len(messages) && strings.ToUpper(string(messages[position])) != "SCHEMA" {
+		switch strings.ToUpper(string(messages[position])) {
+		case "ON":
+			if position+1 >= len(messages) || strings.ToUpper(string(messages[position+1])) != "HASH" {
+				return encodeError(errOnlyHashes)
+			}
+			position += 2
+		case "PREFIX":
+			if position+1 >= len(messages) {
+				return encodeError(errSyntax)
+			}
+			count, err := strconv.Atoi(string(messages[position+1]))
+			if err != nil || count <= 0 || position+2+count > len(messages) {
+				return encodeError(errSyntax)
+			}
+			prefixes = prefixes[:0]
+			for _, prefix := range messages[position+2 : position+2+count] {
+				prefixes = append(prefixes, string(prefix))
+			}
+			position += 2 + count
+		default:
+			return encodeError(errSyntax)
+		}
+	}
+	if position >= len(messages) {
+		return encodeError(errSchemaMissing)
+	}
+	fields, err := parseSchema(messages[position+1:])
+	if err != nil {
+		return encodeError(err)
+	}
+
+	kvstore.lockAll()
+	defer kvstore.unlockAll()
+
+	name := string(messages[1])
+	if _, exists := kvstore.indexes[name]; exists {
+		return encodeError(errIndexExists)
+	}
+	index := newSearchIndex(name, prefixes, fields)
+	kvstore.forEachKey(func(key string, _ *Entry) bool {
+		if entry := kvstore.lookupKeyRead(key); entry != nil {
+			index.update(key, entry)
+		}
+		return true
+	})
+	kvstore.indexes[name] = index
+	return okReply
+}
+
+// searchRequest is the parsed options of FT.SEARCH
+type searchRequest struct {
+	query      queryNode
+	noContent  bool
+	returned   []string
+	sortBy     *searchField
+	descending bool
+	offset     int
+	limit      int
+}
+
+func parseSearchRequest(index *searchIndex, arguments [][]byte) (searchRequest, error) {
+	request := searchRequest{limit: 10}
+	var err error
+	if request.query, err = parseQuery(index, string(arguments[0])); err != nil {
+		return request, err
+	}
+	for position := 1; position < len(arguments); position++ {
+		option := strings.ToUpper(string(arguments[position]))
+		switch {
+		case option == "NOCONTENT":
+			request.noContent = true
+		case option == "RETURN" && position+1 < len(arguments):
+			count, err := strconv.Atoi(string(arguments[position+1]))
+			if err != nil || count < 0 || position+2+count > len(arguments) {
+				return request, errSyntax
+			}
+			request.returned = []string{}
+			for _, name := range arguments[position+2 : position+2+count] {
+				if field := index.field(string(name)); field != nil {
+					request.returned = append(request.returned, field.name)
+				} else {
+					request.returned = append(request.returned, string(name))
+				}
+			}
+			request.noContent = request.noContent || count == 0
+			position += 1 + count
+		case option == "SORTBY" && position+1 < len(arguments):
+			position++
+			if request.sortBy = index.field(string(arguments[position])); request.sortBy == nil {
+				return request, errSortByField
+			}
+			if position+1 < len(arguments) {
+				switch strings.ToUpper(string(arguments[position+1])) {
+				case "DESC":
+					request.descending = true
+					position++
+				case "ASC":
+					position++
+				}
+			}
+		case option == "LIMIT" && position+2 < len(arguments):
+			offset, err := strconv.Atoi(string(arguments[position+1]))
+			limit, limitErr := strconv.Atoi(string(arguments[position+2]))
+			if err != nil || limitErr != nil || offset < 0 || limit < 0 {
+				return request, errLimitArguments
+			}
+			request.offset, request.limit = offset, limit
+			position += 2
+		default:
+			return request, errSyntax
+		}
+	}
+	return request, nil
+}
+
+// compareSortValues orders documents by a field, numerically for NUMERIC
+// fields, with documents missing it last
+func compareSortValues(field *searchField, a string, aOK bool, b string, bOK bool) int {
+	switch {
+	case !aOK || !bOK:
+		if aOK == bOK {
+			return 0
+		} else if aOK {
+			return -1
+		}
+		return 1
+	case field.fieldType == numericField:
+		x, _ := parseFloat([]byte(a))
+		y, _ := parseFloat([]byte(b))
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(a, b)
+}
+
+// handleFTSEARCH replies with the total number of matches then each key
+// in the page with its fields. Matches are ordered by key unless SORTBY
+// is given. Candidates from the index are checked against the current
+// value of their key, so fields or keys that have expired but not yet
+// been removed never match
+func (kvstore *KVStore) handleFTSEARCH(messages [][]byte) []byte {
+	if len(messages) < 3 {
+		return wrongArgumentsError("ft.search")
+	}
+
+	kvstore.rlockAll()
+	defer kvstore.runlockAll()
+
+	index, ok := kvstore.indexes[string(messages[1])]
+	if !ok {
+		return encodeError(errUnknownIndex)
+	}
+	request, err := parseSearchRequest(index, messages[2:])
+	if err != nil {
+		return encodeError(err)
+	}
+
+	type match struct {
+		key    string
+		entry  *Entry
+		values map[string]string
+	}
+	var matches []match
+	for key := range request.query.eval(index) {
+		entry := kvstore.lookupKeyRead(key)
+		if entry == nil || entry.objectType != hashType {
+			continue
+		}
+		values := index.values(entry.hash())
+		if request.query.matches(index, values) {
+			matches = append(matches, match{key: key, entry: entry, values: values})
+		}
+	}
+	slices.SortFunc(matches, func(a, b match) int {
+		if request.sortBy != nil {
+			alias := request.sortBy.alias
+			aValue, aOK := a.values[alias]
+			bValue, bOK := b.values[alias]
+			order := compareSortValues(request.sortBy, aValue, aOK, bValue, bOK)
+			if request.descending && aOK && bOK {
+				order = -order
+			}
+			if order != 0 {
+				return order
+			}
+		}
+		return strings.Compare(a.key, b.key)
+	})
+
+	replies := [][]byte{encodeInteger(int64(len(matches)))}
+	start := min(request.offset, len(matches))
+	end := min(start+request.limit, len(matches))
+	for _, match := range matches[start:end] {
+		replies = append(replies, encodeBulkString([]byte(match.key)))
+		if request.noContent {
+			continue
+		}
+		var fields [][]byte
+		hash := match.entry.hash()
+		if request.returned != nil {
+			for _, name := range request.returned {
+				if value, ok := hash.get(name); ok {
+					fields = append(fields, []byte(name), value)
+				}
+			}
+		} else {
+			hash.forEach(func(field string, value []byte) bool {
+				fields = append(fields, []byte(field), value)
+				return true
+			})
+		}
+		replies = append(replies, encodeArray(fields))
+	}
+	return encodeRawArray(replies)
+}
+
+// handleFTDROPINDEX drops an index, and with DD the keys it indexed
+func (kvstore *KVStore) handleFTDROPINDEX(messages [][]byte) []byte {
+	if len(messages) != 2 && len(messages) != 3 {
+		return wrongArgumentsError("ft.dropindex")
+	}
+	deleteDocuments := false
+	if len(messages) == 3 {
+		if strings.ToUpper(string(messages[2])) != "DD" {
+			return encodeError(errSyntax)
+		}
+		deleteDocuments = true
+	}
+
+	kvstore.lockAll()
+	defer kvstore.unlockAll()
+
+	name := string(messages[1])
+	index, ok := kvstore.indexes[name]
+	if !ok {
+		return encodeError(errUnknownIndex)
+	}
+	delete(kvstore.indexes, name)
+	if deleteDocuments {
+		for key := range index.docs {
+			kvstore.deleteKey(key)
+		}
+	}
+	return okReply
+}
+
+func (kvstore *KVStore) handleFTINFO(messages [][]byte) []byte {
+	if len(messages) != 2 {
+		return wrongArgumentsError("ft.info")
+	}
+
+	kvstore.rlockAll()
+	defer kvstore.runlockAll()
+
+	index, ok := kvstore.indexes[string(messages[1])]
+	if !ok {
+		return encodeError(errUnknownIndex)
+	}
+	prefixes := make([][]byte, len(index.prefixes))
+	for i, prefix := range index.prefixes {
+		prefixes[i] = []byte(prefix)
+	}
+	attributes := make([][]byte, len(index.fields))
+	for i, field := range index.fields {
+		attribute := [][]byte{
+			[]byte("identifier"), []byte(field.name),
+			[]byte("attribute"), []byte(field.alias),
+			[]byte("type"), []byte(searchFieldTypeNames[field.fieldType]),
+		}
+		if field.fieldType == tagField {
+			attribute = append(attribute, []byte("SEPARATOR"), []byte(field.separator))
+		}
+		if field.sortable {
+			attribute = append(attribute, []byte("SORTABLE"))
+		}
+		attributes[i] = encodeArray(attribute)
+	}
+	return encodeRawArray([][]byte{
+		encodeBulkString([]byte("index_name")), encodeBulkString([]byte(index.name)),
+		encodeBulkString([]byte("index_definition")), encodeRawArray([][]byte{
+			encodeBulkString([]byte("key_type")), encodeBulkString([]byte("HASH")),
+			encodeBulkString([]byte("prefixes")), encodeArray(prefixes),
+		}),
+		encodeBulkString([]byte("attributes")), encodeRawArray(attributes),
+		encodeBulkString([]byte("num_docs")), encodeInteger(int64(len(index.docs))),
+	})
+}
+
+func (kvstore *KVStore) handleFTLIST(messages [][]byte) []byte {
+	kvstore.rlockAll()
+	defer kvstore.runlockAll()
+
+	var names [][]byte
+	for name := range kvstore.indexes {
+		names = append(names, []byte(name))
+	}
+	slices.SortFunc(names, func(a, b []byte) int { return strings.Compare(string(a), string(b)) })
+	return encodeArray(names)
+}
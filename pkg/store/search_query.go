@@ -0,0 +1,446 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	querySyntaxFormat       = "ERR Syntax error at offset %d near %s"
+	queryUnknownFieldFormat = "ERR Unknown field '%s'"
+	queryFieldTypeFormat    = "ERR Field '%s' is not a %s field"
+)
+
+// docSet is a set of document keys
+type docSet map[string]struct{}
+
+func (set docSet) intersect(other docSet) docSet {
+	if len(other) < len(set) {
+		set, other = other, set
+	}
+	result := make(docSet)
+	for key := range set {
+		if _, ok := other[key]; ok {
+			result[key] = struct{}{}
+		}
+	}
+	return result
+}
+
+// queryNode is a parsed FT.SEARCH query. eval finds candidates through the
+// index, matches checks a document's current field values, which is how
+// results are confirmed against the keyspace
+type queryNode interface {
+	eval(index *searchIndex) docSet
+	matches(index *searchIndex, values map[string]string) bool
+}
+
+type allNode struct{}
+
+func (allNode) eval(index *searchIndex) docSet {
+	result := make(docSet, len(index.docs))
+	for key := range index.docs {
+		result[key] = struct{}{}
+	}
+	return result
+}
+
+func (allNode) matches(*searchIndex, map[string]string) bool {
+	return true
+}
+
+// termNode matches a word in one TEXT field, or in any of them when field
+// is empty. A prefix term matches any word starting with it
+type termNode struct {
+	field  string
+	term   string
+	prefix bool
+}
+
+func (node termNode) fields(index *searchIndex) []string {
+	if node.field != "" {
+		return []string{node.field}
+	}
+	var fields []string
+	for _, field := range index.fields {
+		if field.fieldType == textField {
+			fields = append(fields, field.alias)
+		}
+	}
+	return fields
+}
+
+func (node termNode) eval(index *searchIndex) docSet {
+	result := make(docSet)
+	for _, field := range node.fields(index) {
+		for term, docs := range index.text[field] {
+			if term != node.term && !(node.prefix && strings.HasPrefix(term, node.term)) {
+				continue
+			}
+			for key := range docs {
+				result[key] = struct{}{}
+			}
+		}
+	}
+	return result
+}
+
+func (node termNode) matches(index *searchIndex, values map[string]string) bool {
+	for _, field := range node.fields(index) {
+		for _, term := range tokenize(values[field]) {
+			if term == node.term || node.prefix && strings.HasPrefix(term, node.term) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tagNode matches documents with any of the tags
+type tagNode struct {
+	field string
+	tags  []string
+}
+
+func (node tagNode) eval(index *searchIndex) docSet {
+	result := make(docSet)
+	for _, tag := range node.tags {
+		for key := range index.tags[node.field][tag] {
+			result[key] = struct{}{}
+		}
+	}
+	return result
+}
+
+func (node tagNode) matches(index *searchIndex, values map[string]string) bool {
+	value, ok := values[node.field]
+	if !ok {
+		return false
+	}
+	for _, tag := range index.field(node.field).splitTags(value) {
+		for _, wanted := range node.tags {
+			if tag == wanted {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type numericNode struct {
+	field  string
+	bounds scoreRange
+}
+
+func (node numericNode) eval(index *searchIndex) docSet {
+	result := make(docSet)
+	for _, skiplistNode := range index.numbers[node.field].nodesByScore(node.bounds, false, 0, -1) {
+		result[skiplistNode.member] = struct{}{}
+	}
+	return result
+}
+
+func (node numericNode) matches(index *searchIndex, values map[string]string) bool {
+	value, ok := values[node.field]
+	if !ok {
+		return false
+	}
+	number, err := parseFloat([]byte(value))
+	if err != nil {
+		return false
+	}
+	skiplistNode := &skiplistNode{score: number}
+	return !node.bounds.isEmpty() && node.bounds.aboveMin(skiplistNode) && node.bounds.belowMax(skiplistNode)
+}
+
+type andNode struct {
+	children []queryNode
+}
+
+func (node andNode) eval(index *searchIndex) docSet {
+	result := node.children[0].eval(index)
+	for _, child := range node.children[1:] {
+		if len(result) == 0 {
+			break
+		}
+		result = result.intersect(child.eval(index))
+	}
+	return result
+}
+
+func (node andNode) matches(index *searchIndex, values map[string]string) bool {
+	for _, child := range node.children {
+		if !child.matches(index, values) {
+			return false
+		}
+	}
+	return true
+}
+
+type orNode struct {
+	children []queryNode
+}
+
+func (node orNode) eval(index *searchIndex) docSet {
+	result := make(docSet)
+	for _, child := range node.children {
+		for key := range child.eval(index) {
+			result[key] = struct{}{}
+		}
+	}
+	return result
+}
+
+func (node orNode) matches(index *searchIndex, values map[string]string) bool {
+	for _, child := range node.children {
+		if child.matches(index, values) {
+			return true
+		}
+	}
+	return false
+}
+
+type notNode struct {
+	child queryNode
+}
+
+func (node notNode) eval(index *searchIndex) docSet {
+	excluded := node.child.eval(index)
+	result := make(docSet)
+	for key := range index.docs {
+		if _, ok := excluded[key]; !ok {
+			result[key] = struct{}{}
+		}
+	}
+	return result
+}
+
+func (node notNode) matches(index *searchIndex, values map[string]string) bool {
+	return !node.child.matches(index, values)
+}
+
+// queryParser reads the query language subset, where words side by side
+// are ANDed, | ORs and binds loosest, - negates and parentheses group.
+// @field: limits what follows to a field, as [min max] for NUMERIC, as
+// {a | b} for TAG and as words for TEXT
+type queryParser struct {
+	index    *searchIndex
+	query    string
+	position int
+}
+
+func parseQuery(index *searchIndex, query string) (queryNode, error) {
+	parser := &queryParser{index: index, query: query}
+	node, err := parser.parseUnion("")
+	if err != nil {
+		return nil, err
+	}
+	parser.skipSpace()
+	if parser.position < len(parser.query) {
+		return nil, parser.syntaxError()
+	}
+	return node, nil
+}
+
+func (parser *queryParser) syntaxError() error {
+	near := parser.query[parser.position:]
+	if len(near) > 10 {
+		near = near[:10]
+	}
+	return fmt.Errorf(querySyntaxFormat, parser.position, near)
+}
+
+func (parser *queryParser) skipSpace() {
+	for parser.position < len(parser.query) && parser.query[parser.position] == ' ' {
+		parser.position++
+	}
+}
+
+func (parser *queryParser) peek() byte {
+	parser.skipSpace()
+	if parser.position >= len(parser.query) {
+		return 0
+	}
+	return parser.query[parser.position]
+}
+
+// parseUnion parses ORs of intersections, field is the TEXT field words
+// are limited to inside @field:( ... )
+func (parser *queryParser) parseUnion(field string) (queryNode, error) {
+	var children []queryNode
+	for {
+		child, err := parser.parseIntersection(field)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+		if parser.peek() != '|' {
+			break
+		}
+		parser.position++
+	}
+	if len(children) == 1 {
+		return children[0], nil
+	}
+	return orNode{children: children}, nil
+}
+
+func (parser *queryParser) parseIntersection(field string) (queryNode, error) {
+	var children []queryNode
+	for next := parser.peek(); next != 0 && next != '|' && next != ')'; next = parser.peek() {
+		child, err := parser.parseUnary(field)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+	}
+	switch len(children) {
+	case 0:
+		return nil, parser.syntaxError()
+	case 1:
+		return children[0], nil
+	}
+	return andNode{children: children}, nil
+}
+
+func (parser *queryParser) parseUnary(field string) (queryNode, error) {
+	switch parser.peek() {
+	case '-':
+		parser.position++
+		child, err := parser.parseUnary(field)
+		if err != nil {
+			return nil, err
+		}
+		return notNode{child: child}, nil
+	case '(':
+		parser.position++
+		node, err := parser.parseUnion(field)
+		if err != nil {
+			return nil, err
+		}
+		if parser.peek() != ')' {
+			return nil, parser.syntaxError()
+		}
+		parser.position++
+		return node, nil
+	case '@':
+		if field != "" {
+			return nil, parser.syntaxError()
+		}
+		parser.position++
+		return parser.parseFieldExpression()
+	case '*':
+		parser.position++
+		return allNode{}, nil
+	}
+	word, prefix := parser.readWord()
+	if word == "" {
+		return nil, parser.syntaxError()
+	}
+	return termNode{field: field, term: strings.ToLower(word), prefix: prefix}, nil
+}
+
+// readWord reads letters, digits and backslash escaped characters, and
+// whether a trailing * made it a prefix
+func (parser *queryParser) readWord() (string, bool) {
+	var word strings.Builder
+	for parser.position < len(parser.query) {
+		c := parser.query[parser.position]
+		if c == '\\' && parser.position+1 < len(parser.query) {
+			word.WriteByte(parser.query[parser.position+1])
+			parser.position += 2
+			continue
+		}
+		// bytes of multibyte characters are taken as part of the word
+		if c < utf8.RuneSelf && !isWordRune(rune(c)) {
+			break
+		}
+		word.WriteByte(c)
+		parser.position++
+	}
+	if word.Len() > 0 && parser.position < len(parser.query) && parser.query[parser.position] == '*' {
+		parser.position++
+		return word.String(), true
+	}
+	return word.String(), false
+}
+
+// readUntil returns everything up to the closing character, which is
+// consumed
+func (parser *queryParser) readUntil(closing byte) (string, error) {
+	end := strings.IndexByte(parser.query[parser.position:], closing)
+	if end < 0 {
+		return "", parser.syntaxError()
+	}
+	content := parser.query[parser.position : parser.position+end]
+	parser.position += end + 1
+	return content, nil
+}
+
+func (parser *queryParser) parseFieldExpression() (queryNode, error) {
+	name, _ := parser.readWord()
+	if name == "" || parser.position >= len(parser.query) || parser.query[parser.position] != ':' {
+		return nil, parser.syntaxError()
+	}
+	parser.position++
+	field := parser.index.field(name)
+	if field == nil {
+		return nil, fmt.Errorf(queryUnknownFieldFormat, name)
+	}
+
+	switch field.fieldType {
+	case numericField:
+		if parser.peek() != '[' {
+			return nil, fmt.Errorf(queryFieldTypeFormat, name, "TEXT or TAG")
+		}
+		parser.position++
+		content, err := parser.readUntil(']')
+		if err != nil {
+			return nil, err
+		}
+		bounds := strings.FieldsFunc(content, func(c rune) bool { return c == ' ' || c == ',' })
+		if len(bounds) != 2 {
+			return nil, parser.syntaxError()
+		}
+		r, err := parseScoreRange([]byte(bounds[0]), []byte(bounds[1]))
+		if err != nil {
+			return nil, parser.syntaxError()
+		}
+		return numericNode{field: field.alias, bounds: r}, nil
+	case tagField:
+		if parser.peek() != '{' {
+			return nil, fmt.Errorf(queryFieldTypeFormat, name, "NUMERIC or TEXT")
+		}
+		parser.position++
+		content, err := parser.readUntil('}')
+		if err != nil {
+			return nil, err
+		}
+		var tags []string
+		for _, tag := range strings.Split(content, "|") {
+			tag = strings.TrimSpace(strings.ReplaceAll(tag, "\\", ""))
+			if !field.caseSensitive {
+				tag = strings.ToLower(tag)
+			}
+			tags = append(tags, tag)
+		}
+		return tagNode{field: field.alias, tags: tags}, nil
+	}
+	switch parser.peek() {
+	case '[', '{':
+		return nil, fmt.Errorf(queryFieldTypeFormat, name, "NUMERIC or TAG")
+	case '(':
+		parser.position++
+		node, err := parser.parseUnion(field.alias)
+		if err != nil {
+			return nil, err
+		}
+		if parser.peek() != ')' {
+			return nil, parser.syntaxError()
+		}
+		parser.position++
+		return node, nil
+	}
+	return parser.parseUnary(field.alias)
+}
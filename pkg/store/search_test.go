@@ -0,0 +1,126 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func searchKeys(t *testing.T, kvstore *KVStore, arguments ...string) string {
+	t.Helper()
+	return string(kvstore.handleFTSEARCH(command(append([]string{"FT.SEARCH", "idx"}, append(arguments, "NOCONTENT")...)...)))
+}
+
+func keysReply(total int64, keys ...string) string {
+	replies := [][]byte{encodeInteger(total)}
+	for _, key := range keys {
+		replies = append(replies, encodeBulkString([]byte(key)))
+	}
+	return string(encodeRawArray(replies))
+}
+
+func newProductIndex(kvstore *KVStore) {
+	kvstore.handleHSET(command("HSET", "product:1", "name", "Red running shoes", "price", "80", "tags", "sport,Shoes"))
+	kvstore.handleHSET(command("HSET", "product:2", "name", "Blue shoes", "price", "45.5", "tags", "casual, shoes"))
+	kvstore.handleHSET(command("HSET", "product:3", "name", "Running shirt", "price", "30", "tags", "sport"))
+	kvstore.handleHSET(command("HSET", "other:1", "name", "Running shoes"))
+	reply := kvstore.handleFTCREATE(command("FT.CREATE", "idx", "ON", "HASH", "PREFIX", "1", "product:", "SCHEMA",
+		"name", "TEXT", "price", "NUMERIC", "SORTABLE", "tags", "AS", "tag", "TAG"))
+	if string(reply) != string(okReply) {
+		panic(string(reply))
+	}
+}
+
+func TestFTSearchQueries(t *testing.T) {
+	kvstore := newKVStore()
+	newProductIndex(kvstore)
+
+	cases := []struct {
+		arguments []string
+		expected  string
+	}{
+		{[]string{"*"}, keysReply(3, "product:1", "product:2", "product:3")},
+		{[]string{"running"}, keysReply(2, "product:1", "product:3")},
+		{[]string{"running shoes"}, keysReply(1, "product:1")},
+		{[]string{"run*"}, keysReply(2, "product:1", "product:3")},
+		{[]string{"shirt | blue"}, keysReply(2, "product:2", "product:3")},
+		{[]string{"running -shirt"}, keysReply(1, "product:1")},
+		{[]string{"@name:(red | blue)"}, keysReply(2, "product:1", "product:2")},
+		{[]string{"@price:[40 (80]"}, keysReply(1, "product:2")},
+		{[]string{"@price:[-inf +inf]", "SORTBY", "price", "DESC"}, keysReply(3, "product:1", "product:2", "product:3")},
+		{[]string{"@tag:{shoes}"}, keysReply(2, "product:1", "product:2")},
+		{[]string{"@tag:{casual | sport} -@tag:{shoes}"}, keysReply(1, "product:3")},
+		{[]string{"*", "SORTBY", "price", "LIMIT", "1", "1"}, keysReply(3, "product:2")},
+	}
+	for _, tc := range cases {
+		if reply := searchKeys(t, kvstore, tc.arguments...); reply != tc.expected {
+			t.Errorf("%v expected %q, got %q", tc.arguments, tc.expected, reply)
+		}
+	}
+
+	reply := kvstore.handleFTSEARCH(command("FT.SEARCH", "idx", "shirt", "RETURN", "1", "price"))
+	expected := "*3\r\n:1\r\n" + string(encodeBulkString([]byte("product:3"))) + string(encodeArray(command("price", "30")))
+	if string(reply) != expected {
+		t.Errorf("expected %q, got %q", expected, reply)
+	}
+	if reply := kvstore.handleFTSEARCH(command("FT.SEARCH", "idx", "@price:{x}")); string(reply) != "-ERR Field 'price' is not a TEXT or TAG field\r\n" {
+		t.Errorf("expected a field type error, got %q", reply)
+	}
+	if reply := kvstore.handleFTSEARCH(command("FT.SEARCH", "idx", "(shoes")); string(reply) != "-ERR Syntax error at offset 6 near \r\n" {
+		t.Errorf("expected a syntax error, got %q", reply)
+	}
+}
+
+// TestFTIndexFollowsWrites checks every way a key can change keeps the
+// index in step
+func TestFTIndexFollowsWrites(t *testing.T) {
+	kvstore := newKVStore()
+	newProductIndex(kvstore)
+	index := kvstore.indexes["idx"]
+
+	kvstore.handleHSET(command("HSET", "product:4", "name", "Green shoes"))
+	kvstore.handleHSET(command("HSET", "product:2", "name", "Blue sandals"))
+	if reply := searchKeys(t, kvstore, "shoes"); reply != keysReply(2, "product:1", "product:4") {
+		t.Errorf("HSET should reindex, got %q", reply)
+	}
+	kvstore.handleHDEL(command("HDEL", "product:1", "tags"))
+	kvstore.handleHINCRBY(command("HINCRBY", "product:3", "price", "100"))
+	if reply := searchKeys(t, kvstore, "@price:[100 200]"); reply != keysReply(1, "product:3") {
+		t.Errorf("HINCRBY should reindex, got %q", reply)
+	}
+	if reply := searchKeys(t, kvstore, "@tag:{sport}"); reply != keysReply(1, "product:3") {
+		t.Errorf("HDEL should reindex, got %q", reply)
+	}
+
+	kvstore.handleSET(command("SET", "product:4", "now a string"))
+	kvstore.handleDEL(command("DEL", "product:3"))
+	if reply := searchKeys(t, kvstore, "*"); reply != keysReply(2, "product:1", "product:2") {
+		t.Errorf("SET and DEL should unindex, got %q", reply)
+	}
+	if _, ok := index.tags["tag"]["sport"]; ok {
+		t.Errorf("postings for deleted keys should be removed")
+	}
+
+	// an expired key is hidden straight away, and unindexed once removed
+	kvstore.find("product:2").expiryTime = time.Now().Add(-time.Second)
+	if reply := searchKeys(t, kvstore, "*"); reply != keysReply(1, "product:1") {
+		t.Errorf("expired keys should not match, got %q", reply)
+	}
+	kvstore.updateExpires("product:2")
+	kvstore.activeExpireCycle(time.Second)
+	if _, ok := index.docs["product:2"]; ok {
+		t.Errorf("expiry should unindex the key")
+	}
+
+	kvstore.handleHEXPIRE(command("HEXPIRE", "product:1", "0", "FIELDS", "1", "price"))
+	if reply := searchKeys(t, kvstore, "@price:[0 +inf]"); reply != keysReply(0) {
+		t.Errorf("an expired field should not match, got %q", reply)
+	}
+
+	kvstore.handleFTDROPINDEX(command("FT.DROPINDEX", "idx", "DD"))
+	if kvstore.find("product:1") != nil {
+		t.Errorf("DD should delete the indexed keys")
+	}
+	if kvstore.find("other:1") == nil {
+		t.Errorf("keys outside the index should be kept")
+	}
+}
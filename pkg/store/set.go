@@ -0,0 +1,708 @@
+package store
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var errLimitNegative = errors.New("ERR LIMIT can't be negative")
+
+// setValue is either an intset, a sorted slice of int64 used while every
+// member is an integer and there are at most set-max-intset-entries of them,
+// or a hashtable. The hashtable keeps members in a slice with a position
+// index so random picks are uniform and O(1) and removal is a swap with the last
+type setValue struct {
+	intset    []int64
+	members   []string
+	positions map[string]int
+	// the members bucketed for SSCAN, nil with the intset
+	index *scanIndex
+}
+
+func newSetValue() *setValue {
+	return &setValue{intset: []int64{}}
+}
+
+func (set *setValue) isIntset() bool {
+	return set.positions == nil
+}
+
+// parseIntsetMember returns the member as an int64 if it can live in an
+// intset, using the same round trip rule as string int encoding
+func parseIntsetMember(member string) (int64, bool) {
+	if len(member) > maxIntEncodedLength {
+		return 0, false
+	}
+	value, err := strconv.ParseInt(member, 10, 64)
+	if err != nil || strconv.FormatInt(value, 10) != member {
+		return 0, false
+	}
+	return value, true
+}
+
+func (set *setValue) Len() int {
+	if set.isIntset() {
+		return len(set.intset)
+	}
+	return len(set.members)
+}
+
+func (set *setValue) intsetSearch(value int64) (int, bool) {
+	position := sort.Search(len(set.intset), func(i int) bool {
+		return set.intset[i] >= value
+	})
+	return position, position < len(set.intset) && set.intset[position] == value
+}
+
+func (set *setValue) contains(member string) bool {
+	if set.isIntset() {
+		value, ok := parseIntsetMember(member)
+		if !ok {
+			return false
+		}
+		_, found := set.intsetSearch(value)
+		return found
+	}
+	_, ok := set.positions[member]
+	return ok
+}
+
+// add returns true if member was not already in the set. The caller is
+// responsible for converting the set first if member can't go in the intset
+func (set *setValue) add(member string) bool {
+	if set.isIntset() {
+		value, _ := parseIntsetMember(member)
+		position, found := set.intsetSearch(value)
+		if found {
+			return false
+		}
+		set.intset = append(set.intset, 0)
+		copy(set.intset[position+1:], set.intset[position:])
+		set.intset[position] = value
+		return true
+	}
+	if _, ok := set.positions[member]; ok {
+		return false
+	}
+	set.positions[member] = len(set.members)
+	set.members = append(set.members, member)
+	set.index.add(member)
+	return true
+}
+
+func (set *setValue) remove(member string) bool {
+	if set.isIntset() {
+		value, ok := parseIntsetMember(member)
+		if !ok {
+			return false
+		}
+		position, found := set.intsetSearch(value)
+		if !found {
+			return false
+		}
+		set.intset = append(set.intset[:position], set.intset[position+1:]...)
+		return true
+	}
+	position, ok := set.positions[member]
+	if !ok {
+		return false
+	}
+	set.removeAt(position)
+	return true
+}
+
+func (set *setValue) removeAt(position int) {
+	if set.isIntset() {
+		set.intset = append(set.intset[:position], set.intset[position+1:]...)
+		return
+	}
+	last := len(set.members) - 1
+	delete(set.positions, set.members[position])
+	set.index.remove(set.members[position])
+	if position != last {
+		set.members[position] = set.members[last]
+		set.positions[set.members[position]] = position
+	}
+	set.members[last] = ""
+	set.members = set.members[:last]
+}
+
+func (set *setValue) memberAt(position int) string {
+	if set.isIntset() {
+		return strconv.FormatInt(set.intset[position], 10)
+	}
+	return set.members[position]
+}
+
+// all returns every member, intsets in ascending order
+func (set *setValue) all() []string {
+	result := make([]string, 0, set.Len())
+	for i := 0; i < set.Len(); i++ {
+		result = append(result, set.memberAt(i))
+	}
+	return result
+}
+
+func (set *setValue) convertToHashtable() {
+	set.members = make([]string, 0, len(set.intset))
+	set.positions = make(map[string]int, len(set.intset))
+	set.index = newScanIndex()
+	for _, value := range set.intset {
+		member := strconv.FormatInt(value, 10)
+		set.positions[member] = len(set.members)
+		set.members = append(set.members, member)
+		set.index.add(member)
+	}
+	set.intset = nil
+}
+
+func (entry *Entry) set() *setValue {
+	return entry.value.(*setValue)
+}
+
+// setAdd adds member to the set held by entry, converting the intset to a
+// hashtable when member isn't an integer or the set grows past the limit
+func (entry *Entry) setAdd(member string, config *Config) bool {
+	set := entry.set()
+	if set.isIntset() {
+		_, isInteger := parseIntsetMember(member)
+		if !isInteger || (!set.contains(member) && int64(set.Len()+1) > config.setMaxIntsetEntries) {
+			set.convertToHashtable()
+			entry.encoding = encodingHashtable
+		}
+	}
+	return set.add(member)
+}
+
+func newSetEntry() *Entry {
+	entry := newEntry()
+	entry.objectType = setType
+	entry.encoding = encodingIntset
+	entry.value = newSetValue()
+	return entry
+}
+
+// lookupOrCreateSet returns the entry for the set at key, creating an
+// empty one if needed. Caller must hold the write lock
+func (kvstore *KVStore) lookupOrCreateSet(key string) (*Entry, error) {
+	entry, err := kvstore.lookupTypedWrite(key, setType)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		entry = newSetEntry()
+		kvstore.setKey(key, entry)
+	}
+	return entry, nil
+}
+
+func (kvstore *KVStore) removeIfEmptySet(key string, set *setValue) {
+	if set.Len() == 0 {
+		kvstore.deleteKey(key)
+	}
+}
+
+func toBytes(members []string) [][]byte {
+	result := make([][]byte, 0, len(members))
+	for _, member := range members {
+		result = append(result, []byte(member))
+	}
+	return result
+}
+
+func (kvstore *KVStore) handleSADD(messages [][]byte) []byte {
+	if len(messages) < 3 {
+		return wrongArgumentsError("sadd")
+	}
+
+	kvstore.lockKeys(string(messages[1]))
+	defer kvstore.unlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupOrCreateSet(string(messages[1]))
+	if err != nil {
+		return encodeError(err)
+	}
+	added := 0
+	for _, member := range messages[2:] {
+		if entry.setAdd(string(member), &kvstore.config) {
+			added++
+		}
+	}
+	return encodeInteger(int64(added))
+}
+
+func (kvstore *KVStore) handleSREM(messages [][]byte) []byte {
+	if len(messages) < 3 {
+		return wrongArgumentsError("srem")
+	}
+
+	key := string(messages[1])
+	kvstore.lockKeys(key)
+	defer kvstore.unlockKeys(key)
+
+	entry, err := kvstore.lookupTypedWrite(key, setType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return encodeInteger(0)
+	}
+	set := entry.set()
+	removed := 0
+	for _, member := range messages[2:] {
+		if set.remove(string(member)) {
+			removed++
+		}
+	}
+	kvstore.removeIfEmptySet(key, set)
+	return encodeInteger(int64(removed))
+}
+
+func (kvstore *KVStore) handleSCARD(messages [][]byte) []byte {
+	if len(messages) != 2 {
+		return wrongArgumentsError("scard")
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedRead(string(messages[1]), setType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return encodeInteger(0)
+	}
+	return encodeInteger(int64(entry.set().Len()))
+}
+
+func (kvstore *KVStore) handleSMEMBERS(messages [][]byte) []byte {
+	if len(messages) != 2 {
+		return wrongArgumentsError("smembers")
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedRead(string(messages[1]), setType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return encodeArray(nil)
+	}
+	return encodeArray(toBytes(entry.set().all()))
+}
+
+func (kvstore *KVStore) handleSISMEMBER(messages [][]byte) []byte {
+	if len(messages) != 3 {
+		return wrongArgumentsError("sismember")
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedRead(string(messages[1]), setType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry != nil && entry.set().contains(string(messages[2])) {
+		return encodeInteger(1)
+	}
+	return encodeInteger(0)
+}
+
+func (kvstore *KVStore) handleSMISMEMBER(messages [][]byte) []byte {
+	if len(messages) < 3 {
+		return wrongArgumentsError("smismember")
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedRead(string(messages[1]), setType)
+	if err != nil {
+		return encodeError(err)
+	}
+	results := make([]int64, len(messages)-2)
+	for i, member := range messages[2:] {
+		if entry != nil && entry.set().contains(string(member)) {
+			results[i] = 1
+		}
+	}
+	return encodeIntegerArray(results)
+}
+
+func (kvstore *KVStore) handleSMOVE(messages [][]byte) []byte {
+	if len(messages) != 4 {
+		return wrongArgumentsError("smove")
+	}
+
+	source := string(messages[1])
+	destination := string(messages[2])
+	member := string(messages[3])
+	kvstore.lockKeys(source, destination)
+	defer kvstore.unlockKeys(source, destination)
+
+	sourceEntry, err := kvstore.lookupTypedWrite(source, setType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if _, err := kvstore.lookupTypedWrite(destination, setType); err != nil {
+		return encodeError(err)
+	}
+	if sourceEntry == nil || !sourceEntry.set().remove(member) {
+		return encodeInteger(0)
+	}
+	kvstore.removeIfEmptySet(source, sourceEntry.set())
+
+	destinationEntry, _ := kvstore.lookupOrCreateSet(destination)
+	destinationEntry.setAdd(member, &kvstore.config)
+	return encodeInteger(1)
+}
+
+type setOperation int
+
+const (
+	setInter setOperation = iota
+	setUnion
+	setDiff
+)
+
+// lookupSets fetches the sets at keys, missing keys come back as nil.
+// Caller must hold at least the read lock
+func (kvstore *KVStore) lookupSets(keys [][]byte) ([]*setValue, error) {
+	sets := make([]*setValue, len(keys))
+	for i, key := range keys {
+		entry, err := kvstore.lookupTypedRead(string(key), setType)
+		if err != nil {
+			return nil, err
+		}
+		if entry != nil {
+			sets[i] = entry.set()
+		}
+	}
+	return sets, nil
+}
+
+// combineSets runs operation over sets, stopping early once limit members
+// have been found when limit is positive
+func combineSets(sets []*setValue, operation setOperation, limit int) []string {
+	var result []string
+	switch operation {
+	case setInter:
+		for _, set := range sets {
+			if set == nil {
+				return nil
+			}
+		}
+		// iterate the smallest set and probe the others
+		sorted := append([]*setValue{}, sets...)
+		sort.Slice(sorted, func(i, j int) bool {
+			return sorted[i].Len() < sorted[j].Len()
+		})
+		for _, member := range sorted[0].all() {
+			inAll := true
+			for _, other := range sorted[1:] {
+				if !other.contains(member) {
+					inAll = false
+					break
+				}
+			}
+			if inAll {
+				result = append(result, member)
+				if limit > 0 && len(result) >= limit {
+					return result
+				}
+			}
+		}
+	case setUnion:
+		seen := make(map[string]bool)
+		for _, set := range sets {
+			if set == nil {
+				continue
+			}
+			for _, member := range set.all() {
+				if !seen[member] {
+					seen[member] = true
+					result = append(result, member)
+				}
+			}
+		}
+	case setDiff:
+		if sets[0] == nil {
+			return nil
+		}
+		for _, member := range sets[0].all() {
+			found := false
+			for _, other := range sets[1:] {
+				if other != nil && other.contains(member) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				result = append(result, member)
+			}
+		}
+	}
+	return result
+}
+
+func parseSetOperation(command string) setOperation {
+	switch {
+	case strings.HasPrefix(command, "SINTER"):
+		return setInter
+	case strings.HasPrefix(command, "SUNION"):
+		return setUnion
+	default:
+		return setDiff
+	}
+}
+
+// handleSINTER serves SINTER, SUNION and SDIFF
+func (kvstore *KVStore) handleSINTER(messages [][]byte) []byte {
+	if len(messages) < 2 {
+		return wrongArgumentsError(string(messages[0]))
+	}
+	operation := parseSetOperation(strings.ToUpper(string(messages[0])))
+
+	keys := keyStrings(messages[1:])
+	kvstore.rlockKeys(keys...)
+	defer kvstore.runlockKeys(keys...)
+
+	sets, err := kvstore.lookupSets(messages[1:])
+	if err != nil {
+		return encodeError(err)
+	}
+	return encodeArray(toBytes(combineSets(sets, operation, 0)))
+}
+
+// handleSINTERSTORE serves SINTERSTORE, SUNIONSTORE and SDIFFSTORE
+func (kvstore *KVStore) handleSINTERSTORE(messages [][]byte) []byte {
+	if len(messages) < 3 {
+		return wrongArgumentsError(string(messages[0]))
+	}
+	operation := parseSetOperation(strings.ToUpper(string(messages[0])))
+
+	// the destination is locked with the sources
+	keys := keyStrings(messages[1:])
+	kvstore.lockKeys(keys...)
+	defer kvstore.unlockKeys(keys...)
+
+	sets, err := kvstore.lookupSets(messages[2:])
+	if err != nil {
+		return encodeError(err)
+	}
+	members := combineSets(sets, operation, 0)
+
+	// the destination is overwritten whatever type it held before
+	destination := string(messages[1])
+	kvstore.deleteKey(destination)
+	if len(members) == 0 {
+		return encodeInteger(0)
+	}
+	entry := newSetEntry()
+	for _, member := range members {
+		entry.setAdd(member, &kvstore.config)
+	}
+	kvstore.setKey(destination, entry)
+	return encodeInteger(int64(len(members)))
+}
+
+func (kvstore *KVStore) handleSINTERCARD(messages [][]byte) []byte {
+	if len(messages) < 3 {
+		return wrongArgumentsError("sintercard")
+	}
+	numkeys, err := parseInteger(messages[1])
+	if err != nil {
+		return encodeError(err)
+	}
+	if numkeys <= 0 {
+		return encodeError(errNumkeys)
+	}
+	if numkeys > int64(len(messages)-2) {
+		return encodeError(errors.New("ERR Number of keys can't be greater than number of args"))
+	}
+	keys := messages[2 : 2+numkeys]
+	rest := messages[2+numkeys:]
+	limit := int64(0)
+	if len(rest) > 0 {
+		if len(rest) != 2 || strings.ToUpper(string(rest[0])) != "LIMIT" {
+			return encodeError(errSyntax)
+		}
+		limit, err = parseInteger(rest[1])
+		if err != nil {
+			return encodeError(err)
+		}
+		if limit < 0 {
+			return encodeError(errLimitNegative)
+		}
+	}
+
+	kvstore.rlockKeys(keyStrings(keys)...)
+	defer kvstore.runlockKeys(keyStrings(keys)...)
+
+	sets, err := kvstore.lookupSets(keys)
+	if err != nil {
+		return encodeError(err)
+	}
+	return encodeInteger(int64(len(combineSets(sets, setInter, int(limit)))))
+}
+
+// randomMembers picks count members. Positive counts return distinct
+// members, negative ones may repeat, every member being equally likely
+func (set *setValue) randomMembers(count int64) []string {
+	var result []string
+	if count < 0 {
+		for i := int64(0); i < -count; i++ {
+			result = append(result, set.memberAt(rand.Intn(set.Len())))
+		}
+		return result
+	}
+	if count >= int64(set.Len()) {
+		return set.all()
+	}
+
+	// partial Fisher-Yates over a virtual copy of the member positions
+	swapped := make(map[int]int)
+	position := func(i int) int {
+		if value, ok := swapped[i]; ok {
+			return value
+		}
+		return i
+	}
+	length := set.Len()
+	for i := 0; i < int(count); i++ {
+		j := i + rand.Intn(length-i)
+		picked := position(j)
+		swapped[j] = position(i)
+		result = append(result, set.memberAt(picked))
+	}
+	return result
+}
+
+func (kvstore *KVStore) handleSRANDMEMBER(messages [][]byte) []byte {
+	if len(messages) != 2 && len(messages) != 3 {
+		return wrongArgumentsError("srandmember")
+	}
+	hasCount := len(messages) == 3
+	var count int64
+	if hasCount {
+		var err error
+		count, err = parseInteger(messages[2])
+		if err != nil {
+			return encodeError(err)
+		}
+		if count == math.MinInt64 {
+			return encodeError(errCountOutRange)
+		}
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedRead(string(messages[1]), setType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		if hasCount {
+			return encodeArray(nil)
+		}
+		return nullBulkReply
+	}
+	if !hasCount {
+		return encodeBulkString([]byte(entry.set().randomMembers(1)[0]))
+	}
+	return encodeArray(toBytes(entry.set().randomMembers(count)))
+}
+
+func (kvstore *KVStore) handleSPOP(messages [][]byte) []byte {
+	if len(messages) != 2 && len(messages) != 3 {
+		return wrongArgumentsError("spop")
+	}
+	hasCount := len(messages) == 3
+	count := int64(1)
+	if hasCount {
+		var err error
+		count, err = parseInteger(messages[2])
+		if err != nil {
+			return encodeError(err)
+		}
+		if count < 0 {
+			return encodeError(errNotPositive)
+		}
+	}
+
+	key := string(messages[1])
+	kvstore.lockKeys(key)
+	defer kvstore.unlockKeys(key)
+
+	entry, err := kvstore.lookupTypedWrite(key, setType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		if hasCount {
+			return encodeArray(nil)
+		}
+		return nullBulkReply
+	}
+
+	set := entry.set()
+	var popped []string
+	for ; count > 0 && set.Len() > 0; count-- {
+		position := rand.Intn(set.Len())
+		popped = append(popped, set.memberAt(position))
+		set.removeAt(position)
+	}
+	kvstore.removeIfEmptySet(key, set)
+
+	if !hasCount {
+		return encodeBulkString([]byte(popped[0]))
+	}
+	return encodeArray(toBytes(popped))
+}
+
+func (kvstore *KVStore) handleSSCAN(messages [][]byte) []byte {
+	if len(messages) < 3 {
+		return wrongArgumentsError("sscan")
+	}
+	options, err := parseScanOptions(messages[2:], false)
+	if err != nil {
+		return encodeError(err)
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedRead(string(messages[1]), setType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return encodeScanReply(0, nil)
+	}
+	set := entry.set()
+
+	var items [][]byte
+	add := func(member string) {
+		if options.pattern == nil || stringMatch(options.pattern, []byte(member)) {
+			items = append(items, []byte(member))
+		}
+	}
+	// intsets are small enough to return in one go
+	if set.isIntset() {
+		for _, member := range set.all() {
+			add(member)
+		}
+		return encodeScanReply(0, items)
+	}
+	cursor := set.index.scan(options.cursor, options.count, add)
+	return encodeScanReply(cursor, items)
+}
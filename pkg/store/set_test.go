@@ -0,0 +1,149 @@
+package store
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func newTestSet(members ...string) *Entry {
+	config := defaultConfig()
+	entry := newSetEntry()
+	for _, member := range members {
+		entry.setAdd(member, &config)
+	}
+	return entry
+}
+
+func TestSetIntsetEncoding(t *testing.T) {
+	config := defaultConfig()
+	entry := newTestSet("3", "1", "2", "1")
+	if entry.encoding != encodingIntset {
+		t.Fatalf("expected intset encoding for integer members")
+	}
+	if result := entry.set().all(); !reflect.DeepEqual(result, []string{"1", "2", "3"}) {
+		t.Errorf("expected sorted intset members, got %v", result)
+	}
+
+	// "01" doesn't round trip through an int64 so it can't be in the intset
+	entry.setAdd("01", &config)
+	if entry.encoding != encodingHashtable {
+		t.Fatalf("expected hashtable encoding after a non integer member")
+	}
+	for _, member := range []string{"1", "2", "3", "01"} {
+		if !entry.set().contains(member) {
+			t.Errorf("expected %s to survive conversion", member)
+		}
+	}
+	if entry.set().contains("4") {
+		t.Errorf("expected 4 to not be a member")
+	}
+
+	config.setMaxIntsetEntries = 2
+	entry = newSetEntry()
+	for _, member := range []string{"1", "2", "3"} {
+		entry.setAdd(member, &config)
+	}
+	if entry.encoding != encodingHashtable {
+		t.Errorf("expected hashtable encoding past set-max-intset-entries")
+	}
+}
+
+func TestSetRemoveKeepsPositions(t *testing.T) {
+	entry := newTestSet("a", "b", "c", "d")
+	entry.set().remove("b")
+	entry.set().remove("a")
+	set := entry.set()
+	for member, position := range set.positions {
+		if set.members[position] != member {
+			t.Errorf("position of %s points at %s", member, set.members[position])
+		}
+	}
+	result := set.all()
+	sort.Strings(result)
+	if !reflect.DeepEqual(result, []string{"c", "d"}) {
+		t.Errorf("expected [c d], got %v", result)
+	}
+}
+
+func TestCombineSets(t *testing.T) {
+	first := newTestSet("a", "b", "c", "1").set()
+	second := newTestSet("b", "c", "d").set()
+	third := newTestSet("c", "x").set()
+
+	tests := []struct {
+		name      string
+		sets      []*setValue
+		operation setOperation
+		limit     int
+		expected  []string
+	}{
+		{"inter", []*setValue{first, second, third}, setInter, 0, []string{"c"}},
+		{"inter with missing key", []*setValue{first, nil}, setInter, 0, nil},
+		{"inter limit", []*setValue{first, second}, setInter, 1, []string{"b"}},
+		{"union", []*setValue{second, nil, third}, setUnion, 0, []string{"b", "c", "d", "x"}},
+		{"diff", []*setValue{first, second, nil}, setDiff, 0, []string{"1", "a"}},
+	}
+
+	for _, test := range tests {
+		result := combineSets(test.sets, test.operation, test.limit)
+		sort.Strings(result)
+		if test.limit > 0 {
+			if len(result) != test.limit {
+				t.Errorf("%s expected %d members, got %v", test.name, test.limit, result)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("%s expected %v, got %v", test.name, test.expected, result)
+		}
+	}
+}
+
+func TestSetRandomMembersDistribution(t *testing.T) {
+	var members []string
+	for i := 0; i < 10; i++ {
+		members = append(members, fmt.Sprint("m", i))
+	}
+	set := newTestSet(members...).set()
+
+	distinct := set.randomMembers(5)
+	seen := make(map[string]bool)
+	for _, member := range distinct {
+		if seen[member] {
+			t.Fatalf("positive count returned %s twice", member)
+		}
+		seen[member] = true
+	}
+	if len(set.randomMembers(50)) != 10 {
+		t.Errorf("expected a count past the size to return every member")
+	}
+	if len(set.randomMembers(-50)) != 50 {
+		t.Errorf("expected negative count to return exactly that many members")
+	}
+
+	// each member should be picked close to 1/10 of the time
+	counts := make(map[string]int)
+	const rounds = 20000
+	for i := 0; i < rounds; i++ {
+		for _, member := range set.randomMembers(3) {
+			counts[member]++
+		}
+	}
+	expected := rounds * 3 / 10
+	for _, member := range members {
+		if counts[member] < expected*9/10 || counts[member] > expected*11/10 {
+			t.Errorf("member %s picked %d times, expected about %d", member, counts[member], expected)
+		}
+	}
+}
+
+func TestSRANDMEMBERRejectsSmallestCount(t *testing.T) {
+	kvstore := newKVStore()
+	client := newTestClient()
+	execute(t, kvstore, client, "SADD", "set", "a", "b")
+	if got := execute(t, kvstore, client, "SRANDMEMBER", "set", "-9223372036854775808"); got != "-"+errCountOutRange.Error()+"\r\n" {
+		t.Errorf("expected the smallest count to be out of range, got %q", got)
+	}
+}
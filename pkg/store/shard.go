@@ -0,0 +1,196 @@
+package store
+
+import (
+	"hash/maphash"
+	"slices"
+	"sync"
+)
+
+// shardCount is how many shards the keyspace is split into, a power of
+// two so a key's shard is a mask of its hash
+const shardCount = 64
+
+// shard is one lock stripe of the keyspace. Each key lives in exactly one
+// shard, picked by hashing it, and is only touched with that shard locked
+type shard struct {
+	sync.RWMutex
+	store map[string]*Entry
+	// keys in this shard that can expire, sampled by activeExpireCycle
+	expires *expiresIndex
+}
+
+func newShard() *shard {
+	return &shard{
+		store:   make(map[string]*Entry),
+		expires: newExpiresIndex(),
+	}
+}
+
+// lockShard and friends lock a single shard. In event loop mode every
+// command already runs alone, so they do nothing
+func (kvstore *KVStore) lockShard(shard *shard) {
+	if !kvstore.options.EventLoop {
+		shard.Lock()
+	}
+}
+
+func (kvstore *KVStore) unlockShard(shard *shard) {
+	if !kvstore.options.EventLoop {
+		shard.Unlock()
+	}
+}
+
+func (kvstore *KVStore) rlockShard(shard *shard) {
+	if !kvstore.options.EventLoop {
+		shard.RLock()
+	}
+}
+
+func (kvstore *KVStore) runlockShard(shard *shard) {
+	if !kvstore.options.EventLoop {
+		shard.RUnlock()
+	}
+}
+
+func (kvstore *KVStore) shardIndex(key string) int {
+	return int(maphash.String(kvstore.seed, key) & (shardCount - 1))
+}
+
+func (kvstore *KVStore) shardFor(key string) *shard {
+	return kvstore.shards[kvstore.shardIndex(key)]
+}
+
+// find returns the entry stored at key, expired or not, nil if there is
+// none. Caller must hold key's shard lock
+func (kvstore *KVStore) find(key string) *Entry {
+	return kvstore.shardFor(key).store[key]
+}
+
+// forEachKey visits every stored key, expired or not, until visit returns
+// false. Caller must hold every shard lock
+func (kvstore *KVStore) forEachKey(visit func(key string, entry *Entry) bool) {
+	for _, shard := range kvstore.shards {
+		for key, entry := range shard.store {
+			if !visit(key, entry) {
+				return
+			}
+		}
+	}
+}
+
+// keyCount returns how many keys are stored, expired or not. Caller must
+// hold every shard lock
+func (kvstore *KVStore) keyCount() int {
+	count := 0
+	for _, shard := range kvstore.shards {
+		count += len(shard.store)
+	}
+	return count
+}
+
+// shardsOf returns the shards holding keys in ascending order without
+// repeats. Every command locks its shards in this order, so commands on
+// several keys can't deadlock each other
+func (kvstore *KVStore) shardsOf(keys []string) []int {
+	indexes := make([]int, len(keys))
+	for i, key := range keys {
+		indexes[i] = kvstore.shardIndex(key)
+	}
+	slices.Sort(indexes)
+	return slices.Compact(indexes)
+}
+
+// lockKeys takes the write lock of the shards holding keys, a command
+// must name every key it reads or writes
+func (kvstore *KVStore) lockKeys(keys ...string) {
+	if len(keys) == 1 {
+		kvstore.lockShard(kvstore.shardFor(keys[0]))
+		return
+	}
+	for _, index := range kvstore.shardsOf(keys) {
+		kvstore.lockShard(kvstore.shards[index])
+	}
+}
+
+// unlockKeys releases what lockKeys took, then serves any blocked clients
+// the command made ready, which needs locks of its own
+func (kvstore *KVStore) unlockKeys(keys ...string) {
+	kvstore.releaseKeys(keys)
+	kvstore.serveBlockedClients()
+}
+
+// releaseKeys releases what lockKeys took, sizing keys again on the way
+// out as the command may have changed them in place
+func (kvstore *KVStore) releaseKeys(keys []string) {
+	for _, key := range keys {
+		kvstore.updateMemory(key)
+	}
+	if len(keys) == 1 {
+		kvstore.unlockShard(kvstore.shardFor(keys[0]))
+		return
+	}
+	for _, index := range kvstore.shardsOf(keys) {
+		kvstore.unlockShard(kvstore.shards[index])
+	}
+}
+
+// rlockKeys is lockKeys for commands that only read
+func (kvstore *KVStore) rlockKeys(keys ...string) {
+	if len(keys) == 1 {
+		kvstore.rlockShard(kvstore.shardFor(keys[0]))
+		return
+	}
+	for _, index := range kvstore.shardsOf(keys) {
+		kvstore.rlockShard(kvstore.shards[index])
+	}
+}
+
+// runlockKeys releases what rlockKeys took, then removes the expired keys
+// the command came across
+func (kvstore *KVStore) runlockKeys(keys ...string) {
+	if len(keys) == 1 {
+		kvstore.runlockShard(kvstore.shardFor(keys[0]))
+	} else {
+		for _, index := range kvstore.shardsOf(keys) {
+			kvstore.runlockShard(kvstore.shards[index])
+		}
+	}
+	kvstore.expireLazily()
+}
+
+// lockAll write locks every shard, for commands that act on the whole
+// keyspace or on state shared by all keys such as the config
+func (kvstore *KVStore) lockAll() {
+	for _, shard := range kvstore.shards {
+		kvstore.lockShard(shard)
+	}
+}
+
+func (kvstore *KVStore) unlockAll() {
+	for _, shard := range kvstore.shards {
+		kvstore.unlockShard(shard)
+	}
+	kvstore.serveBlockedClients()
+}
+
+func (kvstore *KVStore) rlockAll() {
+	for _, shard := range kvstore.shards {
+		kvstore.rlockShard(shard)
+	}
+}
+
+func (kvstore *KVStore) runlockAll() {
+	for _, shard := range kvstore.shards {
+		kvstore.runlockShard(shard)
+	}
+	kvstore.expireLazily()
+}
+
+// keyStrings converts command arguments to keys
+func keyStrings(arguments [][]byte) []string {
+	keys := make([]string, len(arguments))
+	for i, argument := range arguments {
+		keys[i] = string(argument)
+	}
+	return keys
+}
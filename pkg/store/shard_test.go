@@ -0,0 +1,119 @@
+package store
+
+import (
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestShardsOfIsSortedAndUnique(t *testing.T) {
+	kvstore := newKVStore()
+	var keys []string
+	for i := 0; i < 200; i++ {
+		keys = append(keys, "key:"+strconv.Itoa(i%100))
+	}
+	shards := kvstore.shardsOf(keys)
+	if !slices.IsSorted(shards) || len(slices.Compact(slices.Clone(shards))) != len(shards) {
+		t.Errorf("expected sorted shards without repeats, got %v", shards)
+	}
+	if len(shards) > shardCount {
+		t.Errorf("expected at most %d shards, got %d", shardCount, len(shards))
+	}
+}
+
+// Commands on several keys lock them in shard order, so running them
+// against each other with the keys in every order must not deadlock
+func TestMultiKeyCommandsDoNotDeadlock(t *testing.T) {
+	kvstore := newKVStore()
+	keys := make([]string, 8)
+	for i := range keys {
+		keys[i] = "set:" + strconv.Itoa(i)
+		kvstore.handleSADD(command("SADD", keys[i], "a", "b"))
+	}
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 300; i++ {
+				a, b, c := keys[(worker+i)%8], keys[(worker+2*i+1)%8], keys[(i+3)%8]
+				kvstore.handleSINTERSTORE(command("SUNIONSTORE", a, b, c))
+				kvstore.handleSMOVE(command("SMOVE", c, a, "a"))
+				kvstore.handleSADD(command("SADD", b, "a"))
+				kvstore.handleDEL(command("DEL", c, b, "missing"))
+				kvstore.handleSADD(command("SADD", c, "b"))
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("multi-key commands deadlocked")
+	}
+}
+
+func TestBlockedMoveAcrossShards(t *testing.T) {
+	kvstore := newKVStore()
+	reply := make(chan string, 1)
+	go func() {
+		reply <- string(kvstore.handleBLMOVE(command("BLMOVE", "source", "destination", "LEFT", "RIGHT", "0"), newTestClient()))
+	}()
+	waitForBlocked(t, kvstore, "source", 1)
+
+	kvstore.handleRPUSH(command("RPUSH", "source", "job"))
+	if got := <-reply; got != "$3\r\njob\r\n" {
+		t.Errorf("BLMOVE should be served by RPUSH, got %q", got)
+	}
+	if got := string(kvstore.handleLRANGE(command("LRANGE", "destination", "0", "-1"))); got != "*1\r\n$3\r\njob\r\n" {
+		t.Errorf("expected the job moved to destination, got %q", got)
+	}
+}
+
+// run with -cpu 1,2,4,8 to see throughput scale with GOMAXPROCS, every
+// goroutine works on keys of its own so only the shard locks are shared
+func benchmarkParallel(b *testing.B, work func(kvstore *KVStore, key []byte)) {
+	kvstore := newKVStore()
+	var workers atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		prefix := "key:" + strconv.FormatInt(workers.Add(1), 10) + ":"
+		for i := 0; pb.Next(); i++ {
+			work(kvstore, []byte(prefix+strconv.Itoa(i%1024)))
+		}
+	})
+}
+
+func BenchmarkSET(b *testing.B) {
+	benchmarkParallel(b, func(kvstore *KVStore, key []byte) {
+		kvstore.handleSET([][]byte{[]byte("SET"), key, []byte("value")})
+	})
+}
+
+func BenchmarkGET(b *testing.B) {
+	benchmarkParallel(b, func(kvstore *KVStore, key []byte) {
+		kvstore.handleGET([][]byte{[]byte("GET"), key})
+	})
+}
+
+func BenchmarkSETAndGET(b *testing.B) {
+	benchmarkParallel(b, func(kvstore *KVStore, key []byte) {
+		kvstore.handleSET([][]byte{[]byte("SET"), key, []byte("value")})
+		kvstore.handleGET([][]byte{[]byte("GET"), key})
+	})
+}
+
+func BenchmarkHINCRBY(b *testing.B) {
+	benchmarkParallel(b, func(kvstore *KVStore, key []byte) {
+		kvstore.handleHINCRBY([][]byte{[]byte("HINCRBY"), key, []byte("field"), []byte("1")})
+	})
+}
@@ -0,0 +1,226 @@
+package store
+
+import (
+	"math/rand"
+)
+
+const (
+	skiplistMaxLevel = 32
+	// chance of a node being promoted to the next level
+	skiplistP = 0.25
+)
+
+// skiplist orders members by score then member, the same layout as redis's
+// zskiplist. Every forward link records its span, the number of nodes it
+// jumps over, so rank lookups are O(log n) as well
+type skiplist struct {
+	header *skiplistNode
+	tail   *skiplistNode
+	length int
+	level  int
+}
+
+type skiplistNode struct {
+	member   string
+	score    float64
+	backward *skiplistNode
+	levels   []skiplistLevel
+}
+
+type skiplistLevel struct {
+	forward *skiplistNode
+	span    int
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{
+		header: &skiplistNode{levels: make([]skiplistLevel, skiplistMaxLevel)},
+		level:  1,
+	}
+}
+
+func randomLevel() int {
+	level := 1
+	for level < skiplistMaxLevel && rand.Float64() < skiplistP {
+		level++
+	}
+	return level
+}
+
+// less is the skiplist ordering, score first and member to break ties
+func less(score float64, member string, otherScore float64, otherMember string) bool {
+	return score < otherScore || (score == otherScore && member < otherMember)
+}
+
+// insert adds a member that must not already be in the list
+func (list *skiplist) insert(score float64, member string) *skiplistNode {
+	var update [skiplistMaxLevel]*skiplistNode
+	var rank [skiplistMaxLevel]int
+
+	node := list.header
+	for i := list.level - 1; i >= 0; i-- {
+		if i != list.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for node.levels[i].forward != nil && less(node.levels[i].forward.score, node.levels[i].forward.member, score, member) {
+			rank[i] += node.levels[i].span
+			node = node.levels[i].forward
+		}
+		update[i] = node
+	}
+
+	level := randomLevel()
+	if level > list.level {
+		for i := list.level; i < level; i++ {
+			rank[i] = 0
+			update[i] = list.header
+			update[i].levels[i].span = list.length
+		}
+		list.level = level
+	}
+
+	node = &skiplistNode{member: member, score: score, levels: make([]skiplistLevel, level)}
+	for i := 0; i < level; i++ {
+		node.levels[i].forward = update[i].levels[i].forward
+		update[i].levels[i].forward = node
+		node.levels[i].span = update[i].levels[i].span - (rank[0] - rank[i])
+		update[i].levels[i].span = rank[0] - rank[i] + 1
+	}
+	for i := level; i < list.level; i++ {
+		update[i].levels[i].span++
+	}
+
+	if update[0] != list.header {
+		node.backward = update[0]
+	}
+	if node.levels[0].forward != nil {
+		node.levels[0].forward.backward = node
+	} else {
+		list.tail = node
+	}
+	list.length++
+	return node
+}
+
+func (list *skiplist) deleteNode(node *skiplistNode, update *[skiplistMaxLevel]*skiplistNode) {
+	for i := 0; i < list.level; i++ {
+		if update[i].levels[i].forward == node {
+			update[i].levels[i].span += node.levels[i].span - 1
+			update[i].levels[i].forward = node.levels[i].forward
+		} else {
+			update[i].levels[i].span--
+		}
+	}
+	if node.levels[0].forward != nil {
+		node.levels[0].forward.backward = node.backward
+	} else {
+		list.tail = node.backward
+	}
+	for list.level > 1 && list.header.levels[list.level-1].forward == nil {
+		list.level--
+	}
+	list.length--
+}
+
+// delete removes the node with exactly this score and member
+func (list *skiplist) delete(score float64, member string) bool {
+	var update [skiplistMaxLevel]*skiplistNode
+	node := list.header
+	for i := list.level - 1; i >= 0; i-- {
+		for node.levels[i].forward != nil && less(node.levels[i].forward.score, node.levels[i].forward.member, score, member) {
+			node = node.levels[i].forward
+		}
+		update[i] = node
+	}
+	node = node.levels[0].forward
+	if node == nil || node.score != score || node.member != member {
+		return false
+	}
+	list.deleteNode(node, &update)
+	return true
+}
+
+// updateScore moves member from its current score to newScore, reusing the
+// node in place when the order doesn't change
+func (list *skiplist) updateScore(currentScore float64, member string, newScore float64) *skiplistNode {
+	var update [skiplistMaxLevel]*skiplistNode
+	node := list.header
+	for i := list.level - 1; i >= 0; i-- {
+		for node.levels[i].forward != nil && less(node.levels[i].forward.score, node.levels[i].forward.member, currentScore, member) {
+			node = node.levels[i].forward
+		}
+		update[i] = node
+	}
+	node = node.levels[0].forward
+
+	if (node.backward == nil || less(node.backward.score, node.backward.member, newScore, member)) &&
+		(node.levels[0].forward == nil || less(newScore, member, node.levels[0].forward.score, node.levels[0].forward.member)) {
+		node.score = newScore
+		return node
+	}
+
+	list.deleteNode(node, &update)
+	return list.insert(newScore, member)
+}
+
+// rank returns the 1 based position of the member, 0 if it isn't there
+func (list *skiplist) rank(score float64, member string) int {
+	rank := 0
+	node := list.header
+	for i := list.level - 1; i >= 0; i-- {
+		for node.levels[i].forward != nil && !less(score, member, node.levels[i].forward.score, node.levels[i].forward.member) {
+			rank += node.levels[i].span
+			node = node.levels[i].forward
+		}
+		if node != list.header && node.member == member {
+			return rank
+		}
+	}
+	return 0
+}
+
+// byRank returns the node at the 1 based rank
+func (list *skiplist) byRank(rank int) *skiplistNode {
+	traversed := 0
+	node := list.header
+	for i := list.level - 1; i >= 0; i-- {
+		for node.levels[i].forward != nil && traversed+node.levels[i].span <= rank {
+			traversed += node.levels[i].span
+			node = node.levels[i].forward
+		}
+		if traversed == rank {
+			return node
+		}
+	}
+	return nil
+}
+
+// first returns the first node matching inRange, assuming everything
+// below the range fails aboveMin
+func (list *skiplist) first(aboveMin func(*skiplistNode) bool, belowMax func(*skiplistNode) bool) *skiplistNode {
+	node := list.header
+	for i := list.level - 1; i >= 0; i-- {
+		for node.levels[i].forward != nil && !aboveMin(node.levels[i].forward) {
+			node = node.levels[i].forward
+		}
+	}
+	node = node.levels[0].forward
+	if node == nil || !belowMax(node) {
+		return nil
+	}
+	return node
+}
+
+// last returns the last node inside the range
+func (list *skiplist) last(aboveMin func(*skiplistNode) bool, belowMax func(*skiplistNode) bool) *skiplistNode {
+	node := list.header
+	for i := list.level - 1; i >= 0; i-- {
+		for node.levels[i].forward != nil && belowMax(node.levels[i].forward) {
+			node = node.levels[i].forward
+		}
+	}
+	if node == list.header || !aboveMin(node) {
+		return nil
+	}
+	return node
+}
@@ -0,0 +1,128 @@
+package store
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// TestSkiplistAgainstSortedSlice checks ordering, ranks and spans stay
+// right through random inserts, score updates and deletes
+func TestSkiplistAgainstSortedSlice(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	zset := newZsetValue()
+	model := make(map[string]float64)
+
+	for i := 0; i < 3000; i++ {
+		member := fmt.Sprint("m", random.Intn(200))
+		switch random.Intn(3) {
+		case 0, 1:
+			score := float64(random.Intn(50))
+			zset.set(score, member)
+			model[member] = score
+		case 2:
+			zset.remove(member)
+			delete(model, member)
+		}
+	}
+
+	type pair struct {
+		member string
+		score  float64
+	}
+	var expected []pair
+	for member, score := range model {
+		expected = append(expected, pair{member, score})
+	}
+	sort.Slice(expected, func(i, j int) bool {
+		return less(expected[i].score, expected[i].member, expected[j].score, expected[j].member)
+	})
+
+	if zset.list.length != len(expected) || zset.Len() != len(expected) {
+		t.Fatalf("expected length %d, got list %d dict %d", len(expected), zset.list.length, zset.Len())
+	}
+
+	var walked []pair
+	for node := zset.list.header.levels[0].forward; node != nil; node = node.levels[0].forward {
+		walked = append(walked, pair{node.member, node.score})
+	}
+	if !reflect.DeepEqual(walked, expected) {
+		t.Fatalf("skiplist order does not match the sorted model")
+	}
+
+	for i, pair := range expected {
+		if rank, _ := zset.rank(pair.member, false); rank != i {
+			t.Errorf("rank of %s expected %d, got %d", pair.member, i, rank)
+		}
+		if rank, _ := zset.rank(pair.member, true); rank != len(expected)-1-i {
+			t.Errorf("reverse rank of %s expected %d, got %d", pair.member, len(expected)-1-i, rank)
+		}
+		if node := zset.list.byRank(i + 1); node == nil || node.member != pair.member {
+			t.Errorf("byRank(%d) expected %s", i+1, pair.member)
+		}
+	}
+
+	// walking backwards has to give the reverse order
+	count := 0
+	for node := zset.list.tail; node != nil; node = node.backward {
+		if node.member != expected[len(expected)-1-count].member {
+			t.Fatalf("backward links out of order at %d", count)
+		}
+		count++
+	}
+}
+
+func TestZsetRanges(t *testing.T) {
+	zset := newZsetValue()
+	for i, member := range []string{"a", "b", "c", "d", "e"} {
+		zset.set(float64(i+1), member)
+	}
+	members := func(nodes []*skiplistNode) []string {
+		result := []string{}
+		for _, node := range nodes {
+			result = append(result, node.member)
+		}
+		return result
+	}
+
+	tests := []struct {
+		name     string
+		request  zrangeRequest
+		expected []string
+	}{
+		{"rank", zrangeRequest{start: []byte("1"), stop: []byte("-2"), count: -1}, []string{"b", "c", "d"}},
+		{"rank rev", zrangeRequest{start: []byte("0"), stop: []byte("1"), reverse: true, count: -1}, []string{"e", "d"}},
+		{"score", zrangeRequest{by: byScore, start: []byte("(1"), stop: []byte("3"), count: -1}, []string{"b", "c"}},
+		{"score rev", zrangeRequest{by: byScore, start: []byte("+inf"), stop: []byte("4"), reverse: true, count: -1}, []string{"e", "d"}},
+		{"score limit", zrangeRequest{by: byScore, start: []byte("-inf"), stop: []byte("+inf"), offset: 1, count: 2}, []string{"b", "c"}},
+		{"score empty", zrangeRequest{by: byScore, start: []byte("(3"), stop: []byte("3"), count: -1}, []string{}},
+	}
+	for _, test := range tests {
+		nodes, err := zset.nodes(test.request)
+		if err != nil {
+			t.Errorf("%s unexpected error: %v", test.name, err)
+			continue
+		}
+		if result := members(nodes); !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("%s expected %v, got %v", test.name, test.expected, result)
+		}
+	}
+
+	lex := newZsetValue()
+	for _, member := range []string{"a", "b", "c", "d"} {
+		lex.set(0, member)
+	}
+	nodes, _ := lex.nodes(zrangeRequest{by: byLex, start: []byte("[b"), stop: []byte("+"), count: -1})
+	if result := members(nodes); !reflect.DeepEqual(result, []string{"b", "c", "d"}) {
+		t.Errorf("lex expected [b c d], got %v", result)
+	}
+	nodes, _ = lex.nodes(zrangeRequest{by: byLex, start: []byte("(c"), stop: []byte("-"), reverse: true, count: -1})
+	if result := members(nodes); !reflect.DeepEqual(result, []string{"b", "a"}) {
+		t.Errorf("lex rev expected [b a], got %v", result)
+	}
+	if count := lex.countInRange(lexRange{min: "b", max: "c"}.aboveMin, lexRange{min: "b", max: "c"}.belowMax); count != 2 {
+		t.Errorf("expected lex count 2, got %d", count)
+	}
+}
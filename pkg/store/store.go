@@ -0,0 +1,177 @@
+package store
+
+import (
+	"hash/maphash"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	simpleStrings byte = '+'
+	errorString   byte = '-'
+	bulkStrings   byte = '$'
+	arrays        byte = '*'
+	integers      byte = ':'
+)
+
+// KVStore is the keyspace and everything that acts on it. The server
+// drives it with Execute, programs embedding it can use the Go API in
+// api.go and collections.go instead. Both can be used at once
+type KVStore struct {
+	options Options
+	// commands waiting for the event loop, see eventloop.go
+	jobs chan func()
+	// the keyspace, split into lock striped shards, see shard.go
+	shards []*shard
+	seed   maphash.Seed
+	// clients parked by blocking commands, keyed by the key they wait on,
+	// guarded by blockingLock
+	blockingLock   sync.Mutex
+	blocked        map[string][]*blockedClient
+	readyKeys      []string
+	servingBlocked bool
+	hasReadyKeys   atomic.Bool
+	// search indexes by name, see signalModifiedKey. Only changed with
+	// every shard locked
+	indexes map[string]*searchIndex
+	// expired keys found by readers, removed by runlockKeys
+	lazyExpired *lazyExpireQueue
+	// the shard the active expire cycle visits next
+	expireCursor atomic.Int64
+	// the sum of Entry.memory over every key, see memory.go
+	usedMemory atomic.Int64
+	// candidates for eviction once maxmemory is reached, see evict.go
+	eviction evictionPool
+	// the tunables, see config.go
+	config Config
+	// closed by Close to stop background tasks
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newKVStore() *KVStore {
+	kvstore := &KVStore{
+		shards:      make([]*shard, shardCount),
+		seed:        maphash.MakeSeed(),
+		blocked:     make(map[string][]*blockedClient),
+		indexes:     make(map[string]*searchIndex),
+		lazyExpired: newLazyExpireQueue(),
+		config:      defaultConfig(),
+		closed:      make(chan struct{}),
+	}
+	for i := range kvstore.shards {
+		kvstore.shards[i] = newShard()
+	}
+	return kvstore
+}
+
+// New returns an empty store with active expiry running in the
+// background until Close is called
+func New() *KVStore {
+	kvstore, _ := NewWithOptions(Options{})
+	return kvstore
+}
+
+// NewWithOptions is New with options, it fails if options.Config holds a
+// setting CONFIG SET would refuse or the RDB file can't be loaded
+func NewWithOptions(options Options) (*KVStore, error) {
+	kvstore := newKVStore()
+	kvstore.options = options
+	for name, value := range options.Config {
+		tunable, parsed, err := kvstore.config.parseSetting(name, value)
+		if err != nil {
+			return nil, err
+		}
+		*tunable.value = parsed
+	}
+	if options.Dir != "" {
+		kvstore.config.dir = options.Dir
+	}
+	if options.DBFilename != "" {
+		kvstore.config.dbFileName = options.DBFilename
+		if err := kvstore.load(); err != nil {
+			return nil, err
+		}
+	}
+	if options.EventLoop {
+		kvstore.jobs = make(chan func())
+		go kvstore.eventLoop()
+	}
+	go kvstore.activeExpireLoop()
+	return kvstore, nil
+}
+
+// Close stops the store's background tasks. The keyspace stays usable,
+// expired keys are then only removed as they are looked up
+func (kvstore *KVStore) Close() {
+	kvstore.closeOnce.Do(func() {
+		close(kvstore.closed)
+	})
+}
+
+type Entry struct {
+	objectType objectType
+	// string values live in entry/intValue, every other type keeps its
+	// structure in value, e.g. *quicklist for lists
+	value interface{}
+	entry []byte
+	// counters are kept as int64 so INCR and friends don't re-parse entry
+	intValue     int64
+	encoding     encoding
+	creationTime time.Time
+	expiryTime   time.Time
+	// access metadata for eviction, see evict.go
+	lru atomic.Uint32
+	// the estimated size of the key counted in usedMemory, see memory.go
+	memory int64
+}
+
+// Config is a store's settings, most of them tunables CONFIG SET can
+// change while it runs
+type Config struct {
+	// where the RDB file is, see rdb.go
+	dir        string
+	dbFileName string
+	// hashes stay in the compact listpack encoding until either limit is passed
+	hashMaxListpackEntries int64
+	hashMaxListpackValue   int64
+	// sets of integers stay sorted int64 slices up to this many members
+	setMaxIntsetEntries int64
+	// a stream block is closed once it holds this many entries or bytes
+	streamNodeMaxEntries int64
+	streamNodeMaxBytes   int64
+	// sparse HyperLogLogs are converted to dense past this many bytes
+	hllSparseMaxBytes int64
+	// how many times a second background tasks such as active expiry run
+	hz int64
+	// past maxmemory bytes, 0 meaning no limit, keys are evicted under
+	// maxmemoryPolicy, one of the policy* values. Eviction samples
+	// maxmemorySamples keys a round and key sizes sample that many elements
+	maxmemory        int64
+	maxmemoryPolicy  int64
+	maxmemorySamples int64
+	// how many hits it takes to grow an LFU counter and how many minutes
+	// it takes an unaccessed key's counter to drop by one, 0 for never
+	lfuLogFactor int64
+	lfuDecayTime int64
+}
+
+// defaultConfig is what a store starts with, the redis.conf defaults
+func defaultConfig() Config {
+	return Config{
+		dir:                    ".",
+		dbFileName:             "dump.rdb",
+		hashMaxListpackEntries: 128,
+		hashMaxListpackValue:   64,
+		setMaxIntsetEntries:    512,
+		streamNodeMaxEntries:   100,
+		streamNodeMaxBytes:     4096,
+		hllSparseMaxBytes:      3000,
+		hz:                     10,
+		maxmemoryPolicy:        policyNoEviction,
+		maxmemorySamples:       5,
+		lfuLogFactor:           10,
+		lfuDecayTime:           1,
+	}
+}
@@ -0,0 +1,803 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errInvalidStreamID   = errors.New("ERR Invalid stream ID specified as stream command argument")
+	errStreamIDTooSmall  = errors.New("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+	errStreamIDZero      = errors.New("ERR The ID specified in XADD must be greater than 0-0")
+	errStreamExhausted   = errors.New("ERR The stream has exhausted the last possible ID, unable to add more items")
+	errInvalidStartID    = errors.New("ERR invalid start ID for the interval")
+	errInvalidEndID      = errors.New("ERR invalid end ID for the interval")
+	errMaxLenNegative    = errors.New("ERR The MAXLEN argument must be >= 0.")
+	errLimitWithoutTilde = errors.New("ERR syntax error, LIMIT cannot be used without the special ~ option")
+)
+
+// streamID is the ms-seq pair identifying a stream entry
+type streamID struct {
+	ms  uint64
+	seq uint64
+}
+
+var maxStreamID = streamID{math.MaxUint64, math.MaxUint64}
+
+func (id streamID) String() string {
+	return strconv.FormatUint(id.ms, 10) + "-" + strconv.FormatUint(id.seq, 10)
+}
+
+// key is the big endian form of the id, so radix tree order is id order
+func (id streamID) key() []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key, id.ms)
+	binary.BigEndian.PutUint64(key[8:], id.seq)
+	return key
+}
+
+func streamIDFromKey(key []byte) streamID {
+	return streamID{binary.BigEndian.Uint64(key), binary.BigEndian.Uint64(key[8:])}
+}
+
+func (id streamID) compare(other streamID) int {
+	switch {
+	case id.ms < other.ms:
+		return -1
+	case id.ms > other.ms:
+		return 1
+	case id.seq < other.seq:
+		return -1
+	case id.seq > other.seq:
+		return 1
+	}
+	return 0
+}
+
+// increment returns the next id, ok is false past the last possible id
+func (id streamID) increment() (streamID, bool) {
+	switch {
+	case id.seq < math.MaxUint64:
+		return streamID{id.ms, id.seq + 1}, true
+	case id.ms < math.MaxUint64:
+		return streamID{id.ms + 1, 0}, true
+	}
+	return id, false
+}
+
+// decrement returns the previous id, ok is false before 0-0
+func (id streamID) decrement() (streamID, bool) {
+	switch {
+	case id.seq > 0:
+		return streamID{id.ms, id.seq - 1}, true
+	case id.ms > 0:
+		return streamID{id.ms - 1, math.MaxUint64}, true
+	}
+	return id, false
+}
+
+// parseStreamID reads ms-seq or a bare ms, a missing sequence becomes
+// missingSeq. With allowSpecial - and + stand for the smallest and largest ids
+func parseStreamID(value []byte, missingSeq uint64, allowSpecial bool) (streamID, error) {
+	if allowSpecial && len(value) == 1 {
+		switch value[0] {
+		case '-':
+			return streamID{}, nil
+		case '+':
+			return maxStreamID, nil
+		}
+	}
+	msPart, seqPart, hasSeq := bytes.Cut(value, []byte("-"))
+	ms, err := strconv.ParseUint(string(msPart), 10, 64)
+	if err != nil {
+		return streamID{}, errInvalidStreamID
+	}
+	if !hasSeq {
+		return streamID{ms, missingSeq}, nil
+	}
+	seq, err := strconv.ParseUint(string(seqPart), 10, 64)
+	if err != nil {
+		return streamID{}, errInvalidStreamID
+	}
+	return streamID{ms, seq}, nil
+}
+
+// parseStreamInterval reads a range bound, where a leading ( makes it
+// exclusive and an incomplete start or end id covers the whole millisecond
+func parseStreamInterval(value []byte, start bool) (streamID, error) {
+	missingSeq := uint64(0)
+	if !start {
+		missingSeq = math.MaxUint64
+	}
+	if len(value) > 1 && value[0] == '(' {
+		id, err := parseStreamID(value[1:], missingSeq, false)
+		if err != nil {
+			return streamID{}, err
+		}
+		var ok bool
+		if start {
+			if id, ok = id.increment(); !ok {
+				return streamID{}, errInvalidStartID
+			}
+		} else if id, ok = id.decrement(); !ok {
+			return streamID{}, errInvalidEndID
+		}
+		return id, nil
+	}
+	return parseStreamID(value, missingSeq, true)
+}
+
+// streamEntry is an entry as handed out to readers, fields holds the
+// field value pairs flattened
+type streamEntry struct {
+	id     streamID
+	fields [][]byte
+}
+
+// streamBlock is the listpack of a stream, a run of consecutive entries.
+// Field names are stored once as the master fields taken from the first
+// entry, later entries with the same fields only keep their values.
+// Deleted entries are flagged and the block is dropped once all of them are
+type streamBlock struct {
+	masterFields [][]byte
+	entries      []streamBlockEntry
+	live         int
+	size         int
+}
+
+type streamBlockEntry struct {
+	id streamID
+	// values alone when sameFields, otherwise flattened field value pairs
+	values     [][]byte
+	sameFields bool
+	deleted    bool
+}
+
+func newStreamBlock(fields [][]byte) *streamBlock {
+	block := &streamBlock{}
+	for i := 0; i < len(fields); i += 2 {
+		block.masterFields = append(block.masterFields, fields[i])
+		block.size += len(fields[i])
+	}
+	return block
+}
+
+func (block *streamBlock) matchesMaster(fields [][]byte) bool {
+	if len(fields) != len(block.masterFields)*2 {
+		return false
+	}
+	for i, field := range block.masterFields {
+		if !bytes.Equal(fields[i*2], field) {
+			return false
+		}
+	}
+	return true
+}
+
+func (block *streamBlock) append(id streamID, fields [][]byte) {
+	entry := streamBlockEntry{id: id}
+	if block.matchesMaster(fields) {
+		entry.sameFields = true
+		for i := 1; i < len(fields); i += 2 {
+			entry.values = append(entry.values, fields[i])
+			block.size += len(fields[i])
+		}
+	} else {
+		entry.values = fields
+		for _, field := range fields {
+			block.size += len(field)
+		}
+	}
+	block.entries = append(block.entries, entry)
+	block.live++
+}
+
+func (block *streamBlock) fieldsAt(i int) [][]byte {
+	entry := block.entries[i]
+	if !entry.sameFields {
+		return entry.values
+	}
+	fields := make([][]byte, 0, len(entry.values)*2)
+	for j, value := range entry.values {
+		fields = append(fields, block.masterFields[j], value)
+	}
+	return fields
+}
+
+// search returns the position of id in the block or where it would go
+func (block *streamBlock) search(id streamID) (int, bool) {
+	i := sort.Search(len(block.entries), func(i int) bool {
+		return block.entries[i].id.compare(id) >= 0
+	})
+	return i, i < len(block.entries) && block.entries[i].id == id
+}
+
+func (block *streamBlock) lastID() streamID {
+	return block.entries[len(block.entries)-1].id
+}
+
+// streamValue is a stream, blocks are indexed in a radix tree by the id of
+// their first entry
+type streamValue struct {
+	blocks       *radixTree
+	length       int
+	lastID       streamID
+	maxDeletedID streamID
+	entriesAdded uint64
+	groups       map[string]*streamGroup
+}
+
+func newStreamValue() *streamValue {
+	return &streamValue{blocks: newRadixTree()}
+}
+
+func (stream *streamValue) Len() int {
+	return stream.length
+}
+
+// nextID generates the id for XADD *, the current time unless the clock
+// is behind the last id, in which case the sequence carries on from it
+func (stream *streamValue) nextID(now uint64) (streamID, error) {
+	if now > stream.lastID.ms {
+		return streamID{now, 0}, nil
+	}
+	id, ok := stream.lastID.increment()
+	if !ok {
+		return streamID{}, errStreamExhausted
+	}
+	return id, nil
+}
+
+// explicitID validates a caller supplied id, autoSeq is set for ms-*
+func (stream *streamValue) explicitID(id streamID, autoSeq bool) (streamID, error) {
+	if autoSeq {
+		switch {
+		case id.ms < stream.lastID.ms:
+			return streamID{}, errStreamIDTooSmall
+		case id.ms > stream.lastID.ms:
+			return streamID{id.ms, 0}, nil
+		case stream.lastID.seq == math.MaxUint64:
+			return streamID{}, errStreamIDTooSmall
+		}
+		return streamID{id.ms, stream.lastID.seq + 1}, nil
+	}
+	if id == (streamID{}) {
+		return streamID{}, errStreamIDZero
+	}
+	if id.compare(stream.lastID) <= 0 {
+		return streamID{}, errStreamIDTooSmall
+	}
+	return id, nil
+}
+
+// add appends an entry whose id is already known to be past lastID,
+// opening a new block once the tail one is full
+func (stream *streamValue) add(id streamID, fields [][]byte, config *Config) {
+	_, value, ok := stream.blocks.last()
+	var block *streamBlock
+	if ok {
+		block = value.(*streamBlock)
+		full := (config.streamNodeMaxEntries > 0 && int64(len(block.entries)) >= config.streamNodeMaxEntries) ||
+			(config.streamNodeMaxBytes > 0 && int64(block.size) >= config.streamNodeMaxBytes)
+		if full {
+			block = nil
+		}
+	}
+	if block == nil {
+		block = newStreamBlock(fields)
+		stream.blocks.insert(id.key(), block)
+	}
+	block.append(id, fields)
+	stream.length++
+	stream.entriesAdded++
+	stream.lastID = id
+}
+
+// firstID returns the id of the oldest live entry
+func (stream *streamValue) firstID() (streamID, bool) {
+	entries := stream.rangeOf(streamID{}, maxStreamID, false, 1)
+	if len(entries) == 0 {
+		return streamID{}, false
+	}
+	return entries[0].id, true
+}
+
+// rangeOf returns up to count live entries between start and end
+// inclusive, count <= 0 means no limit
+func (stream *streamValue) rangeOf(start streamID, end streamID, reverse bool, count int) []streamEntry {
+	var entries []streamEntry
+	if start.compare(end) > 0 {
+		return entries
+	}
+	full := func() bool {
+		return count > 0 && len(entries) >= count
+	}
+
+	if reverse {
+		stream.blocks.descend(end.key(), func(_ []byte, value interface{}) bool {
+			block := value.(*streamBlock)
+			for i := len(block.entries) - 1; i >= 0; i-- {
+				entry := block.entries[i]
+				if entry.id.compare(end) > 0 || entry.deleted {
+					continue
+				}
+				if entry.id.compare(start) < 0 || full() {
+					return false
+				}
+				entries = append(entries, streamEntry{entry.id, block.fieldsAt(i)})
+			}
+			return true
+		})
+		return entries
+	}
+
+	// the block holding start is keyed at or before it
+	from := start.key()
+	if key, _, ok := stream.blocks.floor(from); ok {
+		from = key
+	}
+	stream.blocks.ascend(from, func(_ []byte, value interface{}) bool {
+		block := value.(*streamBlock)
+		for i := range block.entries {
+			entry := block.entries[i]
+			if entry.id.compare(start) < 0 || entry.deleted {
+				continue
+			}
+			if entry.id.compare(end) > 0 || full() {
+				return false
+			}
+			entries = append(entries, streamEntry{entry.id, block.fieldsAt(i)})
+		}
+		return true
+	})
+	return entries
+}
+
+// lookup returns the fields of the live entry with id
+func (stream *streamValue) lookup(id streamID) ([][]byte, bool) {
+	_, value, ok := stream.blocks.floor(id.key())
+	if !ok {
+		return nil, false
+	}
+	block := value.(*streamBlock)
+	i, found := block.search(id)
+	if !found || block.entries[i].deleted {
+		return nil, false
+	}
+	return block.fieldsAt(i), true
+}
+
+// delete flags the entry with id as deleted, dropping its block when
+// nothing live is left in it
+func (stream *streamValue) delete(id streamID) bool {
+	blockKey, value, ok := stream.blocks.floor(id.key())
+	if !ok {
+		return false
+	}
+	block := value.(*streamBlock)
+	i, found := block.search(id)
+	if !found || block.entries[i].deleted {
+		return false
+	}
+	block.entries[i].deleted = true
+	block.live--
+	stream.length--
+	if block.live == 0 {
+		stream.blocks.remove(blockKey)
+	}
+	if id.compare(stream.maxDeletedID) > 0 {
+		stream.maxDeletedID = id
+	}
+	return true
+}
+
+type trimStrategy int
+
+const (
+	trimNone trimStrategy = iota
+	trimMaxLen
+	trimMinID
+)
+
+// streamTrim holds the MAXLEN / MINID arguments shared by XADD and XTRIM
+type streamTrim struct {
+	strategy    trimStrategy
+	maxLen      int64
+	minID       streamID
+	approximate bool
+	limit       int64
+	limitGiven  bool
+}
+
+// parseArgument consumes a trimming option at position if there is
+// one, returning how many arguments it took
+func (trim *streamTrim) parseArgument(arguments [][]byte, position int) (int, error) {
+	option := strings.ToUpper(string(arguments[position]))
+	switch option {
+	case "MAXLEN", "MINID":
+		if trim.strategy != trimNone || position+1 >= len(arguments) {
+			return 0, errSyntax
+		}
+		taken := 1
+		switch string(arguments[position+1]) {
+		case "~":
+			trim.approximate = true
+			taken++
+		case "=":
+			taken++
+		}
+		if position+taken >= len(arguments) {
+			return 0, errSyntax
+		}
+		threshold := arguments[position+taken]
+		if option == "MAXLEN" {
+			maxLen, err := parseInteger(threshold)
+			if err != nil {
+				return 0, err
+			}
+			if maxLen < 0 {
+				return 0, errMaxLenNegative
+			}
+			trim.strategy, trim.maxLen = trimMaxLen, maxLen
+		} else {
+			minID, err := parseStreamID(threshold, 0, false)
+			if err != nil {
+				return 0, err
+			}
+			trim.strategy, trim.minID = trimMinID, minID
+		}
+		return taken + 1, nil
+	case "LIMIT":
+		if position+1 >= len(arguments) {
+			return 0, errSyntax
+		}
+		limit, err := parseInteger(arguments[position+1])
+		if err != nil {
+			return 0, err
+		}
+		if limit < 0 {
+			return 0, errors.New("ERR The LIMIT argument must be >= 0.")
+		}
+		trim.limit, trim.limitGiven = limit, true
+		return 2, nil
+	}
+	return 0, nil
+}
+
+// validate checks the combination of options once they're all parsed
+// and fills in the default limit for approximate trimming, 100 times
+// nodeMaxEntries
+func (trim *streamTrim) validate(nodeMaxEntries int64) error {
+	if trim.limitGiven && !trim.approximate {
+		return errLimitWithoutTilde
+	}
+	if trim.approximate && !trim.limitGiven {
+		trim.limit = 100 * nodeMaxEntries
+	}
+	return nil
+}
+
+// trim removes entries from the head of the stream. Approximate trimming
+// only ever drops whole blocks, which is far cheaper and may leave a few
+// more entries than asked for. limit caps the entries removed, 0 is no cap
+func (stream *streamValue) trim(trim streamTrim) int {
+	if trim.strategy == trimNone {
+		return 0
+	}
+	removed := 0
+	for {
+		if trim.strategy == trimMaxLen && int64(stream.length) <= trim.maxLen {
+			break
+		}
+		blockKey, value, ok := stream.blocks.first()
+		if !ok {
+			break
+		}
+		block := value.(*streamBlock)
+
+		var removeBlock bool
+		if trim.strategy == trimMaxLen {
+			removeBlock = int64(stream.length-block.live) >= trim.maxLen
+		} else {
+			removeBlock = block.lastID().compare(trim.minID) < 0
+		}
+		if removeBlock {
+			if trim.limit > 0 && int64(removed+block.live) > trim.limit {
+				break
+			}
+			stream.blocks.remove(blockKey)
+			stream.length -= block.live
+			removed += block.live
+			continue
+		}
+		if trim.approximate {
+			break
+		}
+
+		// exact trimming finishes off inside the first block
+		for i := range block.entries {
+			entry := &block.entries[i]
+			if entry.deleted {
+				continue
+			}
+			if trim.strategy == trimMaxLen && int64(stream.length) <= trim.maxLen {
+				break
+			}
+			if trim.strategy == trimMinID && entry.id.compare(trim.minID) >= 0 {
+				break
+			}
+			entry.deleted = true
+			block.live--
+			stream.length--
+			removed++
+		}
+		break
+	}
+	return removed
+}
+
+func (entry *Entry) stream() *streamValue {
+	return entry.value.(*streamValue)
+}
+
+func newStreamEntry() *Entry {
+	entry := newEntry()
+	entry.objectType = streamType
+	entry.encoding = encodingStream
+	entry.value = newStreamValue()
+	return entry
+}
+
+func encodeStreamEntry(entry streamEntry) []byte {
+	result := encodeArrayHeader(2)
+	result = append(result, encodeBulkString([]byte(entry.id.String()))...)
+	// entries read back from a PEL may since have been deleted
+	if entry.fields == nil {
+		return append(result, nullArrayReply...)
+	}
+	return append(result, encodeArray(entry.fields)...)
+}
+
+func encodeStreamEntries(entries []streamEntry) []byte {
+	result := encodeArrayHeader(len(entries))
+	for _, entry := range entries {
+		result = append(result, encodeStreamEntry(entry)...)
+	}
+	return result
+}
+
+func (kvstore *KVStore) handleXADD(messages [][]byte) []byte {
+	if len(messages) < 5 {
+		return wrongArgumentsError("xadd")
+	}
+
+	var trim streamTrim
+	noMkStream := false
+	position := 2
+	for ; position < len(messages); position++ {
+		if strings.EqualFold(string(messages[position]), "NOMKSTREAM") {
+			noMkStream = true
+			continue
+		}
+		taken, err := trim.parseArgument(messages, position)
+		if err != nil {
+			return encodeError(err)
+		}
+		if taken == 0 {
+			break
+		}
+		position += taken - 1
+	}
+	if err := trim.validate(atomic.LoadInt64(&kvstore.config.streamNodeMaxEntries)); err != nil {
+		return encodeError(err)
+	}
+	if position >= len(messages) {
+		return wrongArgumentsError("xadd")
+	}
+	fields := messages[position+1:]
+	if len(fields) == 0 || len(fields)%2 != 0 {
+		return wrongArgumentsError("xadd")
+	}
+
+	idArgument := messages[position]
+	auto := len(idArgument) == 1 && idArgument[0] == '*'
+	var requested streamID
+	autoSeq := false
+	if !auto {
+		if bytes.HasSuffix(idArgument, []byte("-*")) {
+			ms, err := strconv.ParseUint(string(idArgument[:len(idArgument)-2]), 10, 64)
+			if err != nil {
+				return encodeError(errInvalidStreamID)
+			}
+			requested, autoSeq = streamID{ms: ms}, true
+		} else {
+			id, err := parseStreamID(idArgument, 0, false)
+			if err != nil {
+				return encodeError(err)
+			}
+			requested = id
+		}
+	}
+
+	key := string(messages[1])
+	kvstore.lockKeys(key)
+	defer kvstore.unlockKeys(key)
+
+	entry, err := kvstore.lookupTypedWrite(key, streamType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil && noMkStream {
+		return nullBulkReply
+	}
+	stream := newStreamValue()
+	if entry != nil {
+		stream = entry.stream()
+	}
+
+	var id streamID
+	if auto {
+		id, err = stream.nextID(uint64(time.Now().UnixMilli()))
+	} else {
+		id, err = stream.explicitID(requested, autoSeq)
+	}
+	if err != nil {
+		return encodeError(err)
+	}
+
+	if entry == nil {
+		entry = newStreamEntry()
+		entry.value = stream
+		kvstore.setKey(key, entry)
+	}
+	stream.add(id, fields, &kvstore.config)
+	stream.trim(trim)
+	kvstore.signalKeyAsReady(key)
+	return encodeBulkString([]byte(id.String()))
+}
+
+func (kvstore *KVStore) handleXLEN(messages [][]byte) []byte {
+	if len(messages) != 2 {
+		return wrongArgumentsError("xlen")
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedRead(string(messages[1]), streamType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return encodeInteger(0)
+	}
+	return encodeInteger(int64(entry.stream().Len()))
+}
+
+// handleXRANGE serves XRANGE and XREVRANGE, the latter takes end first
+func (kvstore *KVStore) handleXRANGE(messages [][]byte) []byte {
+	command := strings.ToLower(string(messages[0]))
+	if len(messages) < 4 {
+		return wrongArgumentsError(command)
+	}
+	reverse := command == "xrevrange"
+
+	startArgument, endArgument := messages[2], messages[3]
+	if reverse {
+		startArgument, endArgument = endArgument, startArgument
+	}
+	start, err := parseStreamInterval(startArgument, true)
+	if err != nil {
+		return encodeError(err)
+	}
+	end, err := parseStreamInterval(endArgument, false)
+	if err != nil {
+		return encodeError(err)
+	}
+
+	count := -1
+	if len(messages) > 4 {
+		if len(messages) != 6 || !strings.EqualFold(string(messages[4]), "COUNT") {
+			return encodeError(errSyntax)
+		}
+		parsed, err := parseInteger(messages[5])
+		if err != nil {
+			return encodeError(err)
+		}
+		if parsed < 0 {
+			parsed = 0
+		}
+		count = int(parsed)
+	}
+	if count == 0 {
+		return encodeArrayHeader(0)
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedRead(string(messages[1]), streamType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return encodeArrayHeader(0)
+	}
+	return encodeStreamEntries(entry.stream().rangeOf(start, end, reverse, count))
+}
+
+func (kvstore *KVStore) handleXDEL(messages [][]byte) []byte {
+	if len(messages) < 3 {
+		return wrongArgumentsError("xdel")
+	}
+	ids := make([]streamID, 0, len(messages)-2)
+	for _, argument := range messages[2:] {
+		id, err := parseStreamID(argument, 0, false)
+		if err != nil {
+			return encodeError(err)
+		}
+		ids = append(ids, id)
+	}
+
+	kvstore.lockKeys(string(messages[1]))
+	defer kvstore.unlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedWrite(string(messages[1]), streamType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return encodeInteger(0)
+	}
+	stream := entry.stream()
+	deleted := 0
+	for _, id := range ids {
+		if stream.delete(id) {
+			deleted++
+		}
+	}
+	return encodeInteger(int64(deleted))
+}
+
+func (kvstore *KVStore) handleXTRIM(messages [][]byte) []byte {
+	if len(messages) < 4 {
+		return wrongArgumentsError("xtrim")
+	}
+
+	var trim streamTrim
+	for position := 2; position < len(messages); {
+		taken, err := trim.parseArgument(messages, position)
+		if err != nil {
+			return encodeError(err)
+		}
+		if taken == 0 {
+			return encodeError(errSyntax)
+		}
+		position += taken
+	}
+	if trim.strategy == trimNone {
+		return encodeError(errSyntax)
+	}
+	if err := trim.validate(atomic.LoadInt64(&kvstore.config.streamNodeMaxEntries)); err != nil {
+		return encodeError(err)
+	}
+
+	kvstore.lockKeys(string(messages[1]))
+	defer kvstore.unlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedWrite(string(messages[1]), streamType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return encodeInteger(0)
+	}
+	return encodeInteger(int64(entry.stream().trim(trim)))
+}
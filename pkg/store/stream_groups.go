@@ -0,0 +1,1215 @@
+package store
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errBusyGroup        = errors.New("BUSYGROUP Consumer Group name already exists")
+	errXGroupKeyMissing = errors.New("ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+	errEntriesRead      = errors.New("ERR value for ENTRIESREAD must be positive or -1")
+	errInvalidMinIdle   = errors.New("ERR Invalid min-idle-time argument for XCLAIM")
+	errCountPositive    = errors.New("ERR COUNT must be > 0")
+	errDollarInGroup    = errors.New("ERR The $ ID is meaningless in the context of XREADGROUP: you want to read the history of this consumer by specifying a proper ID, or use the > ID to get new messages. The $ ID would just return an empty result set.")
+	errGreaterInXREAD   = errors.New("ERR The > ID can be specified only when calling XREADGROUP using the GROUP <group> <consumer> option.")
+	errMissingGroup     = errors.New("ERR Missing GROUP option for XREADGROUP")
+	errGroupInXREAD     = errors.New("ERR The GROUP option is only supported by XREADGROUP. You called XREAD instead.")
+)
+
+// invalidEntriesRead marks a group whose entries read counter is unknown,
+// lag is then estimated from the stream when possible
+const invalidEntriesRead = -1
+
+// streamNACK is a pending entry, delivered to a consumer and not yet
+// acknowledged. The same NACK is shared by the group and consumer PELs
+type streamNACK struct {
+	deliveryTime  int64
+	deliveryCount int64
+	consumer      *streamConsumer
+}
+
+type streamConsumer struct {
+	name string
+	// seenTime is the last interaction, activeTime the last successful
+	// read or claim, -1 if there never was one. Both unix ms
+	seenTime   int64
+	activeTime int64
+	pending    *radixTree
+}
+
+// streamGroup is a consumer group. pending is the group PEL, every NACK
+// in it is also in the PEL of the consumer it was last delivered to
+type streamGroup struct {
+	lastID      streamID
+	entriesRead int64
+	pending     *radixTree
+	consumers   map[string]*streamConsumer
+}
+
+func newStreamGroup(lastID streamID, entriesRead int64) *streamGroup {
+	return &streamGroup{
+		lastID:      lastID,
+		entriesRead: entriesRead,
+		pending:     newRadixTree(),
+		consumers:   make(map[string]*streamConsumer),
+	}
+}
+
+// noGroupError is the NOGROUP reply when either the key or the group is missing
+func noGroupError(key string, group string) error {
+	return errors.New("NOGROUP No such key '" + key + "' or consumer group '" + group + "'")
+}
+
+// missingGroupError is the NOGROUP reply of commands that name the group
+// on an existing key
+func missingGroupError(key string, group string) error {
+	return errors.New("NOGROUP No such consumer group '" + group + "' for key name '" + key + "'")
+}
+
+func readGroupError(key string, group string) error {
+	return errors.New("NOGROUP No such key '" + key + "' or consumer group '" + group + "' in XREADGROUP with GROUP option")
+}
+
+func (stream *streamValue) group(name string) *streamGroup {
+	return stream.groups[name]
+}
+
+// createGroup returns false if a group with the name already exists
+func (stream *streamValue) createGroup(name string, lastID streamID, entriesRead int64) bool {
+	if stream.groups == nil {
+		stream.groups = make(map[string]*streamGroup)
+	}
+	if _, exists := stream.groups[name]; exists {
+		return false
+	}
+	stream.groups[name] = newStreamGroup(lastID, entriesRead)
+	return true
+}
+
+func (stream *streamValue) groupNames() []string {
+	names := make([]string, 0, len(stream.groups))
+	for name := range stream.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// consumer returns the named consumer, creating it when asked to
+func (group *streamGroup) consumer(name string, now int64, create bool) (*streamConsumer, bool) {
+	consumer, ok := group.consumers[name]
+	if ok || !create {
+		return consumer, false
+	}
+	consumer = &streamConsumer{name: name, seenTime: now, activeTime: -1, pending: newRadixTree()}
+	group.consumers[name] = consumer
+	return consumer, true
+}
+
+func (group *streamGroup) consumerNames() []string {
+	names := make([]string, 0, len(group.consumers))
+	for name := range group.consumers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// deleteConsumer drops the consumer along with its pending entries,
+// returning how many there were
+func (group *streamGroup) deleteConsumer(name string) int {
+	consumer, ok := group.consumers[name]
+	if !ok {
+		return 0
+	}
+	pending := consumer.pending.Len()
+	consumer.pending.ascend(nil, func(key []byte, _ interface{}) bool {
+		group.pending.remove(key)
+		return true
+	})
+	delete(group.consumers, name)
+	return pending
+}
+
+func (group *streamGroup) acknowledge(id streamID) bool {
+	key := id.key()
+	value, ok := group.pending.find(key)
+	if !ok {
+		return false
+	}
+	group.pending.remove(key)
+	value.(*streamNACK).consumer.pending.remove(key)
+	return true
+}
+
+// transfer moves a NACK into the PEL of consumer
+func (group *streamGroup) transfer(key []byte, nack *streamNACK, consumer *streamConsumer) {
+	if nack.consumer == consumer {
+		return
+	}
+	if nack.consumer != nil {
+		nack.consumer.pending.remove(key)
+	}
+	nack.consumer = consumer
+	consumer.pending.insert(key, nack)
+}
+
+// pendingEntries collects NACKs from a PEL in id order between start and
+// end, count <= 0 means no limit
+func pendingEntries(pel *radixTree, start streamID, end streamID, count int, keep func(*streamNACK) bool) ([]streamID, []*streamNACK) {
+	var ids []streamID
+	var nacks []*streamNACK
+	if start.compare(end) > 0 {
+		return ids, nacks
+	}
+	pel.ascend(start.key(), func(key []byte, value interface{}) bool {
+		id := streamIDFromKey(key)
+		if id.compare(end) > 0 || (count > 0 && len(ids) >= count) {
+			return false
+		}
+		nack := value.(*streamNACK)
+		if keep == nil || keep(nack) {
+			ids = append(ids, id)
+			nacks = append(nacks, nack)
+		}
+		return true
+	})
+	return ids, nacks
+}
+
+// rangeHasTombstones reports whether an entry deleted with XDEL may sit
+// between start and end, which makes entries read counters unreliable
+func (stream *streamValue) rangeHasTombstones(start streamID, end streamID) bool {
+	if stream.length == 0 || stream.maxDeletedID == (streamID{}) {
+		return false
+	}
+	if first, _ := stream.firstID(); first.compare(stream.maxDeletedID) > 0 {
+		return false
+	}
+	return start.compare(stream.maxDeletedID) <= 0 && end.compare(stream.maxDeletedID) >= 0
+}
+
+// estimateEntriesRead works out how many entries were ever added up to
+// and including id, or invalidEntriesRead when deletions make it unknowable
+func (stream *streamValue) estimateEntriesRead(id streamID) int64 {
+	added := int64(stream.entriesAdded)
+	if added == 0 {
+		return 0
+	}
+	if stream.length == 0 && id.compare(stream.lastID) <= 0 {
+		return added
+	}
+	switch id.compare(stream.lastID) {
+	case 0:
+		return added
+	case 1:
+		return invalidEntriesRead
+	}
+	first, _ := stream.firstID()
+	if stream.maxDeletedID == (streamID{}) || stream.maxDeletedID.compare(first) < 0 {
+		switch id.compare(first) {
+		case -1:
+			return added - int64(stream.length)
+		case 0:
+			return added - int64(stream.length) + 1
+		}
+	}
+	return invalidEntriesRead
+}
+
+// lag is how many entries the group still has to read, ok is false when
+// it can't be worked out
+func (stream *streamValue) lag(group *streamGroup) (int64, bool) {
+	added := int64(stream.entriesAdded)
+	if added == 0 {
+		return 0, true
+	}
+	if group.entriesRead != invalidEntriesRead && !stream.rangeHasTombstones(group.lastID, maxStreamID) {
+		return added - group.entriesRead, true
+	}
+	entriesRead := stream.estimateEntriesRead(group.lastID)
+	if entriesRead == invalidEntriesRead {
+		return 0, false
+	}
+	return added - entriesRead, true
+}
+
+// readGroupNew delivers entries the group hasn't seen yet to consumer,
+// adding them to the PELs unless noAck is set
+func (stream *streamValue) readGroupNew(group *streamGroup, consumer *streamConsumer, count int, noAck bool, now int64) []streamEntry {
+	start, ok := group.lastID.increment()
+	if !ok {
+		return nil
+	}
+	entries := stream.rangeOf(start, maxStreamID, false, count)
+	for _, entry := range entries {
+		if group.entriesRead != invalidEntriesRead && !stream.rangeHasTombstones(entry.id, maxStreamID) {
+			group.entriesRead++
+		} else if stream.entriesAdded > 0 {
+			group.entriesRead = stream.estimateEntriesRead(entry.id)
+		}
+		group.lastID = entry.id
+		if noAck {
+			continue
+		}
+
+		key := entry.id.key()
+		// the entry can already be pending after XGROUP SETID moved back
+		if value, exists := group.pending.find(key); exists {
+			nack := value.(*streamNACK)
+			group.transfer(key, nack, consumer)
+			nack.deliveryTime, nack.deliveryCount = now, 1
+			continue
+		}
+		nack := &streamNACK{deliveryTime: now, deliveryCount: 1, consumer: consumer}
+		group.pending.insert(key, nack)
+		consumer.pending.insert(key, nack)
+	}
+	if len(entries) > 0 {
+		consumer.activeTime = now
+	}
+	return entries
+}
+
+// readGroupHistory returns entries already delivered to consumer after id,
+// entries deleted from the stream since come back without fields
+func (stream *streamValue) readGroupHistory(consumer *streamConsumer, after streamID, count int, now int64) []streamEntry {
+	entries := []streamEntry{}
+	start, ok := after.increment()
+	if !ok {
+		return entries
+	}
+	ids, nacks := pendingEntries(consumer.pending, start, maxStreamID, count, nil)
+	for i, id := range ids {
+		fields, _ := stream.lookup(id)
+		nacks[i].deliveryTime = now
+		nacks[i].deliveryCount++
+		entries = append(entries, streamEntry{id, fields})
+	}
+	return entries
+}
+
+func (kvstore *KVStore) handleXGROUP(messages [][]byte) []byte {
+	if len(messages) < 2 {
+		return wrongArgumentsError("xgroup")
+	}
+	subcommand := strings.ToUpper(string(messages[1]))
+	arity := map[string]int{"CREATE": 5, "SETID": 5, "DESTROY": 4, "CREATECONSUMER": 5, "DELCONSUMER": 5}
+	minimum, known := arity[subcommand]
+	if !known {
+		return encodeError(errors.New("ERR unknown subcommand '" + string(messages[1]) + "'. Try XGROUP HELP."))
+	}
+	if len(messages) < minimum || (subcommand != "CREATE" && subcommand != "SETID" && len(messages) != minimum) {
+		return wrongArgumentsError("xgroup|" + strings.ToLower(subcommand))
+	}
+
+	mkStream := false
+	entriesRead := int64(invalidEntriesRead)
+	for position := 5; position < len(messages); position++ {
+		switch option := strings.ToUpper(string(messages[position])); {
+		case option == "MKSTREAM" && subcommand == "CREATE":
+			mkStream = true
+		case option == "ENTRIESREAD" && position+1 < len(messages):
+			value, err := parseInteger(messages[position+1])
+			if err != nil {
+				return encodeError(err)
+			}
+			if value < 0 && value != invalidEntriesRead {
+				return encodeError(errEntriesRead)
+			}
+			entriesRead = value
+			position++
+		default:
+			return encodeError(errSyntax)
+		}
+	}
+
+	key := string(messages[2])
+	kvstore.lockKeys(key)
+	defer kvstore.unlockKeys(key)
+
+	groupName := string(messages[3])
+	entry, err := kvstore.lookupTypedWrite(key, streamType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		if !mkStream {
+			return encodeError(errXGroupKeyMissing)
+		}
+		entry = newStreamEntry()
+		kvstore.setKey(key, entry)
+	}
+	stream := entry.stream()
+	now := time.Now().UnixMilli()
+
+	// CREATE and SETID take the id the group continues after
+	parseGroupID := func() (streamID, error) {
+		if string(messages[4]) == "$" {
+			return stream.lastID, nil
+		}
+		return parseStreamID(messages[4], 0, false)
+	}
+
+	switch subcommand {
+	case "CREATE":
+		id, err := parseGroupID()
+		if err != nil {
+			return encodeError(err)
+		}
+		if !stream.createGroup(groupName, id, entriesRead) {
+			return encodeError(errBusyGroup)
+		}
+		return okReply
+	case "DESTROY":
+		if stream.group(groupName) == nil {
+			return encodeInteger(0)
+		}
+		delete(stream.groups, groupName)
+		// readers blocked on the group get told it is gone
+		kvstore.signalKeyAsReady(key)
+		return encodeInteger(1)
+	}
+
+	group := stream.group(groupName)
+	if group == nil {
+		return encodeError(missingGroupError(key, groupName))
+	}
+	switch subcommand {
+	case "SETID":
+		id, err := parseGroupID()
+		if err != nil {
+			return encodeError(err)
+		}
+		group.lastID, group.entriesRead = id, entriesRead
+		return okReply
+	case "CREATECONSUMER":
+		if _, created := group.consumer(string(messages[4]), now, true); created {
+			return encodeInteger(1)
+		}
+		return encodeInteger(0)
+	default:
+		return encodeInteger(int64(group.deleteConsumer(string(messages[4]))))
+	}
+}
+
+type streamReadKind int
+
+const (
+	// readAfter returns entries past the id, $ is resolved to one
+	readAfter streamReadKind = iota
+	// readNew is XREADGROUP's >, entries never delivered to the group
+	readNew
+	// readLastEntry is XREAD's +, the last entry of the stream
+	readLastEntry
+)
+
+type streamReadTarget struct {
+	kind streamReadKind
+	id   streamID
+	// dollar ids are resolved against the stream once the lock is held
+	dollar bool
+}
+
+// streamReadRequest holds the parsed arguments of XREAD and XREADGROUP
+type streamReadRequest struct {
+	grouped  bool
+	group    string
+	consumer string
+	count    int
+	block    bool
+	timeout  time.Duration
+	noAck    bool
+	keys     []string
+	targets  []streamReadTarget
+}
+
+func parseStreamRead(messages [][]byte, grouped bool) (*streamReadRequest, error) {
+	command := strings.ToLower(string(messages[0]))
+	request := &streamReadRequest{grouped: grouped}
+	groupGiven := false
+	position := 1
+	for ; position < len(messages); position++ {
+		option := strings.ToUpper(string(messages[position]))
+		remaining := len(messages) - position - 1
+		switch {
+		case option == "STREAMS":
+		case option == "COUNT" && remaining >= 1:
+			count, err := parseInteger(messages[position+1])
+			if err != nil {
+				return nil, err
+			}
+			if count < 0 {
+				count = 0
+			}
+			request.count = int(count)
+			position++
+			continue
+		case option == "BLOCK" && remaining >= 1:
+			timeout, err := parseTimeoutMilliseconds(messages[position+1])
+			if err != nil {
+				return nil, err
+			}
+			request.block, request.timeout = true, timeout
+			position++
+			continue
+		case option == "GROUP" && remaining >= 2:
+			if !grouped {
+				return nil, errGroupInXREAD
+			}
+			request.group, request.consumer = string(messages[position+1]), string(messages[position+2])
+			groupGiven = true
+			position += 2
+			continue
+		case option == "NOACK" && grouped:
+			request.noAck = true
+			continue
+		default:
+			return nil, errSyntax
+		}
+		break
+	}
+	if grouped && !groupGiven {
+		return nil, errMissingGroup
+	}
+
+	streams := messages[position+1:]
+	if position >= len(messages) || len(streams) == 0 || len(streams)%2 != 0 {
+		wildcard := "$"
+		if grouped {
+			wildcard = ">"
+		}
+		return nil, errors.New("ERR Unbalanced '" + command + "' list of streams: for each stream key an ID or '" + wildcard + "' must be specified.")
+	}
+	half := len(streams) / 2
+	for i := 0; i < half; i++ {
+		request.keys = append(request.keys, string(streams[i]))
+		var target streamReadTarget
+		switch value := string(streams[half+i]); {
+		case value == "$":
+			if grouped {
+				return nil, errDollarInGroup
+			}
+			target.dollar = true
+		case value == ">":
+			if !grouped {
+				return nil, errGreaterInXREAD
+			}
+			target.kind = readNew
+		case value == "+" && !grouped:
+			target.kind = readLastEntry
+		default:
+			id, err := parseStreamID(streams[half+i], 0, !grouped)
+			if err != nil {
+				return nil, err
+			}
+			target.id = id
+		}
+		request.targets = append(request.targets, target)
+	}
+	return request, nil
+}
+
+func encodeKeyAndEntries(key string, entries []streamEntry) []byte {
+	result := encodeArrayHeader(2)
+	result = append(result, encodeBulkString([]byte(key))...)
+	result = append(result, encodeStreamEntries(entries)...)
+	return result
+}
+
+// readStream reads one of the streams of the request, ok is false when
+// there is nothing to send for it. Caller must hold the write lock
+func (kvstore *KVStore) readStream(request *streamReadRequest, i int, now int64) ([]byte, bool, error) {
+	key, target := request.keys[i], request.targets[i]
+	entry, err := kvstore.lookupTypedWrite(key, streamType)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if !request.grouped {
+		if entry == nil {
+			return nil, false, nil
+		}
+		stream := entry.stream()
+		var entries []streamEntry
+		if target.kind == readLastEntry {
+			entries = stream.rangeOf(streamID{}, maxStreamID, true, 1)
+		} else if start, ok := target.id.increment(); ok {
+			entries = stream.rangeOf(start, maxStreamID, false, request.count)
+		}
+		if len(entries) == 0 {
+			return nil, false, nil
+		}
+		return encodeKeyAndEntries(key, entries), true, nil
+	}
+
+	if entry == nil || entry.stream().group(request.group) == nil {
+		return nil, false, readGroupError(key, request.group)
+	}
+	stream := entry.stream()
+	group := stream.group(request.group)
+	consumer, _ := group.consumer(request.consumer, now, true)
+	consumer.seenTime = now
+	if target.kind == readNew {
+		entries := stream.readGroupNew(group, consumer, request.count, request.noAck, now)
+		if len(entries) == 0 {
+			return nil, false, nil
+		}
+		return encodeKeyAndEntries(key, entries), true, nil
+	}
+	// history is always replied to, even when the consumer has nothing pending
+	return encodeKeyAndEntries(key, stream.readGroupHistory(consumer, target.id, request.count, now)), true, nil
+}
+
+// handleXREAD serves XREAD and XREADGROUP
+func (kvstore *KVStore) handleXREAD(messages [][]byte, client *Client) []byte {
+	command := strings.ToLower(string(messages[0]))
+	grouped := command == "xreadgroup"
+	if len(messages) < 4 {
+		return wrongArgumentsError(command)
+	}
+	request, err := parseStreamRead(messages, grouped)
+	if err != nil {
+		return encodeError(err)
+	}
+
+	kvstore.lockKeys(request.keys...)
+	now := time.Now().UnixMilli()
+	// validate every key up front so a missing group leaves no side effects
+	for i, key := range request.keys {
+		entry, err := kvstore.lookupTypedWrite(key, streamType)
+		if err != nil {
+			kvstore.unlockKeys(request.keys...)
+			return encodeError(err)
+		}
+		if grouped && (entry == nil || entry.stream().group(request.group) == nil) {
+			kvstore.unlockKeys(request.keys...)
+			return encodeError(readGroupError(key, request.group))
+		}
+		if request.targets[i].dollar && entry != nil {
+			request.targets[i].id = entry.stream().lastID
+		}
+	}
+
+	var replies [][]byte
+	for i := range request.keys {
+		reply, ok, err := kvstore.readStream(request, i, now)
+		if err != nil {
+			kvstore.unlockKeys(request.keys...)
+			return encodeError(err)
+		}
+		if ok {
+			replies = append(replies, reply)
+		}
+	}
+	if len(replies) > 0 || !request.block {
+		kvstore.unlockKeys(request.keys...)
+		if len(replies) == 0 {
+			return nullArrayReply
+		}
+		return encodeRawArray(replies)
+	}
+
+	// once blocked + waits for the next entry just like $
+	for i, target := range request.targets {
+		if target.kind == readLastEntry {
+			request.targets[i].kind = readAfter
+			if entry := kvstore.lookupKeyWrite(request.keys[i]); entry != nil {
+				request.targets[i].id = entry.stream().lastID
+			}
+		}
+	}
+	blocked := kvstore.blockForKeys(request.keys, nil, func(key string) ([]byte, bool) {
+		for i := range request.keys {
+			if request.keys[i] != key {
+				continue
+			}
+			entry := kvstore.lookupKeyWrite(key)
+			if !grouped && (entry == nil || entry.objectType != streamType) {
+				return nil, false
+			}
+			reply, ok, err := kvstore.readStream(request, i, time.Now().UnixMilli())
+			if err != nil {
+				return encodeError(err), true
+			}
+			if ok {
+				return encodeRawArray([][]byte{reply}), true
+			}
+			return nil, false
+		}
+		return nil, false
+	})
+	kvstore.unlockKeys(request.keys...)
+
+	return kvstore.waitUntilServed(blocked, client, request.timeout, nullArrayReply)
+}
+
+func (kvstore *KVStore) handleXACK(messages [][]byte) []byte {
+	if len(messages) < 4 {
+		return wrongArgumentsError("xack")
+	}
+	ids := make([]streamID, 0, len(messages)-3)
+	for _, argument := range messages[3:] {
+		id, err := parseStreamID(argument, 0, false)
+		if err != nil {
+			return encodeError(err)
+		}
+		ids = append(ids, id)
+	}
+
+	kvstore.lockKeys(string(messages[1]))
+	defer kvstore.unlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedWrite(string(messages[1]), streamType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return encodeInteger(0)
+	}
+	group := entry.stream().group(string(messages[2]))
+	if group == nil {
+		return encodeInteger(0)
+	}
+	acknowledged := 0
+	for _, id := range ids {
+		if group.acknowledge(id) {
+			acknowledged++
+		}
+	}
+	return encodeInteger(int64(acknowledged))
+}
+
+func (kvstore *KVStore) handleXPENDING(messages [][]byte) []byte {
+	if len(messages) < 3 {
+		return wrongArgumentsError("xpending")
+	}
+
+	extended := len(messages) > 3
+	var minIdle int64
+	var start, end streamID
+	count := 0
+	consumerName := ""
+	if extended {
+		position := 3
+		if strings.EqualFold(string(messages[position]), "IDLE") && len(messages) > position+1 {
+			idle, err := parseInteger(messages[position+1])
+			if err != nil {
+				return encodeError(err)
+			}
+			minIdle = idle
+			position += 2
+		}
+		remaining := len(messages) - position
+		if remaining != 3 && remaining != 4 {
+			return encodeError(errSyntax)
+		}
+		var err error
+		if start, err = parseStreamInterval(messages[position], true); err != nil {
+			return encodeError(err)
+		}
+		if end, err = parseStreamInterval(messages[position+1], false); err != nil {
+			return encodeError(err)
+		}
+		parsed, err := parseInteger(messages[position+2])
+		if err != nil {
+			return encodeError(err)
+		}
+		if parsed < 0 {
+			parsed = 0
+		}
+		count = int(parsed)
+		if remaining == 4 {
+			consumerName = string(messages[position+3])
+		}
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	key, groupName := string(messages[1]), string(messages[2])
+	entry, err := kvstore.lookupTypedRead(key, streamType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil || entry.stream().group(groupName) == nil {
+		return encodeError(noGroupError(key, groupName))
+	}
+	group := entry.stream().group(groupName)
+
+	if !extended {
+		if group.pending.Len() == 0 {
+			return encodeRawArray([][]byte{encodeInteger(0), nullBulkReply, nullBulkReply, nullArrayReply})
+		}
+		first, _, _ := group.pending.first()
+		last, _, _ := group.pending.last()
+		var consumers [][]byte
+		for _, name := range group.consumerNames() {
+			if pending := group.consumers[name].pending.Len(); pending > 0 {
+				consumers = append(consumers, encodeArray([][]byte{[]byte(name), []byte(strconv.Itoa(pending))}))
+			}
+		}
+		return encodeRawArray([][]byte{
+			encodeInteger(int64(group.pending.Len())),
+			encodeBulkString([]byte(streamIDFromKey(first).String())),
+			encodeBulkString([]byte(streamIDFromKey(last).String())),
+			encodeRawArray(consumers),
+		})
+	}
+
+	pel := group.pending
+	if consumerName != "" {
+		consumer, ok := group.consumers[consumerName]
+		if !ok {
+			return encodeArrayHeader(0)
+		}
+		pel = consumer.pending
+	}
+	if count == 0 {
+		return encodeArrayHeader(0)
+	}
+	now := time.Now().UnixMilli()
+	ids, nacks := pendingEntries(pel, start, end, count, func(nack *streamNACK) bool {
+		return now-nack.deliveryTime >= minIdle
+	})
+	replies := make([][]byte, 0, len(ids))
+	for i, id := range ids {
+		replies = append(replies, encodeRawArray([][]byte{
+			encodeBulkString([]byte(id.String())),
+			encodeBulkString([]byte(nacks[i].consumer.name)),
+			encodeInteger(now - nacks[i].deliveryTime),
+			encodeInteger(nacks[i].deliveryCount),
+		}))
+	}
+	return encodeRawArray(replies)
+}
+
+// lookupGroupWrite resolves the key and group of the claiming commands.
+// Caller must hold the write lock
+func (kvstore *KVStore) lookupGroupWrite(key string, groupName string) (*streamValue, *streamGroup, error) {
+	entry, err := kvstore.lookupTypedWrite(key, streamType)
+	if err != nil {
+		return nil, nil, err
+	}
+	if entry == nil || entry.stream().group(groupName) == nil {
+		return nil, nil, noGroupError(key, groupName)
+	}
+	return entry.stream(), entry.stream().group(groupName), nil
+}
+
+func parseMinIdle(value []byte) (int64, error) {
+	minIdle, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		return 0, errInvalidMinIdle
+	}
+	if minIdle < 0 {
+		minIdle = 0
+	}
+	return minIdle, nil
+}
+
+func (kvstore *KVStore) handleXCLAIM(messages [][]byte) []byte {
+	if len(messages) < 6 {
+		return wrongArgumentsError("xclaim")
+	}
+	minIdle, err := parseMinIdle(messages[4])
+	if err != nil {
+		return encodeError(err)
+	}
+
+	// ids run until the first argument that isn't one, options follow
+	position := 5
+	var ids []streamID
+	for ; position < len(messages); position++ {
+		id, err := parseStreamID(messages[position], 0, false)
+		if err != nil {
+			break
+		}
+		ids = append(ids, id)
+	}
+
+	now := time.Now().UnixMilli()
+	deliveryTime := int64(-1)
+	retryCount := int64(-1)
+	force, justID := false, false
+	var lastID streamID
+	lastIDGiven := false
+	for ; position < len(messages); position++ {
+		option := strings.ToUpper(string(messages[position]))
+		hasValue := position+1 < len(messages)
+		switch {
+		case option == "FORCE":
+			force = true
+		case option == "JUSTID":
+			justID = true
+		case option == "IDLE" && hasValue:
+			idle, err := strconv.ParseInt(string(messages[position+1]), 10, 64)
+			if err != nil {
+				return encodeError(errors.New("ERR Invalid IDLE option argument for XCLAIM"))
+			}
+			deliveryTime = now - idle
+			position++
+		case option == "TIME" && hasValue:
+			at, err := strconv.ParseInt(string(messages[position+1]), 10, 64)
+			if err != nil {
+				return encodeError(errors.New("ERR Invalid TIME option argument for XCLAIM"))
+			}
+			deliveryTime = at
+			position++
+		case option == "RETRYCOUNT" && hasValue:
+			retries, err := strconv.ParseInt(string(messages[position+1]), 10, 64)
+			if err != nil {
+				return encodeError(errors.New("ERR Invalid RETRYCOUNT option argument for XCLAIM"))
+			}
+			retryCount = retries
+			position++
+		case option == "LASTID" && hasValue:
+			id, err := parseStreamID(messages[position+1], 0, false)
+			if err != nil {
+				return encodeError(err)
+			}
+			lastID, lastIDGiven = id, true
+			position++
+		default:
+			return encodeError(errors.New("ERR Unrecognized XCLAIM option '" + string(messages[position]) + "'"))
+		}
+	}
+	if deliveryTime < 0 || deliveryTime > now {
+		deliveryTime = now
+	}
+
+	kvstore.lockKeys(string(messages[1]))
+	defer kvstore.unlockKeys(string(messages[1]))
+
+	stream, group, err := kvstore.lookupGroupWrite(string(messages[1]), string(messages[2]))
+	if err != nil {
+		return encodeError(err)
+	}
+	if lastIDGiven && lastID.compare(group.lastID) > 0 {
+		group.lastID = lastID
+	}
+	consumer, _ := group.consumer(string(messages[3]), now, true)
+	consumer.seenTime = now
+
+	var replies [][]byte
+	for _, id := range ids {
+		key := id.key()
+		var nack *streamNACK
+		if value, ok := group.pending.find(key); ok {
+			nack = value.(*streamNACK)
+		} else if force {
+			if _, exists := stream.lookup(id); !exists {
+				continue
+			}
+			nack = &streamNACK{}
+			group.pending.insert(key, nack)
+		} else {
+			continue
+		}
+
+		fields, exists := stream.lookup(id)
+		if nack.consumer != nil {
+			// entries deleted from the stream since can't be claimed anymore
+			if !exists {
+				group.acknowledge(id)
+				continue
+			}
+			if minIdle > 0 && now-nack.deliveryTime < minIdle {
+				continue
+			}
+		}
+		group.transfer(key, nack, consumer)
+		nack.deliveryTime = deliveryTime
+		if retryCount >= 0 {
+			nack.deliveryCount = retryCount
+		} else if !justID {
+			nack.deliveryCount++
+		}
+		consumer.activeTime = now
+
+		if justID {
+			replies = append(replies, encodeBulkString([]byte(id.String())))
+		} else {
+			replies = append(replies, encodeStreamEntry(streamEntry{id, fields}))
+		}
+	}
+	return encodeRawArray(replies)
+}
+
+func (kvstore *KVStore) handleXAUTOCLAIM(messages [][]byte) []byte {
+	if len(messages) < 6 {
+		return wrongArgumentsError("xautoclaim")
+	}
+	minIdle, err := parseMinIdle(messages[4])
+	if err != nil {
+		return encodeError(err)
+	}
+	start, err := parseStreamInterval(messages[5], true)
+	if err != nil {
+		return encodeError(err)
+	}
+
+	count := int64(100)
+	justID := false
+	for position := 6; position < len(messages); position++ {
+		switch option := strings.ToUpper(string(messages[position])); {
+		case option == "JUSTID":
+			justID = true
+		case option == "COUNT" && position+1 < len(messages):
+			count, err = parseInteger(messages[position+1])
+			if err != nil {
+				return encodeError(err)
+			}
+			// attempts are count * 10, keep that from overflowing
+			if count < 1 || count > math.MaxInt64/10 {
+				return encodeError(errCountPositive)
+			}
+			position++
+		default:
+			return encodeError(errSyntax)
+		}
+	}
+
+	kvstore.lockKeys(string(messages[1]))
+	defer kvstore.unlockKeys(string(messages[1]))
+
+	stream, group, err := kvstore.lookupGroupWrite(string(messages[1]), string(messages[2]))
+	if err != nil {
+		return encodeError(err)
+	}
+	now := time.Now().UnixMilli()
+	consumer, _ := group.consumer(string(messages[3]), now, true)
+	consumer.seenTime = now
+
+	// the PEL changes as entries are claimed so collect the candidates
+	// first, one extra to find where the next call should start
+	attempts := int(count * 10)
+	ids, nacks := pendingEntries(group.pending, start, maxStreamID, attempts+1, nil)
+
+	var claimed, deleted [][]byte
+	next := streamID{}
+	i := 0
+	for ; i < len(ids) && i < attempts && count > 0; i++ {
+		id, nack := ids[i], nacks[i]
+		fields, exists := stream.lookup(id)
+		if !exists {
+			group.acknowledge(id)
+			deleted = append(deleted, encodeBulkString([]byte(id.String())))
+			continue
+		}
+		if minIdle > 0 && now-nack.deliveryTime < minIdle {
+			continue
+		}
+		group.transfer(id.key(), nack, consumer)
+		nack.deliveryTime = now
+		if !justID {
+			nack.deliveryCount++
+		}
+		consumer.activeTime = now
+		count--
+
+		if justID {
+			claimed = append(claimed, encodeBulkString([]byte(id.String())))
+		} else {
+			claimed = append(claimed, encodeStreamEntry(streamEntry{id, fields}))
+		}
+	}
+	if i < len(ids) {
+		next = ids[i]
+	}
+
+	return encodeRawArray([][]byte{
+		encodeBulkString([]byte(next.String())),
+		encodeRawArray(claimed),
+		encodeRawArray(deleted),
+	})
+}
+
+func encodeOptionalInteger(value int64, ok bool) []byte {
+	if !ok {
+		return nullBulkReply
+	}
+	return encodeInteger(value)
+}
+
+func encodeStreamID(id streamID) []byte {
+	return encodeBulkString([]byte(id.String()))
+}
+
+func encodeField(name string) []byte {
+	return encodeBulkString([]byte(name))
+}
+
+func (kvstore *KVStore) handleXINFO(messages [][]byte) []byte {
+	if len(messages) < 2 {
+		return wrongArgumentsError("xinfo")
+	}
+	subcommand := strings.ToUpper(string(messages[1]))
+	switch {
+	case subcommand == "STREAM" && len(messages) >= 3:
+	case subcommand == "GROUPS" && len(messages) == 3:
+	case subcommand == "CONSUMERS" && len(messages) == 4:
+	case subcommand == "STREAM" || subcommand == "GROUPS" || subcommand == "CONSUMERS":
+		return wrongArgumentsError("xinfo|" + strings.ToLower(subcommand))
+	default:
+		return encodeError(errors.New("ERR unknown subcommand '" + string(messages[1]) + "'. Try XINFO HELP."))
+	}
+
+	full := false
+	count := 10
+	if subcommand == "STREAM" && len(messages) > 3 {
+		if !strings.EqualFold(string(messages[3]), "FULL") {
+			return encodeError(errSyntax)
+		}
+		full = true
+		if len(messages) > 4 {
+			if len(messages) != 6 || !strings.EqualFold(string(messages[4]), "COUNT") {
+				return encodeError(errSyntax)
+			}
+			parsed, err := parseInteger(messages[5])
+			if err != nil {
+				return encodeError(err)
+			}
+			if parsed < 0 {
+				parsed = 0
+			}
+			count = int(parsed)
+		}
+	}
+
+	key := string(messages[2])
+	kvstore.rlockKeys(key)
+	defer kvstore.runlockKeys(key)
+
+	entry, err := kvstore.lookupTypedRead(key, streamType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return encodeError(errNoSuchKey)
+	}
+	stream := entry.stream()
+	now := time.Now().UnixMilli()
+
+	switch subcommand {
+	case "GROUPS":
+		var groups [][]byte
+		for _, name := range stream.groupNames() {
+			group := stream.groups[name]
+			lag, lagOK := stream.lag(group)
+			groups = append(groups, encodeRawArray([][]byte{
+				encodeField("name"), encodeField(name),
+				encodeField("consumers"), encodeInteger(int64(len(group.consumers))),
+				encodeField("pending"), encodeInteger(int64(group.pending.Len())),
+				encodeField("last-delivered-id"), encodeStreamID(group.lastID),
+				encodeField("entries-read"), encodeOptionalInteger(group.entriesRead, group.entriesRead != invalidEntriesRead),
+				encodeField("lag"), encodeOptionalInteger(lag, lagOK),
+			}))
+		}
+		return encodeRawArray(groups)
+	case "CONSUMERS":
+		groupName := string(messages[3])
+		group := stream.group(groupName)
+		if group == nil {
+			return encodeError(missingGroupError(key, groupName))
+		}
+		var consumers [][]byte
+		for _, name := range group.consumerNames() {
+			consumer := group.consumers[name]
+			inactive := int64(-1)
+			if consumer.activeTime != -1 {
+				inactive = now - consumer.activeTime
+			}
+			consumers = append(consumers, encodeRawArray([][]byte{
+				encodeField("name"), encodeField(name),
+				encodeField("pending"), encodeInteger(int64(consumer.pending.Len())),
+				encodeField("idle"), encodeInteger(now - consumer.seenTime),
+				encodeField("inactive"), encodeInteger(inactive),
+			}))
+		}
+		return encodeRawArray(consumers)
+	}
+
+	firstID, _ := stream.firstID()
+	replies := [][]byte{
+		encodeField("length"), encodeInteger(int64(stream.Len())),
+		encodeField("radix-tree-keys"), encodeInteger(int64(stream.blocks.Len())),
+		encodeField("radix-tree-nodes"), encodeInteger(int64(stream.blocks.nodeCount())),
+		encodeField("last-generated-id"), encodeStreamID(stream.lastID),
+		encodeField("max-deleted-entry-id"), encodeStreamID(stream.maxDeletedID),
+		encodeField("entries-added"), encodeInteger(int64(stream.entriesAdded)),
+		encodeField("recorded-first-entry-id"), encodeStreamID(firstID),
+	}
+
+	if !full {
+		edge := func(reverse bool) []byte {
+			entries := stream.rangeOf(streamID{}, maxStreamID, reverse, 1)
+			if len(entries) == 0 {
+				return nullBulkReply
+			}
+			return encodeStreamEntry(entries[0])
+		}
+		replies = append(replies,
+			encodeField("groups"), encodeInteger(int64(len(stream.groups))),
+			encodeField("first-entry"), edge(false),
+			encodeField("last-entry"), edge(true),
+		)
+		return encodeRawArray(replies)
+	}
+
+	replies = append(replies, encodeField("entries"), encodeStreamEntries(stream.rangeOf(streamID{}, maxStreamID, false, count)))
+	var groups [][]byte
+	for _, name := range stream.groupNames() {
+		group := stream.groups[name]
+		lag, lagOK := stream.lag(group)
+
+		var pending [][]byte
+		ids, nacks := pendingEntries(group.pending, streamID{}, maxStreamID, count, nil)
+		for i, id := range ids {
+			pending = append(pending, encodeRawArray([][]byte{
+				encodeStreamID(id),
+				encodeField(nacks[i].consumer.name),
+				encodeInteger(nacks[i].deliveryTime),
+				encodeInteger(nacks[i].deliveryCount),
+			}))
+		}
+
+		var consumers [][]byte
+		for _, consumerName := range group.consumerNames() {
+			consumer := group.consumers[consumerName]
+			var consumerPending [][]byte
+			ids, nacks := pendingEntries(consumer.pending, streamID{}, maxStreamID, count, nil)
+			for i, id := range ids {
+				consumerPending = append(consumerPending, encodeRawArray([][]byte{
+					encodeStreamID(id),
+					encodeInteger(nacks[i].deliveryTime),
+					encodeInteger(nacks[i].deliveryCount),
+				}))
+			}
+			consumers = append(consumers, encodeRawArray([][]byte{
+				encodeField("name"), encodeField(consumerName),
+				encodeField("seen-time"), encodeInteger(consumer.seenTime),
+				encodeField("active-time"), encodeInteger(consumer.activeTime),
+				encodeField("pel-count"), encodeInteger(int64(consumer.pending.Len())),
+				encodeField("pending"), encodeRawArray(consumerPending),
+			}))
+		}
+
+		groups = append(groups, encodeRawArray([][]byte{
+			encodeField("name"), encodeField(name),
+			encodeField("last-delivered-id"), encodeStreamID(group.lastID),
+			encodeField("entries-read"), encodeOptionalInteger(group.entriesRead, group.entriesRead != invalidEntriesRead),
+			encodeField("lag"), encodeOptionalInteger(lag, lagOK),
+			encodeField("pel-count"), encodeInteger(int64(group.pending.Len())),
+			encodeField("pending"), encodeRawArray(pending),
+			encodeField("consumers"), encodeRawArray(consumers),
+		}))
+	}
+	replies = append(replies, encodeField("groups"), encodeRawArray(groups))
+	return encodeRawArray(replies)
+}
@@ -0,0 +1,112 @@
+package store
+
+import (
+	"strings"
+	"testing"
+)
+
+func pendingIDs(pel *radixTree) string {
+	ids, _ := pendingEntries(pel, streamID{}, maxStreamID, 0, nil)
+	var result []string
+	for _, id := range ids {
+		result = append(result, id.String())
+	}
+	return strings.Join(result, " ")
+}
+
+// TestGroupPELs checks NACKs are shared between the group and consumer
+// PELs as entries are delivered, claimed and acknowledged
+func TestGroupPELs(t *testing.T) {
+	stream := newTestStream(t, 5)
+	stream.createGroup("g", streamID{}, 0)
+	group := stream.group("g")
+	alice, _ := group.consumer("alice", 0, true)
+	bob, _ := group.consumer("bob", 0, true)
+
+	stream.readGroupNew(group, alice, 3, false, 100)
+	stream.readGroupNew(group, bob, 0, false, 100)
+	if pendingIDs(group.pending) != "1-0 2-0 3-0 4-0 5-0" || pendingIDs(alice.pending) != "1-0 2-0 3-0" || pendingIDs(bob.pending) != "4-0 5-0" {
+		t.Fatalf("unexpected PELs group %q alice %q bob %q", pendingIDs(group.pending), pendingIDs(alice.pending), pendingIDs(bob.pending))
+	}
+	if group.entriesRead != 5 || group.lastID != (streamID{5, 0}) {
+		t.Errorf("expected 5 entries read up to 5-0, got %d up to %v", group.entriesRead, group.lastID)
+	}
+
+	history := stream.readGroupHistory(alice, streamID{1, 0}, 0, 200)
+	if len(history) != 2 || history[0].id != (streamID{2, 0}) {
+		t.Errorf("history after 1-0 expected 2-0 and 3-0, got %v", history)
+	}
+	if value, _ := group.pending.find(streamID{2, 0}.key()); value.(*streamNACK).deliveryCount != 2 {
+		t.Errorf("reading history should count as a delivery")
+	}
+
+	value, _ := group.pending.find(streamID{2, 0}.key())
+	group.transfer(streamID{2, 0}.key(), value.(*streamNACK), bob)
+	if pendingIDs(alice.pending) != "1-0 3-0" || pendingIDs(bob.pending) != "2-0 4-0 5-0" {
+		t.Errorf("transfer left alice %q bob %q", pendingIDs(alice.pending), pendingIDs(bob.pending))
+	}
+
+	if !group.acknowledge(streamID{4, 0}) || group.acknowledge(streamID{4, 0}) {
+		t.Errorf("an entry can only be acknowledged once")
+	}
+	if removed := group.deleteConsumer("bob"); removed != 2 {
+		t.Errorf("expected bob to take 2 pending entries with him, got %d", removed)
+	}
+	if pendingIDs(group.pending) != "1-0 3-0" {
+		t.Errorf("group PEL expected 1-0 3-0, got %q", pendingIDs(group.pending))
+	}
+}
+
+func TestGroupLag(t *testing.T) {
+	stream := newTestStream(t, 10)
+	stream.createGroup("g", streamID{}, invalidEntriesRead)
+	group := stream.group("g")
+	if lag, ok := stream.lag(group); !ok || lag != 10 {
+		t.Errorf("a new group at 0-0 expected lag 10, got %d %v", lag, ok)
+	}
+
+	consumer, _ := group.consumer("c", 0, true)
+	stream.readGroupNew(group, consumer, 4, true, 0)
+	if lag, ok := stream.lag(group); !ok || lag != 6 || group.entriesRead != 4 {
+		t.Errorf("after reading 4 expected lag 6, got %d %v read %d", lag, ok, group.entriesRead)
+	}
+
+	// a deletion ahead of the group makes the counter unreliable
+	stream.delete(streamID{8, 0})
+	if _, ok := stream.lag(group); ok {
+		t.Errorf("lag should be unknown with a tombstone ahead of the group")
+	}
+	stream.readGroupNew(group, consumer, 0, true, 0)
+	if lag, ok := stream.lag(group); !ok || lag != 0 {
+		t.Errorf("a group at the last id has no lag, got %d %v", lag, ok)
+	}
+}
+
+func TestBlockedXREADGROUPServedByXADD(t *testing.T) {
+	kvstore := newKVStore()
+	kvstore.handleXGROUP(command("XGROUP", "CREATE", "events", "g", "$", "MKSTREAM"))
+
+	reply := make(chan string, 1)
+	go func() {
+		reply <- string(kvstore.handleXREAD(command("XREADGROUP", "GROUP", "g", "worker", "BLOCK", "0", "STREAMS", "events", ">"), newTestClient()))
+	}()
+	waitForBlocked(t, kvstore, "events", 1)
+
+	kvstore.handleXADD(command("XADD", "events", "1-1", "type", "signup"))
+	expected := "*1\r\n*2\r\n$6\r\nevents\r\n*1\r\n*2\r\n$3\r\n1-1\r\n" + string(encodeArray(command("type", "signup")))
+	if got := <-reply; got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+	if got := string(kvstore.handleXPENDING(command("XPENDING", "events", "g"))); !strings.Contains(got, "worker") {
+		t.Errorf("the served entry should be pending for worker, got %q", got)
+	}
+
+	go func() {
+		reply <- string(kvstore.handleXREAD(command("XREADGROUP", "GROUP", "g", "worker", "BLOCK", "0", "STREAMS", "events", ">"), newTestClient()))
+	}()
+	waitForBlocked(t, kvstore, "events", 1)
+	kvstore.handleXGROUP(command("XGROUP", "DESTROY", "events", "g"))
+	if got := <-reply; !strings.HasPrefix(got, "-NOGROUP") {
+		t.Errorf("destroying the group should unblock with NOGROUP, got %q", got)
+	}
+}
@@ -0,0 +1,131 @@
+package store
+
+import (
+	"fmt"
+	"testing"
+)
+
+func newTestStream(t *testing.T, count int) *streamValue {
+	t.Helper()
+	config := defaultConfig()
+	config.streamNodeMaxEntries = 10
+
+	stream := newStreamValue()
+	for i := 1; i <= count; i++ {
+		id, err := stream.explicitID(streamID{ms: uint64(i)}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream.add(id, [][]byte{[]byte("n"), []byte(fmt.Sprint(i))}, &config)
+	}
+	return stream
+}
+
+func ids(entries []streamEntry) []uint64 {
+	var result []uint64
+	for _, entry := range entries {
+		result = append(result, entry.id.ms)
+	}
+	return result
+}
+
+func TestStreamIDs(t *testing.T) {
+	config := defaultConfig()
+	stream := newStreamValue()
+	if _, err := stream.explicitID(streamID{}, false); err != errStreamIDZero {
+		t.Errorf("0-0 expected %v, got %v", errStreamIDZero, err)
+	}
+	if id, _ := stream.explicitID(streamID{}, true); id != (streamID{0, 1}) {
+		t.Errorf("0-* on an empty stream expected 0-1, got %v", id)
+	}
+
+	stream.add(streamID{5, 3}, [][]byte{[]byte("a"), []byte("1")}, &config)
+	if _, err := stream.explicitID(streamID{5, 3}, false); err != errStreamIDTooSmall {
+		t.Errorf("repeating the top id expected %v, got %v", errStreamIDTooSmall, err)
+	}
+	if id, _ := stream.explicitID(streamID{ms: 5}, true); id != (streamID{5, 4}) {
+		t.Errorf("5-* expected 5-4, got %v", id)
+	}
+	// a clock behind the last id keeps counting from it
+	if id, _ := stream.nextID(4); id != (streamID{5, 4}) {
+		t.Errorf("auto id behind the clock expected 5-4, got %v", id)
+	}
+	if id, _ := stream.nextID(9); id != (streamID{9, 0}) {
+		t.Errorf("auto id expected 9-0, got %v", id)
+	}
+}
+
+func TestStreamRangeAcrossBlocks(t *testing.T) {
+	stream := newTestStream(t, 35)
+	if stream.blocks.Len() != 4 {
+		t.Fatalf("expected 4 blocks, got %d", stream.blocks.Len())
+	}
+
+	got := ids(stream.rangeOf(streamID{ms: 8}, streamID{12, maxStreamID.seq}, false, 0))
+	if fmt.Sprint(got) != "[8 9 10 11 12]" {
+		t.Errorf("forward range got %v", got)
+	}
+	got = ids(stream.rangeOf(streamID{ms: 8}, streamID{ms: 25}, true, 3))
+	if fmt.Sprint(got) != "[25 24 23]" {
+		t.Errorf("reverse range got %v", got)
+	}
+
+	entry := stream.rangeOf(streamID{ms: 3}, streamID{ms: 3}, false, 0)
+	if len(entry) != 1 || string(entry[0].fields[0]) != "n" || string(entry[0].fields[1]) != "3" {
+		t.Errorf("entry fields not rebuilt from the master fields: %v", entry)
+	}
+}
+
+func TestStreamDelete(t *testing.T) {
+	stream := newTestStream(t, 20)
+	for i := 1; i <= 10; i++ {
+		if !stream.delete(streamID{ms: uint64(i)}) {
+			t.Fatalf("delete %d failed", i)
+		}
+	}
+	if stream.delete(streamID{ms: 1}) {
+		t.Errorf("deleting twice should report nothing deleted")
+	}
+	if stream.Len() != 10 || stream.blocks.Len() != 1 {
+		t.Errorf("expected 10 entries in 1 block, got %d in %d", stream.Len(), stream.blocks.Len())
+	}
+	if first, _ := stream.firstID(); first.ms != 11 {
+		t.Errorf("expected first id 11, got %v", first)
+	}
+	if stream.maxDeletedID.ms != 10 {
+		t.Errorf("expected max deleted id 10, got %v", stream.maxDeletedID)
+	}
+}
+
+func TestStreamTrim(t *testing.T) {
+	cases := []struct {
+		name     string
+		trim     streamTrim
+		removed  int
+		firstID  uint64
+		expected int
+	}{
+		{"exact maxlen", streamTrim{strategy: trimMaxLen, maxLen: 13}, 22, 23, 13},
+		{"approximate maxlen keeps whole blocks", streamTrim{strategy: trimMaxLen, maxLen: 13, approximate: true}, 20, 21, 15},
+		{"exact minid", streamTrim{strategy: trimMinID, minID: streamID{ms: 17}}, 16, 17, 19},
+		{"approximate minid", streamTrim{strategy: trimMinID, minID: streamID{ms: 17}, approximate: true}, 10, 11, 25},
+		{"limit stops before a block", streamTrim{strategy: trimMaxLen, maxLen: 0, approximate: true, limit: 25}, 20, 21, 15},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			stream := newTestStream(t, 35)
+			if removed := stream.trim(tc.trim); removed != tc.removed {
+				t.Errorf("expected %d removed, got %d", tc.removed, removed)
+			}
+			if stream.Len() != tc.expected {
+				t.Errorf("expected length %d, got %d", tc.expected, stream.Len())
+			}
+			if first, _ := stream.firstID(); first.ms != tc.firstID {
+				t.Errorf("expected first id %d, got %v", tc.firstID, first)
+			}
+			if got := len(stream.rangeOf(streamID{}, maxStreamID, false, 0)); got != tc.expected {
+				t.Errorf("range sees %d entries, expected %d", got, tc.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,862 @@
+package store
+
+import (
+	"errors"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errTSKeyExists       = errors.New("ERR TSDB: key already exists")
+	errTSNoKey           = errors.New("ERR TSDB: the key does not exist")
+	errTSTimestamp       = errors.New("ERR TSDB: invalid timestamp")
+	errTSValue           = errors.New("ERR TSDB: invalid value")
+	errTSRetention       = errors.New("ERR TSDB: Couldn't parse RETENTION")
+	errTSCount           = errors.New("ERR TSDB: Couldn't parse COUNT")
+	errTSAlign           = errors.New("ERR TSDB: unknown ALIGN parameter")
+	errTSAlignNeedsAgg   = errors.New("ERR TSDB: ALIGN parameter can only be used with AGGREGATION")
+	errTSLabels          = errors.New("ERR TSDB: failed parsing labels")
+	errTSPolicy          = errors.New("ERR TSDB: Unknown DUPLICATE_POLICY")
+	errTSAggregation     = errors.New("ERR TSDB: Unknown aggregation type")
+	errTSBucketDuration  = errors.New("ERR TSDB: bucketDuration must be greater than zero")
+	errTSOldSample       = errors.New("ERR TSDB: Timestamp is older than retention")
+	errTSBlocked         = errors.New("ERR TSDB: Error at upsert, update is not supported when DUPLICATE_POLICY is set to BLOCK mode")
+	errTSSameKey         = errors.New("ERR TSDB: the source key and destination key should be different")
+	errTSSourceIsRule    = errors.New("ERR TSDB: the source key already has a source rule")
+	errTSHasSource       = errors.New("ERR TSDB: the destination key already has a src rule")
+	errTSDestinationRule = errors.New("ERR TSDB: the destination key already has a dst rule")
+	errTSNoRule          = errors.New("ERR TSDB: compaction rule does not exist")
+	errTSNoMatcher       = errors.New("ERR TSDB: please provide at least one matcher")
+	errTSFilter          = errors.New("ERR TSDB: failed parsing filter")
+)
+
+type tsSample struct {
+	timestamp int64
+	value     float64
+}
+
+type tsLabel struct {
+	name  string
+	value string
+}
+
+// tsDuplicatePolicy decides what adding a sample at a timestamp the series
+// already has does
+type tsDuplicatePolicy int
+
+const (
+	tsPolicyBlock tsDuplicatePolicy = iota
+	tsPolicyFirst
+	tsPolicyLast
+	tsPolicyMin
+	tsPolicyMax
+	tsPolicySum
+)
+
+var tsDuplicatePolicyNames = []string{"block", "first", "last", "min", "max", "sum"}
+
+func parseTSDuplicatePolicy(argument []byte) (tsDuplicatePolicy, error) {
+	index := slices.Index(tsDuplicatePolicyNames, strings.ToLower(string(argument)))
+	if index < 0 {
+		return 0, errTSPolicy
+	}
+	return tsDuplicatePolicy(index), nil
+}
+
+type tsAggregator int
+
+const (
+	tsAggAvg tsAggregator = iota
+	tsAggSum
+	tsAggMin
+	tsAggMax
+	tsAggRange
+	tsAggCount
+	tsAggFirst
+	tsAggLast
+	tsAggStdP
+	tsAggStdS
+	tsAggVarP
+	tsAggVarS
+)
+
+var tsAggregatorNames = []string{"avg", "sum", "min", "max", "range", "count", "first", "last", "std.p", "std.s", "var.p", "var.s"}
+
+func parseTSAggregator(argument []byte) (tsAggregator, error) {
+	index := slices.Index(tsAggregatorNames, strings.ToLower(string(argument)))
+	if index < 0 {
+		return 0, errTSAggregation
+	}
+	return tsAggregator(index), nil
+}
+
+// apply reduces a non empty run of samples in timestamp order to one value
+func (aggregator tsAggregator) apply(samples []tsSample) float64 {
+	count := float64(len(samples))
+	sum, minimum, maximum := 0.0, math.Inf(1), math.Inf(-1)
+	for _, sample := range samples {
+		sum += sample.value
+		minimum = math.Min(minimum, sample.value)
+		maximum = math.Max(maximum, sample.value)
+	}
+	switch aggregator {
+	case tsAggAvg:
+		return sum / count
+	case tsAggSum:
+		return sum
+	case tsAggMin:
+		return minimum
+	case tsAggMax:
+		return maximum
+	case tsAggRange:
+		return maximum - minimum
+	case tsAggCount:
+		return count
+	case tsAggFirst:
+		return samples[0].value
+	case tsAggLast:
+		return samples[len(samples)-1].value
+	}
+
+	mean, squares := sum/count, 0.0
+	for _, sample := range samples {
+		squares += (sample.value - mean) * (sample.value - mean)
+	}
+	divisor := count
+	if aggregator == tsAggStdS || aggregator == tsAggVarS {
+		if count == 1 {
+			return 0
+		}
+		divisor--
+	}
+	if aggregator == tsAggVarP || aggregator == tsAggVarS {
+		return squares / divisor
+	}
+	return math.Sqrt(squares / divisor)
+}
+
+// bucketStart returns the start of the bucket timestamp falls in, buckets
+// being duration long with one starting at alignment
+func bucketStart(timestamp int64, duration int64, alignment int64) int64 {
+	offset := (timestamp - alignment) % duration
+	if offset < 0 {
+		offset += duration
+	}
+	return timestamp - offset
+}
+
+// aggregateSamples replaces each bucket's samples with a single sample at
+// the start of the bucket
+func aggregateSamples(samples []tsSample, aggregator tsAggregator, duration int64, alignment int64) []tsSample {
+	var result []tsSample
+	for start := 0; start < len(samples); {
+		bucket := bucketStart(samples[start].timestamp, duration, alignment)
+		end := start + 1
+		for end < len(samples) && samples[end].timestamp < bucket+duration {
+			end++
+		}
+		result = append(result, tsSample{timestamp: bucket, value: aggregator.apply(samples[start:end])})
+		start = end
+	}
+	return result
+}
+
+// tsRule is a compaction rule, every bucket of the source series is
+// aggregated into one sample of destination once a later sample closes it
+type tsRule struct {
+	destination    string
+	aggregator     tsAggregator
+	bucketDuration int64
+	alignment      int64
+}
+
+// timeSeries keeps samples sorted by timestamp. With a retention set,
+// samples more than retention milliseconds older than the newest are
+// dropped
+type timeSeries struct {
+	samples         []tsSample
+	retention       int64
+	duplicatePolicy tsDuplicatePolicy
+	labels          []tsLabel
+	rules           []tsRule
+	source          string
+}
+
+func (series *timeSeries) last() (tsSample, bool) {
+	if len(series.samples) == 0 {
+		return tsSample{}, false
+	}
+	return series.samples[len(series.samples)-1], true
+}
+
+// upsert adds sample, resolving a clash with an existing sample by policy
+func (series *timeSeries) upsert(sample tsSample, policy tsDuplicatePolicy) error {
+	if last, ok := series.last(); !ok || sample.timestamp > last.timestamp {
+		series.samples = append(series.samples, sample)
+		return nil
+	}
+	index := sort.Search(len(series.samples), func(i int) bool {
+		return series.samples[i].timestamp >= sample.timestamp
+	})
+	if series.samples[index].timestamp != sample.timestamp {
+		series.samples = slices.Insert(series.samples, index, sample)
+		return nil
+	}
+	existing := &series.samples[index].value
+	switch policy {
+	case tsPolicyBlock:
+		return errTSBlocked
+	case tsPolicyLast:
+		*existing = sample.value
+	case tsPolicyMin:
+		*existing = math.Min(*existing, sample.value)
+	case tsPolicyMax:
+		*existing = math.Max(*existing, sample.value)
+	case tsPolicySum:
+		*existing += sample.value
+	}
+	return nil
+}
+
+func (series *timeSeries) trim() {
+	last, ok := series.last()
+	if series.retention == 0 || !ok {
+		return
+	}
+	cutoff := sort.Search(len(series.samples), func(i int) bool {
+		return series.samples[i].timestamp >= last.timestamp-series.retention
+	})
+	series.samples = series.samples[cutoff:]
+}
+
+// between returns the samples from from to to inclusive
+func (series *timeSeries) between(from int64, to int64) []tsSample {
+	start := sort.Search(len(series.samples), func(i int) bool {
+		return series.samples[i].timestamp >= from
+	})
+	end := sort.Search(len(series.samples), func(i int) bool {
+		return series.samples[i].timestamp > to
+	})
+	if start >= end {
+		return nil
+	}
+	return series.samples[start:end]
+}
+
+func (series *timeSeries) label(name string) (string, bool) {
+	for _, label := range series.labels {
+		if label.name == name {
+			return label.value, true
+		}
+	}
+	return "", false
+}
+
+func (entry *Entry) timeSeries() *timeSeries {
+	return entry.value.(*timeSeries)
+}
+
+func newTimeSeriesEntry(series *timeSeries) *Entry {
+	entry := newEntry()
+	entry.objectType = timeSeriesType
+	entry.encoding = encodingTimeSeries
+	entry.value = series
+	return entry
+}
+
+// lockSeries write locks key along with the destinations of its rules,
+// which addSample writes to, and returns the keys to pass to unlockKeys.
+// The rules can only change with key locked, so the destinations are read
+// with key locked and the locks retaken until they stop changing
+func (kvstore *KVStore) lockSeries(key string) []string {
+	keys := []string{key}
+	for {
+		kvstore.lockKeys(keys...)
+		wanted := []string{key}
+		if entry := kvstore.find(key); entry != nil && entry.objectType == timeSeriesType {
+			for _, rule := range entry.timeSeries().rules {
+				wanted = append(wanted, rule.destination)
+			}
+		}
+		if slices.Equal(wanted, keys) {
+			return keys
+		}
+		kvstore.releaseKeys(keys)
+		keys = wanted
+	}
+}
+
+// addSample adds sample to series, then writes out any compaction bucket
+// it closed or changed before trimming to the retention. Caller must hold
+// the locks lockSeries takes
+func (kvstore *KVStore) addSample(series *timeSeries, sample tsSample, policy tsDuplicatePolicy) error {
+	previous, hadSamples := series.last()
+	if hadSamples && series.retention > 0 && sample.timestamp < previous.timestamp-series.retention {
+		return errTSOldSample
+	}
+	if err := series.upsert(sample, policy); err != nil {
+		return err
+	}
+	if hadSamples {
+		for _, rule := range series.rules {
+			bucket := bucketStart(sample.timestamp, rule.bucketDuration, rule.alignment)
+			openBucket := bucketStart(previous.timestamp, rule.bucketDuration, rule.alignment)
+			switch {
+			case bucket > openBucket:
+				kvstore.compactBucket(series, rule, openBucket)
+			case bucket < openBucket:
+				// a late sample changes a bucket that was already written
+				kvstore.compactBucket(series, rule, bucket)
+			}
+		}
+	}
+	series.trim()
+	return nil
+}
+
+// compactBucket writes the aggregate of the source samples in the bucket
+// to the rule's destination, skipped if the destination has gone
+func (kvstore *KVStore) compactBucket(source *timeSeries, rule tsRule, bucket int64) {
+	samples := source.between(bucket, bucket+rule.bucketDuration-1)
+	destination, err := kvstore.lookupTypedWrite(rule.destination, timeSeriesType)
+	if len(samples) == 0 || err != nil || destination == nil {
+		return
+	}
+	series := destination.timeSeries()
+	series.upsert(tsSample{timestamp: bucket, value: rule.aggregator.apply(samples)}, tsPolicyLast)
+	series.trim()
+}
+
+// tsCreateOptions are the RETENTION, DUPLICATE_POLICY or ON_DUPLICATE and
+// LABELS arguments of TS.CREATE and TS.ADD, LABELS takes the rest
+type tsCreateOptions struct {
+	retention       int64
+	duplicatePolicy tsDuplicatePolicy
+	policyGiven     bool
+	labels          []tsLabel
+}
+
+func parseTSCreateOptions(arguments [][]byte, policyOption string) (tsCreateOptions, error) {
+	var options tsCreateOptions
+	for position := 0; position < len(arguments); position++ {
+		option := strings.ToUpper(string(arguments[position]))
+		if option == "LABELS" {
+			labels := arguments[position+1:]
+			if len(labels) == 0 || len(labels)%2 != 0 {
+				return options, errTSLabels
+			}
+			for i := 0; i < len(labels); i += 2 {
+				options.labels = append(options.labels, tsLabel{name: string(labels[i]), value: string(labels[i+1])})
+			}
+			break
+		}
+		if position+1 >= len(arguments) {
+			return options, errSyntax
+		}
+		position++
+		var err error
+		switch option {
+		case "RETENTION":
+			options.retention, err = strconv.ParseInt(string(arguments[position]), 10, 64)
+			if err != nil || options.retention < 0 {
+				return options, errTSRetention
+			}
+		case policyOption:
+			if options.duplicatePolicy, err = parseTSDuplicatePolicy(arguments[position]); err != nil {
+				return options, err
+			}
+			options.policyGiven = true
+		default:
+			return options, errSyntax
+		}
+	}
+	return options, nil
+}
+
+func (options tsCreateOptions) newSeries() *timeSeries {
+	return &timeSeries{
+		retention:       options.retention,
+		duplicatePolicy: options.duplicatePolicy,
+		labels:          options.labels,
+	}
+}
+
+func (kvstore *KVStore) handleTSCREATE(messages [][]byte) []byte {
+	if len(messages) < 2 {
+		return wrongArgumentsError("ts.create")
+	}
+	options, err := parseTSCreateOptions(messages[2:], "DUPLICATE_POLICY")
+	if err != nil {
+		return encodeError(err)
+	}
+
+	key := string(messages[1])
+	kvstore.lockKeys(key)
+	defer kvstore.unlockKeys(key)
+
+	if kvstore.lookupKeyWrite(key) != nil {
+		return encodeError(errTSKeyExists)
+	}
+	kvstore.setKey(key, newTimeSeriesEntry(options.newSeries()))
+	return okReply
+}
+
+// parseTimestamp reads a millisecond timestamp, with "-" and "+" standing
+// for the earliest and latest possible when bounds are allowed
+func parseTimestamp(argument []byte, bounds bool) (int64, error) {
+	if bounds {
+		switch string(argument) {
+		case "-":
+			return 0, nil
+		case "+":
+			return math.MaxInt64, nil
+		}
+	}
+	timestamp, err := strconv.ParseInt(string(argument), 10, 64)
+	if err != nil || timestamp < 0 {
+		return 0, errTSTimestamp
+	}
+	return timestamp, nil
+}
+
+// handleTSADD adds a sample, creating the series with the given options
+// when the key doesn't exist. A timestamp of * is the current time
+func (kvstore *KVStore) handleTSADD(messages [][]byte) []byte {
+	if len(messages) < 4 {
+		return wrongArgumentsError("ts.add")
+	}
+	timestamp := time.Now().UnixMilli()
+	if string(messages[2]) != "*" {
+		var err error
+		if timestamp, err = parseTimestamp(messages[2], false); err != nil {
+			return encodeError(err)
+		}
+	}
+	value, err := strconv.ParseFloat(string(messages[3]), 64)
+	if err != nil || math.IsNaN(value) {
+		return encodeError(errTSValue)
+	}
+	options, err := parseTSCreateOptions(messages[4:], "ON_DUPLICATE")
+	if err != nil {
+		return encodeError(err)
+	}
+
+	key := string(messages[1])
+	keys := kvstore.lockSeries(key)
+	defer kvstore.unlockKeys(keys...)
+
+	entry, err := kvstore.lookupTypedWrite(key, timeSeriesType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		entry = newTimeSeriesEntry(options.newSeries())
+		kvstore.setKey(key, entry)
+	}
+	series := entry.timeSeries()
+	policy := series.duplicatePolicy
+	if options.policyGiven {
+		policy = options.duplicatePolicy
+	}
+	if err := kvstore.addSample(series, tsSample{timestamp: timestamp, value: value}, policy); err != nil {
+		return encodeError(err)
+	}
+	return encodeInteger(timestamp)
+}
+
+func encodeSample(sample tsSample) []byte {
+	return encodeRawArray([][]byte{
+		encodeInteger(sample.timestamp),
+		encodeSimpleString(strconv.FormatFloat(sample.value, 'f', -1, 64)),
+	})
+}
+
+func encodeSamples(samples []tsSample) []byte {
+	replies := make([][]byte, len(samples))
+	for i, sample := range samples {
+		replies[i] = encodeSample(sample)
+	}
+	return encodeRawArray(replies)
+}
+
+func (kvstore *KVStore) handleTSGET(messages [][]byte) []byte {
+	if len(messages) != 2 {
+		return wrongArgumentsError("ts.get")
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedRead(string(messages[1]), timeSeriesType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return encodeError(errTSNoKey)
+	}
+	last, ok := entry.timeSeries().last()
+	if !ok {
+		return encodeArrayHeader(0)
+	}
+	return encodeSample(last)
+}
+
+// tsFilter matches series on a label. name=value and name!=value can list
+// several values as name=(a,b), an empty value matches a missing label
+type tsFilter struct {
+	name   string
+	values []string
+	negate bool
+}
+
+func parseTSFilter(argument []byte) (tsFilter, error) {
+	expression := string(argument)
+	index := strings.IndexByte(expression, '=')
+	if index <= 0 {
+		return tsFilter{}, errTSFilter
+	}
+	filter := tsFilter{name: expression[:index], values: []string{expression[index+1:]}}
+	if strings.HasSuffix(filter.name, "!") {
+		filter.name, filter.negate = filter.name[:len(filter.name)-1], true
+	}
+	if value := filter.values[0]; strings.HasPrefix(value, "(") && strings.HasSuffix(value, ")") {
+		filter.values = strings.Split(value[1:len(value)-1], ",")
+	}
+	if filter.name == "" {
+		return tsFilter{}, errTSFilter
+	}
+	return filter, nil
+}
+
+func (filter tsFilter) matches(series *timeSeries) bool {
+	value, ok := series.label(filter.name)
+	matched := ok && slices.Contains(filter.values, value)
+	if len(filter.values) == 1 && filter.values[0] == "" {
+		matched = !ok
+	}
+	return matched != filter.negate
+}
+
+// tsRangeOptions are the arguments shared by TS.RANGE and TS.MRANGE
+type tsRangeOptions struct {
+	from           int64
+	to             int64
+	count          int
+	aggregated     bool
+	aggregator     tsAggregator
+	bucketDuration int64
+	alignment      int64
+	withLabels     bool
+	filters        []tsFilter
+}
+
+// parseTSRangeOptions reads from, to and the options after them, multi
+// allows the TS.MRANGE only WITHLABELS and FILTER
+func parseTSRangeOptions(arguments [][]byte, multi bool) (tsRangeOptions, error) {
+	options := tsRangeOptions{count: -1}
+	var err error
+	if options.from, err = parseTimestamp(arguments[0], true); err != nil {
+		return options, err
+	}
+	if options.to, err = parseTimestamp(arguments[1], true); err != nil {
+		return options, err
+	}
+	var align []byte
+	for position := 2; position < len(arguments); position++ {
+		option := strings.ToUpper(string(arguments[position]))
+		switch {
+		case option == "WITHLABELS" && multi:
+			options.withLabels = true
+		case option == "FILTER" && multi:
+			if position+1 >= len(arguments) {
+				return options, errSyntax
+			}
+			for _, argument := range arguments[position+1:] {
+				filter, err := parseTSFilter(argument)
+				if err != nil {
+					return options, err
+				}
+				options.filters = append(options.filters, filter)
+			}
+			position = len(arguments)
+		case option == "COUNT" && position+1 < len(arguments):
+			position++
+			count, err := strconv.Atoi(string(arguments[position]))
+			if err != nil || count < 0 {
+				return options, errTSCount
+			}
+			options.count = count
+		case option == "ALIGN" && position+1 < len(arguments):
+			position++
+			align = arguments[position]
+		case option == "AGGREGATION" && position+2 < len(arguments):
+			if options.aggregator, err = parseTSAggregator(arguments[position+1]); err != nil {
+				return options, err
+			}
+			options.bucketDuration, err = strconv.ParseInt(string(arguments[position+2]), 10, 64)
+			if err != nil || options.bucketDuration <= 0 {
+				return options, errTSBucketDuration
+			}
+			options.aggregated = true
+			position += 2
+		default:
+			return options, errSyntax
+		}
+	}
+
+	if align != nil {
+		if !options.aggregated {
+			return options, errTSAlignNeedsAgg
+		}
+		switch strings.ToLower(string(align)) {
+		case "start", "-":
+			options.alignment = options.from
+		case "end", "+":
+			options.alignment = options.to
+		default:
+			if options.alignment, err = parseTimestamp(align, false); err != nil {
+				return options, errTSAlign
+			}
+		}
+	}
+	if multi {
+		matcher := slices.ContainsFunc(options.filters, func(filter tsFilter) bool {
+			return !filter.negate && !(len(filter.values) == 1 && filter.values[0] == "")
+		})
+		if !matcher {
+			return options, errTSNoMatcher
+		}
+	}
+	return options, nil
+}
+
+// query returns the samples of series in the range, aggregated and
+// limited as asked, newest first when reverse is set
+func (options tsRangeOptions) query(series *timeSeries, reverse bool) []tsSample {
+	samples := series.between(options.from, options.to)
+	if options.aggregated {
+		samples = aggregateSamples(samples, options.aggregator, options.bucketDuration, options.alignment)
+	} else {
+		samples = slices.Clone(samples)
+	}
+	if reverse {
+		slices.Reverse(samples)
+	}
+	if options.count >= 0 && options.count < len(samples) {
+		samples = samples[:options.count]
+	}
+	return samples
+}
+
+// handleTSRANGE serves TS.RANGE and TS.REVRANGE
+func (kvstore *KVStore) handleTSRANGE(messages [][]byte) []byte {
+	if len(messages) < 4 {
+		return wrongArgumentsError(string(messages[0]))
+	}
+	reverse := strings.ToUpper(string(messages[0])) == "TS.REVRANGE"
+	options, err := parseTSRangeOptions(messages[2:], false)
+	if err != nil {
+		return encodeError(err)
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedRead(string(messages[1]), timeSeriesType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return encodeError(errTSNoKey)
+	}
+	return encodeSamples(options.query(entry.timeSeries(), reverse))
+}
+
+func encodeLabels(labels []tsLabel) []byte {
+	replies := make([][]byte, len(labels))
+	for i, label := range labels {
+		replies[i] = encodeArray([][]byte{[]byte(label.name), []byte(label.value)})
+	}
+	return encodeRawArray(replies)
+}
+
+// handleTSMRANGE serves TS.MRANGE and TS.MREVRANGE, a range query over
+// every series whose labels match all the filters, ordered by key
+func (kvstore *KVStore) handleTSMRANGE(messages [][]byte) []byte {
+	if len(messages) < 5 {
+		return wrongArgumentsError(string(messages[0]))
+	}
+	reverse := strings.ToUpper(string(messages[0])) == "TS.MREVRANGE"
+	options, err := parseTSRangeOptions(messages[1:], true)
+	if err != nil {
+		return encodeError(err)
+	}
+
+	kvstore.rlockAll()
+	defer kvstore.runlockAll()
+
+	var keys []string
+	kvstore.forEachKey(func(key string, _ *Entry) bool {
+		entry := kvstore.lookupKeyRead(key)
+		if entry == nil || entry.objectType != timeSeriesType {
+			return true
+		}
+		matched := true
+		for _, filter := range options.filters {
+			matched = matched && filter.matches(entry.timeSeries())
+		}
+		if matched {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	slices.Sort(keys)
+
+	replies := make([][]byte, len(keys))
+	for i, key := range keys {
+		series := kvstore.find(key).timeSeries()
+		var labels []tsLabel
+		if options.withLabels {
+			labels = series.labels
+		}
+		replies[i] = encodeRawArray([][]byte{
+			encodeBulkString([]byte(key)),
+			encodeLabels(labels),
+			encodeSamples(options.query(series, reverse)),
+		})
+	}
+	return encodeRawArray(replies)
+}
+
+// handleTSCREATERULE compacts source into destination. A destination has
+// a single source and can't itself be compacted, so rules never chain
+func (kvstore *KVStore) handleTSCREATERULE(messages [][]byte) []byte {
+	if len(messages) != 6 && len(messages) != 7 {
+		return wrongArgumentsError("ts.createrule")
+	}
+	if strings.ToUpper(string(messages[3])) != "AGGREGATION" {
+		return encodeError(errSyntax)
+	}
+	rule := tsRule{destination: string(messages[2])}
+	var err error
+	if rule.aggregator, err = parseTSAggregator(messages[4]); err != nil {
+		return encodeError(err)
+	}
+	rule.bucketDuration, err = strconv.ParseInt(string(messages[5]), 10, 64)
+	if err != nil || rule.bucketDuration <= 0 {
+		return encodeError(errTSBucketDuration)
+	}
+	if len(messages) == 7 {
+		if rule.alignment, err = parseTimestamp(messages[6], false); err != nil {
+			return encodeError(err)
+		}
+	}
+	if string(messages[1]) == rule.destination {
+		return encodeError(errTSSameKey)
+	}
+
+	kvstore.lockKeys(string(messages[1]), rule.destination)
+	defer kvstore.unlockKeys(string(messages[1]), rule.destination)
+
+	sourceEntry, err := kvstore.lookupTypedWrite(string(messages[1]), timeSeriesType)
+	if err != nil {
+		return encodeError(err)
+	}
+	destinationEntry, err := kvstore.lookupTypedWrite(rule.destination, timeSeriesType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if sourceEntry == nil || destinationEntry == nil {
+		return encodeError(errTSNoKey)
+	}
+	source, destination := sourceEntry.timeSeries(), destinationEntry.timeSeries()
+	switch {
+	case source.source != "":
+		return encodeError(errTSSourceIsRule)
+	case destination.source != "":
+		return encodeError(errTSHasSource)
+	case len(destination.rules) > 0:
+		return encodeError(errTSDestinationRule)
+	}
+	source.rules = append(source.rules, rule)
+	destination.source = string(messages[1])
+	return okReply
+}
+
+func (kvstore *KVStore) handleTSDELETERULE(messages [][]byte) []byte {
+	if len(messages) != 3 {
+		return wrongArgumentsError("ts.deleterule")
+	}
+
+	kvstore.lockKeys(string(messages[1]), string(messages[2]))
+	defer kvstore.unlockKeys(string(messages[1]), string(messages[2]))
+
+	entry, err := kvstore.lookupTypedWrite(string(messages[1]), timeSeriesType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return encodeError(errTSNoKey)
+	}
+	source := entry.timeSeries()
+	index := slices.IndexFunc(source.rules, func(rule tsRule) bool {
+		return rule.destination == string(messages[2])
+	})
+	if index < 0 {
+		return encodeError(errTSNoRule)
+	}
+	source.rules = slices.Delete(source.rules, index, index+1)
+	if destination, _ := kvstore.lookupTypedWrite(string(messages[2]), timeSeriesType); destination != nil {
+		destination.timeSeries().source = ""
+	}
+	return okReply
+}
+
+func (kvstore *KVStore) handleTSINFO(messages [][]byte) []byte {
+	if len(messages) != 2 {
+		return wrongArgumentsError("ts.info")
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedRead(string(messages[1]), timeSeriesType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return encodeError(errTSNoKey)
+	}
+	series := entry.timeSeries()
+	var first, last int64
+	if len(series.samples) > 0 {
+		first, last = series.samples[0].timestamp, series.samples[len(series.samples)-1].timestamp
+	}
+	sourceKey := nullBulkReply
+	if series.source != "" {
+		sourceKey = encodeBulkString([]byte(series.source))
+	}
+	rules := make([][]byte, len(series.rules))
+	for i, rule := range series.rules {
+		rules[i] = encodeRawArray([][]byte{
+			encodeBulkString([]byte(rule.destination)),
+			encodeInteger(rule.bucketDuration),
+			encodeSimpleString(tsAggregatorNames[rule.aggregator]),
+			encodeInteger(rule.alignment),
+		})
+	}
+	return encodeRawArray([][]byte{
+		encodeBulkString([]byte("totalSamples")), encodeInteger(int64(len(series.samples))),
+		encodeBulkString([]byte("firstTimestamp")), encodeInteger(first),
+		encodeBulkString([]byte("lastTimestamp")), encodeInteger(last),
+		encodeBulkString([]byte("retentionTime")), encodeInteger(series.retention),
+		encodeBulkString([]byte("duplicatePolicy")), encodeBulkString([]byte(tsDuplicatePolicyNames[series.duplicatePolicy])),
+		encodeBulkString([]byte("labels")), encodeLabels(series.labels),
+		encodeBulkString([]byte("sourceKey")), sourceKey,
+		encodeBulkString([]byte("rules")), encodeRawArray(rules),
+	})
+}
@@ -0,0 +1,124 @@
+package store
+
+import (
+	"strconv"
+	"testing"
+)
+
+func samplesReply(samples ...tsSample) string {
+	return string(encodeSamples(samples))
+}
+
+func TestTimeSeriesRangeAggregation(t *testing.T) {
+	kvstore := newKVStore()
+	kvstore.handleTSCREATE(command("TS.CREATE", "latency", "LABELS", "endpoint", "/users"))
+	for i, value := range []string{"10", "20", "30", "5", "15"} {
+		kvstore.handleTSADD(command("TS.ADD", "latency", strconv.Itoa(1000+i*400), value))
+	}
+	// samples at 1000 1400 1800 2200 2600
+
+	cases := []struct {
+		arguments []string
+		expected  string
+	}{
+		{[]string{"TS.RANGE", "latency", "1400", "2200"}, samplesReply(tsSample{1400, 20}, tsSample{1800, 30}, tsSample{2200, 5})},
+		{[]string{"TS.RANGE", "latency", "-", "+", "AGGREGATION", "avg", "1000"}, samplesReply(tsSample{1000, 20}, tsSample{2000, 10})},
+		{[]string{"TS.RANGE", "latency", "-", "+", "AGGREGATION", "max", "1000", "COUNT", "1"}, samplesReply(tsSample{1000, 30})},
+		{[]string{"TS.RANGE", "latency", "1400", "+", "ALIGN", "start", "AGGREGATION", "range", "1000"}, samplesReply(tsSample{1400, 25}, tsSample{2400, 0})},
+		{[]string{"TS.REVRANGE", "latency", "-", "+", "COUNT", "2"}, samplesReply(tsSample{2600, 15}, tsSample{2200, 5})},
+		{[]string{"TS.RANGE", "latency", "-", "+", "AGGREGATION", "var.s", "2000"}, samplesReply(tsSample{0, 100}, tsSample{2000, 50})},
+	}
+	for _, tc := range cases {
+		if reply := kvstore.handleTSRANGE(command(tc.arguments...)); string(reply) != tc.expected {
+			t.Errorf("%v expected %q, got %q", tc.arguments, tc.expected, reply)
+		}
+	}
+
+	if reply := kvstore.handleTSADD(command("TS.ADD", "latency", "1000", "1")); string(reply) != string(encodeError(errTSBlocked)) {
+		t.Errorf("a duplicate should be blocked by default, got %q", reply)
+	}
+	kvstore.handleTSADD(command("TS.ADD", "latency", "1000", "1", "ON_DUPLICATE", "sum"))
+	if reply := kvstore.handleTSRANGE(command("TS.RANGE", "latency", "1000", "1000")); string(reply) != samplesReply(tsSample{1000, 11}) {
+		t.Errorf("ON_DUPLICATE sum should add, got %q", reply)
+	}
+}
+
+func TestTimeSeriesRetention(t *testing.T) {
+	kvstore := newKVStore()
+	kvstore.handleTSADD(command("TS.ADD", "series", "1000", "1", "RETENTION", "100"))
+	kvstore.handleTSADD(command("TS.ADD", "series", "1050", "2"))
+	if reply := kvstore.handleTSADD(command("TS.ADD", "series", "800", "3")); string(reply) != string(encodeError(errTSOldSample)) {
+		t.Errorf("expected a sample older than retention to fail, got %q", reply)
+	}
+	kvstore.handleTSADD(command("TS.ADD", "series", "1101", "4"))
+	if reply := kvstore.handleTSRANGE(command("TS.RANGE", "series", "-", "+")); string(reply) != samplesReply(tsSample{1050, 2}, tsSample{1101, 4}) {
+		t.Errorf("expected the first sample trimmed, got %q", reply)
+	}
+}
+
+// TestTimeSeriesCompaction checks buckets are written to the destination
+// once closed, and rewritten when a late sample lands in one
+func TestTimeSeriesCompaction(t *testing.T) {
+	kvstore := newKVStore()
+	kvstore.handleTSCREATE(command("TS.CREATE", "raw", "DUPLICATE_POLICY", "last"))
+	kvstore.handleTSCREATE(command("TS.CREATE", "sums"))
+	if reply := kvstore.handleTSCREATERULE(command("TS.CREATERULE", "raw", "sums", "AGGREGATION", "sum", "100")); string(reply) != string(okReply) {
+		t.Fatalf("creating the rule failed %q", reply)
+	}
+	if reply := kvstore.handleTSCREATERULE(command("TS.CREATERULE", "sums", "raw", "AGGREGATION", "sum", "100")); string(reply) != string(encodeError(errTSSourceIsRule)) {
+		t.Errorf("a destination can't be compacted, got %q", reply)
+	}
+
+	for _, sample := range [][2]string{{"10", "1"}, {"50", "2"}, {"120", "3"}, {"150", "4"}} {
+		kvstore.handleTSADD(command("TS.ADD", "raw", sample[0], sample[1]))
+	}
+	if reply := kvstore.handleTSRANGE(command("TS.RANGE", "sums", "-", "+")); string(reply) != samplesReply(tsSample{0, 3}) {
+		t.Errorf("only the closed bucket should be written, got %q", reply)
+	}
+	kvstore.handleTSADD(command("TS.ADD", "raw", "60", "10"))
+	kvstore.handleTSADD(command("TS.ADD", "raw", "210", "1"))
+	if reply := kvstore.handleTSRANGE(command("TS.RANGE", "sums", "-", "+")); string(reply) != samplesReply(tsSample{0, 13}, tsSample{100, 7}) {
+		t.Errorf("expected the late sample counted, got %q", reply)
+	}
+
+	kvstore.handleTSDELETERULE(command("TS.DELETERULE", "raw", "sums"))
+	kvstore.handleTSADD(command("TS.ADD", "raw", "400", "1"))
+	if reply := kvstore.handleTSRANGE(command("TS.RANGE", "sums", "200", "+")); string(reply) != samplesReply() {
+		t.Errorf("a deleted rule should stop compacting, got %q", reply)
+	}
+}
+
+func TestTimeSeriesMRange(t *testing.T) {
+	kvstore := newKVStore()
+	kvstore.handleTSADD(command("TS.ADD", "a", "1", "1", "LABELS", "service", "api", "region", "eu"))
+	kvstore.handleTSADD(command("TS.ADD", "b", "1", "2", "LABELS", "service", "api"))
+	kvstore.handleTSADD(command("TS.ADD", "c", "1", "3", "LABELS", "service", "web", "region", "us"))
+
+	series := func(key string, labels string, samples ...tsSample) []byte {
+		return encodeRawArray([][]byte{encodeBulkString([]byte(key)), []byte(labels), encodeSamples(samples)})
+	}
+	cases := []struct {
+		filters  []string
+		expected [][]byte
+	}{
+		{[]string{"service=api"}, [][]byte{series("a", "*0\r\n", tsSample{1, 1}), series("b", "*0\r\n", tsSample{1, 2})}},
+		{[]string{"service=(api,web)", "region!=eu"}, [][]byte{series("b", "*0\r\n", tsSample{1, 2}), series("c", "*0\r\n", tsSample{1, 3})}},
+		{[]string{"service=api", "region="}, [][]byte{series("b", "*0\r\n", tsSample{1, 2})}},
+		{[]string{"service=web", "region!="}, [][]byte{series("c", "*0\r\n", tsSample{1, 3})}},
+	}
+	for _, tc := range cases {
+		arguments := append([]string{"TS.MRANGE", "-", "+", "FILTER"}, tc.filters...)
+		if reply := kvstore.handleTSMRANGE(command(arguments...)); string(reply) != string(encodeRawArray(tc.expected)) {
+			t.Errorf("%v got %q", tc.filters, reply)
+		}
+	}
+
+	withLabels := kvstore.handleTSMRANGE(command("TS.MRANGE", "-", "+", "WITHLABELS", "FILTER", "region=us"))
+	expected := encodeRawArray([][]byte{series("c", string(encodeLabels(kvstore.find("c").timeSeries().labels)), tsSample{1, 3})})
+	if string(withLabels) != string(expected) {
+		t.Errorf("expected %q, got %q", expected, withLabels)
+	}
+	if reply := kvstore.handleTSMRANGE(command("TS.MRANGE", "-", "+", "FILTER", "region!=eu")); string(reply) != string(encodeError(errTSNoMatcher)) {
+		t.Errorf("expected a matcher error, got %q", reply)
+	}
+}
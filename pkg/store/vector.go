@@ -0,0 +1,365 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var (
+	errVectorSpecification = errors.New("ERR invalid vector specification")
+	errVectorBlob          = errors.New("ERR FP32 blob length must be a multiple of 4")
+	errVectorNotFinite     = errors.New("ERR vector components must be finite numbers")
+	errVectorMetric        = errors.New("ERR unknown METRIC, expected COSINE, L2 or IP")
+	errVectorM             = errors.New("ERR invalid M")
+	errVectorEF            = errors.New("ERR invalid EF")
+	errVectorCount         = errors.New("ERR invalid COUNT")
+	errVectorMMismatch     = errors.New("ERR asked M value mismatch with existing vector set")
+	errVectorMetricChange  = errors.New("ERR asked METRIC mismatch with existing vector set")
+	errVectorNoElement     = errors.New("ERR element not found in set")
+	errVectorNoKey         = errors.New("ERR key does not exist")
+)
+
+const dimensionMismatchFormat = "ERR Vector dimension mismatch - got %d but set has %d"
+
+// defaults for HNSW graphs, M links per node and EF candidates kept while
+// building and searching
+const (
+	vectorDefaultM  = 16
+	vectorMaxM      = 4096
+	vectorDefaultEF = 200
+	vectorMaxEF     = 1000000
+)
+
+func (entry *Entry) vectorSet() *hnsw {
+	return entry.value.(*hnsw)
+}
+
+// parseVector reads FP32 followed by a little endian float32 blob, or
+// VALUES followed by the dimension and that many numbers, returning how
+// many arguments were used
+func parseVector(arguments [][]byte) ([]float32, int, error) {
+	if len(arguments) < 2 {
+		return nil, 0, errVectorSpecification
+	}
+	switch strings.ToUpper(string(arguments[0])) {
+	case "FP32":
+		blob := arguments[1]
+		if len(blob) == 0 || len(blob)%4 != 0 {
+			return nil, 0, errVectorBlob
+		}
+		values := make([]float32, len(blob)/4)
+		for i := range values {
+			values[i] = math.Float32frombits(binary.LittleEndian.Uint32(blob[i*4:]))
+			if !isFinite(values[i]) {
+				return nil, 0, errVectorNotFinite
+			}
+		}
+		return values, 2, nil
+	case "VALUES":
+		dimension, err := strconv.Atoi(string(arguments[1]))
+		if err != nil || dimension <= 0 || len(arguments) < dimension+2 {
+			return nil, 0, errVectorSpecification
+		}
+		values := make([]float32, dimension)
+		for i := range values {
+			value, err := strconv.ParseFloat(string(arguments[i+2]), 32)
+			if err != nil && !errors.Is(err, strconv.ErrRange) {
+				return nil, 0, errVectorSpecification
+			}
+			values[i] = float32(value)
+			if !isFinite(values[i]) {
+				return nil, 0, errVectorNotFinite
+			}
+		}
+		return values, dimension + 2, nil
+	}
+	return nil, 0, errVectorSpecification
+}
+
+// isFinite reports whether value is neither NaN nor infinite, scores
+// computed from such a component would be meaningless
+func isFinite(value float32) bool {
+	return !math.IsNaN(float64(value)) && !math.IsInf(float64(value), 0)
+}
+
+func parseVectorMetric(argument []byte) (vectorMetric, error) {
+	index := slices.Index(vectorMetricNames, strings.ToUpper(string(argument)))
+	if index < 0 {
+		return 0, errVectorMetric
+	}
+	return vectorMetric(index), nil
+}
+
+// handleVADD adds element with its embedding, replacing the embedding if
+// the element is there already. M, EF and METRIC configure the graph when
+// the key is created, METRIC and M must match an existing graph
+func (kvstore *KVStore) handleVADD(messages [][]byte) []byte {
+	if len(messages) < 5 {
+		return wrongArgumentsError("vadd")
+	}
+	values, used, err := parseVector(messages[2:])
+	if err != nil {
+		return encodeError(err)
+	}
+	position := 2 + used
+	if position >= len(messages) {
+		return wrongArgumentsError("vadd")
+	}
+	element := string(messages[position])
+
+	m, ef, metric := vectorDefaultM, vectorDefaultEF, metricCosine
+	mGiven, metricGiven := false, false
+	for position++; position < len(messages); position++ {
+		option := strings.ToUpper(string(messages[position]))
+		switch {
+		case option == "NOQUANT" || option == "CAS":
+			// embeddings are always kept unquantized and adds are already atomic
+		case option == "M" && position+1 < len(messages):
+			position++
+			if m, err = strconv.Atoi(string(messages[position])); err != nil || m < 2 || m > vectorMaxM {
+				return encodeError(errVectorM)
+			}
+			mGiven = true
+		case option == "EF" && position+1 < len(messages):
+			position++
+			if ef, err = strconv.Atoi(string(messages[position])); err != nil || ef <= 0 || ef > vectorMaxEF {
+				return encodeError(errVectorEF)
+			}
+		case option == "METRIC" && position+1 < len(messages):
+			position++
+			if metric, err = parseVectorMetric(messages[position]); err != nil {
+				return encodeError(err)
+			}
+			metricGiven = true
+		default:
+			return encodeError(errSyntax)
+		}
+	}
+
+	key := string(messages[1])
+	kvstore.lockKeys(key)
+	defer kvstore.unlockKeys(key)
+
+	entry, err := kvstore.lookupTypedWrite(key, vectorSetType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		entry = newEntry()
+		entry.objectType = vectorSetType
+		entry.encoding = encodingHNSW
+		entry.value = newHNSW(metric, len(values), m, ef)
+		kvstore.setKey(key, entry)
+	}
+	graph := entry.vectorSet()
+	switch {
+	case len(values) != graph.dimension:
+		return encodeError(fmt.Errorf(dimensionMismatchFormat, len(values), graph.dimension))
+	case mGiven && m != graph.m:
+		return encodeError(errVectorMMismatch)
+	case metricGiven && metric != graph.metric:
+		return encodeError(errVectorMetricChange)
+	}
+	added := !graph.remove(element)
+	graph.insert(element, newVector(values))
+	if added {
+		return encodeInteger(1)
+	}
+	return encodeInteger(0)
+}
+
+// handleVSIM returns the elements closest to a vector or to another
+// element, closest first
+func (kvstore *KVStore) handleVSIM(messages [][]byte) []byte {
+	if len(messages) < 4 {
+		return wrongArgumentsError("vsim")
+	}
+	var values []float32
+	var queryElement []byte
+	position := 2
+	if strings.ToUpper(string(messages[2])) == "ELE" {
+		queryElement = messages[3]
+		position = 4
+	} else {
+		var used int
+		var err error
+		if values, used, err = parseVector(messages[2:]); err != nil {
+			return encodeError(err)
+		}
+		position += used
+	}
+	count, ef, withScores := 10, 0, false
+	for ; position < len(messages); position++ {
+		option := strings.ToUpper(string(messages[position]))
+		var err error
+		switch {
+		case option == "WITHSCORES":
+			withScores = true
+		case option == "COUNT" && position+1 < len(messages):
+			position++
+			if count, err = strconv.Atoi(string(messages[position])); err != nil || count < 0 {
+				return encodeError(errVectorCount)
+			}
+		case option == "EF" && position+1 < len(messages):
+			position++
+			if ef, err = strconv.Atoi(string(messages[position])); err != nil || ef <= 0 || ef > vectorMaxEF {
+				return encodeError(errVectorEF)
+			}
+		default:
+			return encodeError(errSyntax)
+		}
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedRead(string(messages[1]), vectorSetType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return encodeArrayHeader(0)
+	}
+	graph := entry.vectorSet()
+	var query vector
+	if queryElement != nil {
+		node, ok := graph.nodes[string(queryElement)]
+		if !ok {
+			return encodeError(errVectorNoElement)
+		}
+		query = node.vector
+	} else {
+		if len(values) != graph.dimension {
+			return encodeError(fmt.Errorf(dimensionMismatchFormat, len(values), graph.dimension))
+		}
+		query = newVector(values)
+	}
+	if ef == 0 {
+		ef = graph.efConstruction
+	}
+
+	var replies [][]byte
+	for _, result := range graph.search(query, count, ef) {
+		replies = append(replies, encodeBulkString([]byte(result.node.element)))
+		if withScores {
+			replies = append(replies, encodeBulkString(strconv.AppendFloat(nil, graph.metric.score(result.distance), 'f', -1, 64)))
+		}
+	}
+	return encodeRawArray(replies)
+}
+
+func (kvstore *KVStore) handleVREM(messages [][]byte) []byte {
+	if len(messages) != 3 {
+		return wrongArgumentsError("vrem")
+	}
+
+	key := string(messages[1])
+	kvstore.lockKeys(key)
+	defer kvstore.unlockKeys(key)
+
+	entry, err := kvstore.lookupTypedWrite(key, vectorSetType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil || !entry.vectorSet().remove(string(messages[2])) {
+		return encodeInteger(0)
+	}
+	if len(entry.vectorSet().nodes) == 0 {
+		kvstore.deleteKey(key)
+	}
+	return encodeInteger(1)
+}
+
+func (kvstore *KVStore) handleVCARD(messages [][]byte) []byte {
+	if len(messages) != 2 {
+		return wrongArgumentsError("vcard")
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedRead(string(messages[1]), vectorSetType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return encodeInteger(0)
+	}
+	return encodeInteger(int64(len(entry.vectorSet().nodes)))
+}
+
+func (kvstore *KVStore) handleVDIM(messages [][]byte) []byte {
+	if len(messages) != 2 {
+		return wrongArgumentsError("vdim")
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedRead(string(messages[1]), vectorSetType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return encodeError(errVectorNoKey)
+	}
+	return encodeInteger(int64(entry.vectorSet().dimension))
+}
+
+// handleVEMB returns the embedding of an element
+func (kvstore *KVStore) handleVEMB(messages [][]byte) []byte {
+	if len(messages) != 3 {
+		return wrongArgumentsError("vemb")
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedRead(string(messages[1]), vectorSetType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return nullArrayReply
+	}
+	node, ok := entry.vectorSet().nodes[string(messages[2])]
+	if !ok {
+		return nullArrayReply
+	}
+	values := make([][]byte, len(node.vector.values))
+	for i, value := range node.vector.values {
+		values[i] = strconv.AppendFloat(nil, float64(value), 'f', -1, 32)
+	}
+	return encodeArray(values)
+}
+
+func (kvstore *KVStore) handleVINFO(messages [][]byte) []byte {
+	if len(messages) != 2 {
+		return wrongArgumentsError("vinfo")
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedRead(string(messages[1]), vectorSetType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return nullArrayReply
+	}
+	graph := entry.vectorSet()
+	return encodeRawArray([][]byte{
+		encodeBulkString([]byte("quant-type")), encodeBulkString([]byte("f32")),
+		encodeBulkString([]byte("metric")), encodeBulkString([]byte(vectorMetricNames[graph.metric])),
+		encodeBulkString([]byte("vector-dim")), encodeInteger(int64(graph.dimension)),
+		encodeBulkString([]byte("size")), encodeInteger(int64(len(graph.nodes))),
+		encodeBulkString([]byte("max-level")), encodeInteger(int64(graph.maxLevel())),
+		encodeBulkString([]byte("hnsw-m")), encodeInteger(int64(graph.m)),
+	})
+}
@@ -0,0 +1,153 @@
+package store
+
+import (
+	"math/rand"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func randomValues(random *rand.Rand, dimension int) []float32 {
+	values := make([]float32, dimension)
+	for i := range values {
+		values[i] = random.Float32()*2 - 1
+	}
+	return values
+}
+
+// recall compares the graph's kNN results against a brute force search
+// over the same vectors, returning the fraction found
+func recall(graph *hnsw, queries [][]float32, count int) float64 {
+	found, total := 0, 0
+	for _, query := range queries {
+		target := newVector(query)
+		var exact []hnswCandidate
+		for _, node := range graph.nodes {
+			exact = append(exact, hnswCandidate{node: node, distance: graph.metric.distance(target, node.vector)})
+		}
+		sortCandidates(exact)
+		results := graph.search(target, count, 100)
+		for _, expected := range exact[:count] {
+			total++
+			if slices.ContainsFunc(results, func(result hnswCandidate) bool { return result.node == expected.node }) {
+				found++
+			}
+		}
+	}
+	return float64(found) / float64(total)
+}
+
+func TestHNSWRecall(t *testing.T) {
+	for metric, name := range vectorMetricNames {
+		random := rand.New(rand.NewSource(1))
+		graph := newHNSW(vectorMetric(metric), 16, vectorDefaultM, 100)
+		for i := 0; i < 1000; i++ {
+			graph.insert(strconv.Itoa(i), newVector(randomValues(random, 16)))
+		}
+		checkLinks(t, graph)
+		var queries [][]float32
+		for i := 0; i < 50; i++ {
+			queries = append(queries, randomValues(random, 16))
+		}
+		if r := recall(graph, queries, 10); r < 0.9 {
+			t.Errorf("%s recall %f is below 0.9", name, r)
+		}
+
+		// removing most of the graph shouldn't leave what remains unreachable
+		for i := 0; i < 700; i++ {
+			graph.remove(strconv.Itoa(i))
+		}
+		if r := recall(graph, queries, 10); r < 0.9 {
+			t.Errorf("%s recall %f after removals is below 0.9", name, r)
+		}
+		checkLinks(t, graph)
+	}
+}
+
+// checkLinks fails if a node links to a removed one, linkedFrom doesn't
+// hold exactly the nodes linking to each node or the entry point is gone
+func checkLinks(t *testing.T, graph *hnsw) {
+	t.Helper()
+	if len(graph.nodes) > 0 && graph.nodes[graph.entry.element] != graph.entry {
+		t.Fatalf("the entry point %s isn't in the graph", graph.entry.element)
+	}
+	for _, node := range graph.nodes {
+		for level, links := range node.neighbors {
+			for _, neighbor := range links {
+				if graph.nodes[neighbor.element] != neighbor {
+					t.Fatalf("%s still links to removed %s", node.element, neighbor.element)
+				}
+				if _, ok := neighbor.linkedFrom[level][node]; !ok {
+					t.Fatalf("%s links to %s on layer %d without a reverse link", node.element, neighbor.element, level)
+				}
+			}
+			for from := range node.linkedFrom[level] {
+				if !slices.Contains(from.neighbors[level], node) {
+					t.Fatalf("%s has a stale reverse link from %s on layer %d", node.element, from.element, level)
+				}
+			}
+		}
+	}
+}
+
+func TestVectorSetCommands(t *testing.T) {
+	kvstore := newKVStore()
+	kvstore.handleVADD(command("VADD", "points", "VALUES", "2", "1", "0", "east", "METRIC", "L2"))
+	kvstore.handleVADD(command("VADD", "points", "VALUES", "2", "0", "1", "north"))
+	if reply := kvstore.handleVADD(command("VADD", "points", "FP32", "\x00\x00\x80\xbf\x00\x00\x00\x00", "west")); string(reply) != ":1\r\n" {
+		t.Errorf("expected west added, got %q", reply)
+	}
+	if reply := kvstore.handleVADD(command("VADD", "points", "VALUES", "2", "0", "2", "north")); string(reply) != ":0\r\n" {
+		t.Errorf("re-adding should update, got %q", reply)
+	}
+
+	reply := kvstore.handleVSIM(command("VSIM", "points", "VALUES", "2", "1", "0.5", "COUNT", "2", "WITHSCORES"))
+	expected := encodeArray(command("east", "0.5", "north", "1.8027756377319946"))
+	if string(reply) != string(expected) {
+		t.Errorf("expected %q, got %q", expected, reply)
+	}
+	if reply := kvstore.handleVSIM(command("VSIM", "points", "ELE", "west", "COUNT", "1")); string(reply) != string(encodeArray(command("west"))) {
+		t.Errorf("an element should be closest to itself, got %q", reply)
+	}
+	if reply := kvstore.handleVEMB(command("VEMB", "points", "west")); string(reply) != string(encodeArray(command("-1", "0"))) {
+		t.Errorf("unexpected embedding %q", reply)
+	}
+
+	if reply := kvstore.handleVADD(command("VADD", "points", "VALUES", "3", "1", "2", "3", "up")); string(reply) != "-ERR Vector dimension mismatch - got 3 but set has 2\r\n" {
+		t.Errorf("expected a dimension error, got %q", reply)
+	}
+	if reply := kvstore.handleVADD(command("VADD", "points", "VALUES", "2", "1", "1", "ne", "METRIC", "IP")); string(reply) != string(encodeError(errVectorMetricChange)) {
+		t.Errorf("expected a metric mismatch, got %q", reply)
+	}
+
+	for _, element := range []string{"east", "north", "west"} {
+		kvstore.handleVREM(command("VREM", "points", element))
+	}
+	if kvstore.find("points") != nil {
+		t.Errorf("removing every element should delete the key")
+	}
+}
+
+func TestVectorRejectsNonFiniteComponents(t *testing.T) {
+	kvstore := newKVStore()
+	for _, arguments := range [][]string{
+		{"VALUES", "2", "NaN", "0"},
+		{"VALUES", "2", "1", "+inf"},
+		{"VALUES", "2", "-Inf", "1"},
+		{"VALUES", "2", "1e39", "0"},
+		{"FP32", "\x00\x00\xc0\x7f\x00\x00\x00\x00"},
+		{"FP32", "\x00\x00\x80\x7f\x00\x00\x00\x00"},
+	} {
+		message := append(append([]string{"VADD", "points"}, arguments...), "bad")
+		if reply := kvstore.handleVADD(command(message...)); string(reply) != string(encodeError(errVectorNotFinite)) {
+			t.Errorf("%v: expected a non-finite error, got %q", arguments, reply)
+		}
+	}
+	if kvstore.find("points") != nil {
+		t.Errorf("a rejected vector shouldn't create the key")
+	}
+	kvstore.handleVADD(command("VADD", "points", "VALUES", "2", "1", "0", "east"))
+	if reply := kvstore.handleVSIM(command("VSIM", "points", "VALUES", "2", "NaN", "0")); string(reply) != string(encodeError(errVectorNotFinite)) {
+		t.Errorf("expected VSIM to refuse a NaN query, got %q", reply)
+	}
+}
@@ -0,0 +1,1327 @@
+package store
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var (
+	errMinMaxNotFloat  = errors.New("ERR min or max is not a float")
+	errMinMaxNotString = errors.New("ERR min or max not valid string range item")
+	errScoreNaN        = errors.New("ERR resulting score is not a number (NaN)")
+	errWeightNotFloat  = errors.New("ERR weight value is not a float")
+	errXXAndNX         = errors.New("ERR XX and NX options at the same time are not compatible")
+	errGTLTNX          = errors.New("ERR GT, LT, and/or NX options at the same time are not compatible")
+	errIncrPair        = errors.New("ERR INCR option supports a single increment-element pair")
+	errLimitWithRank   = errors.New("ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")
+	errWithScoresLex   = errors.New("ERR syntax error, WITHSCORES not supported in combination with BYLEX")
+)
+
+// zsetValue pairs a map for O(1) score lookups with a skiplist that keeps
+// members ordered for ranges and ranks
+type zsetValue struct {
+	dict map[string]float64
+	list *skiplist
+}
+
+func newZsetValue() *zsetValue {
+	return &zsetValue{
+		dict: make(map[string]float64),
+		list: newSkiplist(),
+	}
+}
+
+func (zset *zsetValue) Len() int {
+	return len(zset.dict)
+}
+
+func (zset *zsetValue) score(member string) (float64, bool) {
+	score, ok := zset.dict[member]
+	return score, ok
+}
+
+// set adds member or moves it to score, returning true if it is new
+func (zset *zsetValue) set(score float64, member string) bool {
+	current, exists := zset.dict[member]
+	if !exists {
+		zset.dict[member] = score
+		zset.list.insert(score, member)
+		return true
+	}
+	if current != score {
+		zset.list.updateScore(current, member, score)
+		zset.dict[member] = score
+	}
+	return false
+}
+
+func (zset *zsetValue) remove(member string) bool {
+	score, ok := zset.dict[member]
+	if !ok {
+		return false
+	}
+	delete(zset.dict, member)
+	zset.list.delete(score, member)
+	return true
+}
+
+// rank returns the 0 based rank of member, ok is false if it's missing
+func (zset *zsetValue) rank(member string, reverse bool) (int, bool) {
+	score, ok := zset.dict[member]
+	if !ok {
+		return 0, false
+	}
+	rank := zset.list.rank(score, member)
+	if reverse {
+		return zset.Len() - rank, true
+	}
+	return rank - 1, true
+}
+
+func (entry *Entry) zset() *zsetValue {
+	return entry.value.(*zsetValue)
+}
+
+func newZsetEntry() *Entry {
+	entry := newEntry()
+	entry.objectType = zsetType
+	entry.encoding = encodingSkiplist
+	entry.value = newZsetValue()
+	return entry
+}
+
+// lookupOrCreateZset returns the entry for the sorted set at key, creating
+// an empty one if needed. Caller must hold the write lock
+func (kvstore *KVStore) lookupOrCreateZset(key string) (*Entry, error) {
+	entry, err := kvstore.lookupTypedWrite(key, zsetType)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		entry = newZsetEntry()
+		kvstore.setKey(key, entry)
+	}
+	return entry, nil
+}
+
+func (kvstore *KVStore) removeIfEmptyZset(key string, zset *zsetValue) {
+	if zset.Len() == 0 {
+		kvstore.deleteKey(key)
+	}
+}
+
+// formatScore prints scores the way redis does, integers without a
+// trailing .0 and infinities as inf / -inf
+func formatScore(score float64) []byte {
+	switch {
+	case math.IsInf(score, 1):
+		return []byte("inf")
+	case math.IsInf(score, -1):
+		return []byte("-inf")
+	case score == math.Trunc(score) && math.Abs(score) < 1e17:
+		return strconv.AppendFloat(nil, score, 'f', -1, 64)
+	}
+	return strconv.AppendFloat(nil, score, 'g', -1, 64)
+}
+
+// scoreRange is a BYSCORE interval such as (1 +inf
+type scoreRange struct {
+	min          float64
+	max          float64
+	minExclusive bool
+	maxExclusive bool
+}
+
+func parseScoreBound(value []byte) (float64, bool, error) {
+	exclusive := len(value) > 0 && value[0] == '('
+	if exclusive {
+		value = value[1:]
+	}
+	score, err := parseFloat(value)
+	if err != nil {
+		return 0, false, errMinMaxNotFloat
+	}
+	return score, exclusive, nil
+}
+
+func parseScoreRange(min []byte, max []byte) (scoreRange, error) {
+	var result scoreRange
+	var err error
+	if result.min, result.minExclusive, err = parseScoreBound(min); err != nil {
+		return result, err
+	}
+	if result.max, result.maxExclusive, err = parseScoreBound(max); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+func (r scoreRange) aboveMin(node *skiplistNode) bool {
+	if r.minExclusive {
+		return node.score > r.min
+	}
+	return node.score >= r.min
+}
+
+func (r scoreRange) belowMax(node *skiplistNode) bool {
+	if r.maxExclusive {
+		return node.score < r.max
+	}
+	return node.score <= r.max
+}
+
+func (r scoreRange) isEmpty() bool {
+	return r.min > r.max || (r.min == r.max && (r.minExclusive || r.maxExclusive))
+}
+
+// lexRange is a BYLEX interval, - and + stand for the lowest and highest strings
+type lexRange struct {
+	min          string
+	max          string
+	minInfinite  bool
+	maxInfinite  bool
+	minExclusive bool
+	maxExclusive bool
+	// set when min is + or max is - so nothing can match
+	empty bool
+}
+
+func parseLexBound(value []byte) (string, bool, bool, error) {
+	if len(value) == 0 {
+		return "", false, false, errMinMaxNotString
+	}
+	switch value[0] {
+	case '-', '+':
+		if len(value) != 1 {
+			return "", false, false, errMinMaxNotString
+		}
+		return string(value), true, false, nil
+	case '(':
+		return string(value[1:]), false, true, nil
+	case '[':
+		return string(value[1:]), false, false, nil
+	}
+	return "", false, false, errMinMaxNotString
+}
+
+func parseLexRange(min []byte, max []byte) (lexRange, error) {
+	var result lexRange
+	var err error
+	if result.min, result.minInfinite, result.minExclusive, err = parseLexBound(min); err != nil {
+		return result, err
+	}
+	if result.max, result.maxInfinite, result.maxExclusive, err = parseLexBound(max); err != nil {
+		return result, err
+	}
+	if (result.minInfinite && result.min == "+") || (result.maxInfinite && result.max == "-") {
+		result.empty = true
+	}
+	return result, nil
+}
+
+func (r lexRange) aboveMin(node *skiplistNode) bool {
+	switch {
+	case r.minInfinite:
+		return true
+	case r.minExclusive:
+		return node.member > r.min
+	}
+	return node.member >= r.min
+}
+
+func (r lexRange) belowMax(node *skiplistNode) bool {
+	switch {
+	case r.maxInfinite:
+		return true
+	case r.maxExclusive:
+		return node.member < r.max
+	}
+	return node.member <= r.max
+}
+
+// nodesByRank returns the nodes between start and stop inclusive, counting
+// from the highest score when reverse is set
+func (zset *zsetValue) nodesByRank(start int, stop int, reverse bool) []*skiplistNode {
+	start, stop, ok := clampRange(start, stop, zset.Len())
+	if !ok {
+		return nil
+	}
+	var result []*skiplistNode
+	var node *skiplistNode
+	if reverse {
+		node = zset.list.byRank(zset.Len() - start)
+	} else {
+		node = zset.list.byRank(start + 1)
+	}
+	for i := start; i <= stop && node != nil; i++ {
+		result = append(result, node)
+		if reverse {
+			node = node.backward
+		} else {
+			node = node.levels[0].forward
+		}
+	}
+	return result
+}
+
+// nodesInRange walks the nodes between aboveMin and belowMax, skipping
+// offset of them and returning at most count, a negative count means all
+func (zset *zsetValue) nodesInRange(aboveMin func(*skiplistNode) bool, belowMax func(*skiplistNode) bool, reverse bool, offset int, count int) []*skiplistNode {
+	var node *skiplistNode
+	if reverse {
+		node = zset.list.last(aboveMin, belowMax)
+	} else {
+		node = zset.list.first(aboveMin, belowMax)
+	}
+
+	var result []*skiplistNode
+	for node != nil && count != 0 {
+		if reverse && !aboveMin(node) || !reverse && !belowMax(node) {
+			break
+		}
+		if offset > 0 {
+			offset--
+		} else {
+			result = append(result, node)
+			count--
+		}
+		if reverse {
+			node = node.backward
+		} else {
+			node = node.levels[0].forward
+		}
+	}
+	return result
+}
+
+func (zset *zsetValue) nodesByScore(r scoreRange, reverse bool, offset int, count int) []*skiplistNode {
+	if r.isEmpty() {
+		return nil
+	}
+	return zset.nodesInRange(r.aboveMin, r.belowMax, reverse, offset, count)
+}
+
+func (zset *zsetValue) nodesByLex(r lexRange, reverse bool, offset int, count int) []*skiplistNode {
+	if r.empty {
+		return nil
+	}
+	return zset.nodesInRange(r.aboveMin, r.belowMax, reverse, offset, count)
+}
+
+func encodeNodes(nodes []*skiplistNode, withScores bool) []byte {
+	var items [][]byte
+	for _, node := range nodes {
+		items = append(items, []byte(node.member))
+		if withScores {
+			items = append(items, formatScore(node.score))
+		}
+	}
+	return encodeArray(items)
+}
+
+type zaddFlags struct {
+	nx   bool
+	xx   bool
+	gt   bool
+	lt   bool
+	ch   bool
+	incr bool
+}
+
+// add applies one ZADD score/member pair. It returns the member's score
+// afterwards and whether it was added or had its score changed, ok is
+// false when the flags stopped the update
+func (zset *zsetValue) add(score float64, member string, flags zaddFlags) (float64, bool, bool, bool, error) {
+	current, exists := zset.dict[member]
+	if exists {
+		if flags.nx {
+			return current, false, false, false, nil
+		}
+		if flags.incr {
+			score += current
+			if math.IsNaN(score) {
+				return 0, false, false, false, errScoreNaN
+			}
+		}
+		if (flags.gt && score <= current) || (flags.lt && score >= current) {
+			return current, false, false, false, nil
+		}
+		if score != current {
+			zset.set(score, member)
+			return score, false, true, true, nil
+		}
+		return score, false, false, true, nil
+	}
+
+	if flags.xx {
+		return 0, false, false, false, nil
+	}
+	zset.set(score, member)
+	return score, true, false, true, nil
+}
+
+func (kvstore *KVStore) handleZADD(messages [][]byte) []byte {
+	if len(messages) < 4 {
+		return wrongArgumentsError("zadd")
+	}
+
+	var flags zaddFlags
+	position := 2
+flagLoop:
+	for ; position < len(messages); position++ {
+		switch strings.ToUpper(string(messages[position])) {
+		case "NX":
+			flags.nx = true
+		case "XX":
+			flags.xx = true
+		case "GT":
+			flags.gt = true
+		case "LT":
+			flags.lt = true
+		case "CH":
+			flags.ch = true
+		case "INCR":
+			flags.incr = true
+		default:
+			break flagLoop
+		}
+	}
+	pairs := messages[position:]
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return encodeError(errSyntax)
+	}
+	if flags.nx && flags.xx {
+		return encodeError(errXXAndNX)
+	}
+	if (flags.gt && flags.nx) || (flags.lt && flags.nx) || (flags.gt && flags.lt) {
+		return encodeError(errGTLTNX)
+	}
+	if flags.incr && len(pairs) > 2 {
+		return encodeError(errIncrPair)
+	}
+
+	// parse every score up front so a bad one leaves the key untouched
+	scores := make([]float64, len(pairs)/2)
+	for i := range scores {
+		score, err := parseFloat(pairs[i*2])
+		if err != nil {
+			return encodeError(errNotFloat)
+		}
+		scores[i] = score
+	}
+
+	key := string(messages[1])
+	kvstore.lockKeys(key)
+	defer kvstore.unlockKeys(key)
+
+	entry, err := kvstore.lookupOrCreateZset(key)
+	if err != nil {
+		return encodeError(err)
+	}
+	zset := entry.zset()
+
+	added, changed := 0, 0
+	var result float64
+	var applied bool
+	for i, score := range scores {
+		var isNew, isUpdated bool
+		result, isNew, isUpdated, applied, err = zset.add(score, string(pairs[i*2+1]), flags)
+		if err != nil {
+			kvstore.removeIfEmptyZset(key, zset)
+			return encodeError(err)
+		}
+		if isNew {
+			added++
+		}
+		if isUpdated {
+			changed++
+		}
+	}
+	kvstore.removeIfEmptyZset(key, zset)
+	if added > 0 {
+		kvstore.signalKeyAsReady(key)
+	}
+
+	if flags.incr {
+		if !applied {
+			return nullBulkReply
+		}
+		return encodeBulkString(formatScore(result))
+	}
+	if flags.ch {
+		return encodeInteger(int64(added + changed))
+	}
+	return encodeInteger(int64(added))
+}
+
+func (kvstore *KVStore) handleZINCRBY(messages [][]byte) []byte {
+	if len(messages) != 4 {
+		return wrongArgumentsError("zincrby")
+	}
+	increment, err := parseFloat(messages[2])
+	if err != nil {
+		return encodeError(errNotFloat)
+	}
+
+	key := string(messages[1])
+	kvstore.lockKeys(key)
+	defer kvstore.unlockKeys(key)
+
+	entry, err := kvstore.lookupOrCreateZset(key)
+	if err != nil {
+		return encodeError(err)
+	}
+	zset := entry.zset()
+	score, isNew, _, _, err := zset.add(increment, string(messages[3]), zaddFlags{incr: true})
+	if err != nil {
+		kvstore.removeIfEmptyZset(key, zset)
+		return encodeError(err)
+	}
+	if isNew {
+		kvstore.signalKeyAsReady(key)
+	}
+	return encodeBulkString(formatScore(score))
+}
+
+func (kvstore *KVStore) handleZREM(messages [][]byte) []byte {
+	if len(messages) < 3 {
+		return wrongArgumentsError("zrem")
+	}
+
+	key := string(messages[1])
+	kvstore.lockKeys(key)
+	defer kvstore.unlockKeys(key)
+
+	entry, err := kvstore.lookupTypedWrite(key, zsetType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return encodeInteger(0)
+	}
+	zset := entry.zset()
+	removed := 0
+	for _, member := range messages[2:] {
+		if zset.remove(string(member)) {
+			removed++
+		}
+	}
+	kvstore.removeIfEmptyZset(key, zset)
+	return encodeInteger(int64(removed))
+}
+
+func (kvstore *KVStore) handleZCARD(messages [][]byte) []byte {
+	if len(messages) != 2 {
+		return wrongArgumentsError("zcard")
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedRead(string(messages[1]), zsetType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return encodeInteger(0)
+	}
+	return encodeInteger(int64(entry.zset().Len()))
+}
+
+func (kvstore *KVStore) handleZSCORE(messages [][]byte) []byte {
+	if len(messages) != 3 {
+		return wrongArgumentsError("zscore")
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedRead(string(messages[1]), zsetType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return nullBulkReply
+	}
+	score, ok := entry.zset().score(string(messages[2]))
+	if !ok {
+		return nullBulkReply
+	}
+	return encodeBulkString(formatScore(score))
+}
+
+func (kvstore *KVStore) handleZMSCORE(messages [][]byte) []byte {
+	if len(messages) < 3 {
+		return wrongArgumentsError("zmscore")
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedRead(string(messages[1]), zsetType)
+	if err != nil {
+		return encodeError(err)
+	}
+	members := messages[2:]
+	result := encodeArrayHeader(len(members))
+	for _, member := range members {
+		if entry != nil {
+			if score, ok := entry.zset().score(string(member)); ok {
+				result = append(result, encodeBulkString(formatScore(score))...)
+				continue
+			}
+		}
+		result = append(result, nullBulkReply...)
+	}
+	return result
+}
+
+// handleZRANK serves ZRANK and ZREVRANK
+func (kvstore *KVStore) handleZRANK(messages [][]byte) []byte {
+	if len(messages) != 3 && len(messages) != 4 {
+		return wrongArgumentsError(string(messages[0]))
+	}
+	reverse := strings.ToUpper(string(messages[0])) == "ZREVRANK"
+	withScore := false
+	if len(messages) == 4 {
+		if strings.ToUpper(string(messages[3])) != "WITHSCORE" {
+			return encodeError(errSyntax)
+		}
+		withScore = true
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedRead(string(messages[1]), zsetType)
+	if err != nil {
+		return encodeError(err)
+	}
+	nullReply := nullBulkReply
+	if withScore {
+		nullReply = nullArrayReply
+	}
+	if entry == nil {
+		return nullReply
+	}
+	member := string(messages[2])
+	rank, ok := entry.zset().rank(member, reverse)
+	if !ok {
+		return nullReply
+	}
+	if !withScore {
+		return encodeInteger(int64(rank))
+	}
+	score, _ := entry.zset().score(member)
+	result := encodeArrayHeader(2)
+	result = append(result, encodeInteger(int64(rank))...)
+	result = append(result, encodeBulkString(formatScore(score))...)
+	return result
+}
+
+func (kvstore *KVStore) handleZCOUNT(messages [][]byte) []byte {
+	if len(messages) != 4 {
+		return wrongArgumentsError("zcount")
+	}
+	r, err := parseScoreRange(messages[2], messages[3])
+	if err != nil {
+		return encodeError(err)
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedRead(string(messages[1]), zsetType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil || r.isEmpty() {
+		return encodeInteger(0)
+	}
+	return encodeInteger(int64(entry.zset().countInRange(r.aboveMin, r.belowMax)))
+}
+
+func (kvstore *KVStore) handleZLEXCOUNT(messages [][]byte) []byte {
+	if len(messages) != 4 {
+		return wrongArgumentsError("zlexcount")
+	}
+	r, err := parseLexRange(messages[2], messages[3])
+	if err != nil {
+		return encodeError(err)
+	}
+
+	kvstore.rlockKeys(string(messages[1]))
+	defer kvstore.runlockKeys(string(messages[1]))
+
+	entry, err := kvstore.lookupTypedRead(string(messages[1]), zsetType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil || r.empty {
+		return encodeInteger(0)
+	}
+	return encodeInteger(int64(entry.zset().countInRange(r.aboveMin, r.belowMax)))
+}
+
+// countInRange uses the ranks of the first and last nodes in range so
+// counting is O(log n) regardless of how many members match
+func (zset *zsetValue) countInRange(aboveMin func(*skiplistNode) bool, belowMax func(*skiplistNode) bool) int {
+	first := zset.list.first(aboveMin, belowMax)
+	if first == nil {
+		return 0
+	}
+	last := zset.list.last(aboveMin, belowMax)
+	return zset.list.rank(last.score, last.member) - zset.list.rank(first.score, first.member) + 1
+}
+
+type rangeBy int
+
+const (
+	byRank rangeBy = iota
+	byScore
+	byLex
+)
+
+type zrangeRequest struct {
+	by         rangeBy
+	start      []byte
+	stop       []byte
+	reverse    bool
+	offset     int
+	count      int
+	withScores bool
+}
+
+// parseZrangeArguments reads start stop [BYSCORE|BYLEX] [REV] [LIMIT offset count] [WITHSCORES]
+func parseZrangeArguments(arguments [][]byte) (zrangeRequest, error) {
+	request := zrangeRequest{start: arguments[0], stop: arguments[1], count: -1}
+	hasLimit := false
+	for i := 2; i < len(arguments); i++ {
+		switch strings.ToUpper(string(arguments[i])) {
+		case "BYSCORE":
+			request.by = byScore
+		case "BYLEX":
+			request.by = byLex
+		case "REV":
+			request.reverse = true
+		case "WITHSCORES":
+			request.withScores = true
+		case "LIMIT":
+			if i+2 >= len(arguments) {
+				return request, errSyntax
+			}
+			offset, err := parseInteger(arguments[i+1])
+			if err != nil {
+				return request, err
+			}
+			count, err := parseInteger(arguments[i+2])
+			if err != nil {
+				return request, err
+			}
+			request.offset, request.count = int(offset), int(count)
+			hasLimit = true
+			i += 2
+		default:
+			return request, errSyntax
+		}
+	}
+	if hasLimit && request.by == byRank {
+		return request, errLimitWithRank
+	}
+	if request.withScores && request.by == byLex {
+		return request, errWithScoresLex
+	}
+	return request, nil
+}
+
+// nodes resolves the request against zset. For reversed BYSCORE and BYLEX
+// ranges start is the upper bound, as in the redis syntax
+func (zset *zsetValue) nodes(request zrangeRequest) ([]*skiplistNode, error) {
+	if request.offset < 0 {
+		return nil, nil
+	}
+	min, max := request.start, request.stop
+	if request.reverse {
+		min, max = max, min
+	}
+
+	switch request.by {
+	case byScore:
+		r, err := parseScoreRange(min, max)
+		if err != nil {
+			return nil, err
+		}
+		return zset.nodesByScore(r, request.reverse, request.offset, request.count), nil
+	case byLex:
+		r, err := parseLexRange(min, max)
+		if err != nil {
+			return nil, err
+		}
+		return zset.nodesByLex(r, request.reverse, request.offset, request.count), nil
+	}
+
+	start, err := parseInteger(request.start)
+	if err != nil {
+		return nil, err
+	}
+	stop, err := parseInteger(request.stop)
+	if err != nil {
+		return nil, err
+	}
+	return zset.nodesByRank(int(start), int(stop), request.reverse), nil
+}
+
+// validate parses the bounds once so errors come back even when
+// the key doesn't exist
+func (request zrangeRequest) validate() error {
+	_, err := newZsetValue().nodes(request)
+	return err
+}
+
+func (kvstore *KVStore) zrangeGeneric(key string, request zrangeRequest) []byte {
+	if err := request.validate(); err != nil {
+		return encodeError(err)
+	}
+
+	kvstore.rlockKeys(key)
+	defer kvstore.runlockKeys(key)
+
+	entry, err := kvstore.lookupTypedRead(key, zsetType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return encodeArray(nil)
+	}
+	nodes, err := entry.zset().nodes(request)
+	if err != nil {
+		return encodeError(err)
+	}
+	return encodeNodes(nodes, request.withScores)
+}
+
+func (kvstore *KVStore) handleZRANGE(messages [][]byte) []byte {
+	if len(messages) < 4 {
+		return wrongArgumentsError("zrange")
+	}
+	request, err := parseZrangeArguments(messages[2:])
+	if err != nil {
+		return encodeError(err)
+	}
+	return kvstore.zrangeGeneric(string(messages[1]), request)
+}
+
+// handleZRANGELEGACY serves the pre 6.2 range commands by translating them
+// into the matching ZRANGE request
+func (kvstore *KVStore) handleZRANGELEGACY(messages [][]byte) []byte {
+	command := strings.ToUpper(string(messages[0]))
+	if len(messages) < 4 {
+		return wrongArgumentsError(command)
+	}
+
+	arguments := append([][]byte{}, messages[2:]...)
+	switch command {
+	case "ZREVRANGE":
+		arguments = append(arguments, []byte("REV"))
+	case "ZRANGEBYSCORE":
+		arguments = append(arguments, []byte("BYSCORE"))
+	case "ZREVRANGEBYSCORE":
+		arguments = append(arguments, []byte("BYSCORE"), []byte("REV"))
+	case "ZRANGEBYLEX":
+		arguments = append(arguments, []byte("BYLEX"))
+	case "ZREVRANGEBYLEX":
+		arguments = append(arguments, []byte("BYLEX"), []byte("REV"))
+	}
+	request, err := parseZrangeArguments(arguments)
+	if err != nil {
+		return encodeError(err)
+	}
+	return kvstore.zrangeGeneric(string(messages[1]), request)
+}
+
+func (kvstore *KVStore) handleZRANGESTORE(messages [][]byte) []byte {
+	if len(messages) < 5 {
+		return wrongArgumentsError("zrangestore")
+	}
+	request, err := parseZrangeArguments(messages[3:])
+	if err != nil {
+		return encodeError(err)
+	}
+	if request.withScores {
+		return encodeError(errSyntax)
+	}
+	if err := request.validate(); err != nil {
+		return encodeError(err)
+	}
+
+	kvstore.lockKeys(string(messages[1]), string(messages[2]))
+	defer kvstore.unlockKeys(string(messages[1]), string(messages[2]))
+
+	entry, err := kvstore.lookupTypedWrite(string(messages[2]), zsetType)
+	if err != nil {
+		return encodeError(err)
+	}
+	var nodes []*skiplistNode
+	if entry != nil {
+		nodes, _ = entry.zset().nodes(request)
+	}
+
+	result := newZsetValue()
+	for _, node := range nodes {
+		result.set(node.score, node.member)
+	}
+	return encodeInteger(int64(kvstore.storeZset(string(messages[1]), result)))
+}
+
+// storeZset replaces whatever is at key with zset, deleting the key if the
+// set is empty. Caller must hold the write lock
+func (kvstore *KVStore) storeZset(key string, zset *zsetValue) int {
+	kvstore.deleteKey(key)
+	if zset.Len() == 0 {
+		return 0
+	}
+	entry := newZsetEntry()
+	entry.value = zset
+	kvstore.setKey(key, entry)
+	kvstore.signalKeyAsReady(key)
+	return zset.Len()
+}
+
+// popNodes removes up to count members from the lowest or highest end
+func (zset *zsetValue) popNodes(max bool, count int) []*skiplistNode {
+	var popped []*skiplistNode
+	for ; count > 0 && zset.Len() > 0; count-- {
+		var node *skiplistNode
+		if max {
+			node = zset.list.tail
+		} else {
+			node = zset.list.header.levels[0].forward
+		}
+		popped = append(popped, node)
+		zset.remove(node.member)
+	}
+	return popped
+}
+
+// handleZPOPMIN serves ZPOPMIN and ZPOPMAX
+func (kvstore *KVStore) handleZPOPMIN(messages [][]byte) []byte {
+	if len(messages) != 2 && len(messages) != 3 {
+		return wrongArgumentsError(string(messages[0]))
+	}
+	max := strings.ToUpper(string(messages[0])) == "ZPOPMAX"
+	count := int64(1)
+	if len(messages) == 3 {
+		var err error
+		count, err = parseInteger(messages[2])
+		if err != nil {
+			return encodeError(err)
+		}
+		if count < 0 {
+			return encodeError(errNotPositive)
+		}
+	}
+
+	key := string(messages[1])
+	kvstore.lockKeys(key)
+	defer kvstore.unlockKeys(key)
+
+	entry, err := kvstore.lookupTypedWrite(key, zsetType)
+	if err != nil {
+		return encodeError(err)
+	}
+	if entry == nil {
+		return encodeArray(nil)
+	}
+	zset := entry.zset()
+	popped := zset.popNodes(max, int(count))
+	kvstore.removeIfEmptyZset(key, zset)
+	return encodeNodes(popped, true)
+}
+
+type aggregate int
+
+const (
+	aggregateSum aggregate = iota
+	aggregateMin
+	aggregateMax
+)
+
+func (aggregate aggregate) apply(current float64, score float64) float64 {
+	switch aggregate {
+	case aggregateMin:
+		return math.Min(current, score)
+	case aggregateMax:
+		return math.Max(current, score)
+	}
+	// inf + -inf is treated as 0 like redis does
+	result := current + score
+	if math.IsNaN(result) {
+		return 0
+	}
+	return result
+}
+
+type zsetOperation int
+
+const (
+	zsetUnion zsetOperation = iota
+	zsetInter
+	zsetDiff
+)
+
+type zsetCombineRequest struct {
+	operation  zsetOperation
+	keys       [][]byte
+	weights    []float64
+	aggregate  aggregate
+	withScores bool
+}
+
+// parseZsetCombine reads numkeys key [key ...] [WEIGHTS ...] [AGGREGATE ...]
+// [WITHSCORES], ZDIFF only takes WITHSCORES and the STORE forms never do
+func parseZsetCombine(operation zsetOperation, arguments [][]byte, store bool) (zsetCombineRequest, error) {
+	request := zsetCombineRequest{operation: operation}
+	numkeys, err := parseInteger(arguments[0])
+	if err != nil {
+		return request, err
+	}
+	if numkeys <= 0 {
+		return request, errors.New("ERR at least 1 input key is needed for this command")
+	}
+	if numkeys > int64(len(arguments)-1) {
+		return request, errSyntax
+	}
+	request.keys = arguments[1 : 1+numkeys]
+	request.weights = make([]float64, numkeys)
+	for i := range request.weights {
+		request.weights[i] = 1
+	}
+
+	rest := arguments[1+numkeys:]
+	for i := 0; i < len(rest); i++ {
+		option := strings.ToUpper(string(rest[i]))
+		switch {
+		case option == "WEIGHTS" && operation != zsetDiff:
+			if i+int(numkeys) >= len(rest) {
+				return request, errSyntax
+			}
+			for j := range request.weights {
+				weight, err := parseFloat(rest[i+1+j])
+				if err != nil {
+					return request, errWeightNotFloat
+				}
+				request.weights[j] = weight
+			}
+			i += int(numkeys)
+		case option == "AGGREGATE" && operation != zsetDiff:
+			if i+1 >= len(rest) {
+				return request, errSyntax
+			}
+			switch strings.ToUpper(string(rest[i+1])) {
+			case "SUM":
+				request.aggregate = aggregateSum
+			case "MIN":
+				request.aggregate = aggregateMin
+			case "MAX":
+				request.aggregate = aggregateMax
+			default:
+				return request, errSyntax
+			}
+			i++
+		case option == "WITHSCORES" && !store:
+			request.withScores = true
+		default:
+			return request, errSyntax
+		}
+	}
+	return request, nil
+}
+
+// lookupScores returns the members of the set or sorted set at key with their
+// scores, plain sets count as every member scoring 1. Caller must hold a lock
+func (kvstore *KVStore) lookupScores(key string) (map[string]float64, error) {
+	entry := kvstore.lookupKeyRead(key)
+	if entry == nil {
+		return nil, nil
+	}
+	switch entry.objectType {
+	case zsetType:
+		return entry.zset().dict, nil
+	case setType:
+		scores := make(map[string]float64)
+		for _, member := range entry.set().all() {
+			scores[member] = 1
+		}
+		return scores, nil
+	}
+	return nil, errWrongType
+}
+
+// combineZsets runs the union, intersection or difference described by request.
+// Caller must hold at least the read lock
+func (kvstore *KVStore) combineZsets(request zsetCombineRequest) (*zsetValue, error) {
+	inputs := make([]map[string]float64, len(request.keys))
+	for i, key := range request.keys {
+		scores, err := kvstore.lookupScores(string(key))
+		if err != nil {
+			return nil, err
+		}
+		inputs[i] = scores
+	}
+
+	weighted := func(score float64, weight float64) float64 {
+		result := score * weight
+		// 0 * inf
+		if math.IsNaN(result) {
+			return 0
+		}
+		return result
+	}
+
+	result := newZsetValue()
+	switch request.operation {
+	case zsetUnion:
+		scores := make(map[string]float64)
+		for i, input := range inputs {
+			for member, score := range input {
+				score = weighted(score, request.weights[i])
+				if current, ok := scores[member]; ok {
+					scores[member] = request.aggregate.apply(current, score)
+				} else {
+					scores[member] = score
+				}
+			}
+		}
+		for member, score := range scores {
+			result.set(score, member)
+		}
+	case zsetInter:
+		for member, score := range inputs[0] {
+			score = weighted(score, request.weights[0])
+			inAll := true
+			for i, input := range inputs[1:] {
+				other, ok := input[member]
+				if !ok {
+					inAll = false
+					break
+				}
+				score = request.aggregate.apply(score, weighted(other, request.weights[i+1]))
+			}
+			if inAll {
+				result.set(score, member)
+			}
+		}
+	case zsetDiff:
+		for member, score := range inputs[0] {
+			found := false
+			for _, input := range inputs[1:] {
+				if _, ok := input[member]; ok {
+					found = true
+					break
+				}
+			}
+			if !found {
+				result.set(score, member)
+			}
+		}
+	}
+	return result, nil
+}
+
+func parseZsetOperation(command string) zsetOperation {
+	switch {
+	case strings.HasPrefix(command, "ZINTER"):
+		return zsetInter
+	case strings.HasPrefix(command, "ZDIFF"):
+		return zsetDiff
+	}
+	return zsetUnion
+}
+
+// handleZUNION serves ZUNION, ZINTER and ZDIFF
+func (kvstore *KVStore) handleZUNION(messages [][]byte) []byte {
+	command := strings.ToUpper(string(messages[0]))
+	if len(messages) < 3 {
+		return wrongArgumentsError(command)
+	}
+	request, err := parseZsetCombine(parseZsetOperation(command), messages[1:], false)
+	if err != nil {
+		return encodeError(err)
+	}
+
+	keys := keyStrings(request.keys)
+	kvstore.rlockKeys(keys...)
+	defer kvstore.runlockKeys(keys...)
+
+	result, err := kvstore.combineZsets(request)
+	if err != nil {
+		return encodeError(err)
+	}
+	return encodeNodes(result.nodesByRank(0, -1, false), request.withScores)
+}
+
+// handleZUNIONSTORE serves ZUNIONSTORE, ZINTERSTORE and ZDIFFSTORE
+func (kvstore *KVStore) handleZUNIONSTORE(messages [][]byte) []byte {
+	command := strings.ToUpper(string(messages[0]))
+	if len(messages) < 4 {
+		return wrongArgumentsError(command)
+	}
+	request, err := parseZsetCombine(parseZsetOperation(command), messages[2:], true)
+	if err != nil {
+		return encodeError(err)
+	}
+
+	keys := append(keyStrings(request.keys), string(messages[1]))
+	kvstore.lockKeys(keys...)
+	defer kvstore.unlockKeys(keys...)
+
+	result, err := kvstore.combineZsets(request)
+	if err != nil {
+		return encodeError(err)
+	}
+	return encodeInteger(int64(kvstore.storeZset(string(messages[1]), result)))
+}
+
+func parseMinMax(value []byte) (bool, error) {
+	switch strings.ToUpper(string(value)) {
+	case "MIN":
+		return false, nil
+	case "MAX":
+		return true, nil
+	}
+	return false, errSyntax
+}
+
+// popFromFirstNonEmptyZset pops up to count members from the first key
+// holding a sorted set, ok is false if none of them exist.
+// Caller must hold the write lock
+func (kvstore *KVStore) popFromFirstNonEmptyZset(keys []string, max bool, count int) (string, []*skiplistNode, bool, error) {
+	for _, key := range keys {
+		entry, err := kvstore.lookupTypedWrite(key, zsetType)
+		if err != nil {
+			return "", nil, false, err
+		}
+		if entry == nil {
+			continue
+		}
+		zset := entry.zset()
+		popped := zset.popNodes(max, count)
+		kvstore.removeIfEmptyZset(key, zset)
+		return key, popped, true, nil
+	}
+	return "", nil, false, nil
+}
+
+// encodeKeyAndNodes is the [key, [[member, score] ...]] reply of the *ZMPOP commands
+func encodeKeyAndNodes(key string, nodes []*skiplistNode) []byte {
+	result := encodeArrayHeader(2)
+	result = append(result, encodeBulkString([]byte(key))...)
+	result = append(result, encodeArrayHeader(len(nodes))...)
+	for _, node := range nodes {
+		result = append(result, encodeArray([][]byte{[]byte(node.member), formatScore(node.score)})...)
+	}
+	return result
+}
+
+// encodeKeyMemberScore is the flat [key, member, score] reply of BZPOPMIN and BZPOPMAX
+func encodeKeyMemberScore(key string, nodes []*skiplistNode) []byte {
+	return encodeArray([][]byte{[]byte(key), []byte(nodes[0].member), formatScore(nodes[0].score)})
+}
+
+// serveZpop builds the serve function for clients blocked on a sorted set pop
+func (kvstore *KVStore) serveZpop(max bool, count int, encode func(key string, nodes []*skiplistNode) []byte) func(key string) ([]byte, bool) {
+	return func(key string) ([]byte, bool) {
+		_, nodes, ok, err := kvstore.popFromFirstNonEmptyZset([]string{key}, max, count)
+		if err != nil || !ok {
+			return nil, false
+		}
+		return encode(key, nodes), true
+	}
+}
+
+func (kvstore *KVStore) handleZMPOP(messages [][]byte) []byte {
+	keys, where, count, err := parseMultiPopArguments(messages[1:])
+	if err != nil {
+		return encodeError(err)
+	}
+	max, err := parseMinMax(where)
+	if err != nil {
+		return encodeError(err)
+	}
+
+	kvstore.lockKeys(keys...)
+	defer kvstore.unlockKeys(keys...)
+
+	key, nodes, ok, err := kvstore.popFromFirstNonEmptyZset(keys, max, count)
+	if err != nil {
+		return encodeError(err)
+	}
+	if !ok {
+		return nullArrayReply
+	}
+	return encodeKeyAndNodes(key, nodes)
+}
+
+// handleBZPOPMIN serves BZPOPMIN and BZPOPMAX
+func (kvstore *KVStore) handleBZPOPMIN(messages [][]byte, client *Client) []byte {
+	if len(messages) < 3 {
+		return wrongArgumentsError(string(messages[0]))
+	}
+	max := strings.ToUpper(string(messages[0])) == "BZPOPMAX"
+	timeout, err := parseTimeout(messages[len(messages)-1])
+	if err != nil {
+		return encodeError(err)
+	}
+	var keys []string
+	for _, key := range messages[1 : len(messages)-1] {
+		keys = append(keys, string(key))
+	}
+
+	kvstore.lockKeys(keys...)
+	key, nodes, ok, err := kvstore.popFromFirstNonEmptyZset(keys, max, 1)
+	if err != nil || ok {
+		kvstore.unlockKeys(keys...)
+		if err != nil {
+			return encodeError(err)
+		}
+		return encodeKeyMemberScore(key, nodes)
+	}
+	blocked := kvstore.blockForKeys(keys, nil, kvstore.serveZpop(max, 1, encodeKeyMemberScore))
+	kvstore.unlockKeys(keys...)
+
+	return kvstore.waitUntilServed(blocked, client, timeout, nullArrayReply)
+}
+
+func (kvstore *KVStore) handleBZMPOP(messages [][]byte, client *Client) []byte {
+	if len(messages) < 2 {
+		return wrongArgumentsError("bzmpop")
+	}
+	timeout, err := parseTimeout(messages[1])
+	if err != nil {
+		return encodeError(err)
+	}
+	keys, where, count, err := parseMultiPopArguments(messages[2:])
+	if err != nil {
+		return encodeError(err)
+	}
+	max, err := parseMinMax(where)
+	if err != nil {
+		return encodeError(err)
+	}
+
+	kvstore.lockKeys(keys...)
+	key, nodes, ok, err := kvstore.popFromFirstNonEmptyZset(keys, max, count)
+	if err != nil || ok {
+		kvstore.unlockKeys(keys...)
+		if err != nil {
+			return encodeError(err)
+		}
+		return encodeKeyAndNodes(key, nodes)
+	}
+	blocked := kvstore.blockForKeys(keys, nil, kvstore.serveZpop(max, count, encodeKeyAndNodes))
+	kvstore.unlockKeys(keys...)
+
+	return kvstore.waitUntilServed(blocked, client, timeout, nullArrayReply)
+}
@@ -0,0 +1,139 @@
+package store
+
+import (
+	"strings"
+	"testing"
+)
+
+// zsetCase is a command, split on spaces, run through Execute and the
+// reply it should get
+type zsetCase struct {
+	command  string
+	expected string
+}
+
+func runZsetCases(t *testing.T, kvstore *KVStore, cases []zsetCase) {
+	t.Helper()
+	client := newTestClient()
+	for _, c := range cases {
+		if got := execute(t, kvstore, client, strings.Fields(c.command)...); got != c.expected {
+			t.Errorf("%s: expected %q, got %q", c.command, c.expected, got)
+		}
+	}
+}
+
+func TestZADDFlags(t *testing.T) {
+	kvstore := newKVStore()
+	runZsetCases(t, kvstore, []zsetCase{
+		{"ZADD z 1 a 2 b", ":2\r\n"},
+		{"ZADD z NX 5 a 3 c", ":1\r\n"},
+		{"ZSCORE z a", "$1\r\n1\r\n"},
+		{"ZADD z XX 5 a 4 d", ":0\r\n"},
+		{"ZSCORE z a", "$1\r\n5\r\n"},
+		{"ZSCORE z d", string(nullBulkReply)},
+		{"ZADD z XX CH 6 a 5 d", ":1\r\n"},
+		{"ZADD z CH 6 a 2 b", ":0\r\n"},
+		{"ZADD z CH 7 a 8 e", ":2\r\n"},
+
+		// GT and LT only ever move a score one way, new members are added
+		{"ZADD z GT CH 1 a 9 b 0 f", ":2\r\n"},
+		{"ZSCORE z a", "$1\r\n7\r\n"},
+		{"ZSCORE z b", "$1\r\n9\r\n"},
+		{"ZADD z LT CH 10 a 3 b", ":1\r\n"},
+		{"ZSCORE z a", "$1\r\n7\r\n"},
+		{"ZSCORE z b", "$1\r\n3\r\n"},
+		{"ZADD z XX GT CH 4 b 1 g", ":1\r\n"},
+		{"ZCARD z", ":5\r\n"},
+
+		{"ZADD z INCR 2.5 a", "$3\r\n9.5\r\n"},
+		{"ZADD z INCR 1 new", "$1\r\n1\r\n"},
+		{"ZADD z NX INCR 1 a", string(nullBulkReply)},
+		{"ZADD z XX INCR 1 missing", string(nullBulkReply)},
+		{"ZADD z GT INCR -1 a", string(nullBulkReply)},
+		{"ZADD z LT INCR -1 a", "$3\r\n8.5\r\n"},
+		{"ZADD z INCR +inf a", "$3\r\ninf\r\n"},
+		{"ZADD z INCR -inf a", string(encodeError(errScoreNaN))},
+
+		{"ZADD z NX XX 1 a", string(encodeError(errXXAndNX))},
+		{"ZADD z NX GT 1 a", string(encodeError(errGTLTNX))},
+		{"ZADD z GT LT 1 a", string(encodeError(errGTLTNX))},
+		{"ZADD z INCR 1 a 2 b", string(encodeError(errIncrPair))},
+		{"ZADD z nan a", string(encodeError(errNotFloat))},
+	})
+}
+
+func TestZRANGEForms(t *testing.T) {
+	kvstore := newKVStore()
+	array := func(values string) string {
+		return string(encodeArray(command(strings.Fields(values)...)))
+	}
+	runZsetCases(t, kvstore, []zsetCase{
+		{"ZADD scores 1 a 2 b 3 c 4 d 5 e", ":5\r\n"},
+		{"ZRANGE scores 0 -1", array("a b c d e")},
+		{"ZRANGE scores -2 100", array("d e")},
+		{"ZRANGE scores 0 1 REV WITHSCORES", array("e 5 d 4")},
+		{"ZRANGE scores 3 1", array("")},
+
+		{"ZRANGE scores 2 4 BYSCORE", array("b c d")},
+		{"ZRANGE scores (2 4 BYSCORE", array("c d")},
+		{"ZRANGE scores -inf (3 BYSCORE WITHSCORES", array("a 1 b 2")},
+		{"ZRANGE scores +inf 4 BYSCORE REV", array("e d")},
+		{"ZRANGE scores -inf +inf BYSCORE LIMIT 1 2", array("b c")},
+		{"ZRANGE scores +inf -inf BYSCORE REV LIMIT 0 3", array("e d c")},
+		{"ZRANGE scores 0 10 BYSCORE LIMIT 4 -1", array("e")},
+		{"ZRANGE scores 1 x BYSCORE", string(encodeError(errMinMaxNotFloat))},
+
+		{"ZADD letters 0 a 0 b 0 c 0 d 0 e", ":5\r\n"},
+		{"ZRANGE letters [b (d BYLEX", array("b c")},
+		{"ZRANGE letters - + BYLEX LIMIT 2 2", array("c d")},
+		{"ZRANGE letters + [c BYLEX REV", array("e d c")},
+		{"ZRANGE letters (e + BYLEX", array("")},
+		{"ZRANGE letters b d BYLEX", string(encodeError(errMinMaxNotString))},
+		{"ZRANGE letters - + BYLEX WITHSCORES", string(encodeError(errWithScoresLex))},
+		{"ZRANGE letters 0 -1 LIMIT 0 1", string(encodeError(errLimitWithRank))},
+
+		{"ZRANGESTORE top scores 0 1 REV", ":2\r\n"},
+		{"ZRANGE top 0 -1 WITHSCORES", array("d 4 e 5")},
+	})
+}
+
+func TestZUNIONSTOREAndZINTERSTORE(t *testing.T) {
+	kvstore := newKVStore()
+	array := func(values string) string {
+		return string(encodeArray(command(strings.Fields(values)...)))
+	}
+	runZsetCases(t, kvstore, []zsetCase{
+		{"ZADD first 1 a 2 b 3 c", ":3\r\n"},
+		{"ZADD second 10 b 20 c 30 d", ":3\r\n"},
+		{"SADD plain c d", ":2\r\n"},
+
+		{"ZUNIONSTORE out 2 first second", ":4\r\n"},
+		{"ZRANGE out 0 -1 WITHSCORES", array("a 1 b 12 c 23 d 30")},
+		{"ZUNIONSTORE out 2 first second WEIGHTS 2 0.5", ":4\r\n"},
+		{"ZRANGE out 0 -1 WITHSCORES", array("a 2 b 9 d 15 c 16")},
+		{"ZUNIONSTORE out 2 first second AGGREGATE MIN", ":4\r\n"},
+		{"ZRANGE out 0 -1 WITHSCORES", array("a 1 b 2 c 3 d 30")},
+		{"ZUNIONSTORE out 2 first second WEIGHTS 1 -1 AGGREGATE MAX", ":4\r\n"},
+		{"ZRANGE out 0 -1 WITHSCORES", array("d -30 a 1 b 2 c 3")},
+
+		{"ZINTERSTORE out 2 first second", ":2\r\n"},
+		{"ZRANGE out 0 -1 WITHSCORES", array("b 12 c 23")},
+		{"ZINTERSTORE out 2 first second WEIGHTS 3 1 AGGREGATE SUM", ":2\r\n"},
+		{"ZRANGE out 0 -1 WITHSCORES", array("b 16 c 29")},
+		{"ZINTERSTORE out 2 first second AGGREGATE MAX", ":2\r\n"},
+		{"ZRANGE out 0 -1 WITHSCORES", array("b 10 c 20")},
+		{"ZINTERSTORE out 2 first second AGGREGATE MIN", ":2\r\n"},
+		{"ZRANGE out 0 -1 WITHSCORES", array("b 2 c 3")},
+
+		// plain sets count as sorted sets with every score 1
+		{"ZINTERSTORE out 2 first plain WEIGHTS 1 5", ":1\r\n"},
+		{"ZRANGE out 0 -1 WITHSCORES", array("c 8")},
+
+		{"ZINTERSTORE out 2 first missing", ":0\r\n"},
+		{"ZCARD out", ":0\r\n"},
+		{"ZUNIONSTORE out 2 first second WEIGHTS 1", string(encodeError(errSyntax))},
+		{"ZUNIONSTORE out 2 first second WEIGHTS 1 x", string(encodeError(errWeightNotFloat))},
+		{"ZUNIONSTORE out 2 first second AGGREGATE AVG", string(encodeError(errSyntax))},
+		{"ZUNIONSTORE out 0 first", "-ERR at least 1 input key is needed for this command\r\n"},
+	})
+}